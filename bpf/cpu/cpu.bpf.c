@@ -18,17 +18,24 @@
 
 // Number of frames to walk per tail call iteration.
 #define MAX_STACK_DEPTH_PER_PROGRAM 15
-// Number of BPF tail calls that will be attempted.
-#define MAX_TAIL_CALLS 10
-// Maximum number of frames.
-#define MAX_STACK_DEPTH 127
-_Static_assert(MAX_TAIL_CALLS *MAX_STACK_DEPTH_PER_PROGRAM >= MAX_STACK_DEPTH, "enough iterations to traverse the whole stack");
+// Number of BPF tail calls that will be attempted, the kernel allows up to 32
+// including the one to the unwinder.
+#define MAX_TAIL_CALLS 31
+// Maximum number of frames. The actual limit is set in userspace, see
+// `max_stack_depth`. Kernels without `bpf_loop` walk up to
+// (MAX_TAIL_CALLS + 1) * MAX_STACK_DEPTH_PER_PROGRAM frames.
+#define MAX_STACK_DEPTH 512
+// Maximum number of frames of the stacks walked by the kernel, as per the
+// default value of the kernel.perf_event_max_stack sysctl.
+#define MAX_PERF_STACK_DEPTH 127
 // Number of unique stacks.
 #define MAX_STACK_TRACES_ENTRIES 64000
 // Number of items in the stack counts aggregation map.
 #define MAX_STACK_COUNTS_ENTRIES 10240
 // Maximum number of processes we are willing to track.
 #define MAX_PROCESSES 5000
+// Maximum number of cgroups in the cgroup filter.
+#define MAX_CGROUP_FILTER_ENTRIES 5000
 // Binary search iterations for dwarf based stack walking.
 // 2^19 can bisect ~524_288 entries.
 #define MAX_BINARY_SEARCH_DEPTH 19
@@ -47,6 +54,30 @@ _Static_assert(1 << MAX_BINARY_SEARCH_DEPTH >= MAX_UNWIND_TABLE_SIZE, "unwind ta
 #define DWARF_EXPRESSION_UNKNOWN 0
 #define DWARF_EXPRESSION_PLT1 1
 #define DWARF_EXPRESSION_PLT2 2
+// Identifier of the first compiled expression in the dwarf_expressions map.
+#define DWARF_EXPRESSION_COMPILED 3
+
+// Maximum number of compiled dwarf expressions.
+#define MAX_DWARF_EXPRESSIONS 1024
+// Maximum number of operations of a compiled dwarf expression.
+#define MAX_DWARF_EXPRESSION_OPS 16
+// Maximum number of values on the stack while evaluating a compiled dwarf expression.
+#define MAX_DWARF_EXPRESSION_STACK 8
+
+// Operations of compiled dwarf expressions.
+#define EXPRESSION_OP_BREG 1
+#define EXPRESSION_OP_CONST 2
+#define EXPRESSION_OP_PLUS_CONST 3
+#define EXPRESSION_OP_DEREF 4
+#define EXPRESSION_OP_AND 5
+#define EXPRESSION_OP_PLUS 6
+#define EXPRESSION_OP_GE 7
+#define EXPRESSION_OP_SHL 8
+
+// DWARF register numbers.
+#define X86_64_REGISTER_RBP 6
+#define X86_64_REGISTER_RSP 7
+#define X86_64_REGISTER_RIP 16
 
 // Values for the unwind table's CFA type.
 #define CFA_TYPE_RBP 1
@@ -54,6 +85,14 @@ _Static_assert(1 << MAX_BINARY_SEARCH_DEPTH >= MAX_UNWIND_TABLE_SIZE, "unwind ta
 #define CFA_TYPE_EXPRESSION 3
 // Special values.
 #define CFA_TYPE_END_OF_FDE_MARKER 4
+#define CFA_TYPE_SIGNAL_FRAME 5
+
+// Offsets of the registers saved in the ucontext of the rt_sigframe the kernel
+// pushes before running a signal handler, from the stack pointer in the signal
+// trampoline once the handler has returned to it.
+#define UCONTEXT_RBP_OFFSET 120
+#define UCONTEXT_RSP_OFFSET 160
+#define UCONTEXT_RIP_OFFSET 168
 
 // Values for the unwind table's frame pointer type.
 #define RBP_TYPE_UNCHANGED 0
@@ -75,6 +114,11 @@ _Static_assert(1 << MAX_BINARY_SEARCH_DEPTH >= MAX_UNWIND_TABLE_SIZE, "unwind ta
 
 #define ENABLE_STATS_PRINTING false
 
+// How the cgroups in the cgroup_filter map are treated.
+#define CGROUP_FILTER_NONE 0
+#define CGROUP_FILTER_ALLOW 1
+#define CGROUP_FILTER_DENY 2
+
 // Stack walking methods.
 enum stack_walking_method {
   STACK_WALKING_METHOD_FP = 0,
@@ -85,6 +129,8 @@ struct unwinder_config_t {
   bool filter_processes;
   bool verbose_logging;
   bool mixed_stack_enabled;
+  u8 cgroup_filter_mode;
+  u32 max_stack_depth; // Up to MAX_STACK_DEPTH, deeper stacks are recorded as truncated.
 };
 
 struct unwinder_stats_t {
@@ -123,7 +169,7 @@ const volatile struct unwinder_config_t unwinder_config = {};
 // Stack Traces are slightly different
 // in that the value is 1 big byte array
 // of the stack addresses
-typedef u64 stack_trace_type[MAX_STACK_DEPTH];
+typedef u64 stack_trace_type[MAX_PERF_STACK_DEPTH];
 #define BPF_STACK_TRACE(_name, _max_entries) BPF_MAP(_name, BPF_MAP_TYPE_STACK_TRACE, u32, stack_trace_type, _max_entries);
 
 #define BPF_HASH(_name, _key_type, _value_type, _max_entries) BPF_MAP(_name, BPF_MAP_TYPE_HASH, _key_type, _value_type, _max_entries);
@@ -160,6 +206,7 @@ typedef struct {
 // The addresses of a native stack trace.
 typedef struct {
   u64 len;
+  u64 truncated; // Set if the stack had more frames than `max_stack_depth`.
   u64 addresses[MAX_STACK_DEPTH];
 } stack_trace_t;
 
@@ -196,6 +243,8 @@ typedef struct {
   u32 tail_calls;
   stack_trace_t stack;
   bool unwinding_jit; // set to true during JITed unwinding; false unless mixed-mode unwinding is enabled
+  bool dwarf_to_jit;  // set to true once a stack was walked with DWARF unwind information
+  u64 expression_stack[MAX_DWARF_EXPRESSION_STACK];
 } unwind_state_t;
 
 // A row in the stack unwinding table for x86_64.
@@ -213,12 +262,38 @@ typedef struct {
   stack_unwind_row_t rows[MAX_UNWIND_TABLE_SIZE];
 } stack_unwind_table_t;
 
+// An operation of a compiled dwarf expression.
+typedef struct {
+  u8 opcode;
+  u8 reg;
+  u8 _padding[6];
+  s64 operand;
+} dwarf_expression_op_t;
+_Static_assert(sizeof(dwarf_expression_op_t) == 16, "dwarf expression operation has the expected size");
+
+// A dwarf expression compiled in userspace, unwind rows refer to them by identifier.
+typedef struct {
+  u64 len;
+  dwarf_expression_op_t ops[MAX_DWARF_EXPRESSION_OPS];
+} dwarf_expression_t;
+
+// Profiling settings of a process, derived from the target rules
+// in userspace. Processes without an entry are always profiled.
+typedef struct {
+  u8 excluded;
+  u8 sampling_weight; // Percentage of the samples that are kept.
+} target_config_t;
+
 /*================================ MAPS =====================================*/
 
 BPF_HASH(debug_pids, int, u8, 1); // Table size will be updated in userspace.
 BPF_HASH(process_info, int, process_info_t, MAX_PROCESSES);
+BPF_HASH(target_configs, int, target_config_t, MAX_PROCESSES);
+BPF_HASH(cgroup_filter, u64, u8, MAX_CGROUP_FILTER_ENTRIES); // Keyed by cgroup v2 ID.
 
 BPF_STACK_TRACE(stack_traces, MAX_STACK_TRACES_ENTRIES);
+// Its values only hold `max_stack_depth` frames, the map is resized in userspace
+// to use the memory of MAX_STACK_TRACES_ENTRIES stacks of MAX_PERF_STACK_DEPTH frames.
 BPF_HASH(dwarf_stack_traces, int, stack_trace_t, MAX_STACK_TRACES_ENTRIES);
 BPF_HASH(stack_counts, stack_count_key_t, u64, MAX_STACK_COUNTS_ENTRIES);
 
@@ -226,6 +301,8 @@ BPF_HASH(unwind_info_chunks, u64, unwind_info_chunks_t,
          5 * 1000); // Mapping of executable ID to unwind info chunks.
 BPF_HASH(unwind_tables, u64, stack_unwind_table_t,
          5); // Table size will be updated in userspace.
+BPF_MAP(dwarf_expressions, BPF_MAP_TYPE_ARRAY, u32, dwarf_expression_t,
+        MAX_DWARF_EXPRESSIONS); // Indexed by expression identifier minus DWARF_EXPRESSION_COMPILED.
 
 struct {
   __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
@@ -345,6 +422,100 @@ static __always_inline void *bpf_map_lookup_or_try_init(void *map, const void *k
   return bpf_map_lookup_elem(map, key);
 }
 
+// Evaluate the compiled dwarf expression with the given identifier using the registers
+// of the current frame. For register rules the CFA is pushed onto the stack first.
+// Returns zero if the expression could not be evaluated.
+static u64 evaluate_dwarf_expression(s16 expression_id, unwind_state_t *unwind_state, bool push_cfa, u64 cfa) {
+  if (expression_id < DWARF_EXPRESSION_COMPILED) {
+    return 0;
+  }
+  u32 index = expression_id - DWARF_EXPRESSION_COMPILED;
+  dwarf_expression_t *expression = bpf_map_lookup_elem(&dwarf_expressions, &index);
+  if (expression == NULL) {
+    return 0;
+  }
+
+  u32 top = 0; // Number of values on the stack.
+  if (push_cfa) {
+    unwind_state->expression_stack[0] = cfa;
+    top = 1;
+  }
+
+  for (int i = 0; i < MAX_DWARF_EXPRESSION_OPS; i++) {
+    if (i >= expression->len) {
+      break;
+    }
+
+    u8 opcode = expression->ops[i].opcode;
+    s64 operand = expression->ops[i].operand;
+
+    if (opcode == EXPRESSION_OP_BREG || opcode == EXPRESSION_OP_CONST) {
+      u64 value = operand;
+      if (opcode == EXPRESSION_OP_BREG) {
+        u8 reg = expression->ops[i].reg;
+        if (reg == X86_64_REGISTER_RBP) {
+          value += unwind_state->bp;
+        } else if (reg == X86_64_REGISTER_RSP) {
+          value += unwind_state->sp;
+        } else if (reg == X86_64_REGISTER_RIP) {
+          value += unwind_state->ip;
+        } else {
+          return 0;
+        }
+      }
+      // Appease the verifier.
+      if (top >= MAX_DWARF_EXPRESSION_STACK) {
+        return 0;
+      }
+      unwind_state->expression_stack[top] = value;
+      top++;
+    } else if (opcode == EXPRESSION_OP_PLUS_CONST || opcode == EXPRESSION_OP_DEREF) {
+      // Appease the verifier.
+      if (top == 0 || top > MAX_DWARF_EXPRESSION_STACK) {
+        return 0;
+      }
+      u64 value = unwind_state->expression_stack[top - 1];
+      if (opcode == EXPRESSION_OP_PLUS_CONST) {
+        value += operand;
+      } else {
+        u64 address = value;
+        if (bpf_probe_read_user(&value, 8, (void *)address) != 0) {
+          LOG("[error] failed to read the memory at %llx in a dwarf expression", address);
+          return 0;
+        }
+      }
+      unwind_state->expression_stack[top - 1] = value;
+    } else if (opcode == EXPRESSION_OP_AND || opcode == EXPRESSION_OP_PLUS || opcode == EXPRESSION_OP_GE || opcode == EXPRESSION_OP_SHL) {
+      // Appease the verifier.
+      if (top < 2 || top > MAX_DWARF_EXPRESSION_STACK) {
+        return 0;
+      }
+      u64 a = unwind_state->expression_stack[top - 2];
+      u64 b = unwind_state->expression_stack[top - 1];
+      u64 value = 0;
+      if (opcode == EXPRESSION_OP_AND) {
+        value = a & b;
+      } else if (opcode == EXPRESSION_OP_PLUS) {
+        value = a + b;
+      } else if (opcode == EXPRESSION_OP_GE) {
+        value = (s64)a >= (s64)b;
+      } else {
+        value = a << b;
+      }
+      unwind_state->expression_stack[top - 2] = value;
+      top--;
+    } else {
+      return 0;
+    }
+  }
+
+  // Appease the verifier.
+  if (top == 0 || top > MAX_DWARF_EXPRESSION_STACK) {
+    return 0;
+  }
+  return unwind_state->expression_stack[top - 1];
+}
+
 /*================================= EVENTS ==================================*/
 
 static __always_inline void request_unwind_information(struct bpf_perf_event_data *ctx, int user_pid) {
@@ -424,6 +595,36 @@ static __always_inline bool is_debug_enabled_for_pid(int pid) {
   return false;
 }
 
+// Whether the current task runs in a cgroup that should be profiled.
+static __always_inline bool is_cgroup_allowed() {
+  if (unwinder_config.cgroup_filter_mode == CGROUP_FILTER_NONE) {
+    return true;
+  }
+
+  u64 cgroup_id = bpf_get_current_cgroup_id();
+  bool found = bpf_map_lookup_elem(&cgroup_filter, &cgroup_id) != NULL;
+  if (unwinder_config.cgroup_filter_mode == CGROUP_FILTER_ALLOW) {
+    return found;
+  }
+  return !found;
+}
+
+// Whether the current sample of the process should be recorded
+// according to its target config.
+static __always_inline bool should_sample_pid(int pid) {
+  target_config_t *config = bpf_map_lookup_elem(&target_configs, &pid);
+  if (config == NULL) {
+    return true;
+  }
+  if (config->excluded) {
+    return false;
+  }
+  if (config->sampling_weight < 100 && bpf_get_prandom_u32() % 100 >= config->sampling_weight) {
+    return false;
+  }
+  return true;
+}
+
 enum find_unwind_table_return {
   FIND_UNWIND_SUCCESS = 1,
 
@@ -436,9 +637,57 @@ enum find_unwind_table_return {
   FIND_UNWIND_SPECIAL = 200,
 };
 
+// Finds the chunk of the unwind table of an executable where the unwind
+// information for a program counter, relative to its load address, lives.
+static __always_inline chunk_info_t *find_chunk(u64 executable_id, u64 adjusted_pc) {
+  // Each chunk maps to exactly one shard.
+  unwind_info_chunks_t *chunks = bpf_map_lookup_elem(&unwind_info_chunks, &executable_id);
+  if (chunks == NULL) {
+    LOG("[info] chunks is null for executable %llu", executable_id);
+    return NULL;
+  }
+
+  for (int i = 0; i < MAX_UNWIND_TABLE_CHUNKS; i++) {
+    // Reached last chunk.
+    if (chunks->chunks[i].low_pc == 0) {
+      break;
+    }
+    if (chunks->chunks[i].low_pc <= adjusted_pc && adjusted_pc <= chunks->chunks[i].high_pc) {
+      LOG("[info] found chunk");
+      return &chunks->chunks[i];
+    }
+  }
+  return NULL;
+}
+
+// Whether the unwind table of JIT code, generated from its jitdump file,
+// covers the given program counter.
+static __always_inline bool jit_unwind_table_covers(chunk_info_t *chunk_info, u64 pc) {
+  stack_unwind_table_t *unwind_table = bpf_map_lookup_elem(&unwind_tables, &chunk_info->shard_index);
+  if (unwind_table == NULL) {
+    return false;
+  }
+
+  u64 table_idx = find_offset_for_pc(unwind_table, pc, chunk_info->low_index, chunk_info->high_index);
+  if (table_idx == BINARY_SEARCH_DEFAULT || table_idx == BINARY_SEARCH_SHOULD_NEVER_HAPPEN || table_idx == BINARY_SEARCH_EXHAUSTED_ITERATIONS) {
+    return false;
+  }
+
+  // Appease the verifier.
+  if (table_idx < 0 || table_idx >= MAX_UNWIND_TABLE_SIZE) {
+    return false;
+  }
+
+  // In between functions.
+  return unwind_table->rows[table_idx].cfa_type != CFA_TYPE_END_OF_FDE_MARKER;
+}
+
 // Finds the shard information for a given pid and program counter. Optionally,
 // and offset can be passed that will be filled in with the mapping's load
 // address.
+//
+// For JIT code, the shard information of the unwind table generated from
+// its jitdump file is filled in, if it covers the program counter.
 static __always_inline enum find_unwind_table_return find_unwind_table(chunk_info_t **chunk_info, pid_t pid, u64 pc, u64 *offset) {
   process_info_t *proc_info = bpf_map_lookup_elem(&process_info, &pid);
   // Appease the verifier.
@@ -482,6 +731,8 @@ static __always_inline enum find_unwind_table_return find_unwind_table(chunk_inf
     // "type" here is set in userspace in our `proc_info` map to indicate JITed and special sections,
     // It is not something we get from procfs.
     if (type == 1) {
+      // JIT mappings without a jitdump file have the executable ID 0, that has no chunks.
+      *chunk_info = find_chunk(executable_id, pc - load_address);
       return FIND_UNWIND_JITTED;
     }
     if (type == 2) {
@@ -496,28 +747,12 @@ static __always_inline enum find_unwind_table_return find_unwind_table(chunk_inf
   LOG("~checking shards now");
 
   // Find the chunk where this unwind table lives.
-  // Each chunk maps to exactly one shard.
-  unwind_info_chunks_t *chunks = bpf_map_lookup_elem(&unwind_info_chunks, &executable_id);
-  if (chunks == NULL) {
-    LOG("[info] chunks is null for executable %llu", executable_id);
+  *chunk_info = find_chunk(executable_id, pc - load_address);
+  if (*chunk_info == NULL) {
+    LOG("[error] could not find chunk");
     return FIND_UNWIND_CHUNK_NOT_FOUND;
   }
-
-  u64 adjusted_pc = pc - load_address;
-  for (int i = 0; i < MAX_UNWIND_TABLE_CHUNKS; i++) {
-    // Reached last chunk.
-    if (chunks->chunks[i].low_pc == 0) {
-      break;
-    }
-    if (chunks->chunks[i].low_pc <= adjusted_pc && adjusted_pc <= chunks->chunks[i].high_pc) {
-      LOG("[info] found chunk");
-      *chunk_info = &chunks->chunks[i];
-      return FIND_UNWIND_SUCCESS;
-    }
-  }
-
-  LOG("[error] could not find chunk");
-  return FIND_UNWIND_CHUNK_NOT_FOUND;
+  return FIND_UNWIND_SUCCESS;
 }
 
 // Kernel addresses have the top bits set.
@@ -591,7 +826,7 @@ static __always_inline bool has_fp(u64 current_fp) {
   u64 ra;
   int i;
 
-  for (i = 0; i < MAX_STACK_DEPTH; i++) {
+  for (i = 0; i < MAX_PERF_STACK_DEPTH; i++) {
     int err = bpf_probe_read_user(&next_fp, 8, (void *)current_fp);
     bpf_probe_read_user(&ra, 8, (void *)current_fp + 8);
     if (err < 0) {
@@ -644,7 +879,12 @@ static __always_inline void add_stack(struct bpf_perf_event_data *ctx, u64 pid_t
   stack_key.tid = user_tgid;
 
   if (method == STACK_WALKING_METHOD_DWARF) {
-    int stack_hash = MurmurHash2((u32 *)unwind_state->stack.addresses, MAX_STACK_DEPTH * sizeof(u64) / sizeof(u32), 0);
+    u64 len = unwind_state->stack.len;
+    if (len > MAX_STACK_DEPTH) {
+      return;
+    }
+    // Only the walked frames are hashed, and truncated stacks hash differently.
+    int stack_hash = MurmurHash2((u32 *)unwind_state->stack.addresses, len * sizeof(u64), unwind_state->stack.truncated);
     LOG("stack hash %d", stack_hash);
     stack_key.user_stack_id_dwarf = stack_hash;
 
@@ -683,223 +923,261 @@ static __always_inline void add_stack(struct bpf_perf_event_data *ctx, u64 pid_t
   request_process_mappings(ctx, user_pid);
 }
 
-// The unwinding machinery lives here.
-SEC("perf_event")
-int walk_user_stacktrace_impl(struct bpf_perf_event_data *ctx) {
+enum unwind_frame_result {
+  // The frame was unwound, the next one can be walked.
+  UNWIND_FRAME_CONTINUE,
+  // There are no more frames, the stack can be added.
+  UNWIND_FRAME_BOTTOM_OF_STACK,
+  // The stack has more frames than `max_stack_depth`.
+  UNWIND_FRAME_TRUNCATED,
+  // Unwinding failed.
+  UNWIND_FRAME_STOP,
+};
+
+// Unwind the frame in the current registers of the unwind state.
+static __always_inline enum unwind_frame_result unwind_frame(struct bpf_perf_event_data *ctx, unwind_state_t *unwind_state) {
   u64 pid_tgid = bpf_get_current_pid_tgid();
   int user_pid = pid_tgid;
   int err = 0;
 
-  bool reached_bottom_of_stack = false;
-  u64 zero = 0;
+  LOG("[debug] Within unwinding machinery loop");
+  LOG("## frame: %d", unwind_state->stack.len);
 
-  bool dwarf_to_jit = false;
+  LOG("\tcurrent pc: %llx", unwind_state->ip);
+  LOG("\tcurrent sp: %llx", unwind_state->sp);
+  LOG("\tcurrent bp: %llx", unwind_state->bp);
 
-  unwind_state_t *unwind_state = bpf_map_lookup_elem(&heap, &zero);
-  if (unwind_state == NULL) {
-    LOG("unwind_state is NULL, should not happen");
-    return 1;
+  u64 offset = 0;
+
+  chunk_info_t *chunk_info = NULL;
+  enum find_unwind_table_return unwind_table_result = find_unwind_table(&chunk_info, user_pid, unwind_state->ip, &offset);
+
+  // JIT code with unwind information from its jitdump file is unwound as native code.
+  if (unwind_table_result == FIND_UNWIND_JITTED && chunk_info != NULL && jit_unwind_table_covers(chunk_info, unwind_state->ip - offset)) {
+    LOG("[debug] JIT code with unwind information");
+    unwind_table_result = FIND_UNWIND_SUCCESS;
   }
 
-  for (int i = 0; i < MAX_STACK_DEPTH_PER_PROGRAM; i++) {
-    LOG("[debug] Within unwinding machinery loop");
-    LOG("## frame: %d", unwind_state->stack.len);
+  if (unwind_table_result == FIND_UNWIND_JITTED) {
+    if (!unwinder_config.mixed_stack_enabled) {
+      LOG("JIT section, stopping. Please enable mixed-mode unwinding with the --dwarf-unwinding-mixed=true to profile JITed stacks.");
+      bump_unwind_error_jit_mixed_mode_disabled();
+      return UNWIND_FRAME_STOP;
+    }
 
-    LOG("\tcurrent pc: %llx", unwind_state->ip);
-    LOG("\tcurrent sp: %llx", unwind_state->sp);
-    LOG("\tcurrent bp: %llx", unwind_state->bp);
+    LOG("[debug] Unwinding JITed stacks");
 
-    u64 offset = 0;
+    // Every JIT frame is added to the stack.
+    if (unwind_state->stack.len >= unwinder_config.max_stack_depth) {
+      return UNWIND_FRAME_TRUNCATED;
+    }
 
-    chunk_info_t *chunk_info = NULL;
-    enum find_unwind_table_return unwind_table_result = find_unwind_table(&chunk_info, user_pid, unwind_state->ip, &offset);
+    unwind_state->unwinding_jit = true;
+    if (unwind_state->dwarf_to_jit) {
+      unwind_state->dwarf_to_jit = false;
+      bump_unwind_success_dwarf_to_jit();
+    }
 
-    if (unwind_table_result == FIND_UNWIND_JITTED) {
-      if (!unwinder_config.mixed_stack_enabled) {
-        LOG("JIT section, stopping. Please enable mixed-mode unwinding with the --dwarf-unwinding-mixed=true to profile JITed stacks.");
-        bump_unwind_error_jit_mixed_mode_disabled();
-        return 1;
-      }
+    u64 next_fp = 0;
+    u64 ra = 0;
+    u64 len = unwind_state->stack.len;
 
-      LOG("[debug] Unwinding JITed stacks");
+    // When we enter a JITed stack, the first JITed frame can
+    // be obtained from the current value of pc(program counter)
 
-      unwind_state->unwinding_jit = true;
-      if (dwarf_to_jit) {
-        dwarf_to_jit = false;
-        bump_unwind_success_dwarf_to_jit();
+    if (unwind_state->stack.len == 0) {
+      if (len >= 0 && len < MAX_STACK_DEPTH) {
+        unwind_state->stack.addresses[len] = unwind_state->ip;
+        unwind_state->stack.len++;
+        return UNWIND_FRAME_CONTINUE;
       }
+    }
 
-      u64 next_fp = 0;
-      u64 ra = 0;
-      u64 len = unwind_state->stack.len;
+    err = bpf_probe_read_user(&next_fp, 8, (void *)unwind_state->bp);
+    if (err < 0) {
+      // TODO(sylfrena):
+      // For some weird reason commenting out this and the next err log line results in a panic
+      // Using more than 3 arguments also results in a panic in some older kernels because of
+      // https://github.com/libbpf/libbpf/blob/f7eb43b90f4c8882edf6354f8585094f8f3aade0/src/bpf_helpers.h#L287-L289
+      LOG("[error] rbp failed with err = %d", err);
+      return UNWIND_FRAME_STOP;
+    }
 
-      // When we enter a JITed stack, the first JITed frame can
-      // be obtained from the current value of pc(program counter)
+    // LOG("[debug]  i=%d, err = %d && rbp = %llx && ra=%llx", i, err, next_fp, ra);
 
-      if (unwind_state->stack.len == 0) {
-        if (len >= 0 && len < MAX_STACK_DEPTH) {
-          unwind_state->stack.addresses[len] = unwind_state->ip;
-          unwind_state->stack.len++;
-          continue;
-        }
-      }
+    // reading return address
+    err = bpf_probe_read_user(&ra, 8, (void *)unwind_state->bp + 8);
+    if (err < 0) {
+      // TODO(sylfrena)
+      //  For some weird reason commenting out this and the next err log line results in a panic
+      //  Using more than 3 arguments also results in a panic in some older kernels because of
+      //  https://github.com/libbpf/libbpf/blob/f7eb43b90f4c8882edf6354f8585094f8f3aade0/src/bpf_helpers.h#L287-L289
+      LOG("[error] ra failed with err = %d", err);
+      return UNWIND_FRAME_STOP;
+    }
 
-      err = bpf_probe_read_user(&next_fp, 8, (void *)unwind_state->bp);
-      if (err < 0) {
-        // TODO(sylfrena):
-        // For some weird reason commenting out this and the next err log line results in a panic
-        // Using more than 3 arguments also results in a panic in some older kernels because of
-        // https://github.com/libbpf/libbpf/blob/f7eb43b90f4c8882edf6354f8585094f8f3aade0/src/bpf_helpers.h#L287-L289
-        LOG("[error] rbp failed with err = %d", err);
-        return 0;
-      }
+    if (next_fp == 0) {
+      LOG("[info] found bottom frame while walking JITed section");
+      bump_unwind_success_jit_reach_bottom();
+      return UNWIND_FRAME_STOP;
+    }
 
-      // LOG("[debug]  i=%d, err = %d && rbp = %llx && ra=%llx", i, err, next_fp, ra);
+    // Stacktraces are essentially a list of saved return addresses from function calls pushed onto a stack
+    // The base pointer (`rbp` in x86_64) is a register pushed onto the stack and points to/references the beginning of the stack
+    // The stack pointer(`rsp`) points to the frame at the `rbp`, updating the top of the stack to 8 bytes ahead of the `rbp`
+    // When the current instruction is pushed, top of the stack moves up by 1 frame, updating `rsp` by another 8 bytes
+    // Hence, we update current stack pointer by 16 bytes ahead of `rbp`
+    unwind_state->sp = unwind_state->bp + 16;
+    unwind_state->bp = next_fp;
+    // Rewinding the program counter to get the instruction pointer for the previous function
+    // would be ideal but is unreliable in `x86` due to variable width encoding. We can ensure correctness only by disassembling the `.text` section which would be unfeasible.
+    // Since return addresses always point to the next instruction to be executed after returning from the function
+    // (and stack grows downwards), subtracting 1 from the current `ra` gives us the current instruction pointer location,
+    // if not the exact instruction boundary
+    unwind_state->ip = ra - 1;
+    len = unwind_state->stack.len;
+
+    // add ra for frame
+    if (len >= 0 && len < MAX_STACK_DEPTH) {
+      unwind_state->stack.addresses[len] = ra;
+      unwind_state->stack.len++;
+      bump_unwind_success_jit_frame();
+    }
 
-      // reading return address
-      err = bpf_probe_read_user(&ra, 8, (void *)unwind_state->bp + 8);
-      if (err < 0) {
-        // TODO(sylfrena)
-        //  For some weird reason commenting out this and the next err log line results in a panic
-        //  Using more than 3 arguments also results in a panic in some older kernels because of
-        //  https://github.com/libbpf/libbpf/blob/f7eb43b90f4c8882edf6354f8585094f8f3aade0/src/bpf_helpers.h#L287-L289
-        LOG("[error] ra failed with err = %d", err);
-        return 0;
-      }
+    return UNWIND_FRAME_CONTINUE;
+  } else if (unwind_table_result == FIND_UNWIND_SPECIAL) {
+    LOG("special section, stopping");
+    return UNWIND_FRAME_STOP;
+  } else if (unwind_table_result == FIND_UNWIND_MAPPING_NOT_FOUND) {
+    request_refresh_process_info(ctx, user_pid);
+    return UNWIND_FRAME_STOP;
+  } else if (chunk_info == NULL) {
+    // improve
+    return UNWIND_FRAME_BOTTOM_OF_STACK;
+  }
 
-      if (next_fp == 0) {
-        LOG("[info] found bottom frame while walking JITed section");
-        bump_unwind_success_jit_reach_bottom();
-        return 1;
-      }
+  stack_unwind_table_t *unwind_table = bpf_map_lookup_elem(&unwind_tables, &chunk_info->shard_index);
+  if (unwind_table == NULL) {
+    LOG("unwind table is null :( for shard %llu", chunk_info->shard_index);
+    return UNWIND_FRAME_STOP;
+  }
 
-      // Stacktraces are essentially a list of saved return addresses from function calls pushed onto a stack
-      // The base pointer (`rbp` in x86_64) is a register pushed onto the stack and points to/references the beginning of the stack
-      // The stack pointer(`rsp`) points to the frame at the `rbp`, updating the top of the stack to 8 bytes ahead of the `rbp`
-      // When the current instruction is pushed, top of the stack moves up by 1 frame, updating `rsp` by another 8 bytes
-      // Hence, we update current stack pointer by 16 bytes ahead of `rbp`
-      unwind_state->sp = unwind_state->bp + 16;
-      unwind_state->bp = next_fp;
-      // Rewinding the program counter to get the instruction pointer for the previous function
-      // would be ideal but is unreliable in `x86` due to variable width encoding. We can ensure correctness only by disassembling the `.text` section which would be unfeasible.
-      // Since return addresses always point to the next instruction to be executed after returning from the function
-      // (and stack grows downwards), subtracting 1 from the current `ra` gives us the current instruction pointer location,
-      // if not the exact instruction boundary
-      unwind_state->ip = ra - 1;
-      len = unwind_state->stack.len;
-
-      // add ra for frame
-      if (len >= 0 && len < MAX_STACK_DEPTH) {
-        unwind_state->stack.addresses[len] = ra;
-        unwind_state->stack.len++;
-        bump_unwind_success_jit_frame();
-      }
+  LOG("le offset: %llx", offset);
+  u64 left = chunk_info->low_index;
+  u64 right = chunk_info->high_index;
+  LOG("========== left %llu right %llu", left, right);
 
-      continue;
-    } else if (unwind_table_result == FIND_UNWIND_SPECIAL) {
-      LOG("special section, stopping");
-      return 1;
-    } else if (unwind_table_result == FIND_UNWIND_MAPPING_NOT_FOUND) {
-      request_refresh_process_info(ctx, user_pid);
-      return 1;
-    } else if (chunk_info == NULL) {
-      // improve
-      reached_bottom_of_stack = true;
-      break;
-    }
+  u64 table_idx = find_offset_for_pc(unwind_table, unwind_state->ip - offset, left, right);
 
-    stack_unwind_table_t *unwind_table = bpf_map_lookup_elem(&unwind_tables, &chunk_info->shard_index);
-    if (unwind_table == NULL) {
-      LOG("unwind table is null :( for shard %llu", chunk_info->shard_index);
-      return 0;
-    }
+  if (table_idx == BINARY_SEARCH_DEFAULT || table_idx == BINARY_SEARCH_SHOULD_NEVER_HAPPEN || table_idx == BINARY_SEARCH_EXHAUSTED_ITERATIONS) {
+    LOG("[error] binary search failed with %llx", table_idx);
+    return UNWIND_FRAME_STOP;
+  }
 
-    LOG("le offset: %llx", offset);
-    u64 left = chunk_info->low_index;
-    u64 right = chunk_info->high_index;
-    LOG("========== left %llu right %llu", left, right);
+  LOG("\t=> table_index: %d", table_idx);
+  LOG("\t=> adjusted pc: %llx", unwind_state->ip - offset);
 
-    u64 table_idx = find_offset_for_pc(unwind_table, unwind_state->ip - offset, left, right);
+  // Appease the verifier.
+  if (table_idx < 0 || table_idx >= MAX_UNWIND_TABLE_SIZE) {
+    LOG("\t[error] this should never happen");
+    bump_unwind_error_should_never_happen();
+    return UNWIND_FRAME_STOP;
+  }
 
-    if (table_idx == BINARY_SEARCH_DEFAULT || table_idx == BINARY_SEARCH_SHOULD_NEVER_HAPPEN || table_idx == BINARY_SEARCH_EXHAUSTED_ITERATIONS) {
-      LOG("[error] binary search failed with %llx", table_idx);
-      return 1;
-    }
+  u64 found_pc = unwind_table->rows[table_idx].pc;
+  u8 found_cfa_type = unwind_table->rows[table_idx].cfa_type;
+  u8 found_rbp_type = unwind_table->rows[table_idx].rbp_type;
+  s16 found_cfa_offset = unwind_table->rows[table_idx].cfa_offset;
+  s16 found_rbp_offset = unwind_table->rows[table_idx].rbp_offset;
+  LOG("\tcfa type: %d, offset: %d (row pc: %llx)", found_cfa_type, found_cfa_offset, found_pc);
+
+  if (found_cfa_type == CFA_TYPE_END_OF_FDE_MARKER) {
+    LOG("[info] PC %llx not contained in the unwind info, found marker", unwind_state->ip);
+    bump_unwind_success_dwarf_reach_bottom(); // assuming we only have unwind tables for DWARF frames, not FP or JIT frames
+    return UNWIND_FRAME_BOTTOM_OF_STACK;
+  }
 
-    LOG("\t=> table_index: %d", table_idx);
-    LOG("\t=> adjusted pc: %llx", unwind_state->ip - offset);
+  if (found_rbp_type == RBP_TYPE_UNDEFINED_RETURN_ADDRESS) {
+    LOG("[info] null return address, end of stack", unwind_state->ip);
+    bump_unwind_success_dwarf_reach_bottom();
+    return UNWIND_FRAME_BOTTOM_OF_STACK;
+  }
 
-    // Appease the verifier.
-    if (table_idx < 0 || table_idx >= MAX_UNWIND_TABLE_SIZE) {
-      LOG("\t[error] this should never happen");
-      bump_unwind_error_should_never_happen();
-      return 1;
+  // Add address to stack.
+  u64 len = unwind_state->stack.len;
+  // Appease the verifier.
+  // For some reason bailing out here if the condition is not true does
+  // not work?
+
+  // This is for the case when we are NOT switching unwinding from JIT to DWARF section
+  // i.e. unwind_state->unwinding_jit holds false
+  if (!unwind_state->unwinding_jit) {
+    if (len >= unwinder_config.max_stack_depth) {
+      return UNWIND_FRAME_TRUNCATED;
     }
+    if (len >= 0 && len < MAX_STACK_DEPTH) {
+      unwind_state->stack.addresses[len] = unwind_state->ip;
 
-    u64 found_pc = unwind_table->rows[table_idx].pc;
-    u8 found_cfa_type = unwind_table->rows[table_idx].cfa_type;
-    u8 found_rbp_type = unwind_table->rows[table_idx].rbp_type;
-    s16 found_cfa_offset = unwind_table->rows[table_idx].cfa_offset;
-    s16 found_rbp_offset = unwind_table->rows[table_idx].rbp_offset;
-    LOG("\tcfa type: %d, offset: %d (row pc: %llx)", found_cfa_type, found_cfa_offset, found_pc);
-
-    if (found_cfa_type == CFA_TYPE_END_OF_FDE_MARKER) {
-      LOG("[info] PC %llx not contained in the unwind info, found marker", unwind_state->ip);
-      reached_bottom_of_stack = true;
-      bump_unwind_success_dwarf_reach_bottom(); // assuming we only have unwind tables for DWARF frames, not FP or JIT frames
-      break;
+      unwind_state->stack.len++;
     }
+  }
 
-    if (found_rbp_type == RBP_TYPE_UNDEFINED_RETURN_ADDRESS) {
-      LOG("[info] null return address, end of stack", unwind_state->ip);
-      reached_bottom_of_stack = true;
-      bump_unwind_success_dwarf_reach_bottom();
-      break;
-    }
+  // Set unwind_state->unwinding_jit to false once we have checked for switch from JITed unwinding to DWARF unwinding
+  if (unwind_state->unwinding_jit) {
+    bump_unwind_success_jit_to_dwarf();
+    LOG("[debug] Switched to mixed-mode DWARF unwinding");
+  }
+  unwind_state->unwinding_jit = false;
 
-    // Add address to stack.
-    u64 len = unwind_state->stack.len;
-    // Appease the verifier.
-    // For some reason bailing out here if the condition is not true does
-    // not work?
+  if (found_cfa_type == CFA_TYPE_SIGNAL_FRAME) {
+    // The interrupted code's registers are restored from the signal frame.
+    u64 ucontext = unwind_state->sp;
+    u64 previous_rip = 0;
+    u64 previous_rsp = 0;
+    u64 previous_rbp = 0;
+    if (bpf_probe_read_user(&previous_rip, 8, (void *)(ucontext + UCONTEXT_RIP_OFFSET)) != 0 ||
+        bpf_probe_read_user(&previous_rsp, 8, (void *)(ucontext + UCONTEXT_RSP_OFFSET)) != 0 ||
+        bpf_probe_read_user(&previous_rbp, 8, (void *)(ucontext + UCONTEXT_RBP_OFFSET)) != 0) {
+      LOG("[error] failed to read the registers saved in the signal frame @ %llx", ucontext);
+      bump_unwind_error_catchall();
+      return UNWIND_FRAME_STOP;
+    }
 
-    // This is for the case when we are NOT switching unwinding from JIT to DWARF section
-    // i.e. unwind_state->unwinding_jit holds false
-    if (!unwind_state->unwinding_jit) {
-      if (len >= 0 && len < MAX_STACK_DEPTH) {
-        unwind_state->stack.addresses[len] = unwind_state->ip;
+    LOG("\tsignal frame, previous ip: %llx sp: %llx bp: %llx", previous_rip, previous_rsp, previous_rbp);
+    unwind_state->ip = previous_rip;
+    unwind_state->sp = previous_rsp;
+    unwind_state->bp = previous_rbp;
+    return UNWIND_FRAME_CONTINUE;
+  }
 
-        unwind_state->stack.len++;
-      }
-    }
+  if (found_rbp_type == RBP_TYPE_REGISTER || (found_rbp_type == RBP_TYPE_EXPRESSION && found_rbp_offset == DWARF_EXPRESSION_UNKNOWN)) {
+    LOG("\t[error] frame pointer is %d (register or exp), bailing out", found_rbp_type);
+    bump_unwind_error_unsupported_frame_pointer_action();
+    return UNWIND_FRAME_STOP;
+  }
 
-    // Set unwind_state->unwinding_jit to false once we have checked for switch from JITed unwinding to DWARF unwinding
-    if (unwind_state->unwinding_jit) {
-      bump_unwind_success_jit_to_dwarf();
-      LOG("[debug] Switched to mixed-mode DWARF unwinding");
+  u64 previous_rsp = 0;
+  if (found_cfa_type == CFA_TYPE_RBP) {
+    previous_rsp = unwind_state->bp + found_cfa_offset;
+  } else if (found_cfa_type == CFA_TYPE_RSP) {
+    previous_rsp = unwind_state->sp + found_cfa_offset;
+  } else if (found_cfa_type == CFA_TYPE_EXPRESSION) {
+    if (found_cfa_offset == DWARF_EXPRESSION_UNKNOWN) {
+      LOG("[unsup] CFA is an unsupported expression, bailing out");
+      bump_unwind_error_unsupported_expression();
+      return UNWIND_FRAME_STOP;
     }
-    unwind_state->unwinding_jit = false;
 
-    if (found_rbp_type == RBP_TYPE_REGISTER || found_rbp_type == RBP_TYPE_EXPRESSION) {
-      LOG("\t[error] frame pointer is %d (register or exp), bailing out", found_rbp_type);
-      bump_unwind_error_unsupported_frame_pointer_action();
-      return 1;
-    }
+    LOG("CFA expression found with id %d", found_cfa_offset);
 
-    u64 previous_rsp = 0;
-    if (found_cfa_type == CFA_TYPE_RBP) {
-      previous_rsp = unwind_state->bp + found_cfa_offset;
-    } else if (found_cfa_type == CFA_TYPE_RSP) {
-      previous_rsp = unwind_state->sp + found_cfa_offset;
-    } else if (found_cfa_type == CFA_TYPE_EXPRESSION) {
-      if (found_cfa_offset == DWARF_EXPRESSION_UNKNOWN) {
-        LOG("[unsup] CFA is an unsupported expression, bailing out");
+    if (found_cfa_offset >= DWARF_EXPRESSION_COMPILED) {
+      previous_rsp = evaluate_dwarf_expression(found_cfa_offset, unwind_state, false, 0);
+      if (previous_rsp == 0) {
+        LOG("[error] CFA expression %d could not be evaluated", found_cfa_offset);
         bump_unwind_error_unsupported_expression();
-        return 1;
+        return UNWIND_FRAME_STOP;
       }
-
-      LOG("CFA expression found with id %d", found_cfa_offset);
-
+    } else {
       u64 threshold = 0;
       if (found_cfa_offset == DWARF_EXPRESSION_PLT1) {
         threshold = 11;
@@ -909,128 +1187,225 @@ int walk_user_stacktrace_impl(struct bpf_perf_event_data *ctx) {
 
       if (threshold == 0) {
         bump_unwind_error_should_never_happen();
-        return 1;
+        return UNWIND_FRAME_STOP;
       }
       previous_rsp = unwind_state->sp + 8 + ((((unwind_state->ip & 15) >= threshold)) << 3);
-    } else {
-      LOG("\t[unsup] register %d not valid (expected $rbp or $rsp)", found_cfa_type);
-      bump_unwind_error_unsupported_cfa_register();
-      return 1;
     }
+  } else {
+    LOG("\t[unsup] register %d not valid (expected $rbp or $rsp)", found_cfa_type);
+    bump_unwind_error_unsupported_cfa_register();
+    return UNWIND_FRAME_STOP;
+  }
 
-    // TODO(javierhonduco): A possible check could be to see whether this value
-    // is within the stack. This check could be quite brittle though, so if we
-    // add it, it would be best to add it only during development.
-    if (previous_rsp == 0) {
-      LOG("[error] previous_rsp should not be zero.");
-      bump_unwind_error_catchall();
-      return 1;
+  // TODO(javierhonduco): A possible check could be to see whether this value
+  // is within the stack. This check could be quite brittle though, so if we
+  // add it, it would be best to add it only during development.
+  if (previous_rsp == 0) {
+    LOG("[error] previous_rsp should not be zero.");
+    bump_unwind_error_catchall();
+    return UNWIND_FRAME_STOP;
+  }
+
+  // HACK(javierhonduco): This is an architectural shortcut we can take. As we
+  // only support x86_64 at the minute, we can assume that the return address
+  // is *always* 8 bytes ahead of the previous stack pointer.
+  u64 previous_rip_addr = previous_rsp - 8; // the saved return address is 8 bytes ahead of the previous stack pointer
+  u64 previous_rip = 0;
+  err = bpf_probe_read_user(&previous_rip, 8, (void *)(previous_rip_addr));
+
+  if (previous_rip == 0) {
+    int user_pid = pid_tgid;
+    process_info_t *proc_info = bpf_map_lookup_elem(&process_info, &user_pid);
+    if (proc_info == NULL) {
+      LOG("[error] should never happen");
+      return UNWIND_FRAME_STOP;
     }
 
-    // HACK(javierhonduco): This is an architectural shortcut we can take. As we
-    // only support x86_64 at the minute, we can assume that the return address
-    // is *always* 8 bytes ahead of the previous stack pointer.
-    u64 previous_rip_addr = previous_rsp - 8; // the saved return address is 8 bytes ahead of the previous stack pointer
-    u64 previous_rip = 0;
-    int err = bpf_probe_read_user(&previous_rip, 8, (void *)(previous_rip_addr));
+    if (proc_info->is_jit_compiler) {
+      LOG("[warn] mapping not added yet");
+      request_refresh_process_info(ctx, user_pid);
 
-    if (previous_rip == 0) {
-      int user_pid = pid_tgid;
-      process_info_t *proc_info = bpf_map_lookup_elem(&process_info, &user_pid);
-      if (proc_info == NULL) {
-        LOG("[error] should never happen");
-        return 1;
-      }
+      bump_unwind_error_jit_unupdated_mapping();
+      return UNWIND_FRAME_STOP;
+    }
 
-      if (proc_info->is_jit_compiler) {
-        LOG("[warn] mapping not added yet");
-        request_refresh_process_info(ctx, user_pid);
+    LOG("[error] previous_rip should not be zero. This can mean that the read failed, ret=%d while reading @ %llx.", err, previous_rip_addr);
+    bump_unwind_error_catchall();
+    return UNWIND_FRAME_STOP;
+  }
 
-        bump_unwind_error_jit_unupdated_mapping();
-        return 1;
+  // Set rbp register.
+  u64 previous_rbp = 0;
+  if (found_rbp_type == RBP_TYPE_UNCHANGED) {
+    previous_rbp = unwind_state->bp;
+  } else {
+    u64 previous_rbp_addr = 0;
+    if (found_rbp_type == RBP_TYPE_EXPRESSION) {
+      // The expression computes where the frame pointer is saved from the CFA.
+      previous_rbp_addr = evaluate_dwarf_expression(found_rbp_offset, unwind_state, true, previous_rsp);
+      if (previous_rbp_addr == 0) {
+        LOG("[error] frame pointer expression %d could not be evaluated", found_rbp_offset);
+        bump_unwind_error_unsupported_expression();
+        return UNWIND_FRAME_STOP;
       }
-
-      LOG("[error] previous_rip should not be zero. This can mean that the read failed, ret=%d while reading @ %llx.", err, previous_rip_addr);
+    } else {
+      previous_rbp_addr = previous_rsp + found_rbp_offset;
+    }
+    LOG("\t(bp_offset: %d, bp value stored at %llx)", found_rbp_offset, previous_rbp_addr);
+    int ret = bpf_probe_read_user(&previous_rbp, 8, (void *)(previous_rbp_addr));
+    if (ret != 0) {
+      LOG("[error] previous_rbp should not be zero. This can mean "
+          "that the read has failed %d.",
+          ret);
       bump_unwind_error_catchall();
-      return 1;
+      return UNWIND_FRAME_STOP;
     }
+  }
 
-    // Set rbp register.
-    u64 previous_rbp = 0;
-    if (found_rbp_type == RBP_TYPE_UNCHANGED) {
-      previous_rbp = unwind_state->bp;
-    } else {
-      u64 previous_rbp_addr = previous_rsp + found_rbp_offset;
-      LOG("\t(bp_offset: %d, bp value stored at %llx)", found_rbp_offset, previous_rbp_addr);
-      int ret = bpf_probe_read_user(&previous_rbp, 8, (void *)(previous_rbp_addr));
-      if (ret != 0) {
-        LOG("[error] previous_rbp should not be zero. This can mean "
-            "that the read has failed %d.",
-            ret);
-        bump_unwind_error_catchall();
-        return 1;
-      }
+  LOG("\tprevious ip: %llx (@ %llx)", previous_rip, previous_rip_addr);
+  LOG("\tprevious sp: %llx", previous_rsp);
+  // Set rsp and rip registers
+  unwind_state->ip = previous_rip;
+  unwind_state->sp = previous_rsp;
+  // Set rbp
+  LOG("\tprevious bp: %llx", previous_rbp);
+  unwind_state->bp = previous_rbp;
+
+  // Frame finished! :)
+  return UNWIND_FRAME_CONTINUE;
+}
+
+// Add the stack once its bottom frame has been reached.
+static __always_inline void finish_stack(struct bpf_perf_event_data *ctx, unwind_state_t *unwind_state) {
+  u64 pid_tgid = bpf_get_current_pid_tgid();
+
+  // We've reached the bottom of the stack once we don't find an unwind
+  // entry for the given program counter and the current frame pointer
+  // is 0. As per the x86_64 ABI:
+  //
+  // From 3.4.1 Initial Stack and Register State
+  // > %rbp The content of this register is unspecified at process
+  // > initialization time, > but the user code should mark the deepest
+  // > stack frame by setting the frame > pointer to zero.
+  //
+  // https://refspecs.linuxbase.org/elf/x86_64-abi-0.99.pdf
+
+  if (unwind_state->bp == 0) {
+    LOG("======= reached main! =======");
+    add_stack(ctx, pid_tgid, STACK_WALKING_METHOD_DWARF, unwind_state);
+    bump_unwind_success_dwarf();
+    // success_dwarf_to_jit keeps track of transition from DWARF unwinding to JIT unwinding
+    unwind_state->dwarf_to_jit = true;
+  } else {
+    int user_pid = pid_tgid;
+    process_info_t *proc_info = bpf_map_lookup_elem(&process_info, &user_pid);
+    if (proc_info == NULL) {
+      LOG("[error] should never happen");
+      return;
     }
 
-    LOG("\tprevious ip: %llx (@ %llx)", previous_rip, previous_rip_addr);
-    LOG("\tprevious sp: %llx", previous_rsp);
-    // Set rsp and rip registers
-    unwind_state->ip = previous_rip;
-    unwind_state->sp = previous_rsp;
-    // Set rbp
-    LOG("\tprevious bp: %llx", previous_rbp);
-    unwind_state->bp = previous_rbp;
+    if (proc_info->is_jit_compiler) {
+      LOG("[warn] mapping not added yet to BPF maps, rbp %llx", unwind_state->bp);
+      request_refresh_process_info(ctx, user_pid);
+      bump_unwind_error_jit_unupdated_mapping(); // rbp != 0 and we are expecting unwind info which is absent and not expecting JITed stacks and therefore are
+                                                 // not symbolising JITed stacks here but maybe it's a JIT stack
+      return;
+    }
 
-    // Frame finished! :)
-  }
-
-  if (reached_bottom_of_stack) {
-    // We've reached the bottom of the stack once we don't find an unwind
-    // entry for the given program counter and the current frame pointer
-    // is 0. As per the x86_64 ABI:
-    //
-    // From 3.4.1 Initial Stack and Register State
-    // > %rbp The content of this register is unspecified at process
-    // > initialization time, > but the user code should mark the deepest
-    // > stack frame by setting the frame > pointer to zero.
-    //
-    // https://refspecs.linuxbase.org/elf/x86_64-abi-0.99.pdf
-
-    if (unwind_state->bp == 0) {
-      LOG("======= reached main! =======");
-      add_stack(ctx, pid_tgid, STACK_WALKING_METHOD_DWARF, unwind_state);
-      bump_unwind_success_dwarf();
-      // success_dwarf_to_jit keeps track of transition from DWARF unwinding to JIT unwinding
-      dwarf_to_jit = true;
-    } else {
-      int user_pid = pid_tgid;
-      process_info_t *proc_info = bpf_map_lookup_elem(&process_info, &user_pid);
-      if (proc_info == NULL) {
-        LOG("[error] should never happen");
-        return 1;
-      }
+    LOG("[error] Could not find unwind table and rbp != 0 (%llx). New mapping?", unwind_state->bp);
+    request_refresh_process_info(ctx, user_pid);
+    bump_unwind_error_pc_not_covered();
+  }
+}
 
-      if (proc_info->is_jit_compiler) {
-        LOG("[warn] mapping not added yet to BPF maps, rbp %llx", unwind_state->bp);
-        request_refresh_process_info(ctx, user_pid);
-        bump_unwind_error_jit_unupdated_mapping(); // rbp != 0 and we are expecting unwind info which is absent and not expecting JITed stacks and therefore are
-                                                   // not symbolising JITed stacks here but maybe it's a JIT stack
-        return 1;
-      }
+// Add the frames walked so far of a stack that's deeper than `max_stack_depth`
+// or than the unwinder can walk.
+static __always_inline void add_truncated_stack(struct bpf_perf_event_data *ctx, unwind_state_t *unwind_state) {
+  LOG("[warn] stack truncated after %d frames", unwind_state->stack.len);
+  unwind_state->stack.truncated = 1;
+  add_stack(ctx, bpf_get_current_pid_tgid(), STACK_WALKING_METHOD_DWARF, unwind_state);
+  bump_unwind_error_truncated();
+}
 
-      LOG("[error] Could not find unwind table and rbp != 0 (%llx). New mapping?", unwind_state->bp);
-      request_refresh_process_info(ctx, user_pid);
-      bump_unwind_error_pc_not_covered();
+// Add the stack, if possible, once unwinding stopped with the given result.
+static __always_inline void stop_unwinding(struct bpf_perf_event_data *ctx, unwind_state_t *unwind_state, enum unwind_frame_result result) {
+  if (result == UNWIND_FRAME_BOTTOM_OF_STACK) {
+    finish_stack(ctx, unwind_state);
+  } else if (result == UNWIND_FRAME_TRUNCATED) {
+    add_truncated_stack(ctx, unwind_state);
+  }
+}
+
+// The unwinding machinery lives here, for kernels without `bpf_loop`. Up to
+// MAX_STACK_DEPTH_PER_PROGRAM frames are walked per program, which tail calls
+// itself to keep walking the stack.
+SEC("perf_event")
+int walk_user_stacktrace_impl(struct bpf_perf_event_data *ctx) {
+  u32 zero = 0;
+  unwind_state_t *unwind_state = bpf_map_lookup_elem(&heap, &zero);
+  if (unwind_state == NULL) {
+    LOG("unwind_state is NULL, should not happen");
+    return 1;
+  }
+
+  for (int i = 0; i < MAX_STACK_DEPTH_PER_PROGRAM; i++) {
+    enum unwind_frame_result result = unwind_frame(ctx, unwind_state);
+    if (result != UNWIND_FRAME_CONTINUE) {
+      stop_unwinding(ctx, unwind_state, result);
+      return 0;
     }
-    return 0;
-  } else if (unwind_state->stack.len < MAX_STACK_DEPTH && unwind_state->tail_calls < MAX_TAIL_CALLS) {
+  }
+
+  if (unwind_state->tail_calls < MAX_TAIL_CALLS) {
     LOG("Continuing walking the stack in a tail call, current tail %d", unwind_state->tail_calls);
     unwind_state->tail_calls++;
     bpf_tail_call(ctx, &programs, 0);
   }
 
   // We couldn't get the whole stacktrace.
-  bump_unwind_error_truncated();
+  add_truncated_stack(ctx, unwind_state);
+  return 0;
+}
+
+struct unwind_loop_ctx {
+  struct bpf_perf_event_data *ctx;
+  unwind_state_t *unwind_state;
+  enum unwind_frame_result result;
+};
+
+static long unwind_frame_callback(u32 index, void *data) {
+  struct unwind_loop_ctx *loop_ctx = data;
+  loop_ctx->result = unwind_frame(loop_ctx->ctx, loop_ctx->unwind_state);
+  // Any non-zero value stops the loop.
+  return loop_ctx->result != UNWIND_FRAME_CONTINUE;
+}
+
+// The unwinding machinery lives here, for kernels with `bpf_loop` (5.17+),
+// where the whole stack is walked in a single program.
+SEC("perf_event")
+int walk_user_stacktrace_loop(struct bpf_perf_event_data *ctx) {
+  u32 zero = 0;
+  unwind_state_t *unwind_state = bpf_map_lookup_elem(&heap, &zero);
+  if (unwind_state == NULL) {
+    LOG("unwind_state is NULL, should not happen");
+    return 1;
+  }
+
+  struct unwind_loop_ctx loop_ctx = {
+      .ctx = ctx,
+      .unwind_state = unwind_state,
+      .result = UNWIND_FRAME_CONTINUE,
+  };
+  // Some frames take more than one iteration, such as the first native
+  // frame after JIT code.
+  bpf_loop(2 * unwinder_config.max_stack_depth, unwind_frame_callback, &loop_ctx, 0);
+
+  if (loop_ctx.result == UNWIND_FRAME_CONTINUE) {
+    // We couldn't get the whole stacktrace.
+    add_truncated_stack(ctx, unwind_state);
+    return 0;
+  }
+  stop_unwinding(ctx, unwind_state, loop_ctx.result);
   return 0;
 }
 
@@ -1047,8 +1422,10 @@ static __always_inline bool set_initial_state(bpf_user_pt_regs_t *regs) {
   // Just reset the stack size. This must be checked in userspace to ensure
   // we aren't reading garbage data.
   unwind_state->stack.len = 0;
+  unwind_state->stack.truncated = 0;
   unwind_state->tail_calls = 0;
   unwind_state->unwinding_jit = false;
+  unwind_state->dwarf_to_jit = false;
 
   u64 ip = 0;
   u64 sp = 0;
@@ -1098,6 +1475,10 @@ int profile_cpu(struct bpf_perf_event_data *ctx) {
     return 0;
   }
 
+  if (!is_cgroup_allowed()) {
+    return 0;
+  }
+
   if (unwinder_config.filter_processes) {
     // This can be very noisy
     // LOG("debug mode enabled, make sure you specified process name");
@@ -1106,6 +1487,10 @@ int profile_cpu(struct bpf_perf_event_data *ctx) {
     }
   }
 
+  if (!should_sample_pid(user_tgid)) {
+    return 0;
+  }
+
   set_initial_state(&ctx->regs);
   u32 zero = 0;
   unwind_state_t *unwind_state = bpf_map_lookup_elem(&heap, &zero);
@@ -15,47 +15,200 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 
 	"github.com/alecthomas/kong"
+	"github.com/go-kit/log"
 
 	"github.com/parca-dev/parca-agent/pkg/logger"
 	"github.com/parca-dev/parca-agent/pkg/stack/unwind"
 )
 
+var errUnwindTableTooLarge = errors.New("unwind table does not fit in the unwind table chunks")
+
 type flags struct {
+	Print    printCmd    `kong:"cmd,default='withargs',help='Print the unwind table of an executable.'"`
+	Validate validateCmd `kong:"cmd,help='Check how well the unwind table of an executable covers its code.'"`
+	Diff     diffCmd     `kong:"cmd,help='Compare the compact unwind tables of two builds of an executable.'"`
+	Dump     dumpCmd     `kong:"cmd,help='Dump the rows of the unwind table of an executable as loaded in the unwind_tables BPF map.'"`
+}
+
+type printCmd struct {
 	Executable string `kong:"help='The executable to print the .eh_unwind tables for.'"`
 	Compact    bool   `kong:"help='Whether to use the compact format.'"`
 	RelativePC uint64 `kong:"help='Filter FDEs that contain this PC'"`
 }
 
+type validateCmd struct {
+	Executable       string  `kong:"arg,help='The executable to validate.'"`
+	DebugFile        string  `kong:"help='Separate debug file of the executable, for its .debug_frame section.'"`
+	MinCoverage      float64 `kong:"help='Fail if less than this percentage of .text is covered.',default='0'"`
+	AllowUnsupported bool    `kong:"help='Do not fail if there are rows the unwinder does not support.'"`
+}
+
+type diffCmd struct {
+	Old string `kong:"arg,help='The executable of the old build.'"`
+	New string `kong:"arg,help='The executable of the new build.'"`
+}
+
+type dumpCmd struct {
+	Executable string `kong:"arg,help='The executable to dump the unwind table of.'"`
+	DebugFile  string `kong:"help='Separate debug file of the executable, for its .debug_frame section.'"`
+	Raw        bool   `kong:"help='Write the values of the unwind_tables shards, back to back, instead of describing them.'"`
+}
+
 // This tool exists for debugging .eh_frame unwinding and its intended for Parca Agent's
-// developers.
+// developers. The validate and diff commands exit with status 1 if the unwind table
+// is not good enough, or if the tables differ, so they can be used in CI.
 func main() {
 	logger := logger.NewLogger("debug", logger.LogFormatLogfmt, "eh-frame")
 
 	flags := flags{}
-	kong.Parse(&flags)
-
-	executablePath := flags.Executable
-
-	if executablePath == "" {
+	ctx := kong.Parse(&flags)
+	ctx.BindTo(logger, (*log.Logger)(nil))
+	ctx.BindTo(os.Stdout, (*io.Writer)(nil))
+	if err := ctx.Run(); err != nil {
 		// nolint
-		fmt.Fprintln(os.Stderr, "The executable argument is required")
+		fmt.Fprintln(os.Stderr, "failed with:", err)
 		os.Exit(1)
 	}
+}
+
+func (c *printCmd) Run(logger log.Logger, w io.Writer) error {
+	if c.Executable == "" {
+		return errors.New("the executable argument is required")
+	}
 
 	var pc *uint64
-
-	if flags.RelativePC != 0 {
-		pc = &flags.RelativePC
+	if c.RelativePC != 0 {
+		pc = &c.RelativePC
 	}
 
 	ptb := unwind.NewUnwindTableBuilder(logger)
-	err := ptb.PrintTable(os.Stdout, executablePath, flags.Compact, pc)
+	return ptb.PrintTable(w, c.Executable, c.Compact, pc)
+}
+
+func (c *validateCmd) Run(w io.Writer) error {
+	report, err := unwind.Validate(c.Executable, c.DebugFile)
 	if err != nil {
-		// nolint
-		fmt.Println("failed with:", err)
+		return err
+	}
+
+	fmt.Fprintf(w, ".text: %x-%x (%d bytes)\n", report.TextStart, report.TextEnd, report.TextEnd-report.TextStart)
+	fmt.Fprintf(w, "Rows: %d\n", report.Rows)
+	fmt.Fprintf(w, "Coverage: %.2f%% (%d bytes)\n", report.Coverage(), report.CoveredBytes)
+
+	if len(report.Gaps) > 0 {
+		fmt.Fprintf(w, "\nGaps (%d):\n", len(report.Gaps))
+		for _, gap := range report.Gaps {
+			fmt.Fprintf(w, "\t%x-%x (%d bytes)", gap.Start, gap.End, gap.End-gap.Start)
+			if len(gap.Functions) > 0 {
+				fmt.Fprintf(w, " %s", strings.Join(gap.Functions, ", "))
+			}
+			fmt.Fprintln(w)
+		}
+	}
+
+	if len(report.Unsupported) > 0 {
+		fmt.Fprintf(w, "\nUnsupported rows (%d):\n", len(report.Unsupported))
+		for _, row := range report.Unsupported {
+			fmt.Fprintf(w, "\t%x", row.PC)
+			if row.Function != "" {
+				fmt.Fprintf(w, " (%s)", row.Function)
+			}
+			fmt.Fprintf(w, ": %s\n", row.Reason)
+		}
+	}
+
+	var errs []error
+	if report.Coverage() < c.MinCoverage {
+		errs = append(errs, fmt.Errorf("coverage %.2f%% is below %.2f%%", report.Coverage(), c.MinCoverage))
+	}
+	if len(report.Unsupported) > 0 && !c.AllowUnsupported {
+		errs = append(errs, fmt.Errorf("%d rows are not supported", len(report.Unsupported)))
+	}
+	return errors.Join(errs...)
+}
+
+func (c *diffCmd) Run(w io.Writer) error {
+	diff, err := unwind.DiffCompactUnwindTables(c.Old, c.New)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range diff.Removed {
+		fmt.Fprintf(w, "- %s\n", name)
+	}
+	for _, name := range diff.Added {
+		fmt.Fprintf(w, "+ %s\n", name)
+	}
+	for _, f := range diff.Changed {
+		fmt.Fprintf(w, "~ %s\n", f.Name)
+		for _, row := range f.Old {
+			fmt.Fprintf(w, "\t- %s\n", row)
+		}
+		for _, row := range f.New {
+			fmt.Fprintf(w, "\t+ %s\n", row)
+		}
+	}
+	fmt.Fprintf(w, "%d functions unchanged, %d changed, %d added, %d removed\n", diff.Unchanged, len(diff.Changed), len(diff.Added), len(diff.Removed))
+
+	if !diff.Empty() {
+		return errors.New("the unwind tables differ")
+	}
+	return nil
+}
+
+func (c *dumpCmd) Run(w io.Writer) error {
+	expressions := unwind.NewExpressionTable(unwind.MaxDwarfExpressions)
+	table, err := unwind.GenerateCompactUnwindTable(c.Executable, c.DebugFile, expressions)
+	if err != nil {
+		return err
+	}
+
+	// As loaded in empty shards, the chunks of tables loaded before other
+	// tables start at other rows.
+	chunks, ok := unwind.NewShardAllocator(unwind.MaxUnwindTableChunks, unwind.MaxUnwindTableSize).Allocate(table)
+	if !ok {
+		return errUnwindTableTooLarge
+	}
+
+	buf := make([]byte, unwind.MaxUnwindTableSize*unwind.CompactUnwindRowSizeBytes)
+	if c.Raw {
+		rest := table
+		for _, chunk := range chunks {
+			rows := rest[:chunk.Rows()]
+			rest = rest[len(rows):]
+			for i := range buf {
+				buf[i] = 0
+			}
+			for i, row := range rows {
+				row.PutBinary(buf[(chunk.LowIndex+uint64(i))*unwind.CompactUnwindRowSizeBytes:])
+			}
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	rest := table
+	for _, chunk := range chunks {
+		rows := rest[:chunk.Rows()]
+		rest = rest[len(rows):]
+		fmt.Fprintf(w, "=> Shard: %d, rows: %d-%d, pcs: %x-%x\n", chunk.ShardIndex, chunk.LowIndex, chunk.HighIndex, chunk.LowPC, chunk.HighPC)
+		for i, row := range rows {
+			rowBuf := buf[:unwind.CompactUnwindRowSizeBytes]
+			row.PutBinary(rowBuf)
+			fmt.Fprintf(w, "\t%08x: % x  %s\n", (chunk.LowIndex+uint64(i))*unwind.CompactUnwindRowSizeBytes, rowBuf, unwind.FormatCompactUnwindTableRow(row, expressions.Expressions()))
+		}
+	}
+	for i, expression := range expressions.Expressions() {
+		fmt.Fprintf(w, "=> Expression %d: %v\n", int(unwind.ExpressionCompiled)+i, expression)
 	}
+	return nil
 }
@@ -43,6 +43,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	promconfig "github.com/prometheus/common/config"
 	"github.com/prometheus/procfs"
+	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/zcalusic/sysinfo"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
@@ -76,6 +77,7 @@ import (
 	"github.com/parca-dev/parca-agent/pkg/profiler"
 	"github.com/parca-dev/parca-agent/pkg/profiler/cpu"
 	"github.com/parca-dev/parca-agent/pkg/rlimit"
+	"github.com/parca-dev/parca-agent/pkg/stack/unwind"
 	"github.com/parca-dev/parca-agent/pkg/template"
 	"github.com/parca-dev/parca-agent/pkg/tracer"
 	"github.com/parca-dev/parca-agent/pkg/vdso"
@@ -104,6 +106,10 @@ const (
 	// Setting the CPU sampling frequency too high can impact overall machine performance.
 	maxAdvicedCPUSamplingFrequency = 150
 
+	// Names of the profile stores configured by flags.
+	localStoreName         = "local"
+	defaultRemoteStoreName = "default"
+
 	profilerStatusError    = "error"
 	profilerStatusActive   = "active"
 	profilerStatusInactive = "inactive"
@@ -166,6 +172,11 @@ type FlagsProfiling struct {
 type FlagsMetadata struct {
 	ExternalLabels             map[string]string `help:"Label(s) to attach to all profiles."`
 	ContainerRuntimeSocketPath string            `help:"The filesystem path to the container runtimes socket. Leave this empty to use the defaults."`
+	DockerSocketPath           string            `default:"/var/run/docker.sock"    help:"The filesystem path to the Docker Engine API socket used to discover containers. Leave this empty to disable Docker discovery."`
+	PodmanSocketPath           string            `default:"/run/podman/podman.sock" help:"The filesystem path to the Podman API socket used to discover containers. Leave this empty to disable Podman discovery."`
+	ContainerLabels            []string          `help:"Docker and Podman container labels to attach to the profiles of the containers."`
+	CloudDisable               bool              `default:"false"                   help:"Disable the detection of the cloud instance the agent runs on."`
+	CloudMetadataURL           string            `help:"The base URL of the cloud instance metadata endpoint. Leave this empty to use the endpoint of the detected cloud."`
 
 	DisableCaching bool `default:"false" help:"Disable caching of metadata."`
 }
@@ -209,6 +220,11 @@ type FlagsSymbolizer struct {
 type FlagsDWARFUnwinding struct {
 	Disable bool `help:"Do not unwind using .eh_frame information."`
 	Mixed   bool `default:"true"                                    help:"Unwind using .eh_frame information and frame pointers"`
+
+	CacheDir          string `help:"The local directory to cache the generated unwind tables in across restarts. Leave this empty to disable the cache."`
+	CacheMaxSizeBytes int64  `default:"536870912" help:"The maximum size in bytes of the unwind table cache, the least recently used tables are evicted."`
+
+	MaxStackDepth uint32 `default:"127" help:"The maximum number of frames to walk, up to 512. Deeper stacks are labeled with stack_truncated. Kernels older than 5.17 walk up to 480 frames."`
 }
 
 // FlagsHidden contains hidden flags. Hidden debug flags (only for debugging).
@@ -217,6 +233,106 @@ type FlagsHidden struct {
 	DebugNormalizeAddresses bool     `default:"true"                                                                                                                                                       help:"Normalize sampled addresses." hidden:""`
 }
 
+// applyConfig overrides the flags with the settings of the config file.
+// Flags that are explicitly set, on the command line or through their
+// environment variables, take precedence.
+func (f *flags) applyConfig(cfg *config.Config, setFlags map[string]struct{}) {
+	if p := cfg.Profiling; p != nil {
+		override(setFlags, "profiling-duration", &f.Profiling.Duration, p.Duration)
+		override(setFlags, "profiling-cpu-sampling-frequency", &f.Profiling.CPUSamplingFrequency, p.CPUSamplingFrequency)
+		override(setFlags, "profiling-perf-event-buffer-poll-interval", &f.Profiling.PerfEventBufferPollInterval, p.PerfEventBufferPollInterval)
+		override(setFlags, "profiling-perf-event-buffer-processing-interval", &f.Profiling.PerfEventBufferProcessingInterval, p.PerfEventBufferProcessingInterval)
+		override(setFlags, "profiling-perf-event-buffer-worker-count", &f.Profiling.PerfEventBufferWorkerCount, p.PerfEventBufferWorkerCount)
+		if p.ProcessNames != nil {
+			override(setFlags, "debug-process-names", &f.Hidden.DebugProcessNames, &p.ProcessNames)
+		}
+	}
+	if rs := cfg.RemoteStore; rs != nil {
+		override(setFlags, "remote-store-address", &f.RemoteStore.Address, rs.Address)
+		if rs.BearerToken != nil {
+			token := string(*rs.BearerToken)
+			override(setFlags, "remote-store-bearer-token", &f.RemoteStore.BearerToken, &token)
+		}
+		override(setFlags, "remote-store-bearer-token-file", &f.RemoteStore.BearerTokenFile, rs.BearerTokenFile)
+		override(setFlags, "remote-store-insecure", &f.RemoteStore.Insecure, rs.Insecure)
+		override(setFlags, "remote-store-insecure-skip-verify", &f.RemoteStore.InsecureSkipVerify, rs.InsecureSkipVerify)
+		override(setFlags, "remote-store-batch-write-interval", &f.RemoteStore.BatchWriteInterval, rs.BatchWriteInterval)
+		override(setFlags, "remote-store-rpc-logging-enable", &f.RemoteStore.RPCLoggingEnable, rs.RPCLoggingEnable)
+		override(setFlags, "remote-store-rpc-unary-timeout", &f.RemoteStore.RPCUnaryTimeout, rs.RPCUnaryTimeout)
+	}
+	if d := cfg.Debuginfo; d != nil {
+		if d.Directories != nil {
+			override(setFlags, "debuginfo-directories", &f.Debuginfo.Directories, &d.Directories)
+		}
+		override(setFlags, "debuginfo-temp-dir", &f.Debuginfo.TempDir, d.TempDir)
+		override(setFlags, "debuginfo-strip", &f.Debuginfo.Strip, d.Strip)
+		override(setFlags, "debuginfo-upload-disable", &f.Debuginfo.UploadDisable, d.UploadDisable)
+		override(setFlags, "debuginfo-upload-max-parallel", &f.Debuginfo.UploadMaxParallel, d.UploadMaxParallel)
+		override(setFlags, "debuginfo-upload-timeout-duration", &f.Debuginfo.UploadTimeoutDuration, d.UploadTimeoutDuration)
+		override(setFlags, "debuginfo-upload-cache-duration", &f.Debuginfo.UploadCacheDuration, d.UploadCacheDuration)
+		override(setFlags, "debuginfo-disable-caching", &f.Debuginfo.DisableCaching, d.DisableCaching)
+	}
+	if s := cfg.Symbolizer; s != nil {
+		override(setFlags, "symbolizer-jit-disable", &f.Symbolizer.JITDisable, s.JITDisable)
+	}
+	if m := cfg.Metadata; m != nil {
+		if m.ExternalLabels != nil {
+			override(setFlags, "metadata-external-labels", &f.Metadata.ExternalLabels, &m.ExternalLabels)
+		}
+		override(setFlags, "metadata-container-runtime-socket-path", &f.Metadata.ContainerRuntimeSocketPath, m.ContainerRuntimeSocketPath)
+		override(setFlags, "metadata-docker-socket-path", &f.Metadata.DockerSocketPath, m.DockerSocketPath)
+		override(setFlags, "metadata-podman-socket-path", &f.Metadata.PodmanSocketPath, m.PodmanSocketPath)
+		if m.ContainerLabels != nil {
+			override(setFlags, "metadata-container-labels", &f.Metadata.ContainerLabels, &m.ContainerLabels)
+		}
+		override(setFlags, "metadata-cloud-disable", &f.Metadata.CloudDisable, m.CloudDisable)
+		override(setFlags, "metadata-cloud-metadata-url", &f.Metadata.CloudMetadataURL, m.CloudMetadataURL)
+		override(setFlags, "metadata-disable-caching", &f.Metadata.DisableCaching, m.DisableCaching)
+	}
+}
+
+// override sets dst to the value of src, unless src is not set or
+// the flag with the given name was explicitly set.
+func override[T any](setFlags map[string]struct{}, name string, dst, src *T) {
+	if src == nil {
+		return
+	}
+	if _, ok := setFlags[name]; ok {
+		return
+	}
+	*dst = *src
+}
+
+// withConfig returns a function that combines the parsed flags with the settings of a config file.
+func withConfig(parsed flags, setFlags map[string]struct{}) func(*config.Config) flags {
+	return func(cfg *config.Config) flags {
+		f := parsed
+		f.applyConfig(cfg, setFlags)
+		return f
+	}
+}
+
+// explicitFlags returns the names of the flags that were passed on the command
+// line or set through their environment variables, as kong resolved them.
+func explicitFlags(ctx *kong.Context) map[string]struct{} {
+	names := map[string]struct{}{}
+	for _, p := range ctx.Path {
+		if p.Flag != nil {
+			names[p.Flag.Name] = struct{}{}
+		}
+	}
+	for _, f := range ctx.Flags() {
+		for _, env := range f.Envs {
+			// kong uses the first environment variable that is not empty.
+			if os.Getenv(env) != "" {
+				names[f.Name] = struct{}{}
+				break
+			}
+		}
+	}
+	return names
+}
+
 var _ Profiler = (*profiler.NoopProfiler)(nil)
 
 type Profiler interface {
@@ -228,6 +344,30 @@ type Profiler interface {
 	ProcessLastErrors() map[int]error
 }
 
+// samplingFrequencyReporter is implemented by the profilers that sample processes at different frequencies.
+type samplingFrequencyReporter interface {
+	ProcessSamplingFrequency(pid int) uint64
+}
+
+// processSettings describes the effective profiling settings of a process for the status page.
+func processSettings(p Profiler, settings discovery.TargetSettings, pid int) []string {
+	var res []string
+	if r, ok := p.(samplingFrequencyReporter); ok {
+		if f := r.ProcessSamplingFrequency(pid); f > 0 {
+			res = append(res, fmt.Sprintf("sampling frequency: %dHz", f))
+		} else {
+			res = append(res, "profiling: disabled")
+		}
+	}
+	if settings.Profilers != nil {
+		res = append(res, "profilers: "+strings.Join(settings.Profilers, ","))
+	}
+	if !settings.DebuginfoUpload {
+		res = append(res, "debuginfo upload: disabled")
+	}
+	return res
+}
+
 func main() {
 	// Fetch build info such as the git revision we are based off
 	buildInfo, err := buildinfo.FetchBuildInfo()
@@ -249,7 +389,7 @@ func main() {
 	hostname, hostnameErr := os.Hostname() // hotnameErr handled below.
 
 	flags := flags{}
-	kong.Parse(&flags, kong.Vars{
+	kongCtx := kong.Parse(&flags, kong.Vars{
 		"hostname":                       hostname,
 		"default_memlock_rlimit":         "0", // No limit by default.
 		"default_cpu_sampling_frequency": strconv.Itoa(defaultCPUSamplingFrequency),
@@ -261,6 +401,20 @@ func main() {
 	}
 
 	logger := logger.NewLogger(flags.Log.Level, flags.Log.Format, "parca-agent")
+
+	// Used at startup and whenever the config file is reloaded.
+	flagsWithConfig := withConfig(flags, explicitFlags(kongCtx))
+
+	cfg := &config.Config{}
+	if flags.ConfigPath != "" {
+		cfg, err = config.LoadFile(flags.ConfigPath)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to read config", "err", err)
+			os.Exit(1)
+		}
+		flags = flagsWithConfig(cfg)
+	}
+
 	level.Debug(logger).Log("msg", "parca-agent initialized",
 		"version", version,
 		"commit", commit,
@@ -315,6 +469,14 @@ func main() {
 	} else if flags.Profiling.CPUSamplingFrequency > maxAdvicedCPUSamplingFrequency {
 		level.Warn(logger).Log("msg", "cpu sampling frequency is too high, it can impact overall machine performance", "max", maxAdvicedCPUSamplingFrequency)
 	}
+	if flags.DWARFUnwinding.MaxStackDepth == 0 {
+		level.Error(logger).Log("msg", "max stack depth must be greater than 0")
+		os.Exit(1)
+	}
+	if flags.DWARFUnwinding.MaxStackDepth > cpu.MaxStackDepth {
+		level.Warn(logger).Log("msg", "max stack depth is too high. Setting it to the maximum value", "max", cpu.MaxStackDepth)
+		flags.DWARFUnwinding.MaxStackDepth = cpu.MaxStackDepth
+	}
 	if flags.Profiling.CPUSamplingFrequency != defaultCPUSamplingFrequency {
 		level.Warn(logger).Log("msg", "non default cpu sampling frequency is used, please consult https://github.com/parca-dev/parca-agent/blob/main/docs/design.md#cpu-sampling-frequency")
 	}
@@ -336,29 +498,18 @@ func main() {
 	runtime.SetBlockProfileRate(flags.BlockProfileRate)
 	runtime.SetMutexProfileFraction(flags.MutexProfileFraction)
 
-	if err := run(logger, reg, flags); err != nil {
+	if err := run(logger, reg, flags, cfg, flagsWithConfig); err != nil {
 		level.Error(logger).Log("err", err)
 	}
 }
 
-func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
+func run(logger log.Logger, reg *prometheus.Registry, flags flags, cfg *config.Config, flagsWithConfig func(*config.Config) flags) error {
 	var (
 		ctx = context.Background()
 
-		cfg              = &config.Config{}
-		configFileExists bool
+		configFileExists = flags.ConfigPath != ""
 	)
 
-	if flags.ConfigPath != "" {
-		configFileExists = true
-
-		cfgFile, err := config.LoadFile(flags.ConfigPath)
-		if err != nil {
-			return fmt.Errorf("failed to read config: %w", err)
-		}
-		cfg = cfgFile
-	}
-
 	// Initialize tracing.
 	var (
 		exporter tracer.Exporter
@@ -397,66 +548,116 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 		level.Info(logger).Log("msg", "eBPF is supported and enabled by the host kernel")
 	}
 
-	profileStoreClient := agent.NewNoopProfileStoreClient()
-	var debuginfoClient debuginfopb.DebuginfoServiceClient = debuginfo.NewNoopClient()
+	var (
+		g                    okrun.Group
+		localStorageEnabled  = flags.LocalStore.Directory != ""
+		remoteStorageEnabled = flags.RemoteStore.Address != "" || len(cfg.RemoteStores) > 0 || !localStorageEnabled
 
-	if len(flags.RemoteStore.Address) > 0 {
-		encoding.RegisterCodec(vtproto.Codec{})
+		debuginfoClient debuginfopb.DebuginfoServiceClient = debuginfo.NewNoopClient()
+		destinations    []*profiler.Destination
+		profileListener = agent.NewMatchingProfileListener(logger, agent.NewNoopProfileStoreClient())
+	)
 
-		var opts []grpc.DialOption
-		if flags.RemoteStore.Insecure {
-			opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
-		} else {
-			config := &tls.Config{
-				//nolint:gosec
+	if localStorageEnabled {
+		destinations = append(destinations, &profiler.Destination{
+			Name:  localStoreName,
+			Store: profiler.NewFileStore(flags.LocalStore.Directory),
+		})
+		level.Info(logger).Log("msg", "local profile storage is enabled", "dir", flags.LocalStore.Directory)
+	}
+
+	if remoteStorageEnabled {
+		remoteStores := []*config.RemoteStoreConfig{}
+		// Even without an address, the default remote store is kept when nothing else is configured,
+		// profiles are discarded but they can still be queried through the UI.
+		if flags.RemoteStore.Address != "" || (!localStorageEnabled && len(cfg.RemoteStores) == 0) {
+			remoteStores = append(remoteStores, &config.RemoteStoreConfig{
+				Name:               defaultRemoteStoreName,
+				Address:            flags.RemoteStore.Address,
+				BearerToken:        promconfig.Secret(flags.RemoteStore.BearerToken),
+				BearerTokenFile:    flags.RemoteStore.BearerTokenFile,
+				Insecure:           flags.RemoteStore.Insecure,
 				InsecureSkipVerify: flags.RemoteStore.InsecureSkipVerify,
+				BatchWriteInterval: flags.RemoteStore.BatchWriteInterval,
+			})
+		}
+		for _, rs := range cfg.RemoteStores {
+			if rs.Name == defaultRemoteStoreName || rs.Name == localStoreName {
+				return fmt.Errorf("remote store name %q is reserved", rs.Name)
 			}
-			opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+			remoteStores = append(remoteStores, rs)
 		}
 
-		if flags.RemoteStore.BearerToken != "" {
-			opts = append(opts, grpc.WithPerRPCCredentials(
-				parcagrpc.NewPerRequestBearerToken(flags.RemoteStore.BearerToken, flags.RemoteStore.Insecure)),
-			)
-		}
+		debuginfoUploadConfigured := false
+		for i, rs := range remoteStores {
+			logger := log.With(logger, "store", rs.Name)
+			reg := prometheus.WrapRegistererWith(prometheus.Labels{"store": rs.Name}, reg)
 
-		if flags.RemoteStore.BearerTokenFile != "" {
-			b, err := os.ReadFile(flags.RemoteStore.BearerTokenFile)
-			if err != nil {
-				return fmt.Errorf("failed to read bearer token from file: %w", err)
+			var profileStoreClient profilestorepb.ProfileStoreServiceClient = agent.NewNoopProfileStoreClient()
+			if rs.Address != "" {
+				conn, err := remoteStoreConn(logger, reg, tp, rs, flags.RemoteStore.RPCLoggingEnable, flags.RemoteStore.RPCUnaryTimeout)
+				if err != nil {
+					return err
+				}
+				defer conn.Close()
+
+				profileStoreClient = profilestorepb.NewProfileStoreServiceClient(conn)
+				// Debug information is uploaded to the first remote store with an address,
+				// the one configured by flags if any.
+				if !debuginfoUploadConfigured {
+					debuginfoUploadConfigured = true
+					if !flags.Debuginfo.UploadDisable {
+						level.Info(logger).Log("msg", "uploading debug information to remote store")
+						debuginfoClient = debuginfopb.NewDebuginfoServiceClient(conn)
+					} else {
+						level.Info(logger).Log("msg", "debug information collection is disabled")
+					}
+				}
 			}
-			opts = append(opts, grpc.WithPerRPCCredentials(
-				parcagrpc.NewPerRequestBearerToken(strings.TrimSpace(string(b)), flags.RemoteStore.Insecure)),
-			)
-		}
 
-		var grpcLogger log.Logger
-		if !flags.RemoteStore.RPCLoggingEnable {
-			grpcLogger = log.NewNopLogger()
-		} else {
-			grpcLogger = log.With(logger, "service", "gRPC/client")
-		}
-		conn, err := parcagrpc.Conn(grpcLogger, reg, tp, flags.RemoteStore.Address, flags.RemoteStore.RPCUnaryTimeout, opts...)
-		if err != nil {
-			return err
-		}
-		defer conn.Close()
+			batchWriteClient := agent.NewBatchWriteClient(logger, reg, profileStoreClient, rs.BatchWriteInterval, flags.Hidden.DebugNormalizeAddresses)
 
-		profileStoreClient = profilestorepb.NewProfileStoreServiceClient(conn)
-		if !flags.Debuginfo.UploadDisable {
-			debuginfoClient = debuginfopb.NewDebuginfoServiceClient(conn)
-		} else {
-			level.Info(logger).Log("msg", "debug information collection is disabled")
+			var next profilestorepb.ProfileStoreServiceClient = batchWriteClient
+			if i == 0 {
+				// Profiles shown in the UI are the ones sent to the first remote store.
+				profileListener = agent.NewMatchingProfileListener(logger, batchWriteClient)
+				next = profileListener
+			}
+
+			destinations = append(destinations, &profiler.Destination{
+				Name:           rs.Name,
+				Store:          profiler.NewRemoteStore(logger, next, flags.Hidden.DebugNormalizeAddresses),
+				RelabelConfigs: rs.RelabelConfigs,
+			})
+
+			// Run group of profile writer.
+			{
+				logger := log.With(logger, "group", "profile_writer")
+				ctx, cancel := context.WithCancel(ctx)
+				g.Add(func() error {
+					level.Debug(logger).Log("msg", "starting")
+					defer level.Debug(logger).Log("msg", "stopped")
+
+					var err error
+					runtimepprof.Do(ctx, runtimepprof.Labels("component", "remote_profile_writer"), func(ctx context.Context) {
+						err = batchWriteClient.Run(ctx)
+					})
+
+					return err
+				}, func(error) {
+					level.Debug(logger).Log("msg", "cleaning up")
+					defer level.Debug(logger).Log("msg", "cleanup finished")
+					cancel()
+				})
+			}
 		}
 	}
 
-	var (
-		g                   okrun.Group
-		batchWriteClient    = agent.NewBatchWriteClient(logger, reg, profileStoreClient, flags.RemoteStore.BatchWriteInterval, flags.Hidden.DebugNormalizeAddresses)
-		localStorageEnabled = flags.LocalStore.Directory != ""
-		profileListener     = agent.NewMatchingProfileListener(logger, batchWriteClient)
-		profileStore        profiler.ProfileStore
-	)
+	profileStore := profiler.NewFanoutStore(log.With(logger, "component", "profile_store"), reg, destinations)
+	remoteStoreConfigs := map[string]*config.RemoteStoreConfig{}
+	for _, rs := range cfg.RemoteStores {
+		remoteStoreConfigs[rs.Name] = rs
+	}
 
 	// Run group of OTL exporter.
 	if exporter != nil {
@@ -520,34 +721,6 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 		})
 	}
 
-	if localStorageEnabled {
-		profileStore = profiler.NewFileStore(flags.LocalStore.Directory)
-		level.Info(logger).Log("msg", "local profile storage is enabled", "dir", flags.LocalStore.Directory)
-	} else {
-		profileStore = profiler.NewRemoteStore(logger, profileListener, flags.Hidden.DebugNormalizeAddresses)
-
-		// Run group of profile writer.
-		{
-			logger := log.With(logger, "group", "profile_writer")
-			ctx, cancel := context.WithCancel(ctx)
-			g.Add(func() error {
-				level.Debug(logger).Log("msg", "starting")
-				defer level.Debug(logger).Log("msg", "stopped")
-
-				var err error
-				runtimepprof.Do(ctx, runtimepprof.Labels("component", "remote_profile_writer"), func(ctx context.Context) {
-					err = batchWriteClient.Run(ctx)
-				})
-
-				return err
-			}, func(error) {
-				level.Debug(logger).Log("msg", "cleaning up")
-				defer level.Debug(logger).Log("msg", "cleanup finished")
-				cancel()
-			})
-		}
-	}
-
 	logger.Log("msg", "starting...", "node", flags.Node, "store", flags.RemoteStore.Address)
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
@@ -582,6 +755,14 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 				flags.Metadata.ContainerRuntimeSocketPath,
 			),
 			discovery.NewSystemdConfig(),
+			discovery.NewContainerEngineConfig("docker", flags.Metadata.DockerSocketPath, flags.Metadata.ContainerLabels),
+			discovery.NewContainerEngineConfig("podman", flags.Metadata.PodmanSocketPath, flags.Metadata.ContainerLabels),
+		}
+		for _, sd := range cfg.FileSDConfigs {
+			configs = append(configs, discovery.NewFileConfig(sd.Files, sd.RefreshInterval))
+		}
+		for _, sd := range cfg.HTTPSDConfigs {
+			configs = append(configs, discovery.NewHTTPConfig(sd.URL, sd.RefreshInterval))
 		}
 		discoveryManager = discovery.NewManager(logger, reg)
 		if err := discoveryManager.ApplyConfig(ctx, map[string]discovery.Configs{"all": configs}); err != nil {
@@ -651,22 +832,35 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 
 	nsCache := namespace.NewCache(logger, reg, flags.Profiling.Duration)
 
+	// All the metadata providers work best-effort.
+	metadataProviders := []metadata.Provider{
+		discoveryMetadata,
+		metadata.Target(flags.Node, flags.Metadata.ExternalLabels),
+		metadata.Compiler(logger, reg, ofp),
+		metadata.GoBuildInfo(reg, ofp),
+		metadata.Process(pfs),
+		metadata.Runtime(logger, pfs, reg, ofp, nsCache),
+		metadata.System(),
+		metadata.PodHosts(),
+	}
+	if !flags.Metadata.CloudDisable {
+		metadataProviders = append(metadataProviders, metadata.Cloud(
+			log.With(logger, "component", "cloud_metadata"),
+			metadata.DMIDir,
+			flags.Metadata.CloudMetadataURL,
+			metadata.CloudPlatforms()...,
+		))
+	}
+	if cfg.Metadata != nil && cfg.Metadata.ProcessLabels != nil {
+		metadataProviders = append(metadataProviders, metadata.ProcessLabels(reg, pfs, cfg.Metadata.ProcessLabels))
+	}
+
 	labelsManager := labels.NewManager(
 		log.With(logger, "component", "labels_manager"),
 		tp.Tracer("labels_manager"),
 		reg,
-		// All the metadata providers work best-effort.
-		[]metadata.Provider{
-			discoveryMetadata,
-			metadata.Target(flags.Node, flags.Metadata.ExternalLabels),
-			metadata.Compiler(logger, reg, ofp),
-			metadata.Process(pfs),
-			metadata.Java(logger, nsCache),
-			metadata.Ruby(pfs, reg, ofp),
-			metadata.Python(pfs, reg, ofp),
-			metadata.System(),
-			metadata.PodHosts(),
-		},
+		pfs,
+		metadataProviders,
 		cfg.RelabelConfigs,
 		flags.Metadata.DisableCaching,
 		flags.Profiling.Duration, // Cache durations are calculated from profiling duration.
@@ -679,9 +873,13 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 		level.Warn(logger).Log("msg", "failed to initialize vdso cache", "err", err)
 	}
 
-	var dbginfo process.DebuginfoManager
+	var (
+		dbginfo process.DebuginfoManager
+		// The separate debug files are also looked up for their .debug_frame section.
+		debuginfoFinder *debuginfo.Finder
+	)
 	if !flags.Debuginfo.UploadDisable {
-		dbginfo = debuginfo.New(
+		dbginfoManager := debuginfo.New(
 			log.With(logger, "component", "debuginfo"),
 			tp,
 			reg,
@@ -694,9 +892,31 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 			flags.Debuginfo.Strip,
 			flags.Debuginfo.TempDir,
 		)
-		defer dbginfo.Close()
+		defer dbginfoManager.Close()
+		dbginfo = dbginfoManager
+		debuginfoFinder = dbginfoManager.Finder
 	} else {
 		dbginfo = debuginfo.NoopDebuginfoManager{}
+		debuginfoFinder = debuginfo.NewFinder(
+			log.With(logger, "component", "debuginfo"),
+			tp.Tracer("debuginfo"),
+			reg,
+			flags.Debuginfo.Directories,
+		)
+		defer debuginfoFinder.Close()
+	}
+
+	var unwindTableCache *unwind.TableCache
+	if flags.DWARFUnwinding.CacheDir != "" {
+		unwindTableCache, err = unwind.NewTableCache(
+			log.With(logger, "component", "unwind_table_cache"),
+			reg,
+			flags.DWARFUnwinding.CacheDir,
+			flags.DWARFUnwinding.CacheMaxSizeBytes,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to initialize unwind table cache: %w", err)
+		}
 	}
 
 	processInfoManager := process.NewInfoManager(
@@ -712,6 +932,7 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 			flags.Hidden.DebugNormalizeAddresses,
 		),
 		dbginfo,
+		discoveryMetadata,
 		labelsManager,
 		flags.Profiling.Duration,
 		flags.Debuginfo.UploadCacheDuration,
@@ -730,34 +951,49 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 		})
 	}
 
-	profilers := []Profiler{
-		cpu.NewCPUProfiler(
-			log.With(logger, "component", "cpu_profiler"),
+	var cgroupFilterConfig *config.CgroupFilterConfig
+	if cfg.Profiling != nil {
+		cgroupFilterConfig = cfg.Profiling.CgroupFilter
+	}
+	cgroupFilter := cpu.NewCgroupFilter(log.With(logger, "component", "cgroup_filter"), cgroupFilterConfig, discoveryMetadata.Targets)
+
+	cpuProfiler := cpu.NewCPUProfiler(
+		log.With(logger, "component", "cpu_profiler"),
+		reg,
+		processInfoManager,
+		converter.NewManager(
+			log.With(logger, "component", "converter_manager"),
 			reg,
-			processInfoManager,
-			converter.NewManager(
-				log.With(logger, "component", "converter_manager"),
-				reg,
-				ksym.NewKsym(logger, reg, flags.Debuginfo.TempDir),
-				perf.NewPerfMapCache(logger, reg, nsCache, flags.Profiling.Duration),
-				perf.NewJitdumpCache(logger, reg, flags.Profiling.Duration),
-				vdsoResolver,
-				flags.Symbolizer.JITDisable,
-			),
-			profileStore,
-			flags.Profiling.Duration,
-			flags.Profiling.CPUSamplingFrequency,
-			flags.Profiling.PerfEventBufferPollInterval,
-			flags.Profiling.PerfEventBufferProcessingInterval,
-			flags.Profiling.PerfEventBufferWorkerCount,
-			flags.MemlockRlimit,
-			flags.Hidden.DebugProcessNames,
-			flags.DWARFUnwinding.Disable,
-			flags.DWARFUnwinding.Mixed,
-			flags.VerboseBpfLogging,
-			bpfProgramLoaded,
+			ksym.NewKsym(logger, reg, flags.Debuginfo.TempDir),
+			perf.NewPerfMapCache(logger, reg, nsCache, flags.Profiling.Duration),
+			perf.NewJitdumpCache(logger, reg, flags.Profiling.Duration),
+			vdsoResolver,
+			flags.Symbolizer.JITDisable,
 		),
+		profileStore,
+		flags.Profiling.Duration,
+		flags.Profiling.CPUSamplingFrequency,
+		flags.Profiling.PerfEventBufferPollInterval,
+		flags.Profiling.PerfEventBufferProcessingInterval,
+		flags.Profiling.PerfEventBufferWorkerCount,
+		flags.MemlockRlimit,
+		flags.Hidden.DebugProcessNames,
+		flags.DWARFUnwinding.Disable,
+		flags.DWARFUnwinding.Mixed,
+		flags.VerboseBpfLogging,
+		flags.DWARFUnwinding.MaxStackDepth,
+		cgroupFilter,
+		discoveryMetadata,
+		ofp,
+		debuginfoFinder,
+		unwindTableCache,
+		bpfProgramLoaded,
+	)
+	if cfg.Profiling != nil {
+		cpuProfiler.SetTargetRules(cfg.Profiling.TargetRules)
 	}
+	profilers := []Profiler{cpuProfiler}
+
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/healthy" || r.URL.Path == "/ready" || r.URL.Path == "/favicon.ico" {
 			return
@@ -766,7 +1002,7 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 			w.Header().Set("Content-Type", "text/html; charset=utf-8")
 			statusPage := template.StatusPage{
 				ProfilingInterval:   flags.Profiling.Duration,
-				ProfileLinksEnabled: !localStorageEnabled,
+				ProfileLinksEnabled: remoteStorageEnabled,
 				Config:              cfg.String(),
 			}
 
@@ -819,7 +1055,7 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 						profilingStatus = profilerStatusInactive
 					}
 
-					if !localStorageEnabled {
+					if remoteStorageEnabled {
 						q := url.Values{}
 						q.Add("debug", "1")
 						q.Add("query", lbls.String())
@@ -831,6 +1067,7 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 						PID:             pid,
 						Profiler:        prflr.Name(),
 						Labels:          lbls,
+						Settings:        processSettings(prflr, discoveryMetadata.TargetSettings(r.Context(), pid), pid),
 						Error:           lastError,
 						Link:            link,
 						ProfilingStatus: profilingStatus,
@@ -851,7 +1088,7 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 			return
 		}
 
-		if !localStorageEnabled && strings.HasPrefix(r.URL.Path, "/query") {
+		if remoteStorageEnabled && strings.HasPrefix(r.URL.Path, "/query") {
 			query := r.URL.Query().Get("query")
 			matchers, err := parser.ParseMetricSelector(query)
 			if err != nil {
@@ -993,9 +1230,50 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 					return labelsManager.ApplyConfig(cfg.RelabelConfigs)
 				},
 			},
+			{
+				Name: "profiling",
+				Reloader: func(newCfg *config.Config) error {
+					var (
+						targetRules        []*config.TargetRule
+						cgroupFilterConfig *config.CgroupFilterConfig
+					)
+					if newCfg.Profiling != nil {
+						targetRules = newCfg.Profiling.TargetRules
+						cgroupFilterConfig = newCfg.Profiling.CgroupFilter
+					}
+					cpuProfiler.SetTargetRules(targetRules)
+					if err := cgroupFilter.ApplyConfig(cgroupFilterConfig); err != nil {
+						return err
+					}
+
+					f := flagsWithConfig(newCfg)
+					return cpuProfiler.ApplyConfig(f.Profiling.CPUSamplingFrequency, f.Hidden.DebugProcessNames)
+				},
+			},
+			{
+				Name: "profile_stores",
+				Reloader: func(newCfg *config.Config) error {
+					if len(newCfg.RemoteStores) != len(remoteStoreConfigs) {
+						return errors.New("adding or removing remote stores requires a restart")
+					}
+					relabelConfigs := map[string][]*relabel.Config{}
+					for _, rs := range newCfg.RemoteStores {
+						old, ok := remoteStoreConfigs[rs.Name]
+						if !ok {
+							return fmt.Errorf("adding remote store %q requires a restart", rs.Name)
+						}
+						// Connections, and the debug information upload, are set up at startup.
+						if !sameRemoteStoreConnection(old, rs) {
+							return fmt.Errorf("changing the connection settings of remote store %q requires a restart", rs.Name)
+						}
+						relabelConfigs[rs.Name] = rs.RelabelConfigs
+					}
+					return profileStore.ApplyConfig(relabelConfigs)
+				},
+			},
 		}
 
-		cfgReloader, err := config.NewConfigReloader(logger, reg, flags.ConfigPath, reloaders)
+		cfgReloader, err := config.NewConfigReloader(logger, reg, flags.ConfigPath, cfg, reloaders)
 		if err != nil {
 			level.Error(logger).Log("msg", "failed to instantiate config file reloader", "err", err)
 			return err
@@ -1028,6 +1306,57 @@ func run(logger log.Logger, reg *prometheus.Registry, flags flags) error {
 	return g.Run()
 }
 
+// sameRemoteStoreConnection returns whether both configs connect to a remote
+// store the same way, only their relabel configs may differ.
+func sameRemoteStoreConnection(a, b *config.RemoteStoreConfig) bool {
+	return a.Address == b.Address &&
+		a.BearerToken == b.BearerToken &&
+		a.BearerTokenFile == b.BearerTokenFile &&
+		a.Insecure == b.Insecure &&
+		a.InsecureSkipVerify == b.InsecureSkipVerify &&
+		a.BatchWriteInterval == b.BatchWriteInterval
+}
+
+// remoteStoreConn dials the given remote store using its TLS and authentication settings.
+func remoteStoreConn(logger log.Logger, reg prometheus.Registerer, tp trace.TracerProvider, rs *config.RemoteStoreConfig, rpcLoggingEnable bool, rpcUnaryTimeout time.Duration) (*grpc.ClientConn, error) {
+	encoding.RegisterCodec(vtproto.Codec{})
+
+	var opts []grpc.DialOption
+	if rs.Insecure {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	} else {
+		config := &tls.Config{
+			//nolint:gosec
+			InsecureSkipVerify: rs.InsecureSkipVerify,
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+	}
+
+	if rs.BearerToken != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(
+			parcagrpc.NewPerRequestBearerToken(string(rs.BearerToken), rs.Insecure)),
+		)
+	}
+
+	if rs.BearerTokenFile != "" {
+		b, err := os.ReadFile(rs.BearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bearer token from file: %w", err)
+		}
+		opts = append(opts, grpc.WithPerRPCCredentials(
+			parcagrpc.NewPerRequestBearerToken(strings.TrimSpace(string(b)), rs.Insecure)),
+		)
+	}
+
+	var grpcLogger log.Logger
+	if !rpcLoggingEnable {
+		grpcLogger = log.NewNopLogger()
+	} else {
+		grpcLogger = log.With(logger, "service", "gRPC/client")
+	}
+	return parcagrpc.Conn(grpcLogger, reg, tp, rs.Address, rpcUnaryTimeout, opts...)
+}
+
 const containerCgroupPath = "/proc/1/cgroup"
 
 // isInContainer returns true is the process is running in a container
@@ -109,6 +109,16 @@ function(params) {
         resources: ['nodes'],
         verbs: ['get'],
       },
+      {
+        apiGroups: ['apps'],
+        resources: ['replicasets'],
+        verbs: ['list', 'watch'],
+      },
+      {
+        apiGroups: ['batch'],
+        resources: ['jobs'],
+        verbs: ['list', 'watch'],
+      },
     ],
   },
 
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"sort"
+	"strings"
 )
 
 // CommonInformationEntry represents a Common Information Entry in
@@ -24,6 +25,12 @@ type CommonInformationEntry struct {
 	ptrEncAddr ptrEnc
 }
 
+// SignalFrame returns whether the FDEs of this CIE describe signal trampolines,
+// which the 'S' augmentation indicates.
+func (cie *CommonInformationEntry) SignalFrame() bool {
+	return strings.HasPrefix(cie.Augmentation, "z") && strings.ContainsRune(cie.Augmentation, 'S')
+}
+
 // FrameDescriptionEntry represents a Frame Descriptor Entry in the
 // Dwarf .debug_frame section.
 type FrameDescriptionEntry struct {
@@ -105,6 +112,29 @@ func (fdes FrameDescriptionEntries) Append(otherFDEs FrameDescriptionEntries) Fr
 	return r
 }
 
+// Merge returns the entries of fdes along with the entries of otherFDEs that do
+// not overlap any of them, sorted by address. The entries of fdes take precedence,
+// which is used to fill in the gaps of .eh_frame with .debug_frame.
+func (fdes FrameDescriptionEntries) Merge(otherFDEs FrameDescriptionEntries) FrameDescriptionEntries {
+	sorted := make(FrameDescriptionEntries, len(fdes), len(fdes)+len(otherFDEs))
+	copy(sorted, fdes)
+	sort.Sort(sorted)
+
+	r := sorted
+	for _, fde := range otherFDEs {
+		// The first entry that ends after the start of fde.
+		i := sort.Search(len(sorted), func(i int) bool {
+			return sorted[i].End() > fde.Begin()
+		})
+		if i < len(sorted) && sorted[i].Begin() < fde.End() {
+			continue
+		}
+		r = append(r, fde)
+	}
+	sort.Sort(r)
+	return r
+}
+
 // ptrEnc represents a pointer encoding value, used during eh_frame decoding
 // to determine how pointers were encoded.
 // Least significant 4 (0xf) bytes encode the size  as well as its
@@ -54,6 +54,38 @@ func TestFDEForPC(t *testing.T) {
 	}
 }
 
+func TestMerge(t *testing.T) {
+	ehFrame := FrameDescriptionEntries{
+		&FrameDescriptionEntry{begin: 50, size: 50},
+		&FrameDescriptionEntry{begin: 10, size: 40},
+	}
+	debugFrame := FrameDescriptionEntries{
+		// Already covered.
+		&FrameDescriptionEntry{begin: 10, size: 40},
+		// Overlaps.
+		&FrameDescriptionEntry{begin: 90, size: 20},
+		// Missing.
+		&FrameDescriptionEntry{begin: 0, size: 10},
+		&FrameDescriptionEntry{begin: 100, size: 100},
+	}
+
+	merged := ehFrame.Merge(debugFrame)
+	want := FrameDescriptionEntries{debugFrame[2], ehFrame[1], ehFrame[0], debugFrame[3]}
+	if len(merged) != len(want) {
+		t.Fatalf("Expected %d FDEs, but get %d", len(want), len(merged))
+	}
+	for i := range want {
+		if merged[i] != want[i] {
+			t.Errorf("[%d] got [%d, %d), expected [%d, %d)", i, merged[i].Begin(), merged[i].End(), want[i].Begin(), want[i].End())
+		}
+	}
+
+	// The receiver is left untouched.
+	if ehFrame[0].Begin() != 50 || len(ehFrame) != 2 {
+		t.Errorf("Merge modified the receiver")
+	}
+}
+
 func BenchmarkFDEForPC(b *testing.B) {
 	f, err := os.Open("testdata/frame")
 	if err != nil {
@@ -8,6 +8,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 
 	"github.com/parca-dev/parca-agent/internal/dwarf/util"
 )
@@ -58,11 +59,14 @@ func (ctx *parseContext) parsingEHFrame() bool {
 	return ctx.ehFrameAddr > 0
 }
 
-func (ctx *parseContext) cieEntry(cieid uint32) bool {
+// cieEntry returns true if the CIE id / CIE pointer of idSize bytes identifies a CIE.
+// In .debug_frame CIEs are identified by an id with all its bits set,
+// in .eh_frame by a zero CIE pointer.
+func (ctx *parseContext) cieEntry(cieid uint64, idSize int) bool {
 	if ctx.parsingEHFrame() {
 		return cieid == 0x00
 	}
-	return cieid == 0xffffffff
+	return cieid == ^uint64(0)>>(64-8*idSize)
 }
 
 func (ctx *parseContext) offset() int {
@@ -71,7 +75,7 @@ func (ctx *parseContext) offset() int {
 
 func parselength(ctx *parseContext) parsefunc {
 	start := ctx.offset()
-	err := binary.Read(ctx.buf, binary.LittleEndian, &ctx.length) // TODO(aarzilli): this does not support 64bit DWARF
+	err := binary.Read(ctx.buf, binary.LittleEndian, &ctx.length)
 	if err != nil {
 		panic("Could not read from buffer")
 	}
@@ -81,22 +85,46 @@ func parselength(ctx *parseContext) parsefunc {
 		return parselength
 	}
 
-	var cieid uint32
-	err = binary.Read(ctx.buf, binary.LittleEndian, &cieid)
+	// In the 64-bit DWARF format the initial length is an escape,
+	// the actual length of the entry follows as 8 bytes.
+	dwarf64 := ctx.length == 0xffffffff
+	if dwarf64 {
+		var length uint64
+		err = binary.Read(ctx.buf, binary.LittleEndian, &length)
+		if err != nil {
+			panic("Could not read from buffer")
+		}
+		if length > math.MaxUint32 {
+			ctx.err = fmt.Errorf("entry length %#x too large at %#x", length, start)
+			return nil
+		}
+		ctx.length = uint32(length)
+	}
+
+	// The CIE id / CIE pointer is 8 bytes long in the 64-bit format of .debug_frame,
+	// .eh_frame always uses 4 bytes.
+	idSize := 4
+	if dwarf64 && !ctx.parsingEHFrame() {
+		idSize = 8
+	}
+	idOffset := ctx.offset()
+	cieid, err := util.ReadUintRaw(ctx.buf, binary.LittleEndian, idSize)
 	if err != nil {
 		panic("Could not read from buffer")
 	}
 
-	ctx.length -= 4 // take off the length of the CIE id / CIE pointer.
+	ctx.length -= uint32(idSize) // take off the length of the CIE id / CIE pointer.
 
-	if ctx.cieEntry(cieid) {
-		ctx.common = &CommonInformationEntry{Length: ctx.length, staticBase: ctx.staticBase, CIE_id: cieid}
+	if ctx.cieEntry(cieid, idSize) {
+		ctx.common = &CommonInformationEntry{Length: ctx.length, staticBase: ctx.staticBase, CIE_id: uint32(cieid)}
 		ctx.ciemap[start] = ctx.common
 		return parseCIE
 	}
 
-	if ctx.ehFrameAddr > 0 {
-		cieid = uint32(start - int(cieid) + 4)
+	// In .eh_frame the CIE pointer is relative to its own position,
+	// in .debug_frame it is an offset from the start of the section.
+	if ctx.parsingEHFrame() {
+		cieid = uint64(idOffset) - cieid
 	}
 
 	common := ctx.ciemap[int(cieid)]
@@ -176,14 +204,21 @@ func parseCIE(ctx *parseContext) parsefunc {
 		}
 	}
 
+	// In version 4 of .debug_frame the address size and segment selector size follow,
+	// only flat address spaces are supported so they are skipped.
+	if !ctx.parsingEHFrame() && ctx.common.Version == 4 {
+		_, _ = buf.ReadByte() // address size
+		_, _ = buf.ReadByte() // segment selector size
+	}
+
 	// parse code alignment factor
 	ctx.common.CodeAlignmentFactor, _ = util.DecodeULEB128(buf)
 
 	// parse data alignment factor
 	ctx.common.DataAlignmentFactor, _ = util.DecodeSLEB128(buf)
 
-	// parse return address register
-	if ctx.parsingEHFrame() && ctx.common.Version == 1 {
+	// parse return address register, a single byte in version 1.
+	if ctx.common.Version == 1 {
 		b, _ := buf.ReadByte()
 		ctx.common.ReturnAddressRegister = uint64(b)
 	} else {
@@ -207,7 +242,7 @@ func parseCIE(ctx *parseContext) parsefunc {
 					return nil
 				}
 			case 'S':
-				// Signal handler invocation frame, we don't support this but there is no associated data to read.
+				// Signal handler invocation frame, see CommonInformationEntry.SignalFrame. There is no associated data to read.
 			case 'P':
 				// Personality function encoded as a pointer encoding byte followed by
 				// the pointer to the personality function encoded as specified by the
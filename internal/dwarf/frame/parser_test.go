@@ -41,6 +41,90 @@ func TestParseCIE(t *testing.T) {
 	}
 }
 
+// debugFrameEntry encodes a .debug_frame CIE or FDE with the given CIE id or CIE pointer.
+func debugFrameEntry(dwarf64 bool, id uint64, body []byte) []byte {
+	var buf []byte
+	if dwarf64 {
+		buf = binary.LittleEndian.AppendUint32(buf, 0xffffffff)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(8+len(body)))
+		buf = binary.LittleEndian.AppendUint64(buf, id)
+	} else {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(4+len(body)))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(id))
+	}
+	return append(buf, body...)
+}
+
+func TestParseDebugFrame(t *testing.T) {
+	fde := func(begin, size uint64) []byte {
+		var body []byte
+		body = binary.LittleEndian.AppendUint64(body, begin)
+		body = binary.LittleEndian.AppendUint64(body, size)
+		// DW_CFA_advance_loc 1, DW_CFA_def_cfa_offset 16
+		return append(body, 0x41, 0x0e, 0x10)
+	}
+	// DW_CFA_def_cfa rsp+8, DW_CFA_offset rip at cfa-8
+	initialInstructions := []byte{0x0c, 0x07, 0x08, 0x90, 0x01}
+
+	for _, tc := range []struct {
+		name    string
+		dwarf64 bool
+		cie     []byte
+	}{
+		{
+			name: "version 1",
+			// version, augmentation, code alignment factor, data alignment factor, return address register (1 byte)
+			cie: append([]byte{1, 0, 1, 0x78, 16}, initialInstructions...),
+		},
+		{
+			name: "version 4",
+			// version, augmentation, address size, segment selector size, code alignment factor, data alignment factor, return address register
+			cie: append([]byte{4, 0, 8, 0, 1, 0x78, 16}, initialInstructions...),
+		},
+		{
+			name:    "64-bit DWARF",
+			dwarf64: true,
+			cie:     append([]byte{3, 0, 1, 0x78, 16}, initialInstructions...),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cieID := uint64(0xffffffff)
+			if tc.dwarf64 {
+				cieID = 0xffffffffffffffff
+			}
+			// The CIE pointers of .debug_frame are offsets from the start of the section.
+			data := debugFrameEntry(tc.dwarf64, cieID, tc.cie)
+			data = append(data, debugFrameEntry(tc.dwarf64, 0, fde(0x1000, 0x20))...)
+			data = append(data, debugFrameEntry(tc.dwarf64, 0, fde(0x1020, 0x10))...)
+
+			fdes, err := Parse(data, binary.LittleEndian, 0, 8, 0)
+			if err != nil {
+				t.Fatalf("failed to parse frame data: %v", err)
+			}
+			if len(fdes) != 2 {
+				t.Fatalf("Expected 2 FDEs, but get %d", len(fdes))
+			}
+			if fdes[0].Begin() != 0x1000 || fdes[0].End() != 0x1020 || fdes[1].Begin() != 0x1020 || fdes[1].End() != 0x1030 {
+				t.Fatalf("Unexpected FDE ranges [%#x, %#x) [%#x, %#x)", fdes[0].Begin(), fdes[0].End(), fdes[1].Begin(), fdes[1].End())
+			}
+
+			common := fdes[0].CIE
+			if fdes[1].CIE != common {
+				t.Fatalf("Expected the FDEs to share their CIE")
+			}
+			if common.DataAlignmentFactor != -8 {
+				t.Fatalf("Expected DataAlignmentFactor -8, but get %d", common.DataAlignmentFactor)
+			}
+			if common.ReturnAddressRegister != 16 {
+				t.Fatalf("Expected ReturnAddressRegister 16, but get %d", common.ReturnAddressRegister)
+			}
+			if !bytes.Equal(common.InitialInstructions, initialInstructions) {
+				t.Fatalf("Expected InitialInstructions %v, but get %v", initialInstructions, common.InitialInstructions)
+			}
+		})
+	}
+}
+
 func TestParse(t *testing.T) {
 	type args struct {
 		path        string
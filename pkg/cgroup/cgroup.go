@@ -21,6 +21,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"unsafe"
 
@@ -119,6 +120,54 @@ func PathV2AddMountpoint(path string) (string, error) {
 	return pathWithMountpoint, nil
 }
 
+// PIDs returns the PIDs of the processes in the cgroup and its descendants,
+// e.g., all the processes of a systemd unit.
+// The path does not include the mountpoint, e.g., "/system.slice/nginx.service".
+// The cgroup2 hierarchy is preferred over the cgroup1 systemd hierarchy.
+func PIDs(path string) ([]int, error) {
+	for _, mountpoint := range []string{"/sys/fs/cgroup/unified", "/sys/fs/cgroup", "/sys/fs/cgroup/systemd"} {
+		dir := filepath.Join(mountpoint, path)
+		if _, err := os.Stat(filepath.Join(dir, "cgroup.procs")); err == nil {
+			return pids(dir)
+		}
+	}
+	return nil, fmt.Errorf("cannot access cgroup %q", path)
+}
+
+// pids reads the cgroup.procs files of the cgroup directory and its descendants.
+func pids(dir string) ([]int, error) {
+	var pids []int
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		// Descendant cgroups come and go while walking.
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != "cgroup.procs" {
+			return nil
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		for _, field := range strings.Fields(string(content)) {
+			pid, err := strconv.Atoi(field)
+			if err != nil {
+				return fmt.Errorf("invalid PID in %q: %w", path, err)
+			}
+			pids = append(pids, pid)
+		}
+		return nil
+	})
+	return pids, err
+}
+
 // ID returns the cgroup2 ID of a path.
 func ID(pathWithMountpoint string) (uint64, error) {
 	cPathWithMountpoint := C.CString(pathWithMountpoint)
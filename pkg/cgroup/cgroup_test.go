@@ -15,6 +15,8 @@
 package cgroup
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/prometheus/procfs"
@@ -199,3 +201,22 @@ func TestFindFirstCPUCgroup(t *testing.T) {
 		})
 	}
 }
+
+func TestPIDs(t *testing.T) {
+	dir := t.TempDir()
+	for path, procs := range map[string]string{
+		"cgroup.procs":                "1234\n1235\n",
+		"app/cgroup.procs":            "1240\n",
+		"app/worker/cgroup.procs":     "1241\n1242\n",
+		"app/worker/cgroup.max.depth": "max\n",
+		"empty/cgroup.procs":          "",
+	} {
+		path = filepath.Join(dir, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(procs), 0o644))
+	}
+
+	got, err := pids(dir)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []int{1234, 1235, 1240, 1241, 1242}, got)
+}
@@ -15,15 +15,240 @@ package config
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
 
+	promconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/relabel"
 	"gopkg.in/yaml.v3"
 )
 
+const defaultRemoteStoreBatchWriteInterval = 10 * time.Second
+
+// Names of the config sections as reported by RestartRequired.
+const (
+	SectionProfiling    = "profiling"
+	SectionRemoteStore  = "remote_store"
+	SectionRemoteStores = "remote_stores"
+	SectionDebuginfo    = "debuginfo"
+	SectionSymbolizer   = "symbolizer"
+	SectionMetadata     = "metadata"
+	SectionFileSD       = "file_sd_configs"
+	SectionHTTPSD       = "http_sd_configs"
+)
+
+var sections = []string{
+	SectionProfiling,
+	SectionRemoteStore,
+	SectionRemoteStores,
+	SectionDebuginfo,
+	SectionSymbolizer,
+	SectionMetadata,
+	SectionFileSD,
+	SectionHTTPSD,
+}
+
 // Config holds all the configuration information for Parca Agent.
+//
+// Settings that are also available as flags are optional, a setting that is
+// left out keeps the value of its flag. Flags that are explicitly passed on
+// the command line take precedence over the config file.
 type Config struct {
+	RelabelConfigs []*relabel.Config    `yaml:"relabel_configs,omitempty"`
+	RemoteStores   []*RemoteStoreConfig `yaml:"remote_stores,omitempty"`
+
+	Profiling   *ProfilingConfig          `yaml:"profiling,omitempty"`
+	RemoteStore *DefaultRemoteStoreConfig `yaml:"remote_store,omitempty"`
+	Debuginfo   *DebuginfoConfig          `yaml:"debuginfo,omitempty"`
+	Symbolizer  *SymbolizerConfig         `yaml:"symbolizer,omitempty"`
+	Metadata    *MetadataConfig           `yaml:"metadata,omitempty"`
+
+	FileSDConfigs []*FileSDConfig `yaml:"file_sd_configs,omitempty"`
+	HTTPSDConfigs []*HTTPSDConfig `yaml:"http_sd_configs,omitempty"`
+}
+
+// FileSDConfig discovers targets from JSON or YAML files listing process selectors and their labels.
+type FileSDConfig struct {
+	// Files are glob patterns of the files, they are watched for changes.
+	Files []string `yaml:"files"`
+	// RefreshInterval is how often the files are re-read if no change was noticed.
+	RefreshInterval time.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// HTTPSDConfig discovers targets by polling an HTTP endpoint returning the same format as the files of FileSDConfig.
+type HTTPSDConfig struct {
+	URL             string        `yaml:"url"`
+	RefreshInterval time.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// ProfilingConfig mirrors the --profiling-* flags.
+// CPUSamplingFrequency and ProcessNames can be changed without a restart.
+type ProfilingConfig struct {
+	Duration             *time.Duration `yaml:"duration,omitempty"`
+	CPUSamplingFrequency *uint64        `yaml:"cpu_sampling_frequency,omitempty"`
+	// ProcessNames only profiles the processes whose comm matches one of the regexes.
+	ProcessNames []string `yaml:"process_names,omitempty"`
+	// TargetRules are evaluated in order against the labels of every process,
+	// the first matching rule decides how the process is profiled.
+	TargetRules []*TargetRule `yaml:"target_rules,omitempty"`
+	// CgroupFilter restricts profiling to the cgroups of discovered targets in the kernel.
+	CgroupFilter *CgroupFilterConfig `yaml:"cgroup_filter,omitempty"`
+
+	PerfEventBufferPollInterval       *time.Duration `yaml:"perf_event_buffer_poll_interval,omitempty"`
+	PerfEventBufferProcessingInterval *time.Duration `yaml:"perf_event_buffer_processing_interval,omitempty"`
+	PerfEventBufferWorkerCount        *int           `yaml:"perf_event_buffer_worker_count,omitempty"`
+}
+
+// TargetRuleAction decides whether the processes matching a TargetRule are profiled.
+type TargetRuleAction string
+
+const (
+	TargetRuleInclude TargetRuleAction = "include"
+	TargetRuleExclude TargetRuleAction = "exclude"
+)
+
+// MaxSamplingWeight is the sampling weight of a process that keeps all of its samples.
+const MaxSamplingWeight = 100
+
+// LabelMatchers maps label names, e.g. namespace, pod, systemd_unit, comm or cgroup_name,
+// to anchored regexes that all have to match. Empty matchers match every label set.
+type LabelMatchers map[model.LabelName]relabel.Regexp
+
+// Matches returns whether the given labels match.
+// Labels that are not present are matched as empty strings.
+func (m LabelMatchers) Matches(lset model.LabelSet) bool {
+	for name, regex := range m {
+		if !regex.MatchString(string(lset[name])) {
+			return false
+		}
+	}
+	return true
+}
+
+// TargetRule decides whether the processes whose labels match are profiled
+// and which share of their samples is kept.
+type TargetRule struct {
+	Match LabelMatchers `yaml:"match,omitempty"`
+	// Action defaults to include.
+	Action TargetRuleAction `yaml:"action,omitempty"`
+	// SamplingWeight is the percentage of samples kept for matching processes,
+	// between 1 and 100. Defaults to 100. Weights above 100 are rejected, as
+	// processes can not be sampled more often than the agent's frequency.
+	SamplingWeight uint8 `yaml:"sampling_weight,omitempty"`
+}
+
+// Matches returns whether the given labels match the rule.
+func (r *TargetRule) Matches(lset model.LabelSet) bool {
+	return r.Match.Matches(lset)
+}
+
+// CgroupFilterMode decides how the cgroups selected by a CgroupFilterConfig are treated.
+type CgroupFilterMode string
+
+const (
+	// CgroupFilterAllow only profiles the selected cgroups.
+	CgroupFilterAllow CgroupFilterMode = "allow"
+	// CgroupFilterDeny profiles everything but the selected cgroups.
+	CgroupFilterDeny CgroupFilterMode = "deny"
+)
+
+// CgroupFilterConfig selects cgroups by the labels of the discovered targets
+// running in them. The filter is applied in the kernel using cgroup v2 IDs.
+type CgroupFilterConfig struct {
+	// Mode can not be changed without a restart.
+	Mode CgroupFilterMode `yaml:"mode"`
+	// Targets selects the discovered targets matching any of the matchers.
+	Targets []LabelMatchers `yaml:"targets,omitempty"`
+}
+
+// DefaultRemoteStoreConfig mirrors the --remote-store-* flags.
+type DefaultRemoteStoreConfig struct {
+	Address            *string            `yaml:"address,omitempty"`
+	BearerToken        *promconfig.Secret `yaml:"bearer_token,omitempty"`
+	BearerTokenFile    *string            `yaml:"bearer_token_file,omitempty"`
+	Insecure           *bool              `yaml:"insecure,omitempty"`
+	InsecureSkipVerify *bool              `yaml:"insecure_skip_verify,omitempty"`
+
+	BatchWriteInterval *time.Duration `yaml:"batch_write_interval,omitempty"`
+	RPCLoggingEnable   *bool          `yaml:"rpc_logging_enable,omitempty"`
+	RPCUnaryTimeout    *time.Duration `yaml:"rpc_unary_timeout,omitempty"`
+}
+
+// DebuginfoConfig mirrors the --debuginfo-* flags.
+type DebuginfoConfig struct {
+	Directories           []string       `yaml:"directories,omitempty"`
+	TempDir               *string        `yaml:"temp_dir,omitempty"`
+	Strip                 *bool          `yaml:"strip,omitempty"`
+	UploadDisable         *bool          `yaml:"upload_disable,omitempty"`
+	UploadMaxParallel     *int           `yaml:"upload_max_parallel,omitempty"`
+	UploadTimeoutDuration *time.Duration `yaml:"upload_timeout_duration,omitempty"`
+	UploadCacheDuration   *time.Duration `yaml:"upload_cache_duration,omitempty"`
+	DisableCaching        *bool          `yaml:"disable_caching,omitempty"`
+}
+
+// SymbolizerConfig mirrors the --symbolizer-* flags.
+type SymbolizerConfig struct {
+	JITDisable *bool `yaml:"jit_disable,omitempty"`
+}
+
+// MetadataConfig mirrors the --metadata-* flags.
+type MetadataConfig struct {
+	ExternalLabels             map[string]string `yaml:"external_labels,omitempty"`
+	ContainerRuntimeSocketPath *string           `yaml:"container_runtime_socket_path,omitempty"`
+	DockerSocketPath           *string           `yaml:"docker_socket_path,omitempty"`
+	PodmanSocketPath           *string           `yaml:"podman_socket_path,omitempty"`
+	ContainerLabels            []string          `yaml:"container_labels,omitempty"`
+	CloudDisable               *bool             `yaml:"cloud_disable,omitempty"`
+	CloudMetadataURL           *string           `yaml:"cloud_metadata_url,omitempty"`
+	DisableCaching             *bool             `yaml:"disable_caching,omitempty"`
+
+	// ProcessLabels has no flag.
+	ProcessLabels *ProcessLabelsConfig `yaml:"process_labels,omitempty"`
+}
+
+// ProcessLabelsConfig exposes environment variables and command-line arguments
+// of processes as labels. Nothing is exposed unless it is listed,
+// since both commonly hold secrets.
+type ProcessLabelsConfig struct {
+	// Environ maps the names of environment variables to label names,
+	// e.g. APP_VERSION: app_version.
+	Environ map[string]model.LabelName `yaml:"environ,omitempty"`
+	// Cmdline sets labels from the command line of processes.
+	Cmdline []*CmdlineLabelConfig `yaml:"cmdline,omitempty"`
+}
+
+// CmdlineLabelConfig sets the target label if the anchored regex matches
+// the command line, i.e. the arguments joined by spaces.
+type CmdlineLabelConfig struct {
+	Regex       relabel.Regexp  `yaml:"regex"`
+	TargetLabel model.LabelName `yaml:"target_label"`
+	// Replacement is expanded with the capture groups of the regex. Defaults to $1.
+	Replacement string `yaml:"replacement,omitempty"`
+}
+
+// RemoteStoreConfig configures an additional remote store that profiles are sent to.
+// Every remote store has its own connection, batching and relabeling rules.
+type RemoteStoreConfig struct {
+	// Name identifies the store in logs and metrics. Defaults to the address.
+	Name               string            `yaml:"name,omitempty"`
+	Address            string            `yaml:"address"`
+	BearerToken        promconfig.Secret `yaml:"bearer_token,omitempty"`
+	BearerTokenFile    string            `yaml:"bearer_token_file,omitempty"`
+	Insecure           bool              `yaml:"insecure,omitempty"`
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify,omitempty"`
+
+	BatchWriteInterval time.Duration `yaml:"batch_write_interval,omitempty"`
+
+	// RelabelConfigs are applied to the labels of every profile before it is
+	// sent to this store, after the global relabel configs.
 	RelabelConfigs []*relabel.Config `yaml:"relabel_configs,omitempty"`
 }
 
@@ -45,9 +270,127 @@ func Load(s string) (*Config, error) {
 		return nil, err
 	}
 
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
 
+// validate checks the config for semantic errors and fills in defaults.
+func (c *Config) validate() error {
+	if c.Profiling != nil {
+		if f := c.Profiling.CPUSamplingFrequency; f != nil && *f == 0 {
+			return errors.New("profiling: cpu_sampling_frequency must be greater than zero")
+		}
+		if d := c.Profiling.Duration; d != nil && *d <= 0 {
+			return errors.New("profiling: duration must be greater than zero")
+		}
+		for _, name := range c.Profiling.ProcessNames {
+			if _, err := regexp.Compile(name); err != nil {
+				return fmt.Errorf("profiling: invalid process name regex %q: %w", name, err)
+			}
+		}
+		for i, r := range c.Profiling.TargetRules {
+			if r == nil {
+				return fmt.Errorf("profiling: empty target rule at index %d", i)
+			}
+			switch r.Action {
+			case "":
+				r.Action = TargetRuleInclude
+			case TargetRuleInclude, TargetRuleExclude:
+			default:
+				return fmt.Errorf("profiling: target rule at index %d: unknown action %q", i, r.Action)
+			}
+			if r.SamplingWeight == 0 {
+				r.SamplingWeight = MaxSamplingWeight
+			}
+			if r.SamplingWeight > MaxSamplingWeight {
+				return fmt.Errorf("profiling: target rule at index %d: sampling_weight must be between 1 and %d, processes can not be sampled more often than cpu_sampling_frequency", i, MaxSamplingWeight)
+			}
+		}
+		if f := c.Profiling.CgroupFilter; f != nil && f.Mode != CgroupFilterAllow && f.Mode != CgroupFilterDeny {
+			return fmt.Errorf("profiling: cgroup_filter: unknown mode %q", f.Mode)
+		}
+	}
+	if c.Metadata != nil && c.Metadata.ProcessLabels != nil {
+		pl := c.Metadata.ProcessLabels
+		for env, name := range pl.Environ {
+			if env == "" || strings.Contains(env, "=") {
+				return fmt.Errorf("metadata: process_labels: invalid environment variable name %q", env)
+			}
+			if !name.IsValid() {
+				return fmt.Errorf("metadata: process_labels: invalid label name %q for environment variable %q", name, env)
+			}
+		}
+		for i, cl := range pl.Cmdline {
+			if cl == nil || cl.Regex.Regexp == nil {
+				return fmt.Errorf("metadata: process_labels: cmdline label at index %d: regex is required", i)
+			}
+			if !cl.TargetLabel.IsValid() {
+				return fmt.Errorf("metadata: process_labels: cmdline label at index %d: invalid target_label %q", i, cl.TargetLabel)
+			}
+			if cl.Replacement == "" {
+				cl.Replacement = "$1"
+			}
+		}
+	}
+	if c.RemoteStore != nil && c.RemoteStore.BearerToken != nil && c.RemoteStore.BearerTokenFile != nil {
+		return errors.New("remote_store: at most one of bearer_token and bearer_token_file must be configured")
+	}
+
+	for i, sd := range c.FileSDConfigs {
+		if sd == nil || len(sd.Files) == 0 {
+			return fmt.Errorf("file_sd_configs: config at index %d: files are required", i)
+		}
+		for _, f := range sd.Files {
+			if _, err := filepath.Match(f, ""); err != nil {
+				return fmt.Errorf("file_sd_configs: config at index %d: invalid file pattern %q: %w", i, f, err)
+			}
+		}
+		if sd.RefreshInterval < 0 {
+			return fmt.Errorf("file_sd_configs: config at index %d: refresh_interval must not be negative", i)
+		}
+	}
+	for i, sd := range c.HTTPSDConfigs {
+		if sd == nil {
+			return fmt.Errorf("http_sd_configs: empty config at index %d", i)
+		}
+		u, err := url.Parse(sd.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("http_sd_configs: config at index %d: invalid URL %q", i, sd.URL)
+		}
+		if sd.RefreshInterval < 0 {
+			return fmt.Errorf("http_sd_configs: config at index %d: refresh_interval must not be negative", i)
+		}
+	}
+
+	names := map[string]struct{}{}
+	for i, rs := range c.RemoteStores {
+		if rs == nil {
+			return fmt.Errorf("empty remote store config at index %d", i)
+		}
+		if rs.Address == "" {
+			return fmt.Errorf("remote store config at index %d: address is required", i)
+		}
+		if rs.BearerToken != "" && rs.BearerTokenFile != "" {
+			return fmt.Errorf("remote store config %q: at most one of bearer_token and bearer_token_file must be configured", rs.Address)
+		}
+		if rs.Name == "" {
+			rs.Name = rs.Address
+		}
+		if _, ok := names[rs.Name]; ok {
+			return fmt.Errorf("found multiple remote store configs with name %q", rs.Name)
+		}
+		names[rs.Name] = struct{}{}
+
+		if rs.BatchWriteInterval <= 0 {
+			rs.BatchWriteInterval = defaultRemoteStoreBatchWriteInterval
+		}
+	}
+	return nil
+}
+
 // LoadFile parses the given YAML file into a Config.
 func LoadFile(filename string) (*Config, error) {
 	content, err := os.ReadFile(filename)
@@ -60,3 +403,63 @@ func LoadFile(filename string) (*Config, error) {
 	}
 	return cfg, nil
 }
+
+// RestartRequired returns the sections of the config that differ between the
+// running and the new config and can not be applied without a restart.
+// Relabel configs, the CPU sampling frequency, the process names, the
+// target rules and the cgroup filter targets are applied at runtime and
+// therefore never reported.
+func RestartRequired(running, c *Config) []string {
+	var sections []string
+	if !reflect.DeepEqual(running.Profiling.restartOnly(), c.Profiling.restartOnly()) {
+		sections = append(sections, SectionProfiling)
+	}
+	if !reflect.DeepEqual(running.RemoteStore, c.RemoteStore) {
+		sections = append(sections, SectionRemoteStore)
+	}
+	if !reflect.DeepEqual(remoteStoresRestartOnly(running.RemoteStores), remoteStoresRestartOnly(c.RemoteStores)) {
+		sections = append(sections, SectionRemoteStores)
+	}
+	if !reflect.DeepEqual(running.Debuginfo, c.Debuginfo) {
+		sections = append(sections, SectionDebuginfo)
+	}
+	if !reflect.DeepEqual(running.Symbolizer, c.Symbolizer) {
+		sections = append(sections, SectionSymbolizer)
+	}
+	if !reflect.DeepEqual(running.Metadata, c.Metadata) {
+		sections = append(sections, SectionMetadata)
+	}
+	if !reflect.DeepEqual(running.FileSDConfigs, c.FileSDConfigs) {
+		sections = append(sections, SectionFileSD)
+	}
+	if !reflect.DeepEqual(running.HTTPSDConfigs, c.HTTPSDConfigs) {
+		sections = append(sections, SectionHTTPSD)
+	}
+	return sections
+}
+
+// restartOnly returns a copy of the profiling config without the settings
+// that can be changed at runtime.
+func (c *ProfilingConfig) restartOnly() *ProfilingConfig {
+	if c == nil {
+		return &ProfilingConfig{}
+	}
+	cfg := *c
+	cfg.CPUSamplingFrequency = nil
+	cfg.ProcessNames = nil
+	cfg.TargetRules = nil
+	if cfg.CgroupFilter != nil {
+		cfg.CgroupFilter = &CgroupFilterConfig{Mode: cfg.CgroupFilter.Mode}
+	}
+	return &cfg
+}
+
+func remoteStoresRestartOnly(stores []*RemoteStoreConfig) []RemoteStoreConfig {
+	res := make([]RemoteStoreConfig, 0, len(stores))
+	for _, rs := range stores {
+		cfg := *rs
+		cfg.RelabelConfigs = nil
+		res = append(res, cfg)
+	}
+	return res
+}
@@ -15,6 +15,7 @@ package config_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/relabel"
@@ -44,3 +45,320 @@ func TestLoad(t *testing.T) {
 		},
 	}, c)
 }
+
+func TestLoadRemoteStores(t *testing.T) {
+	t.Parallel()
+
+	c, err := config.Load(`remote_stores:
+- name: regional
+  address: regional.parca.example.com:443
+  bearer_token: hunter2
+  relabel_configs:
+  - source_labels: [namespace]
+    regex: production
+    action: keep
+- address: central.parca.example.com:443
+  insecure: true
+  batch_write_interval: 30s
+`)
+	require.NoError(t, err)
+	require.Equal(t, []*config.RemoteStoreConfig{
+		{
+			Name:               "regional",
+			Address:            "regional.parca.example.com:443",
+			BearerToken:        "hunter2",
+			BatchWriteInterval: 10 * time.Second,
+			RelabelConfigs: []*relabel.Config{
+				{
+					SourceLabels: model.LabelNames{"namespace"},
+					Separator:    ";",
+					Regex:        relabel.MustNewRegexp(`production`),
+					Replacement:  "$1",
+					Action:       relabel.Keep,
+				},
+			},
+		},
+		{
+			Name:               "central.parca.example.com:443",
+			Address:            "central.parca.example.com:443",
+			Insecure:           true,
+			BatchWriteInterval: 30 * time.Second,
+		},
+	}, c.RemoteStores)
+	require.NotContains(t, c.String(), "hunter2")
+}
+
+func TestLoadRemoteStoresInvalid(t *testing.T) {
+	t.Parallel()
+
+	for name, cfg := range map[string]string{
+		"missing address": `remote_stores:
+- name: regional
+`,
+		"duplicate name": `remote_stores:
+- address: a:443
+  name: regional
+- address: b:443
+  name: regional
+`,
+		"multiple bearer tokens": `remote_stores:
+- address: a:443
+  bearer_token: secret
+  bearer_token_file: /etc/token
+`,
+	} {
+		cfg := cfg
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := config.Load(cfg)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestLoadAgentSettings(t *testing.T) {
+	t.Parallel()
+
+	c, err := config.Load(`profiling:
+  duration: 5s
+  cpu_sampling_frequency: 49
+  process_names: [parca.*]
+remote_store:
+  address: parca.example.com:443
+  insecure: false
+debuginfo:
+  directories: [/usr/lib/debug, /opt/debug]
+  upload_disable: true
+symbolizer:
+  jit_disable: true
+metadata:
+  external_labels:
+    region: eu-west-1
+`)
+	require.NoError(t, err)
+
+	require.Equal(t, 5*time.Second, *c.Profiling.Duration)
+	require.Equal(t, uint64(49), *c.Profiling.CPUSamplingFrequency)
+	require.Equal(t, []string{"parca.*"}, c.Profiling.ProcessNames)
+	require.Nil(t, c.Profiling.PerfEventBufferWorkerCount)
+	require.Equal(t, "parca.example.com:443", *c.RemoteStore.Address)
+	require.False(t, *c.RemoteStore.Insecure)
+	require.Nil(t, c.RemoteStore.BearerToken)
+	require.Equal(t, []string{"/usr/lib/debug", "/opt/debug"}, c.Debuginfo.Directories)
+	require.True(t, *c.Debuginfo.UploadDisable)
+	require.Nil(t, c.Debuginfo.Strip)
+	require.True(t, *c.Symbolizer.JITDisable)
+	require.Equal(t, map[string]string{"region": "eu-west-1"}, c.Metadata.ExternalLabels)
+}
+
+func TestLoadAgentSettingsInvalid(t *testing.T) {
+	t.Parallel()
+
+	for name, cfg := range map[string]string{
+		"zero sampling frequency": `profiling:
+  cpu_sampling_frequency: 0
+`,
+		"invalid process name": `profiling:
+  process_names: ["("]
+`,
+		"unknown setting": `symbolizer:
+  disable: true
+`,
+		"invalid environment variable label": `metadata:
+  process_labels:
+    environ:
+      APP_VERSION: app-version
+`,
+		"cmdline label without regex": `metadata:
+  process_labels:
+    cmdline:
+    - target_label: region
+`,
+	} {
+		cfg := cfg
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := config.Load(cfg)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	t.Parallel()
+
+	running, err := config.Load(`profiling:
+  duration: 10s
+  cpu_sampling_frequency: 19
+remote_stores:
+- address: a:443
+`)
+	require.NoError(t, err)
+
+	// Hot-reloadable settings only.
+	c, err := config.Load(`relabel_configs:
+- source_labels: [pid]
+  action: drop
+profiling:
+  duration: 10s
+  cpu_sampling_frequency: 97
+  process_names: [parca.*]
+remote_stores:
+- address: a:443
+  relabel_configs:
+  - source_labels: [pid]
+    action: drop
+`)
+	require.NoError(t, err)
+	require.Empty(t, config.RestartRequired(running, c))
+
+	c, err = config.Load(`profiling:
+  duration: 5s
+  cpu_sampling_frequency: 19
+remote_stores:
+- address: b:443
+debuginfo:
+  strip: false
+`)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		config.SectionProfiling,
+		config.SectionRemoteStores,
+		config.SectionDebuginfo,
+	}, config.RestartRequired(running, c))
+}
+
+func TestLoadTargetRules(t *testing.T) {
+	t.Parallel()
+
+	c, err := config.Load(`profiling:
+  target_rules:
+  - match:
+      namespace: batch-.*
+    action: exclude
+  - match:
+      namespace: production
+      pod: checkout-.*
+    sampling_weight: 100
+  - sampling_weight: 10
+`)
+	require.NoError(t, err)
+
+	rules := c.Profiling.TargetRules
+	require.Len(t, rules, 3)
+	require.Equal(t, config.TargetRuleExclude, rules[0].Action)
+	require.Equal(t, config.TargetRuleInclude, rules[1].Action)
+	require.Equal(t, uint8(10), rules[2].SamplingWeight)
+	require.Equal(t, uint8(config.MaxSamplingWeight), rules[0].SamplingWeight)
+
+	require.True(t, rules[0].Matches(model.LabelSet{"namespace": "batch-nightly"}))
+	require.False(t, rules[0].Matches(model.LabelSet{"namespace": "my-batch-nightly"}))
+	require.True(t, rules[1].Matches(model.LabelSet{"namespace": "production", "pod": "checkout-1"}))
+	require.False(t, rules[1].Matches(model.LabelSet{"namespace": "production"}))
+	require.True(t, rules[2].Matches(model.LabelSet{}))
+
+	for name, cfg := range map[string]string{
+		"unknown action": `profiling:
+  target_rules:
+  - action: ignore
+`,
+		"sampling weight too high": `profiling:
+  target_rules:
+  - sampling_weight: 101
+`,
+		"invalid regex": `profiling:
+  target_rules:
+  - match:
+      comm: "("
+`,
+	} {
+		_, err := config.Load(cfg)
+		require.Error(t, err, name)
+	}
+}
+
+func TestLoadCgroupFilter(t *testing.T) {
+	t.Parallel()
+
+	running, err := config.Load(`profiling:
+  cgroup_filter:
+    mode: allow
+    targets:
+    - namespace: production
+    - systemd_unit: postgresql.service
+`)
+	require.NoError(t, err)
+
+	f := running.Profiling.CgroupFilter
+	require.Equal(t, config.CgroupFilterAllow, f.Mode)
+	require.Len(t, f.Targets, 2)
+	require.True(t, f.Targets[0].Matches(model.LabelSet{"namespace": "production"}))
+	require.False(t, f.Targets[1].Matches(model.LabelSet{"namespace": "production"}))
+
+	// Targets are reloaded at runtime, the mode is not.
+	c, err := config.Load(`profiling:
+  cgroup_filter:
+    mode: allow
+`)
+	require.NoError(t, err)
+	require.Empty(t, config.RestartRequired(running, c))
+
+	c, err = config.Load(`profiling:
+  cgroup_filter:
+    mode: deny
+`)
+	require.NoError(t, err)
+	require.Equal(t, []string{config.SectionProfiling}, config.RestartRequired(running, c))
+
+	_, err = config.Load(`profiling:
+  cgroup_filter:
+    mode: block
+`)
+	require.Error(t, err)
+}
+
+func TestLoadServiceDiscoveryConfigs(t *testing.T) {
+	t.Parallel()
+
+	running, err := config.Load(`file_sd_configs:
+- files: [/etc/parca-agent/targets/*.yaml]
+http_sd_configs:
+- url: http://inventory.example.com/targets
+  refresh_interval: 30s
+`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/etc/parca-agent/targets/*.yaml"}, running.FileSDConfigs[0].Files)
+	require.Equal(t, time.Duration(0), running.FileSDConfigs[0].RefreshInterval)
+	require.Equal(t, "http://inventory.example.com/targets", running.HTTPSDConfigs[0].URL)
+	require.Equal(t, 30*time.Second, running.HTTPSDConfigs[0].RefreshInterval)
+
+	c, err := config.Load(`file_sd_configs:
+- files: [/etc/parca-agent/targets/*.json]
+`)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		config.SectionFileSD,
+		config.SectionHTTPSD,
+	}, config.RestartRequired(running, c))
+
+	for name, cfg := range map[string]string{
+		"no files": `file_sd_configs:
+- refresh_interval: 1m
+`,
+		"invalid file pattern": `file_sd_configs:
+- files: ["["]
+`,
+		"invalid URL scheme": `http_sd_configs:
+- url: ftp://inventory.example.com/targets
+`,
+		"negative refresh interval": `http_sd_configs:
+- url: http://inventory.example.com/targets
+  refresh_interval: -1m
+`,
+	} {
+		_, err := config.Load(cfg)
+		require.Error(t, err, name)
+	}
+}
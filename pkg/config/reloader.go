@@ -17,6 +17,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -41,13 +42,20 @@ type ConfigReloader struct {
 	triggerReload     chan struct{}
 	configSuccess     prometheus.Gauge
 	configSuccessTime prometheus.Gauge
+	restartRequired   *prometheus.GaugeVec
+
+	// running is the config the agent was started with, the sections
+	// that can not be reloaded are compared against it.
+	running *Config
 }
 
-// NewConfigReloader returns an instantiated config reloader.
+// NewConfigReloader returns an instantiated config reloader. The given config
+// is the one the agent was started with.
 func NewConfigReloader(
 	logger log.Logger,
 	reg prometheus.Registerer,
 	filename string,
+	running *Config,
 	reloaders []ComponentReloader,
 ) (*ConfigReloader, error) {
 	watcher, err := fsnotify.NewWatcher()
@@ -78,6 +86,15 @@ func NewConfigReloader(
 			Name: "parca_agent_config_last_reload_success_timestamp_seconds",
 			Help: "Timestamp of the last successful configuration reload.",
 		}),
+		restartRequired: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "parca_agent_config_restart_required",
+			Help: "Whether a section of the configuration file changed in a way that is only applied after a restart.",
+		}, []string{"section"}),
+
+		running: running,
+	}
+	for _, section := range sections {
+		r.restartRequired.WithLabelValues(section).Set(0)
 	}
 	return r, nil
 }
@@ -138,6 +155,8 @@ func (r *ConfigReloader) reloadFile() (err error) {
 		return fmt.Errorf("failed to load configuration: %w", err)
 	}
 
+	r.reportRestartRequired(RestartRequired(r.running, cfg))
+
 	failed := false
 	for _, rl := range r.reloaders {
 		rstart := time.Now()
@@ -156,6 +175,20 @@ func (r *ConfigReloader) reloadFile() (err error) {
 	return nil
 }
 
+// reportRestartRequired logs and exposes the sections that changed since startup
+// and are only applied after a restart.
+func (r *ConfigReloader) reportRestartRequired(changed []string) {
+	for _, section := range sections {
+		r.restartRequired.WithLabelValues(section).Set(0)
+	}
+	for _, section := range changed {
+		r.restartRequired.WithLabelValues(section).Set(1)
+	}
+	if len(changed) > 0 {
+		level.Warn(r.logger).Log("msg", "configuration changes require a restart to be applied", "sections", strings.Join(changed, ","))
+	}
+}
+
 // Run starts watching the config file and wait for reload triggers.
 func (r *ConfigReloader) Run(ctx context.Context) error {
 	go r.watchFile()
@@ -29,7 +29,7 @@ import (
 	"github.com/parca-dev/parca-agent/pkg/config"
 )
 
-func setupReloader(ctx context.Context, t *testing.T) (*os.File, chan *config.Config) {
+func setupReloader(ctx context.Context, t *testing.T, running *config.Config) (*os.File, chan *config.Config, *prometheus.Registry) {
 	t.Helper()
 
 	logger := log.NewNopLogger()
@@ -59,7 +59,7 @@ func setupReloader(ctx context.Context, t *testing.T) (*os.File, chan *config.Co
 		},
 	}
 
-	cfgReloader, err := config.NewConfigReloader(logger, reg, filename, reloaders)
+	cfgReloader, err := config.NewConfigReloader(logger, reg, filename, running, reloaders)
 	if err != nil {
 		t.Errorf("failed to instantiate config reloader: %v", err)
 	}
@@ -68,7 +68,7 @@ func setupReloader(ctx context.Context, t *testing.T) (*os.File, chan *config.Co
 
 	time.Sleep(time.Millisecond * 100)
 
-	return f, reloadConfig
+	return f, reloadConfig, reg
 }
 
 func TestReloadValid(t *testing.T) {
@@ -77,7 +77,7 @@ func TestReloadValid(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
 	defer cancel()
 
-	f, reloadConfig := setupReloader(ctx, t)
+	f, reloadConfig, _ := setupReloader(ctx, t, &config.Config{})
 	defer f.Close()
 
 	cfgStr := `relabel_configs:
@@ -114,7 +114,7 @@ func TestReloadInvalid(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
 	defer cancel()
 
-	f, reloadConfig := setupReloader(ctx, t)
+	f, reloadConfig, _ := setupReloader(ctx, t, &config.Config{})
 	defer f.Close()
 
 	config := "{"
@@ -130,6 +130,43 @@ func TestReloadInvalid(t *testing.T) {
 	}
 }
 
+func TestReloadRestartRequired(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+
+	// The file changed after the agent was started with this config.
+	running, err := config.Load("symbolizer:\n  jit_disable: true\n")
+	require.NoError(t, err)
+	f, reloadConfig, reg := setupReloader(ctx, t, running)
+	defer f.Close()
+
+	if _, err := f.WriteString("profiling:\n  cpu_sampling_frequency: 97\n"); err != nil {
+		t.Errorf("failed to update temporary config file: %v", err)
+	}
+
+	select {
+	case <-reloadConfig:
+	case <-ctx.Done():
+		t.Fatal("configuration reload timed out")
+	}
+
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	restartRequired := map[string]float64{}
+	for _, mf := range mfs {
+		if mf.GetName() != "parca_agent_config_restart_required" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			restartRequired[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+	}
+	require.Equal(t, 1.0, restartRequired[config.SectionSymbolizer])
+	require.Equal(t, 0.0, restartRequired[config.SectionProfiling])
+}
+
 func TestReloadSymlink(t *testing.T) {
 	t.Parallel()
 
@@ -188,7 +225,7 @@ func TestReloadSymlink(t *testing.T) {
 		},
 	}
 
-	cfgReloader, err := config.NewConfigReloader(logger, reg, symlinkName, reloaders)
+	cfgReloader, err := config.NewConfigReloader(logger, reg, symlinkName, &config.Config{}, reloaders)
 	if err != nil {
 		t.Errorf("failed to instantiate config reloader: %v", err)
 	}
@@ -0,0 +1,199 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/util/strutil"
+
+	"github.com/parca-dev/parca-agent/pkg/discovery/containerengine"
+)
+
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+)
+
+// ContainerEngineConfig discovers the containers of a Docker or Podman engine.
+type ContainerEngineConfig struct {
+	engine     string
+	socketPath string
+	// labels are the container labels that are attached to the targets.
+	labels []string
+
+	interval time.Duration
+}
+
+// NewContainerEngineConfig creates a config for the engine listening on the given unix socket,
+// e.g. "docker" or "podman". Only the given container labels are attached to the targets.
+func NewContainerEngineConfig(engine, socketPath string, labels []string) *ContainerEngineConfig {
+	return &ContainerEngineConfig{
+		engine:     engine,
+		socketPath: socketPath,
+		labels:     labels,
+		interval:   5 * time.Second,
+	}
+}
+
+func (c *ContainerEngineConfig) Name() string {
+	return c.engine
+}
+
+func (c *ContainerEngineConfig) NewDiscoverer(d DiscovererOptions) (Discoverer, error) {
+	if c.socketPath == "" {
+		return nil, fmt.Errorf("%s discovery is disabled", c.engine)
+	}
+	// Most hosts run only one of the engines, do not try to connect to the missing one.
+	if _, err := os.Stat(c.socketPath); err != nil {
+		return nil, fmt.Errorf("%s socket not found: %w", c.engine, err)
+	}
+
+	client, err := containerengine.New(c.socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("create %s client: %w", c.engine, err)
+	}
+
+	return &ContainerEngineDiscoverer{
+		logger:   d.Logger,
+		engine:   c.engine,
+		labels:   c.labels,
+		interval: c.interval,
+		client:   client,
+		groups:   map[string]*MultiTargetGroup{},
+	}, nil
+}
+
+type ContainerEngineDiscoverer struct {
+	logger   log.Logger
+	engine   string
+	labels   []string
+	interval time.Duration
+
+	client *containerengine.Client
+	groups map[string]*MultiTargetGroup
+}
+
+func (d *ContainerEngineDiscoverer) Run(ctx context.Context, up chan<- []Group) error {
+	defer func() {
+		if err := d.client.Close(); err != nil {
+			level.Warn(d.logger).Log("msg", "failed to close container engine client", "err", err)
+		}
+	}()
+
+	for {
+		groups, err := d.update(ctx)
+		if err != nil {
+			level.Warn(d.logger).Log("msg", "failed to get containers from container engine", "engine", d.engine, "err", err)
+		}
+		if len(groups) > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case up <- groups:
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d.interval):
+		}
+	}
+}
+
+// update returns the groups of the containers that were started, changed or stopped.
+func (d *ContainerEngineDiscoverer) update(ctx context.Context) ([]Group, error) {
+	containers, err := d.client.Containers(ctx)
+	if containers == nil {
+		return nil, err
+	}
+	if err != nil {
+		level.Warn(d.logger).Log("msg", "failed to inspect containers", "engine", d.engine, "err", err)
+	}
+
+	recent := make(map[string]*MultiTargetGroup, len(containers))
+	for _, c := range containers {
+		if c.PID == 0 {
+			// The container is still running but could not be inspected,
+			// it keeps its labels until the next update.
+			if tg, ok := d.groups[d.source(c.ID)]; ok {
+				recent[tg.source] = tg
+			}
+			continue
+		}
+		tg := d.buildGroup(c)
+		recent[tg.source] = tg
+	}
+
+	var groups []Group
+	for source, tg := range recent {
+		if seen, ok := d.groups[source]; ok && reflect.DeepEqual(seen, tg) {
+			continue
+		}
+		groups = append(groups, tg)
+	}
+	// Indicate that containers were stopped, they are no longer listed.
+	for source := range d.groups {
+		if _, ok := recent[source]; !ok {
+			groups = append(groups, &MultiTargetGroup{source: source})
+		}
+	}
+	d.groups = recent
+
+	return groups, nil
+}
+
+// source returns the source of the group of the container with the given ID.
+func (d *ContainerEngineDiscoverer) source(id string) string {
+	return d.engine + "/" + id
+}
+
+func (d *ContainerEngineDiscoverer) buildGroup(c containerengine.Container) *MultiTargetGroup {
+	tg := &MultiTargetGroup{
+		source: d.source(c.ID),
+		labels: model.LabelSet{
+			// The pod discoverer sets "container" to the name of the container in the pod spec.
+			"container_engine_name": model.LabelValue(c.Name),
+			"containerid":           model.LabelValue(c.ID),
+			"container_image":       model.LabelValue(c.Image),
+		},
+		Targets: map[int]model.LabelSet{
+			c.PID: {},
+		},
+	}
+	if c.ImageDigest != "" {
+		tg.labels["container_image_digest"] = model.LabelValue(c.ImageDigest)
+	}
+	if v, ok := c.Labels[composeProjectLabel]; ok {
+		tg.labels["compose_project"] = model.LabelValue(v)
+	}
+	if v, ok := c.Labels[composeServiceLabel]; ok {
+		tg.labels["compose_service"] = model.LabelValue(v)
+	}
+	for _, name := range d.labels {
+		if v, ok := c.Labels[name]; ok {
+			tg.labels[model.LabelName("container_label_"+strutil.SanitizeLabelName(name))] = model.LabelValue(v)
+		}
+	}
+
+	return tg
+}
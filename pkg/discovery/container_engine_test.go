@@ -0,0 +1,254 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeContainer struct {
+	id      string
+	name    string
+	pid     int
+	image   string
+	imageID string
+	labels  map[string]string
+}
+
+// fakeEngine serves the subset of the Docker Engine API that is used for discovery.
+type fakeEngine struct {
+	mtx        sync.Mutex
+	containers []fakeContainer
+	digests    map[string][]string
+	// failing are the IDs of the containers and images that can not be inspected.
+	failing map[string]bool
+}
+
+var apiVersionPrefix = regexp.MustCompile(`^/v[0-9.]+`)
+
+func (e *fakeEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	path := apiVersionPrefix.ReplaceAllString(r.URL.Path, "")
+	switch {
+	case path == "/_ping":
+		w.Header().Set("Api-Version", "1.43")
+		w.WriteHeader(http.StatusOK)
+	case path == "/containers/json":
+		list := []map[string]any{}
+		for _, c := range e.containers {
+			list = append(list, map[string]any{"Id": c.id, "Image": c.image, "Labels": c.labels})
+		}
+		json.NewEncoder(w).Encode(list) //nolint:errcheck
+	case strings.HasPrefix(path, "/containers/"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/json")
+		if e.failing[id] {
+			http.Error(w, `{"message":"internal error"}`, http.StatusInternalServerError)
+			return
+		}
+		for _, c := range e.containers {
+			if c.id == id {
+				json.NewEncoder(w).Encode(map[string]any{ //nolint:errcheck
+					"Id":     c.id,
+					"Name":   "/" + c.name,
+					"Image":  c.imageID,
+					"State":  map[string]any{"Running": true, "Pid": c.pid},
+					"Config": map[string]any{"Image": c.image, "Labels": c.labels},
+				})
+				return
+			}
+		}
+		http.Error(w, `{"message":"no such container"}`, http.StatusNotFound)
+	case strings.HasPrefix(path, "/images/"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/json")
+		if e.failing[id] {
+			http.Error(w, `{"message":"internal error"}`, http.StatusInternalServerError)
+			return
+		}
+		digests, ok := e.digests[id]
+		if !ok {
+			http.Error(w, `{"message":"no such image"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"Id": id, "RepoDigests": digests}) //nolint:errcheck
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (e *fakeEngine) setContainers(containers ...fakeContainer) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	e.containers = containers
+}
+
+func newFakeEngine(t *testing.T, e *fakeEngine) string {
+	t.Helper()
+
+	socketPath := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	s := httptest.NewUnstartedServer(e)
+	s.Listener = l
+	s.Start()
+	t.Cleanup(s.Close)
+
+	return socketPath
+}
+
+func TestContainerEngineDiscoverer(t *testing.T) {
+	engine := &fakeEngine{
+		digests: map[string][]string{
+			"sha256:web": {"registry.example.com/web@sha256:0123"},
+			"sha256:db":  {},
+		},
+	}
+	c1 := fakeContainer{
+		id:      "c1",
+		name:    "shop-web-1",
+		pid:     100,
+		image:   "registry.example.com/web:v1",
+		imageID: "sha256:web",
+		labels: map[string]string{
+			"com.docker.compose.project": "shop",
+			"com.docker.compose.service": "web",
+			"org.example.team":           "payments",
+			"org.example.secret":         "hidden",
+		},
+	}
+	c2 := fakeContainer{
+		id:      "c2",
+		name:    "db",
+		pid:     200,
+		image:   "postgres:15",
+		imageID: "sha256:db",
+	}
+	engine.setContainers(c1, c2)
+	socketPath := newFakeEngine(t, engine)
+
+	cfg := NewContainerEngineConfig("docker", socketPath, []string{"org.example.team"})
+	d, err := cfg.NewDiscoverer(DiscovererOptions{Logger: log.NewNopLogger()})
+	require.NoError(t, err)
+	discoverer := d.(*ContainerEngineDiscoverer)
+
+	ctx := context.Background()
+	groups, err := discoverer.update(ctx)
+	require.NoError(t, err)
+	require.Len(t, groups, 2)
+
+	bySource := map[string]*MultiTargetGroup{}
+	for _, g := range groups {
+		bySource[g.Source()] = g.(*MultiTargetGroup)
+	}
+	require.Equal(t, model.LabelSet{
+		"container_engine_name":            "shop-web-1",
+		"containerid":                      "c1",
+		"container_image":                  "registry.example.com/web:v1",
+		"container_image_digest":           "sha256:0123",
+		"compose_project":                  "shop",
+		"compose_service":                  "web",
+		"container_label_org_example_team": "payments",
+	}, bySource["docker/c1"].Labels())
+	require.Equal(t, map[int]model.LabelSet{100: {}}, bySource["docker/c1"].Targets)
+	require.Equal(t, model.LabelSet{
+		"container_engine_name": "db",
+		"containerid":           "c2",
+		"container_image":       "postgres:15",
+	}, bySource["docker/c2"].Labels())
+
+	// Unchanged containers are not sent again.
+	groups, err = discoverer.update(ctx)
+	require.NoError(t, err)
+	require.Empty(t, groups)
+
+	// Stopped containers are sent as empty groups.
+	engine.setContainers(c2)
+	groups, err = discoverer.update(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []Group{&MultiTargetGroup{source: "docker/c1"}}, groups)
+}
+
+func TestContainerEngineDiscovererFailingContainers(t *testing.T) {
+	engine := &fakeEngine{
+		digests: map[string][]string{"sha256:db": {}},
+		failing: map[string]bool{"c1": true, "sha256:web": true},
+	}
+	engine.setContainers(
+		fakeContainer{id: "c1", name: "broken", pid: 100, image: "postgres:15", imageID: "sha256:db"},
+		fakeContainer{id: "c2", name: "web", pid: 200, image: "web:v1", imageID: "sha256:web"},
+		fakeContainer{id: "c3", name: "db", pid: 300, image: "postgres:15", imageID: "sha256:db"},
+	)
+	socketPath := newFakeEngine(t, engine)
+
+	cfg := NewContainerEngineConfig("docker", socketPath, nil)
+	d, err := cfg.NewDiscoverer(DiscovererOptions{Logger: log.NewNopLogger()})
+	require.NoError(t, err)
+
+	// The container that can not be inspected is skipped, the one whose image
+	// can not be inspected has no digest.
+	groups, err := d.(*ContainerEngineDiscoverer).update(context.Background())
+	require.NoError(t, err)
+	sources := map[string]model.LabelSet{}
+	for _, g := range groups {
+		sources[g.Source()] = g.Labels()
+	}
+	require.Equal(t, map[string]model.LabelSet{
+		"docker/c2": {"container_engine_name": "web", "containerid": "c2", "container_image": "web:v1"},
+		"docker/c3": {"container_engine_name": "db", "containerid": "c3", "container_image": "postgres:15"},
+	}, sources)
+
+	// A known container that can not be inspected anymore, but is still
+	// running, keeps its group.
+	engine.mtx.Lock()
+	engine.failing["c3"] = true
+	engine.mtx.Unlock()
+	groups, err = d.(*ContainerEngineDiscoverer).update(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, groups)
+	require.Contains(t, d.(*ContainerEngineDiscoverer).groups, "docker/c3")
+
+	// It is stopped once it is no longer listed.
+	engine.setContainers(
+		fakeContainer{id: "c2", name: "web", pid: 200, image: "web:v1", imageID: "sha256:web"},
+	)
+	groups, err = d.(*ContainerEngineDiscoverer).update(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []Group{&MultiTargetGroup{source: "docker/c3"}}, groups)
+}
+
+func TestContainerEngineConfigMissingSocket(t *testing.T) {
+	cfg := NewContainerEngineConfig("podman", filepath.Join(t.TempDir(), "podman.sock"), nil)
+	_, err := cfg.NewDiscoverer(DiscovererOptions{Logger: log.NewNopLogger()})
+	require.Error(t, err)
+
+	cfg = NewContainerEngineConfig("podman", "", nil)
+	_, err = cfg.NewDiscoverer(DiscovererOptions{Logger: log.NewNopLogger()})
+	require.Error(t, err)
+}
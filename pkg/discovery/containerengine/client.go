@@ -0,0 +1,160 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package containerengine talks to the Docker Engine API of Docker and Podman
+// (the latter through its Docker compatible API) to discover running containers.
+package containerengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+const DefaultTimeout = 2 * time.Second
+
+// Container is a running container.
+type Container struct {
+	ID   string
+	Name string
+	// PID is the process ID of the container's init process in the host PID
+	// namespace, 0 if the container could not be inspected.
+	PID int
+	// Image is the image reference the container was created from.
+	Image string
+	// ImageDigest is the registry digest of the image, empty for images that were never pushed or pulled.
+	ImageDigest string
+	Labels      map[string]string
+}
+
+type Client struct {
+	client *client.Client
+
+	mtx *sync.Mutex
+	// imageDigests caches the registry digests by image ID, images are immutable.
+	imageDigests map[string]string
+}
+
+// New creates a client for the Engine API listening on the given unix socket.
+func New(socketPath string) (*Client, error) {
+	cli, err := client.NewClientWithOpts(
+		client.WithHost("unix://"+socketPath),
+		client.WithAPIVersionNegotiation(),
+		client.WithDialContext(func(ctx context.Context, _, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: DefaultTimeout}
+			return d.DialContext(ctx, "unix", socketPath)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		client:       cli,
+		mtx:          &sync.Mutex{},
+		imageDigests: map[string]string{},
+	}, nil
+}
+
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+// Containers returns all running containers. Containers that can not be
+// inspected only have an ID and no PID, and containers whose image can not be
+// inspected have no digest, both are reported in the returned error next to
+// the other containers. The containers are nil if they can not be listed.
+func (c *Client) Containers(ctx context.Context) ([]Container, error) {
+	list, err := c.client.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	var errs error
+	containers := make([]Container, 0, len(list))
+	for _, l := range list {
+		// The PID is only part of the inspect response.
+		info, err := c.client.ContainerInspect(ctx, l.ID)
+		if err != nil {
+			if client.IsErrNotFound(err) {
+				// The container has been removed in the meantime.
+				continue
+			}
+			errs = errors.Join(errs, fmt.Errorf("failed to inspect container %s: %w", l.ID, err))
+			containers = append(containers, Container{ID: l.ID})
+			continue
+		}
+		if info.State == nil || !info.State.Running || info.State.Pid == 0 {
+			continue
+		}
+
+		digest, err := c.imageDigest(ctx, info.Image)
+		if err != nil {
+			errs = errors.Join(errs, err)
+		}
+
+		ctr := Container{
+			ID:          info.ID,
+			Name:        strings.TrimPrefix(info.Name, "/"),
+			PID:         info.State.Pid,
+			Image:       l.Image,
+			ImageDigest: digest,
+			Labels:      l.Labels,
+		}
+		if info.Config != nil {
+			ctr.Image = info.Config.Image
+			ctr.Labels = info.Config.Labels
+		}
+		containers = append(containers, ctr)
+	}
+
+	return containers, errs
+}
+
+func (c *Client) imageDigest(ctx context.Context, imageID string) (string, error) {
+	c.mtx.Lock()
+	digest, ok := c.imageDigests[imageID]
+	c.mtx.Unlock()
+	if ok {
+		return digest, nil
+	}
+
+	image, _, err := c.client.ImageInspectWithRaw(ctx, imageID)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to inspect image %s: %w", imageID, err)
+	}
+
+	// RepoDigests are in the form of <repository>@<digest>.
+	for _, d := range image.RepoDigests {
+		if _, after, found := strings.Cut(d, "@"); found {
+			digest = after
+			break
+		}
+	}
+
+	c.mtx.Lock()
+	c.imageDigests[imageID] = digest
+	c.mtx.Unlock()
+
+	return digest, nil
+}
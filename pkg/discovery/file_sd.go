@@ -0,0 +1,183 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// DefaultFileRefreshInterval is how often the files are re-read if no change was noticed.
+const DefaultFileRefreshInterval = 5 * time.Minute
+
+// FileConfig discovers targets listed in JSON or YAML files.
+type FileConfig struct {
+	files           []string
+	refreshInterval time.Duration
+}
+
+// NewFileConfig creates a config that reads the target groups from the files
+// matching the given glob patterns. The files are watched for changes and
+// re-read every refresh interval.
+func NewFileConfig(files []string, refreshInterval time.Duration) *FileConfig {
+	if refreshInterval <= 0 {
+		refreshInterval = DefaultFileRefreshInterval
+	}
+	return &FileConfig{
+		files:           files,
+		refreshInterval: refreshInterval,
+	}
+}
+
+func (c *FileConfig) Name() string {
+	return "file"
+}
+
+func (c *FileConfig) NewDiscoverer(d DiscovererOptions) (Discoverer, error) {
+	resolver, err := newStaticTargetResolver()
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileDiscoverer{
+		logger:          d.Logger,
+		patterns:        c.files,
+		refreshInterval: c.refreshInterval,
+		resolver:        resolver,
+		targets:         map[string][]*StaticTargetGroup{},
+	}, nil
+}
+
+type FileDiscoverer struct {
+	logger          log.Logger
+	patterns        []string
+	refreshInterval time.Duration
+
+	resolver *staticTargetResolver
+	// targets are the target groups by file.
+	targets map[string][]*StaticTargetGroup
+}
+
+func (d *FileDiscoverer) Run(ctx context.Context, up chan<- []Group) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create file watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	// Watch the directories, files matching the patterns can be created at any time.
+	for _, p := range d.patterns {
+		dir := filepath.Dir(p)
+		if err := watcher.Add(dir); err != nil {
+			level.Warn(d.logger).Log("msg", "failed to watch directory", "dir", dir, "err", err)
+		}
+	}
+
+	refresh := time.NewTicker(d.refreshInterval)
+	defer refresh.Stop()
+	resolve := time.NewTicker(processResolveInterval)
+	defer resolve.Stop()
+
+	removed := d.refresh()
+	for {
+		groups := removed
+		for file, tgs := range d.targets {
+			update, err := d.resolver.resolve(file, tgs)
+			if err != nil {
+				level.Warn(d.logger).Log("msg", "failed to resolve targets", "file", file, "err", err)
+				continue
+			}
+			groups = append(groups, update...)
+		}
+		if len(groups) > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case up <- groups:
+			}
+		}
+
+		removed = nil
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event := <-watcher.Events:
+			if d.matches(event.Name) {
+				removed = d.refresh()
+			}
+		case err := <-watcher.Errors:
+			level.Warn(d.logger).Log("msg", "file watcher error", "err", err)
+		case <-refresh.C:
+			removed = d.refresh()
+		case <-resolve.C:
+		}
+	}
+}
+
+// matches returns whether the file matches one of the patterns.
+func (d *FileDiscoverer) matches(file string) bool {
+	for _, p := range d.patterns {
+		if ok, _ := filepath.Match(p, file); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// refresh re-reads the files and returns empty groups for the files that are gone.
+// Files that fail to parse keep their previous targets.
+func (d *FileDiscoverer) refresh() []Group {
+	seen := map[string]struct{}{}
+	for _, p := range d.patterns {
+		files, err := filepath.Glob(p)
+		if err != nil {
+			level.Warn(d.logger).Log("msg", "invalid file pattern", "pattern", p, "err", err)
+			continue
+		}
+		for _, file := range files {
+			seen[file] = struct{}{}
+
+			content, err := os.ReadFile(file)
+			if err != nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					level.Warn(d.logger).Log("msg", "failed to read targets file", "file", file, "err", err)
+				}
+				continue
+			}
+			tgs, err := ParseStaticTargetGroups(content)
+			if err != nil {
+				level.Warn(d.logger).Log("msg", "failed to parse targets file", "file", file, "err", err)
+				continue
+			}
+			d.targets[file] = tgs
+		}
+	}
+
+	var removed []Group
+	for file := range d.targets {
+		if _, ok := seen[file]; !ok {
+			delete(d.targets, file)
+			removed = append(removed, d.resolver.remove(file)...)
+		}
+	}
+	return removed
+}
@@ -0,0 +1,143 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	// DefaultHTTPRefreshInterval is how often the targets are fetched.
+	DefaultHTTPRefreshInterval = time.Minute
+
+	httpTimeout     = 10 * time.Second
+	httpMaxBodySize = 10 << 20
+)
+
+// HTTPConfig discovers targets by polling an HTTP endpoint that returns
+// the target groups in the same format as the files of file based discovery.
+type HTTPConfig struct {
+	url             string
+	refreshInterval time.Duration
+}
+
+func NewHTTPConfig(url string, refreshInterval time.Duration) *HTTPConfig {
+	if refreshInterval <= 0 {
+		refreshInterval = DefaultHTTPRefreshInterval
+	}
+	return &HTTPConfig{
+		url:             url,
+		refreshInterval: refreshInterval,
+	}
+}
+
+func (c *HTTPConfig) Name() string {
+	return "http"
+}
+
+func (c *HTTPConfig) NewDiscoverer(d DiscovererOptions) (Discoverer, error) {
+	resolver, err := newStaticTargetResolver()
+	if err != nil {
+		return nil, err
+	}
+
+	return &HTTPDiscoverer{
+		logger:          d.Logger,
+		url:             c.url,
+		refreshInterval: c.refreshInterval,
+		client:          &http.Client{Timeout: httpTimeout},
+		resolver:        resolver,
+	}, nil
+}
+
+type HTTPDiscoverer struct {
+	logger          log.Logger
+	url             string
+	refreshInterval time.Duration
+
+	client   *http.Client
+	resolver *staticTargetResolver
+	targets  []*StaticTargetGroup
+}
+
+func (d *HTTPDiscoverer) Run(ctx context.Context, up chan<- []Group) error {
+	refresh := time.NewTicker(d.refreshInterval)
+	defer refresh.Stop()
+	resolve := time.NewTicker(processResolveInterval)
+	defer resolve.Stop()
+
+	d.refresh(ctx)
+	for {
+		groups, err := d.resolver.resolve(d.url, d.targets)
+		if err != nil {
+			level.Warn(d.logger).Log("msg", "failed to resolve targets", "url", d.url, "err", err)
+		}
+		if len(groups) > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case up <- groups:
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-refresh.C:
+			d.refresh(ctx)
+		case <-resolve.C:
+		}
+	}
+}
+
+// refresh fetches the target groups, the previous ones are kept if that fails.
+func (d *HTTPDiscoverer) refresh(ctx context.Context) {
+	tgs, err := d.fetch(ctx)
+	if err != nil {
+		level.Warn(d.logger).Log("msg", "failed to fetch targets", "url", d.url, "err", err)
+		return
+	}
+	d.targets = tgs
+}
+
+func (d *HTTPDiscoverer) fetch(ctx context.Context) ([]*StaticTargetGroup, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json, application/yaml")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, httpMaxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	return ParseStaticTargetGroups(content)
+}
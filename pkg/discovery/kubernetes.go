@@ -37,6 +37,8 @@ type PodDiscoverer struct {
 	createdChan chan *v1.Pod
 	deletedChan chan string
 	k8sClient   *kubernetes.Client
+	owners      *kubernetes.OwnerResolver
+	nodeLabels  model.LabelSet
 }
 
 func (c *PodConfig) Name() string {
@@ -69,6 +71,8 @@ func (c *PodConfig) NewDiscoverer(d DiscovererOptions) (Discoverer, error) {
 		createdChan: createdChan,
 		deletedChan: deletedChan,
 		k8sClient:   k8sClient,
+		owners:      kubernetes.NewOwnerResolver(k8sClient.Clientset()),
+		nodeLabels:  nodeLabels(c.nodeName, k8sClient.NodeLabels()),
 	}
 	return g, nil
 }
@@ -76,12 +80,13 @@ func (c *PodConfig) NewDiscoverer(d DiscovererOptions) (Discoverer, error) {
 func (g *PodDiscoverer) Run(ctx context.Context, up chan<- []Group) error {
 	defer g.podInformer.Stop()
 	defer g.k8sClient.Close()
-
+	defer g.owners.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case key := <-g.deletedChan:
+			g.owners.Forget(key)
 			// Prefix key with "pod/" to create identical key as podSourceFromNamespaceAndName()
 			groups := []Group{&MultiTargetGroup{source: "pod/" + key}}
 			select {
@@ -91,7 +96,7 @@ func (g *PodDiscoverer) Run(ctx context.Context, up chan<- []Group) error {
 			}
 		case pod := <-g.createdChan:
 			containers := g.k8sClient.PodToContainers(pod)
-			groups := []Group{g.buildGroup(pod, containers)}
+			groups := []Group{g.buildGroup(ctx, pod, containers)}
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
@@ -101,7 +106,7 @@ func (g *PodDiscoverer) Run(ctx context.Context, up chan<- []Group) error {
 	}
 }
 
-func (g *PodDiscoverer) buildGroup(pod *v1.Pod, containers []*kubernetes.ContainerDefinition) *MultiTargetGroup {
+func (g *PodDiscoverer) buildGroup(ctx context.Context, pod *v1.Pod, containers []*kubernetes.ContainerDefinition) *MultiTargetGroup {
 	tg := &MultiTargetGroup{
 		source:  g.podSourceFromNamespaceAndName(pod.Namespace, pod.Name),
 		labels:  model.LabelSet{},
@@ -120,6 +125,13 @@ func (g *PodDiscoverer) buildGroup(pod *v1.Pod, containers []*kubernetes.Contain
 		tg.labels[model.LabelName(strutil.SanitizeLabelName(k))] = model.LabelValue(v)
 	}
 
+	if owner, ok := g.owners.Owner(ctx, pod); ok {
+		tg.labels["owner_kind"] = model.LabelValue(owner.Kind)
+		tg.labels["owner_name"] = model.LabelValue(owner.Name)
+	}
+
+	tg.labels = tg.labels.Merge(g.nodeLabels).Merge(podMetaLabels(pod))
+
 	for _, container := range containers {
 		tg.Targets[container.PID] = tg.Targets[container.PID].Merge(model.LabelSet{
 			"container":   model.LabelValue(container.ContainerName),
@@ -130,6 +142,56 @@ func (g *PodDiscoverer) buildGroup(pod *v1.Pod, containers []*kubernetes.Contain
 	return tg
 }
 
+// podMetaLabels returns the labels that are only available to relabel configs,
+// they are dropped after relabeling.
+func podMetaLabels(pod *v1.Pod) model.LabelSet {
+	ls := model.LabelSet{
+		model.MetaLabelPrefix + "kubernetes_namespace":     model.LabelValue(pod.Namespace),
+		model.MetaLabelPrefix + "kubernetes_pod_name":      model.LabelValue(pod.Name),
+		model.MetaLabelPrefix + "kubernetes_pod_uid":       model.LabelValue(pod.UID),
+		model.MetaLabelPrefix + "kubernetes_pod_node_name": model.LabelValue(pod.Spec.NodeName),
+	}
+	if controller, ok := kubernetes.Controller(pod); ok {
+		ls[model.MetaLabelPrefix+"kubernetes_pod_controller_kind"] = model.LabelValue(controller.Kind)
+		ls[model.MetaLabelPrefix+"kubernetes_pod_controller_name"] = model.LabelValue(controller.Name)
+	}
+	for k, v := range pod.Labels {
+		name := strutil.SanitizeLabelName(k)
+		ls[model.LabelName(model.MetaLabelPrefix+"kubernetes_pod_label_"+name)] = model.LabelValue(v)
+		ls[model.LabelName(model.MetaLabelPrefix+"kubernetes_pod_labelpresent_"+name)] = "true"
+	}
+	// The annotations also carry the settings of the pod, see TargetSettingsFromLabels.
+	for k, v := range pod.Annotations {
+		ls[podAnnotationLabel(k)] = model.LabelValue(v)
+		ls[model.LabelName(model.MetaLabelPrefix+"kubernetes_pod_annotationpresent_"+strutil.SanitizeLabelName(k))] = "true"
+	}
+	return ls
+}
+
+// nodeLabels returns the topology labels of the node and its labels as meta labels.
+func nodeLabels(nodeName string, labels map[string]string) model.LabelSet {
+	ls := model.LabelSet{
+		model.MetaLabelPrefix + "kubernetes_node_name": model.LabelValue(nodeName),
+	}
+	for k, v := range labels {
+		ls[model.LabelName(model.MetaLabelPrefix+"kubernetes_node_label_"+strutil.SanitizeLabelName(k))] = model.LabelValue(v)
+	}
+	// The deprecated beta labels are still set by some providers.
+	for name, keys := range map[model.LabelName][]string{
+		"zone":          {v1.LabelTopologyZone, v1.LabelFailureDomainBetaZone},
+		"region":        {v1.LabelTopologyRegion, v1.LabelFailureDomainBetaRegion},
+		"instance_type": {v1.LabelInstanceTypeStable, v1.LabelInstanceType},
+	} {
+		for _, k := range keys {
+			if v, ok := labels[k]; ok {
+				ls[name] = model.LabelValue(v)
+				break
+			}
+		}
+	}
+	return ls
+}
+
 func (g *PodDiscoverer) podSourceFromNamespaceAndName(namespace, name string) string {
 	return "pod/" + namespace + "/" + name
 }
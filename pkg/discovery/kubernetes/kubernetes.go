@@ -45,6 +45,7 @@ type Client struct {
 	nodeName      string
 	fieldSelector string
 	criClient     containerruntimes.CRIClient
+	nodeLabels    map[string]string
 }
 
 func NewKubernetesClient(logger log.Logger, nodeName, socketPath string) (*Client, error) {
@@ -89,6 +90,7 @@ func NewKubernetesClient(logger log.Logger, nodeName, socketPath string) (*Clien
 		nodeName:      nodeName,
 		fieldSelector: fieldSelector,
 		criClient:     criClient,
+		nodeLabels:    node.Labels,
 	}, nil
 }
 
@@ -96,6 +98,11 @@ func (c *Client) Clientset() kubernetes.Interface {
 	return c.clientset
 }
 
+// NodeLabels returns the labels of the node the agent is running on, as of when the client was created.
+func (c *Client) NodeLabels() map[string]string {
+	return c.nodeLabels
+}
+
 func newCRIClient(logger log.Logger, node *v1.Node, socketPath string) (containerruntimes.CRIClient, error) {
 	criVersion := node.Status.NodeInfo.ContainerRuntimeVersion
 	list := strings.Split(criVersion, "://")
@@ -0,0 +1,227 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appsv1listers "k8s.io/client-go/listers/apps/v1"
+	batchv1listers "k8s.io/client-go/listers/batch/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ownerSyncTimeout is how long resolving the owner of the first pod of a
+// namespace waits for its ReplicaSets and Jobs to be listed.
+const ownerSyncTimeout = 5 * time.Second
+
+// Owner is a controller that owns a pod, e.g. a Deployment or a CronJob.
+type Owner struct {
+	Kind string
+	Name string
+}
+
+// OwnerResolver resolves the workloads that own pods.
+// Pods that are created by a ReplicaSet or a Job are resolved to the Deployment
+// or the CronJob that created them, if any. The ReplicaSets and Jobs are only
+// watched in the namespaces of the pods of the node, and only their metadata
+// is kept.
+type OwnerResolver struct {
+	clientset kubernetes.Interface
+
+	mtx        sync.Mutex
+	namespaces map[string]*namespaceOwners
+}
+
+// namespaceOwners watches the ReplicaSets and Jobs of a namespace.
+type namespaceOwners struct {
+	factory     informers.SharedInformerFactory
+	replicaSets appsv1listers.ReplicaSetLister
+	jobs        batchv1listers.JobLister
+	synced      []cache.InformerSynced
+	stop        chan struct{}
+	// Pods of the namespace the owner was resolved for, by name.
+	pods map[string]struct{}
+}
+
+func NewOwnerResolver(clientset kubernetes.Interface) *OwnerResolver {
+	return &OwnerResolver{
+		clientset:  clientset,
+		namespaces: map[string]*namespaceOwners{},
+	}
+}
+
+// Controller returns the controller that directly owns the pod.
+func Controller(pod *v1.Pod) (Owner, bool) {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return Owner{}, false
+	}
+	return Owner{Kind: ref.Kind, Name: ref.Name}, true
+}
+
+// Owner returns the top-level controller of the pod.
+// It returns false if the pod is not controlled by anything.
+func (r *OwnerResolver) Owner(ctx context.Context, pod *v1.Pod) (Owner, bool) {
+	owner, ok := Controller(pod)
+	if !ok {
+		return Owner{}, false
+	}
+	if owner.Kind != "ReplicaSet" && owner.Kind != "Job" {
+		return owner, true
+	}
+
+	ns := r.watch(pod.Namespace, pod.Name)
+	if !ns.waitForCacheSync(ctx) {
+		return owner, true
+	}
+
+	var obj metav1.Object
+	var err error
+	switch owner.Kind {
+	case "ReplicaSet":
+		obj, err = ns.replicaSets.ReplicaSets(pod.Namespace).Get(owner.Name)
+	case "Job":
+		obj, err = ns.jobs.Jobs(pod.Namespace).Get(owner.Name)
+	}
+	if err != nil {
+		// The ReplicaSet or Job is not in the cache yet or has been deleted.
+		return owner, true
+	}
+	ref := metav1.GetControllerOf(obj)
+	if ref == nil {
+		return owner, true
+	}
+	return Owner{Kind: ref.Kind, Name: ref.Name}, true
+}
+
+// Forget drops the pod with the given namespace/name key. The ReplicaSets and
+// Jobs of its namespace are not watched anymore once it has no pods left.
+func (r *OwnerResolver) Forget(key string) {
+	namespace, name, ok := strings.Cut(key, "/")
+	if !ok {
+		return
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	ns, ok := r.namespaces[namespace]
+	if !ok {
+		return
+	}
+	delete(ns.pods, name)
+	if len(ns.pods) == 0 {
+		ns.shutdown()
+		delete(r.namespaces, namespace)
+	}
+}
+
+// Stop stops watching all namespaces.
+func (r *OwnerResolver) Stop() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for namespace, ns := range r.namespaces {
+		ns.shutdown()
+		delete(r.namespaces, namespace)
+	}
+}
+
+// watch returns the watcher of the namespace of the pod, it is started
+// for the first pod of the namespace.
+func (r *OwnerResolver) watch(namespace, pod string) *namespaceOwners {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	ns, ok := r.namespaces[namespace]
+	if !ok {
+		ns = newNamespaceOwners(r.clientset, namespace)
+		r.namespaces[namespace] = ns
+	}
+	ns.pods[pod] = struct{}{}
+	return ns
+}
+
+func newNamespaceOwners(clientset kubernetes.Interface, namespace string) *namespaceOwners {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(namespace))
+	replicaSets := factory.Apps().V1().ReplicaSets()
+	jobs := factory.Batch().V1().Jobs()
+	// Only the owners are needed, the rest of the objects is not kept.
+	// The transform can only fail once the informers are started.
+	_ = replicaSets.Informer().SetTransform(ownerMeta)
+	_ = jobs.Informer().SetTransform(ownerMeta)
+
+	// Requesting the listers registers the informers with the factory, this must happen before it is started.
+	ns := &namespaceOwners{
+		factory:     factory,
+		replicaSets: replicaSets.Lister(),
+		jobs:        jobs.Lister(),
+		synced:      []cache.InformerSynced{replicaSets.Informer().HasSynced, jobs.Informer().HasSynced},
+		stop:        make(chan struct{}),
+		pods:        map[string]struct{}{},
+	}
+	factory.Start(ns.stop)
+	return ns
+}
+
+// waitForCacheSync blocks until the ReplicaSets and Jobs of the namespace have
+// been listed, or for up to ownerSyncTimeout. It returns whether they were.
+func (ns *namespaceOwners) waitForCacheSync(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, ownerSyncTimeout)
+	defer cancel()
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-ns.stop:
+		}
+		close(stop)
+	}()
+	return cache.WaitForCacheSync(stop, ns.synced...)
+}
+
+func (ns *namespaceOwners) shutdown() {
+	close(ns.stop)
+	ns.factory.Shutdown()
+}
+
+// ownerMeta strips the ReplicaSets and Jobs down to the metadata used to
+// resolve the owners.
+func ownerMeta(obj any) (any, error) {
+	meta := func(m metav1.ObjectMeta) metav1.ObjectMeta {
+		return metav1.ObjectMeta{
+			Namespace:       m.Namespace,
+			Name:            m.Name,
+			ResourceVersion: m.ResourceVersion,
+			OwnerReferences: m.OwnerReferences,
+		}
+	}
+	switch o := obj.(type) {
+	case *appsv1.ReplicaSet:
+		return &appsv1.ReplicaSet{ObjectMeta: meta(o.ObjectMeta)}, nil
+	case *batchv1.Job:
+		return &batchv1.Job{ObjectMeta: meta(o.ObjectMeta)}, nil
+	}
+	return obj, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func controlledBy(kind, name string) []metav1.OwnerReference {
+	controller := true
+	return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+}
+
+func TestOwnerResolver(t *testing.T) {
+	// The API server only knows these objects.
+	lists := map[string]any{
+		"/apis/apps/v1/namespaces/shop/replicasets": &appsv1.ReplicaSetList{Items: []appsv1.ReplicaSet{
+			{ObjectMeta: metav1.ObjectMeta{
+				Namespace:       "shop",
+				Name:            "checkout-5d4f8",
+				OwnerReferences: controlledBy("Deployment", "checkout"),
+				Labels:          map[string]string{"app": "checkout"},
+			}},
+			{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "shop",
+				Name:      "standalone",
+			}},
+		}},
+		"/apis/batch/v1/namespaces/shop/jobs": &batchv1.JobList{Items: []batchv1.Job{
+			{ObjectMeta: metav1.ObjectMeta{
+				Namespace:       "shop",
+				Name:            "report-28145",
+				OwnerReferences: controlledBy("CronJob", "report"),
+			}},
+		}},
+	}
+	var (
+		mtx    sync.Mutex
+		listed = map[string]int{}
+	)
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "true" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-done:
+			}
+			return
+		}
+
+		mtx.Lock()
+		listed[r.URL.Path]++
+		mtx.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		list, ok := lists[r.URL.Path]
+		if !ok {
+			list = &metav1.List{}
+		}
+		json.NewEncoder(w).Encode(list) //nolint:errcheck
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(done) })
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	require.NoError(t, err)
+	r := NewOwnerResolver(clientset)
+	t.Cleanup(r.Stop)
+
+	for _, tc := range []struct {
+		name   string
+		owners []metav1.OwnerReference
+		owner  Owner
+		ok     bool
+	}{
+		{name: "deployment", owners: controlledBy("ReplicaSet", "checkout-5d4f8"), owner: Owner{"Deployment", "checkout"}, ok: true},
+		{name: "replicaset", owners: controlledBy("ReplicaSet", "standalone"), owner: Owner{"ReplicaSet", "standalone"}, ok: true},
+		{name: "unknown replicaset", owners: controlledBy("ReplicaSet", "missing"), owner: Owner{"ReplicaSet", "missing"}, ok: true},
+		{name: "cronjob", owners: controlledBy("Job", "report-28145"), owner: Owner{"CronJob", "report"}, ok: true},
+		{name: "statefulset", owners: controlledBy("StatefulSet", "db"), owner: Owner{"StatefulSet", "db"}, ok: true},
+		{name: "bare pod"},
+	} {
+		pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "shop",
+			Name:            tc.name,
+			OwnerReferences: tc.owners,
+		}}
+		owner, ok := r.Owner(context.Background(), pod)
+		require.Equal(t, tc.ok, ok, tc.name)
+		require.Equal(t, tc.owner, owner, tc.name)
+	}
+
+	// Only the namespace of the pods is watched, it is listed once.
+	mtx.Lock()
+	require.Equal(t, map[string]int{
+		"/apis/apps/v1/namespaces/shop/replicasets": 1,
+		"/apis/batch/v1/namespaces/shop/jobs":       1,
+	}, listed)
+	mtx.Unlock()
+
+	// Only the metadata used to resolve the owners is kept.
+	rs, err := r.namespaces["shop"].replicaSets.ReplicaSets("shop").Get("checkout-5d4f8")
+	require.NoError(t, err)
+	require.Empty(t, rs.Labels)
+
+	// The namespace is not watched anymore once all of its pods are gone.
+	for _, name := range []string{"deployment", "replicaset", "unknown replicaset", "cronjob"} {
+		require.Contains(t, r.namespaces, "shop")
+		r.Forget("shop/" + name)
+	}
+	require.NotContains(t, r.namespaces, "shop")
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodMetaLabels(t *testing.T) {
+	controller := true
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "shop",
+			Name:            "checkout-5d4f8-x2x7q",
+			UID:             "6f1c",
+			Labels:          map[string]string{"app.kubernetes.io/name": "checkout"},
+			Annotations:     map[string]string{"example.com/team": "payments"},
+			OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "checkout-5d4f8", Controller: &controller}},
+		},
+		Spec: v1.PodSpec{NodeName: "node-a"},
+	}
+
+	require.Equal(t, model.LabelSet{
+		"__meta_kubernetes_namespace":                               "shop",
+		"__meta_kubernetes_pod_name":                                "checkout-5d4f8-x2x7q",
+		"__meta_kubernetes_pod_uid":                                 "6f1c",
+		"__meta_kubernetes_pod_node_name":                           "node-a",
+		"__meta_kubernetes_pod_controller_kind":                     "ReplicaSet",
+		"__meta_kubernetes_pod_controller_name":                     "checkout-5d4f8",
+		"__meta_kubernetes_pod_label_app_kubernetes_io_name":        "checkout",
+		"__meta_kubernetes_pod_labelpresent_app_kubernetes_io_name": "true",
+		"__meta_kubernetes_pod_annotation_example_com_team":         "payments",
+		"__meta_kubernetes_pod_annotationpresent_example_com_team":  "true",
+	}, podMetaLabels(pod))
+}
+
+func TestNodeLabels(t *testing.T) {
+	require.Equal(t, model.LabelSet{
+		"__meta_kubernetes_node_name":                                   "node-a",
+		"__meta_kubernetes_node_label_topology_kubernetes_io_zone":      "eu-west-1a",
+		"__meta_kubernetes_node_label_beta_kubernetes_io_instance_type": "m5.large",
+		"zone":          "eu-west-1a",
+		"instance_type": "m5.large",
+	}, nodeLabels("node-a", map[string]string{
+		"topology.kubernetes.io/zone":      "eu-west-1a",
+		"beta.kubernetes.io/instance-type": "m5.large",
+	}))
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/util/strutil"
+)
+
+// Pod annotations that let the owners of a workload choose how it is profiled.
+const (
+	// AnnotationProfile opts the pod out of profiling when set to "false".
+	AnnotationProfile = "parca.dev/profile"
+	// AnnotationSamplingFrequency lowers the CPU sampling frequency of the pod, e.g. "9".
+	AnnotationSamplingFrequency = "parca.dev/sampling-frequency"
+	// AnnotationProfilers is a comma separated list of the profilers enabled for the pod, e.g. "cpu,offcpu".
+	AnnotationProfilers = "parca.dev/profilers"
+	// AnnotationDebuginfoUpload disables the debuginfo upload of the pod's binaries when set to "false".
+	AnnotationDebuginfoUpload = "parca.dev/debuginfo-upload"
+)
+
+// TargetSettings are the profiling settings a target asked for.
+type TargetSettings struct {
+	// Profile is false if the target opted out of profiling.
+	Profile bool
+	// SamplingFrequency is the CPU sampling frequency the target asked for, 0 uses the agent's frequency.
+	SamplingFrequency uint64
+	// Profilers are the profilers enabled for the target, nil enables all of them.
+	Profilers []string
+	// DebuginfoUpload is false if the debuginfo of the target must not be uploaded.
+	DebuginfoUpload bool
+}
+
+// DefaultTargetSettings are used for targets that do not ask for anything.
+var DefaultTargetSettings = TargetSettings{
+	Profile:         true,
+	DebuginfoUpload: true,
+}
+
+// ProfilerEnabled returns whether the profiler with the given name, e.g. "cpu", is enabled for the target.
+func (s TargetSettings) ProfilerEnabled(name string) bool {
+	if s.Profilers == nil {
+		return true
+	}
+	for _, p := range s.Profilers {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// podAnnotationLabel returns the meta label that holds the value of the pod annotation.
+func podAnnotationLabel(annotation string) model.LabelName {
+	return model.LabelName(model.MetaLabelPrefix + "kubernetes_pod_annotation_" + strutil.SanitizeLabelName(annotation))
+}
+
+// TargetSettingsFromLabels returns the settings of a target from its discovered labels.
+// Invalid settings are reported in the error and replaced by their defaults.
+func TargetSettingsFromLabels(lset model.LabelSet) (TargetSettings, error) {
+	s := DefaultTargetSettings
+
+	var errs error
+	parseBool := func(annotation string, dst *bool) {
+		v, ok := lset[podAnnotationLabel(annotation)]
+		if !ok {
+			return
+		}
+		b, err := strconv.ParseBool(string(v))
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("invalid %s annotation %q: %w", annotation, v, err))
+			return
+		}
+		*dst = b
+	}
+	parseBool(AnnotationProfile, &s.Profile)
+	parseBool(AnnotationDebuginfoUpload, &s.DebuginfoUpload)
+
+	if v, ok := lset[podAnnotationLabel(AnnotationSamplingFrequency)]; ok {
+		f, err := strconv.ParseUint(string(v), 10, 64)
+		if err != nil || f == 0 {
+			errs = errors.Join(errs, fmt.Errorf("invalid %s annotation %q, must be a positive integer", AnnotationSamplingFrequency, v))
+		} else {
+			s.SamplingFrequency = f
+		}
+	}
+
+	if v, ok := lset[podAnnotationLabel(AnnotationProfilers)]; ok {
+		s.Profilers = []string{}
+		for _, p := range strings.Split(string(v), ",") {
+			if p = strings.ToLower(strings.TrimSpace(p)); p != "" {
+				s.Profilers = append(s.Profilers, p)
+			}
+		}
+	}
+
+	return s, errs
+}
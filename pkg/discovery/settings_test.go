@@ -0,0 +1,56 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTargetSettingsFromLabels(t *testing.T) {
+	s, err := TargetSettingsFromLabels(model.LabelSet{"namespace": "shop"})
+	require.NoError(t, err)
+	require.Equal(t, DefaultTargetSettings, s)
+	require.True(t, s.ProfilerEnabled("cpu"))
+
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		AnnotationProfile:           "true",
+		AnnotationSamplingFrequency: "9",
+		AnnotationProfilers:         "CPU, offcpu",
+		AnnotationDebuginfoUpload:   "false",
+	}}}
+	s, err = TargetSettingsFromLabels(podMetaLabels(pod))
+	require.NoError(t, err)
+	require.Equal(t, TargetSettings{
+		Profile:           true,
+		SamplingFrequency: 9,
+		Profilers:         []string{"cpu", "offcpu"},
+		DebuginfoUpload:   false,
+	}, s)
+	require.True(t, s.ProfilerEnabled("cpu"))
+	require.False(t, s.ProfilerEnabled("memory"))
+
+	pod.Annotations = map[string]string{
+		AnnotationProfile:           "no",
+		AnnotationSamplingFrequency: "0",
+		AnnotationDebuginfoUpload:   "false",
+	}
+	s, err = TargetSettingsFromLabels(podMetaLabels(pod))
+	require.Error(t, err)
+	require.Equal(t, TargetSettings{Profile: true}, s)
+}
@@ -0,0 +1,228 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/procfs"
+	"gopkg.in/yaml.v3"
+)
+
+// processResolveInterval is how often the processes matching the selectors
+// of file and HTTP based targets are looked up.
+const processResolveInterval = 5 * time.Second
+
+// ProcessSelector selects processes on the host.
+// All the fields that are set must match.
+type ProcessSelector struct {
+	// Exe is a glob matched against the path of the executable, e.g. "/usr/bin/postgres*".
+	Exe string `yaml:"exe,omitempty"`
+	// Comm is a regex matched against the comm of the process.
+	Comm string `yaml:"comm,omitempty"`
+	// Cgroup selects the processes in the cgroup or below it, e.g. "/system.slice/nginx.service".
+	Cgroup string `yaml:"cgroup,omitempty"`
+	// PIDFile is the path to a file holding the PID of the process.
+	PIDFile string `yaml:"pid_file,omitempty"`
+
+	comm *regexp.Regexp
+}
+
+// StaticTargetGroup is a set of process selectors sharing the same labels,
+// as listed in the files of file based discovery or returned by HTTP based discovery.
+type StaticTargetGroup struct {
+	Targets []*ProcessSelector `yaml:"targets"`
+	Labels  map[string]string  `yaml:"labels,omitempty"`
+}
+
+// ParseStaticTargetGroups parses a JSON or YAML list of target groups.
+func ParseStaticTargetGroups(content []byte) ([]*StaticTargetGroup, error) {
+	var groups []*StaticTargetGroup
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return nil, err
+	}
+
+	for i, g := range groups {
+		if g == nil {
+			return nil, fmt.Errorf("empty target group at index %d", i)
+		}
+		for name := range g.Labels {
+			if !model.LabelName(name).IsValid() {
+				return nil, fmt.Errorf("target group at index %d: invalid label name %q", i, name)
+			}
+		}
+		for j, s := range g.Targets {
+			if s == nil || (s.Exe == "" && s.Comm == "" && s.Cgroup == "" && s.PIDFile == "") {
+				return nil, fmt.Errorf("target group at index %d: empty target at index %d", i, j)
+			}
+			if s.Exe != "" {
+				if _, err := filepath.Match(s.Exe, ""); err != nil {
+					return nil, fmt.Errorf("target group at index %d: invalid exe glob %q: %w", i, s.Exe, err)
+				}
+			}
+			if s.Comm != "" {
+				re, err := regexp.Compile("^(?:" + s.Comm + ")$")
+				if err != nil {
+					return nil, fmt.Errorf("target group at index %d: invalid comm regex %q: %w", i, s.Comm, err)
+				}
+				s.comm = re
+			}
+		}
+	}
+	return groups, nil
+}
+
+// staticTargetResolver turns static target groups into groups of the matching processes.
+// It remembers the groups it returned last, so that only changes are sent.
+type staticTargetResolver struct {
+	fs     procfs.FS
+	groups map[string]*MultiTargetGroup
+}
+
+func newStaticTargetResolver() (*staticTargetResolver, error) {
+	fs, err := procfs.NewDefaultFS()
+	if err != nil {
+		return nil, err
+	}
+	return &staticTargetResolver{fs: fs, groups: map[string]*MultiTargetGroup{}}, nil
+}
+
+// resolve returns the groups that changed since the last call.
+// The sources of the groups are prefixed with the given source.
+func (r *staticTargetResolver) resolve(source string, tgs []*StaticTargetGroup) ([]Group, error) {
+	procs, err := r.fs.AllProcs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list processes: %w", err)
+	}
+
+	recent := make(map[string]*MultiTargetGroup, len(tgs))
+	for i, tg := range tgs {
+		g := &MultiTargetGroup{
+			source:  source + "/" + strconv.Itoa(i),
+			labels:  make(model.LabelSet, len(tg.Labels)),
+			Targets: map[int]model.LabelSet{},
+		}
+		for k, v := range tg.Labels {
+			g.labels[model.LabelName(k)] = model.LabelValue(v)
+		}
+		for _, s := range tg.Targets {
+			for _, pid := range r.match(s, procs) {
+				g.Targets[pid] = model.LabelSet{}
+			}
+		}
+		recent[g.source] = g
+	}
+
+	var groups []Group
+	for src, g := range recent {
+		if seen, ok := r.groups[src]; ok && reflect.DeepEqual(seen, g) {
+			continue
+		}
+		groups = append(groups, g)
+	}
+	// Indicate that groups were removed.
+	for src := range r.groups {
+		if _, ok := recent[src]; !ok && strings.HasPrefix(src, source+"/") {
+			groups = append(groups, &MultiTargetGroup{source: src})
+			delete(r.groups, src)
+		}
+	}
+	for src, g := range recent {
+		r.groups[src] = g
+	}
+
+	return groups, nil
+}
+
+// remove returns empty groups for all groups of the given source.
+func (r *staticTargetResolver) remove(source string) []Group {
+	var groups []Group
+	for src := range r.groups {
+		if strings.HasPrefix(src, source+"/") {
+			groups = append(groups, &MultiTargetGroup{source: src})
+			delete(r.groups, src)
+		}
+	}
+	return groups
+}
+
+func (r *staticTargetResolver) match(s *ProcessSelector, procs procfs.Procs) []int {
+	if s.PIDFile != "" {
+		content, err := os.ReadFile(s.PIDFile)
+		if err != nil {
+			return nil
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			return nil
+		}
+		proc, err := r.fs.Proc(pid)
+		if err != nil || !matches(s, proc) {
+			return nil
+		}
+		return []int{pid}
+	}
+
+	var pids []int
+	for _, proc := range procs {
+		if matches(s, proc) {
+			pids = append(pids, proc.PID)
+		}
+	}
+	return pids
+}
+
+func matches(s *ProcessSelector, proc procfs.Proc) bool {
+	if s.comm != nil {
+		comm, err := proc.Comm()
+		if err != nil || !s.comm.MatchString(comm) {
+			return false
+		}
+	}
+	if s.Exe != "" {
+		exe, err := proc.Executable()
+		if err != nil {
+			return false
+		}
+		if ok, _ := filepath.Match(s.Exe, exe); !ok {
+			return false
+		}
+	}
+	if s.Cgroup != "" {
+		cgroups, err := proc.Cgroups()
+		if err != nil {
+			return false
+		}
+		prefix := strings.TrimSuffix(s.Cgroup, "/")
+		found := false
+		for _, cg := range cgroups {
+			if cg.Path == prefix || strings.HasPrefix(cg.Path, prefix+"/") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,169 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func ownComm(t *testing.T) string {
+	t.Helper()
+
+	comm, err := os.ReadFile("/proc/self/comm")
+	require.NoError(t, err)
+	return strings.TrimSpace(string(comm))
+}
+
+func TestParseStaticTargetGroups(t *testing.T) {
+	tgs, err := ParseStaticTargetGroups([]byte(`[
+  {"targets": [{"exe": "/usr/bin/postgres*"}, {"pid_file": "/run/nginx.pid", "comm": "nginx"}], "labels": {"team": "storage"}}
+]`))
+	require.NoError(t, err)
+	require.Len(t, tgs, 1)
+	require.Equal(t, "/usr/bin/postgres*", tgs[0].Targets[0].Exe)
+	require.Equal(t, "/run/nginx.pid", tgs[0].Targets[1].PIDFile)
+	require.Equal(t, map[string]string{"team": "storage"}, tgs[0].Labels)
+
+	for name, content := range map[string]string{
+		"empty target":       `- targets: [{}]`,
+		"invalid regex":      `- targets: [{comm: "("}]`,
+		"invalid glob":       `- targets: [{exe: "["}]`,
+		"invalid label name": `- {targets: [{comm: a}], labels: {"a-b": c}}`,
+		"unknown field":      `- targets: [{pid: 1}]`,
+	} {
+		_, err := ParseStaticTargetGroups([]byte(content))
+		require.Error(t, err, name)
+	}
+}
+
+func TestStaticTargetResolver(t *testing.T) {
+	pid := os.Getpid()
+	pidFile := filepath.Join(t.TempDir(), "test.pid")
+	require.NoError(t, os.WriteFile(pidFile, []byte(strconv.Itoa(pid)+"\n"), 0o600))
+
+	tgs, err := ParseStaticTargetGroups([]byte(fmt.Sprintf(`
+- targets: [{pid_file: %q}]
+  labels: {service: pidfile}
+- targets: [{comm: %q, cgroup: /}]
+  labels: {service: comm}
+- targets: [{comm: does-not-exist}]
+`, pidFile, regexp.QuoteMeta(ownComm(t)))))
+	require.NoError(t, err)
+
+	r, err := newStaticTargetResolver()
+	require.NoError(t, err)
+
+	groups, err := r.resolve("targets.yaml", tgs)
+	require.NoError(t, err)
+	require.Len(t, groups, 3)
+
+	bySource := map[string]*MultiTargetGroup{}
+	for _, g := range groups {
+		bySource[g.Source()] = g.(*MultiTargetGroup)
+	}
+	require.Equal(t, model.LabelSet{"service": "pidfile"}, bySource["targets.yaml/0"].Labels())
+	require.Equal(t, map[int]model.LabelSet{pid: {}}, bySource["targets.yaml/0"].Targets)
+	require.Contains(t, bySource["targets.yaml/1"].Targets, pid)
+	require.Empty(t, bySource["targets.yaml/2"].Targets)
+
+	// Removed groups are sent as empty groups.
+	groups, err = r.resolve("targets.yaml", tgs[:1])
+	require.NoError(t, err)
+	require.ElementsMatch(t, []Group{
+		&MultiTargetGroup{source: "targets.yaml/1"},
+		&MultiTargetGroup{source: "targets.yaml/2"},
+	}, groups)
+
+	require.Equal(t, []Group{&MultiTargetGroup{source: "targets.yaml/0"}}, r.remove("targets.yaml"))
+}
+
+func receiveGroups(t *testing.T, up <-chan []Group) map[string]*MultiTargetGroup {
+	t.Helper()
+
+	select {
+	case groups := <-up:
+		bySource := map[string]*MultiTargetGroup{}
+		for _, g := range groups {
+			bySource[g.Source()] = g.(*MultiTargetGroup)
+		}
+		return bySource
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for groups")
+		return nil
+	}
+}
+
+func TestFileDiscoverer(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "targets.yaml")
+	target := fmt.Sprintf("- targets: [{comm: %q}]\n  labels: {service: %%s}\n", regexp.QuoteMeta(ownComm(t)))
+	require.NoError(t, os.WriteFile(file, []byte(fmt.Sprintf(target, "a")), 0o600))
+
+	d, err := NewFileConfig([]string{filepath.Join(dir, "*.yaml")}, 0).NewDiscoverer(DiscovererOptions{Logger: log.NewNopLogger()})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up := make(chan []Group)
+	go d.Run(ctx, up) //nolint:errcheck
+
+	groups := receiveGroups(t, up)
+	require.Equal(t, model.LabelSet{"service": "a"}, groups[file+"/0"].Labels())
+	require.Contains(t, groups[file+"/0"].Targets, os.Getpid())
+
+	// Changes are picked up without waiting for the refresh interval.
+	require.NoError(t, os.WriteFile(file, []byte(fmt.Sprintf(target, "b")), 0o600))
+	groups = receiveGroups(t, up)
+	require.Equal(t, model.LabelSet{"service": "b"}, groups[file+"/0"].Labels())
+
+	require.NoError(t, os.Remove(file))
+	groups = receiveGroups(t, up)
+	require.Equal(t, &MultiTargetGroup{source: file + "/0"}, groups[file+"/0"])
+}
+
+func TestHTTPDiscoverer(t *testing.T) {
+	// Missing PID files are not an error, the process might not be running yet.
+	pidFile := filepath.Join(t.TempDir(), "missing.pid")
+	comm := regexp.QuoteMeta(ownComm(t))
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[{"targets": [{"pid_file": %q}, {"comm": %q}], "labels": {"service": "http"}}]`, pidFile, comm)
+	}))
+	defer s.Close()
+
+	d, err := NewHTTPConfig(s.URL, 0).NewDiscoverer(DiscovererOptions{Logger: log.NewNopLogger()})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up := make(chan []Group)
+	go d.Run(ctx, up) //nolint:errcheck
+
+	groups := receiveGroups(t, up)
+	require.Equal(t, model.LabelSet{"service": "http"}, groups[s.URL+"/0"].Labels())
+	require.Contains(t, groups[s.URL+"/0"].Targets, os.Getpid())
+}
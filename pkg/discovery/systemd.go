@@ -15,16 +15,29 @@ package discovery
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/common/model"
 
+	"github.com/parca-dev/parca-agent/pkg/cgroup"
 	"github.com/parca-dev/parca-agent/pkg/discovery/systemd"
 )
 
+const (
+	// systemdSignalTimeout is how long to wait for signals
+	// before checking whether the discoverer must stop.
+	systemdSignalTimeout = time.Second
+	// systemdCgroupRefreshInterval is how often the processes in the cgroups
+	// of the units are looked up, processes come and go without any signal.
+	systemdCgroupRefreshInterval = 5 * time.Second
+)
+
 type SystemdConfig struct{}
 
 func NewSystemdConfig() *SystemdConfig {
@@ -38,117 +51,223 @@ func (c *SystemdConfig) Name() string {
 func (c *SystemdConfig) NewDiscoverer(d DiscovererOptions) (Discoverer, error) {
 	return &SystemdDiscoverer{
 		logger: d.Logger,
+		newClient: func() (systemdClient, error) {
+			return systemd.New()
+		},
+		cgroupPIDs: cgroup.PIDs,
+		units:      map[string]*systemd.Service{},
+		groups:     map[string]*MultiTargetGroup{},
 	}, nil
 }
 
+// systemdClient is the part of systemd.Client used by SystemdDiscoverer.
+type systemdClient interface {
+	ListUnits(p systemd.Predicate, f func(*systemd.Unit)) error
+	Service(name string) (*systemd.Service, error)
+	Subscribe() error
+	ReadSignals(timeout time.Duration) ([]systemd.Signal, error)
+	Reset() error
+	Close() error
+}
+
+// SystemdDiscoverer discovers the running systemd services.
+// It is notified about changes by D-Bus signals,
+// and attributes all the processes in the cgroup of a service to it.
 type SystemdDiscoverer struct {
-	logger log.Logger
-	client *systemd.Client
-	units  map[string]systemd.Unit
+	logger     log.Logger
+	newClient  func() (systemdClient, error)
+	cgroupPIDs func(path string) ([]int, error)
+
+	// units are the running services by name.
+	units map[string]*systemd.Service
+	// groups are the groups sent last by unit name.
+	groups map[string]*MultiTargetGroup
 }
 
 func (d *SystemdDiscoverer) Run(ctx context.Context, up chan<- []Group) error {
-	var err error
-	d.client, err = systemd.New()
+	client, err := d.newClient()
 	if err != nil {
 		return fmt.Errorf("failed to connect to systemd D-Bus API, %w", err)
 	}
 	defer func() {
-		if err := d.client.Close(); err != nil {
+		if err := client.Close(); err != nil {
 			level.Warn(d.logger).Log("msg", "failed to close systemd client", "err", err)
 		}
 	}()
 
-	for {
-		select {
-		case <-time.After(5 * time.Second):
-			update, err := d.unitsUpdate()
-			if err != nil {
-				level.Warn(d.logger).Log("msg", "failed to get units from systemd D-Bus API", "err", err)
-				if err = d.client.Reset(); err != nil {
-					return err
-				}
-
-				continue
-			}
-			if len(update) == 0 {
-				continue
-			}
-
-			groups := make([]Group, 0, len(update))
-			for unitName, unit := range update {
-				if unit.Name == "" || unit.SubState != "running" {
-					groups = append(groups, &SingleTargetGroup{source: unitName})
-					continue
-				}
+	// Subscribe before listing the units, so that no change is missed in between.
+	if err = client.Subscribe(); err != nil {
+		return fmt.Errorf("failed to subscribe to systemd D-Bus signals, %w", err)
+	}
+	changed, err := d.listUnits(client)
+	if err != nil {
+		return fmt.Errorf("failed to get units from systemd D-Bus API, %w", err)
+	}
 
-				pid, err := d.client.MainPID(unitName)
-				if err != nil {
-					level.Warn(d.logger).Log("msg", "failed to get MainPID from systemd D-Bus API", "err", err, "unit", unitName)
-					if err = d.client.Reset(); err != nil {
-						return err
-					}
+	refresh := time.NewTicker(systemdCgroupRefreshInterval)
+	defer refresh.Stop()
 
-					continue
+	for {
+		var groups []Group
+		groups, err = d.update(client, changed)
+		if err == nil {
+			if len(groups) > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case up <- groups:
 				}
-
-				groups = append(groups, &SingleTargetGroup{
-					source: unitName,
-					labels: model.LabelSet{
-						model.LabelName("systemd_unit"): model.LabelValue(unitName),
-					},
-					Target: int(pid),
-				})
 			}
 
-			select {
-			case <-ctx.Done():
+			changed, err = d.wait(ctx, client, refresh.C)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
 				return ctx.Err()
-			case up <- groups:
 			}
 
+			level.Warn(d.logger).Log("msg", "failed to get units from systemd D-Bus API", "err", err)
+			if err = client.Reset(); err != nil {
+				return err
+			}
+			// Signals might have been missed, start over from the list of units.
+			if changed, err = d.listUnits(client); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// wait returns the services mentioned by signals,
+// or nothing when it is time to look up the processes of the services again.
+func (d *SystemdDiscoverer) wait(ctx context.Context, client systemdClient, refresh <-chan time.Time) (map[string]struct{}, error) {
+	changed := map[string]struct{}{}
+	for {
+		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			return nil, ctx.Err()
+		case <-refresh:
+			return changed, nil
+		default:
+		}
+
+		signals, err := client.ReadSignals(systemdSignalTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signals: %w", err)
+		}
+		for _, s := range signals {
+			if strings.HasSuffix(s.Unit, ".service") {
+				changed[s.Unit] = struct{}{}
+			}
+		}
+		if len(changed) > 0 {
+			return changed, nil
 		}
 	}
 }
 
-// unitsUpdate returns systemd units if there were any changes detected.
-func (d *SystemdDiscoverer) unitsUpdate() (map[string]systemd.Unit, error) {
-	recent := make(map[string]systemd.Unit)
-	err := d.client.ListUnits(systemd.IsService, func(u *systemd.Unit) {
-		// Must copy a unit,
-		// otherwise it will be modified on the next function call.
-		recent[u.Name] = *u
+// listUnits returns the running services and forgets the services that are gone.
+func (d *SystemdDiscoverer) listUnits(client systemdClient) (map[string]struct{}, error) {
+	running := map[string]struct{}{}
+	err := client.ListUnits(systemd.IsService, func(u *systemd.Unit) {
+		if u.SubState == "running" {
+			running[u.Name] = struct{}{}
+		}
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	// Collect new and changed units.
-	update := make(map[string]systemd.Unit)
-	for unitName, unit := range recent {
-		seenUnit, ok := d.units[unitName]
-		// Is it a new unit or
-		// the existing one but with an updated substate?
-		if !ok || seenUnit.SubState != unit.SubState {
-			update[unitName] = unit
+	for name := range d.units {
+		if _, ok := running[name]; !ok {
+			delete(d.units, name)
 		}
+	}
+
+	return running, nil
+}
 
-		delete(d.units, unitName)
+// update fetches the properties of the changed services
+// and returns the groups that changed since the last call.
+func (d *SystemdDiscoverer) update(client systemdClient, changed map[string]struct{}) ([]Group, error) {
+	for name := range changed {
+		svc, err := client.Service(name)
+		var replyErr *systemd.ReplyError
+		switch {
+		// The unit was unloaded in the meantime.
+		case errors.As(err, &replyErr):
+			level.Debug(d.logger).Log("msg", "failed to get systemd unit", "unit", name, "err", err)
+			delete(d.units, name)
+		case err != nil:
+			return nil, err
+		case svc.SubState != "running":
+			delete(d.units, name)
+		default:
+			d.units[name] = svc
+		}
 	}
 
-	// Indicate that units were deleted.
-	for unitName := range d.units {
-		update[unitName] = systemd.Unit{}
+	var groups []Group
+	for name, svc := range d.units {
+		g := d.buildGroup(svc)
+		if seen, ok := d.groups[name]; ok && reflect.DeepEqual(seen, g) {
+			continue
+		}
+		d.groups[name] = g
+		groups = append(groups, g)
 	}
+	// Indicate that units were removed.
+	for name := range d.groups {
+		if _, ok := d.units[name]; !ok {
+			groups = append(groups, &MultiTargetGroup{source: name})
+			delete(d.groups, name)
+		}
+	}
+
+	return groups, nil
+}
 
-	d.units = recent
+func (d *SystemdDiscoverer) buildGroup(svc *systemd.Service) *MultiTargetGroup {
+	g := &MultiTargetGroup{
+		source: svc.Name,
+		labels: model.LabelSet{
+			"systemd_unit": model.LabelValue(svc.Name),
+		},
+		Targets: map[int]model.LabelSet{},
+	}
+	for name, value := range map[model.LabelName]string{
+		"systemd_slice":              svc.Slice,
+		"systemd_unit_control_group": svc.ControlGroup,
+		"systemd_unit_exec_start":    execStart(svc.ExecStart),
+		"systemd_unit_description":   svc.Description,
+	} {
+		if value != "" {
+			g.labels[name] = model.LabelValue(value)
+		}
+	}
 
-	// No changes.
-	if len(update) == 0 {
-		return nil, nil //nolint:nilnil
+	if svc.MainPID != 0 {
+		g.Targets[int(svc.MainPID)] = model.LabelSet{}
+	}
+	if svc.ControlGroup != "" {
+		pids, err := d.cgroupPIDs(svc.ControlGroup)
+		if err != nil {
+			level.Debug(d.logger).Log("msg", "failed to get processes of systemd unit", "unit", svc.Name, "err", err)
+		}
+		for _, pid := range pids {
+			g.Targets[pid] = model.LabelSet{}
+		}
 	}
 
-	return update, nil
+	return g
+}
+
+// execStart joins the arguments of each command with spaces
+// and separates the commands with semicolons.
+func execStart(cmds []systemd.ExecCommand) string {
+	s := make([]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		s = append(s, strings.Join(cmd.Args, " "))
+	}
+	return strings.Join(s, "; ")
 }
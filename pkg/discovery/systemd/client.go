@@ -19,6 +19,7 @@ package systemd
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -130,6 +131,12 @@ type Client struct {
 	// used as a cookie by the sender to identify the reply corresponding to this request.
 	// This must not be zero.
 	msgSerial uint32
+
+	// subscribed indicates that the signals about units were requested,
+	// so the subscription must be renewed after reconnecting.
+	subscribed bool
+	// signals are the received signals that weren't read yet.
+	signals []Signal
 }
 
 // Close closes the connection.
@@ -169,11 +176,18 @@ func (c *Client) Reset() error {
 	c.bufConn.Reset(conn)
 	c.connName = ""
 	c.msgSerial = 0
+	c.signals = nil
 
 	if err = c.hello(); err != nil {
 		return fmt.Errorf("dbus Hello failed: %w", err)
 	}
 
+	if c.subscribed {
+		if err = c.subscribe(); err != nil {
+			return fmt.Errorf("dbus subscribe failed: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -321,3 +335,206 @@ func (c *Client) MainPID(service string) (uint32, error) {
 
 	return pid, err
 }
+
+// call sends a method call encoded by encode and decodes the reply with decode.
+// The caller must hold the lock.
+func (c *Client) call(method string, encode func(msgSerial uint32) error, decode func() error) error {
+	err := c.conn.SetDeadline(time.Now().Add(c.conf.connTimeout))
+	if err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+
+	serial := c.nextMsgSerial()
+	if err = encode(serial); err != nil {
+		return fmt.Errorf("encode %s: %w", method, err)
+	}
+
+	if err = decode(); err != nil {
+		return fmt.Errorf("decode %s: %w", method, err)
+	}
+
+	if c.conf.isSerialCheckEnabled {
+		err = verifyMsgSerial(c.msgDec.Header(), c.connName, serial)
+	}
+
+	return err
+}
+
+// Service fetches the properties of the service, e.g., "dbus.service".
+// The properties of a service that isn't running are mostly empty,
+// see Service.SubState.
+//
+// An error reply, e.g., due to an invalid unit name,
+// is returned as ReplyError.
+func (c *Client) Service(name string) (*Service, error) {
+	if !c.mu.TryLock() {
+		return nil, fmt.Errorf("must be called serially")
+	}
+	defer c.mu.Unlock()
+
+	svc := Service{Name: name}
+	props := []struct {
+		iface string
+		name  string
+		dst   *string
+	}{
+		{unitInterface, "Description", &svc.Description},
+		{unitInterface, "SubState", &svc.SubState},
+		{serviceInterface, "Slice", &svc.Slice},
+		{serviceInterface, "ControlGroup", &svc.ControlGroup},
+	}
+	for _, p := range props {
+		err := c.call(p.name,
+			func(serial uint32) error {
+				return c.msgEnc.EncodeGetProperty(c.conn, name, p.iface, p.name, serial)
+			},
+			func() (err error) {
+				*p.dst, err = c.msgDec.DecodeStringProperty(c.bufConn)
+				return err
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := c.call("MainPID",
+		func(serial uint32) error {
+			return c.msgEnc.EncodeMainPID(c.conn, name, serial)
+		},
+		func() (err error) {
+			svc.MainPID, err = c.msgDec.DecodeMainPID(c.bufConn)
+			return err
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.call("ExecStart",
+		func(serial uint32) error {
+			return c.msgEnc.EncodeGetProperty(c.conn, name, serviceInterface, "ExecStart", serial)
+		},
+		func() (err error) {
+			svc.ExecStart, err = c.msgDec.DecodeExecProperty(c.bufConn)
+			return err
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &svc, nil
+}
+
+// matchRules select the signals about units,
+// see https://dbus.freedesktop.org/doc/dbus-specification.html#message-bus-routing-match-rules.
+var matchRules = []string{
+	"type='signal',sender='" + systemdName + "',interface='" + managerInterface + "',member='" + SignalUnitNew + "'",
+	"type='signal',sender='" + systemdName + "',interface='" + managerInterface + "',member='" + SignalUnitRemoved + "'",
+	"type='signal',sender='" + systemdName + "',interface='" + propertiesInterface + "',member='" + SignalPropertiesChanged + "',path_namespace='" + strings.TrimSuffix(unitPathPrefix, "/") + "'",
+}
+
+// Subscribe asks the message bus and systemd to send
+// UnitNew, UnitRemoved, and PropertiesChanged signals of units to the Client.
+// The signals can be read with ReadSignals,
+// they are also collected while waiting for replies to other method calls.
+//
+// The subscription is renewed by Reset,
+// though the signals sent in the meantime are lost.
+func (c *Client) Subscribe() error {
+	if !c.mu.TryLock() {
+		return fmt.Errorf("must be called serially")
+	}
+	defer c.mu.Unlock()
+
+	if err := c.subscribe(); err != nil {
+		return err
+	}
+
+	c.subscribed = true
+	return nil
+}
+
+// subscribe adds the match rules of the signals and calls systemd Subscribe method.
+// The caller must hold the lock.
+func (c *Client) subscribe() error {
+	c.msgDec.OnSignal = func(s Signal) {
+		c.signals = append(c.signals, s)
+	}
+
+	for _, rule := range matchRules {
+		rule := rule
+		err := c.call("AddMatch",
+			func(serial uint32) error {
+				return c.msgEnc.EncodeAddMatch(c.conn, rule, serial)
+			},
+			func() error {
+				return c.msgDec.DecodeEmptyReply(c.bufConn)
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.call("Subscribe",
+		func(serial uint32) error {
+			return c.msgEnc.EncodeSubscribe(c.conn, serial)
+		},
+		func() error {
+			return c.msgDec.DecodeEmptyReply(c.bufConn)
+		},
+	)
+}
+
+// ReadSignals returns the signals received since the last call.
+// If there are none, it waits for the next message until the timeout expires,
+// in which case neither signals nor an error are returned.
+//
+// Note, the Client must be subscribed, see Subscribe.
+// The same unit might be mentioned by many signals,
+// e.g., a service restart results in several PropertiesChanged signals.
+func (c *Client) ReadSignals(timeout time.Duration) ([]Signal, error) {
+	if !c.mu.TryLock() {
+		return nil, fmt.Errorf("must be called serially")
+	}
+	defer c.mu.Unlock()
+
+	if len(c.signals) == 0 {
+		err := c.conn.SetDeadline(time.Now().Add(timeout))
+		if err != nil {
+			return nil, fmt.Errorf("set deadline: %w", err)
+		}
+
+		// Peek doesn't consume anything from the connection,
+		// so hitting the deadline leaves it usable.
+		if _, err = c.bufConn.Peek(1); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("wait for signal: %w", err)
+		}
+
+		// A message has started arriving, it must be read in full.
+		err = c.conn.SetDeadline(time.Now().Add(c.conf.connTimeout))
+		if err != nil {
+			return nil, fmt.Errorf("set deadline: %w", err)
+		}
+
+		// Signals usually come in bursts,
+		// so all the buffered messages are decoded at once.
+		for {
+			if err = c.msgDec.DecodeSignal(c.bufConn); err != nil {
+				return nil, fmt.Errorf("decode signal: %w", err)
+			}
+			if c.bufConn.Buffered() == 0 {
+				break
+			}
+		}
+	}
+
+	signals := c.signals
+	c.signals = nil
+	return signals, nil
+}
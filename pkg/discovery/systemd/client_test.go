@@ -0,0 +1,497 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package systemd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeBus is a D-Bus peer that serves systemd service units.
+// It speaks the wire protocol using the same encoder and decoder as the Client.
+type fakeBus struct {
+	addr string
+	ln   *net.UnixListener
+
+	mu    sync.Mutex
+	units map[string]*Service
+	conn  net.Conn
+	// serial is the serial of the last message sent by the bus.
+	serial uint32
+	// matches are the match rules added by the clients.
+	matches []string
+	// subscriptions is the count of Subscribe calls.
+	subscriptions int
+	// pending are the signals sent right before the next reply.
+	pending []Signal
+}
+
+const fakeConnName = ":1.47"
+
+func newFakeBus(t *testing.T, units ...*Service) *fakeBus {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "bus")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := fakeBus{
+		addr:  "unix:path=" + path,
+		ln:    ln,
+		units: make(map[string]*Service),
+	}
+	for _, u := range units {
+		b.units[u.Name] = u
+	}
+
+	go b.serve()
+	t.Cleanup(func() {
+		ln.Close()
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.conn != nil {
+			b.conn.Close()
+		}
+	})
+
+	return &b
+}
+
+func (b *fakeBus) serve() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		b.mu.Lock()
+		b.conn = conn
+		b.mu.Unlock()
+
+		go b.handle(conn)
+	}
+}
+
+// handle authenticates the client and replies to its method calls
+// until the connection is closed.
+func (b *fakeBus) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// The client sends a null byte, "AUTH EXTERNAL <uid>\r\n",
+	// and "BEGIN\r\n" after the server replied with OK.
+	if _, err := r.ReadByte(); err != nil {
+		return
+	}
+	if _, err := r.ReadString('\n'); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte("OK eb50e12940d90495b897de9f64090a3e\r\n")); err != nil {
+		return
+	}
+	if _, err := r.ReadString('\n'); err != nil {
+		return
+	}
+
+	var (
+		dec  = newDecoder(nil)
+		conv = newStringConverter(DefaultStringConverterSize)
+		call header
+	)
+	for {
+		dec.Reset(r)
+		if err := decodeHeader(dec, conv, &call, false); err != nil {
+			return
+		}
+
+		// All the methods called by the Client have string arguments.
+		body := io.LimitedReader{R: r, N: int64(call.BodyLen)}
+		dec.Reset(&body)
+		var args []string
+		for body.N > 0 {
+			s, err := dec.String()
+			if err != nil {
+				return
+			}
+			args = append(args, conv.String(s))
+		}
+
+		b.reply(conn, &call, args)
+	}
+}
+
+func (b *fakeBus) reply(conn net.Conn, call *header, args []string) {
+	var member, path string
+	for _, f := range call.Fields {
+		switch f.Code {
+		case fieldMember:
+			member = f.S
+		case fieldPath:
+			path = f.S
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, s := range b.pending {
+		b.writeSignal(conn, s)
+	}
+	b.pending = nil
+
+	var (
+		buf  bytes.Buffer
+		enc  = newEncoder(&buf)
+		sign string
+	)
+	switch member {
+	case "Hello":
+		sign = "s"
+		enc.String(fakeConnName)
+	case "AddMatch":
+		b.matches = append(b.matches, args[0])
+	case "Subscribe":
+		b.subscriptions++
+	case "Get":
+		u, ok := b.units[unescapeBusLabel(strings.TrimPrefix(path, unitPathPrefix))]
+		if !ok {
+			b.writeError(conn, call, "Unit "+path+" not loaded.")
+			return
+		}
+
+		sign = "v"
+		switch args[1] {
+		case "Description":
+			encodeStringVariant(enc, u.Description)
+		case "SubState":
+			encodeStringVariant(enc, u.SubState)
+		case "Slice":
+			encodeStringVariant(enc, u.Slice)
+		case "ControlGroup":
+			encodeStringVariant(enc, u.ControlGroup)
+		case "MainPID":
+			enc.Signature("u")
+			enc.Uint32(u.MainPID)
+		case "ExecStart":
+			encodeExecCommandsVariant(enc, u.ExecStart)
+		default:
+			b.writeError(conn, call, "Unknown property "+args[1])
+			return
+		}
+	default:
+		b.writeError(conn, call, "Unknown method "+member)
+		return
+	}
+
+	b.writeMessage(conn, header{
+		Type: msgTypeMethodReply,
+		Fields: []headerField{
+			{Signature: "u", U: uint64(call.Serial), Code: fieldReplySerial},
+			{Signature: "s", S: fakeConnName, Code: fieldDestination},
+			{Signature: "s", S: busName, Code: fieldSender},
+		},
+	}, sign, buf.Bytes())
+}
+
+func encodeStringVariant(enc *encoder, s string) {
+	enc.Signature("s")
+	enc.String(s)
+}
+
+func encodeExecCommandsVariant(enc *encoder, cmds []ExecCommand) {
+	enc.Signature(execCommandsSignature)
+
+	enc.Align(u32size)
+	arrLenOffset := enc.Offset()
+	enc.Uint32(0)
+	enc.Align(8)
+	arrStart := enc.Offset()
+	for _, cmd := range cmds {
+		enc.Align(8)
+		enc.String(cmd.Path)
+
+		enc.Align(u32size)
+		argsLenOffset := enc.Offset()
+		enc.Uint32(0)
+		argsStart := enc.Offset()
+		for _, arg := range cmd.Args {
+			enc.String(arg)
+		}
+		enc.Uint32At(enc.Offset()-argsStart, argsLenOffset) //nolint:errcheck
+
+		// The last run: ignore failure, timestamps, PID, exit code and status.
+		enc.Uint32(0)
+		for i := 0; i < 4; i++ {
+			enc.Uint64(1700000000000000)
+		}
+		enc.Uint32(1234)
+		enc.Uint32(1)
+		enc.Uint32(0)
+	}
+	enc.Uint32At(enc.Offset()-arrStart, arrLenOffset) //nolint:errcheck
+}
+
+func (b *fakeBus) writeError(conn net.Conn, call *header, msg string) {
+	var buf bytes.Buffer
+	newEncoder(&buf).String(msg)
+
+	b.writeMessage(conn, header{
+		Type: msgTypeError,
+		Fields: []headerField{
+			{Signature: "s", S: "org.freedesktop.DBus.Error.UnknownObject", Code: fieldErrorName},
+			{Signature: "u", U: uint64(call.Serial), Code: fieldReplySerial},
+			{Signature: "s", S: fakeConnName, Code: fieldDestination},
+		},
+	}, "s", buf.Bytes())
+}
+
+func (b *fakeBus) writeSignal(conn net.Conn, s Signal) {
+	var (
+		buf bytes.Buffer
+		enc = newEncoder(&buf)
+		h   = header{Type: msgTypeSignal}
+	)
+	unitPath := func() string {
+		var p bytes.Buffer
+		p.WriteString(unitPathPrefix)
+		escapeBusLabel(s.Unit, &p)
+		return p.String()
+	}
+
+	var sign string
+	switch s.Member {
+	case SignalUnitNew, SignalUnitRemoved:
+		h.Fields = []headerField{
+			{Signature: "o", S: systemdPath, Code: fieldPath},
+			{Signature: "s", S: managerInterface, Code: fieldInterface},
+			{Signature: "s", S: s.Member, Code: fieldMember},
+			{Signature: "s", S: ":1.1", Code: fieldSender},
+		}
+		sign = "so"
+		enc.String(s.Unit)
+		enc.String(unitPath())
+	case SignalPropertiesChanged:
+		h.Fields = []headerField{
+			{Signature: "o", S: unitPath(), Code: fieldPath},
+			{Signature: "s", S: propertiesInterface, Code: fieldInterface},
+			{Signature: "s", S: s.Member, Code: fieldMember},
+			{Signature: "s", S: ":1.1", Code: fieldSender},
+		}
+		// The changed properties {"SubState": "running"}
+		// and no invalidated properties.
+		sign = "sa{sv}as"
+		enc.String(unitInterface)
+		enc.Align(u32size)
+		arrLenOffset := enc.Offset()
+		enc.Uint32(0)
+		enc.Align(8)
+		arrStart := enc.Offset()
+		enc.Align(8)
+		enc.String("SubState")
+		encodeStringVariant(enc, "running")
+		enc.Uint32At(enc.Offset()-arrStart, arrLenOffset) //nolint:errcheck
+		enc.Uint32(0)
+	}
+
+	b.writeMessage(conn, h, sign, buf.Bytes())
+}
+
+func (b *fakeBus) writeMessage(conn net.Conn, h header, sign string, body []byte) {
+	b.serial++
+	h.ByteOrder = littleEndian
+	h.Proto = 1
+	h.Serial = b.serial
+	h.BodyLen = uint32(len(body))
+	if sign != "" {
+		h.Fields = append(h.Fields, headerField{Signature: "g", S: sign, Code: fieldSignature})
+	}
+
+	var buf bytes.Buffer
+	if err := encodeHeader(newEncoder(&buf), &h); err != nil {
+		panic(err)
+	}
+	buf.Write(body)
+
+	conn.Write(buf.Bytes()) //nolint:errcheck
+}
+
+// emit sends the signals right away.
+func (b *fakeBus) emit(signals ...Signal) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, s := range signals {
+		b.writeSignal(b.conn, s)
+	}
+}
+
+// emitBeforeReply sends the signals before the next reply.
+func (b *fakeBus) emitBeforeReply(signals ...Signal) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending = append(b.pending, signals...)
+}
+
+func (b *fakeBus) subscriptionState() ([]string, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]string(nil), b.matches...), b.subscriptions
+}
+
+var nginxService = Service{
+	Name:         "nginx.service",
+	Description:  "A high performance web server",
+	SubState:     "running",
+	Slice:        "system.slice",
+	ControlGroup: "/system.slice/nginx.service",
+	MainPID:      1234,
+	ExecStart: []ExecCommand{
+		{Path: "/usr/sbin/nginx", Args: []string{"/usr/sbin/nginx", "-g", "daemon on; master_process on;"}},
+	},
+}
+
+func TestClientService(t *testing.T) {
+	bus := newFakeBus(t, &nginxService)
+
+	c, err := New(WithAddress(bus.addr), WithSerialCheck())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	svc, err := c.Service("nginx.service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(&nginxService, svc); diff != "" {
+		t.Error(diff)
+	}
+
+	_, err = c.Service("missing.service")
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) {
+		t.Fatalf("expected ReplyError got %v", err)
+	}
+
+	// The connection remains usable after an error reply.
+	if _, err = c.Service("nginx.service"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readSignals reads the signals until n of them are received.
+func readSignals(t *testing.T, c *Client, n int) []Signal {
+	t.Helper()
+
+	var signals []Signal
+	deadline := time.Now().Add(5 * time.Second)
+	for len(signals) < n && time.Now().Before(deadline) {
+		s, err := c.ReadSignals(100 * time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signals = append(signals, s...)
+	}
+
+	return signals
+}
+
+func TestClientSignals(t *testing.T) {
+	bus := newFakeBus(t, &nginxService)
+
+	c, err := New(WithAddress(bus.addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Signals are discarded before subscribing.
+	bus.emitBeforeReply(Signal{Member: SignalUnitNew, Unit: "early.service"})
+	if _, err = c.Service("nginx.service"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Subscribe(); err != nil {
+		t.Fatal(err)
+	}
+	matches, subscriptions := bus.subscriptionState()
+	if diff := cmp.Diff(matchRules, matches); diff != "" {
+		t.Error(diff)
+	}
+	if subscriptions != 1 {
+		t.Errorf("expected 1 subscription got %d", subscriptions)
+	}
+
+	signals, err := c.ReadSignals(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signals) != 0 {
+		t.Errorf("expected no signals got %v", signals)
+	}
+
+	want := []Signal{
+		{Member: SignalUnitNew, Unit: "foo@bar.service"},
+		{Member: SignalPropertiesChanged, Unit: "foo@bar.service"},
+		{Member: SignalUnitRemoved, Unit: "nginx.service"},
+	}
+	bus.emit(want...)
+	if diff := cmp.Diff(want, readSignals(t, c, len(want))); diff != "" {
+		t.Error(diff)
+	}
+
+	// Signals that came before a reply are kept.
+	want = []Signal{{Member: SignalPropertiesChanged, Unit: "nginx.service"}}
+	bus.emitBeforeReply(want...)
+	if _, err = c.Service("nginx.service"); err != nil {
+		t.Fatal(err)
+	}
+	signals, err = c.ReadSignals(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, signals); diff != "" {
+		t.Error(diff)
+	}
+
+	// The subscription is renewed after reconnecting.
+	if err = c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	matches, subscriptions = bus.subscriptionState()
+	if len(matches) != 2*len(matchRules) || subscriptions != 2 {
+		t.Errorf("expected the subscription to be renewed, got %d match rules and %d subscriptions", len(matches), subscriptions)
+	}
+
+	want = []Signal{{Member: SignalUnitNew, Unit: "nginx.service"}}
+	bus.emit(want...)
+	if diff := cmp.Diff(want, readSignals(t, c, len(want))); diff != "" {
+		t.Error(diff)
+	}
+}
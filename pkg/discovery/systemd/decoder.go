@@ -103,6 +103,25 @@ func (d *decoder) Uint32() (uint32, error) {
 	return u, nil
 }
 
+const u64size = 8
+
+// Uint64 decodes D-Bus UINT64.
+func (d *decoder) Uint64() (uint64, error) {
+	err := d.Align(u64size)
+	if err != nil {
+		return 0, err
+	}
+
+	b, err := readN(d.src, d.buf, u64size)
+	if err != nil {
+		return 0, err
+	}
+
+	u := d.order.Uint64(b)
+	d.offset += u64size
+	return u, nil
+}
+
 // String decodes D-Bus STRING or OBJECT_PATH.
 // A caller must not retain the returned byte slice.
 // The string conversion is not done here to avoid allocations.
@@ -18,6 +18,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"strings"
 )
 
 // newEncoder creates a new D-Bus encoder.
@@ -37,7 +38,7 @@ type encoder struct {
 	// pad must always contain zeroes to add padding to dst.
 	pad [8]byte
 	// buf is a buffer that is used to encode integers.
-	buf [4]byte
+	buf [8]byte
 	// offset is a current position in the encoded message
 	// which is used solely to determine the alignment.
 	// The offset is limited by maxMessageSize.
@@ -84,6 +85,16 @@ func (e *encoder) Uint32(u uint32) {
 	e.offset += u32size
 }
 
+// Uint64 encodes D-Bus UINT64.
+func (e *encoder) Uint64(u uint64) {
+	e.Align(u64size)
+
+	b := e.buf[:u64size]
+	e.order.PutUint64(b, u)
+	e.dst.Write(b)
+	e.offset += u64size
+}
+
 // Uint32At encodes UINT32 at the given offset.
 // This is useful when overwriting a header field such as FieldsLen
 // because it is not known in advance.
@@ -157,6 +168,31 @@ func escapeBusLabel(s string, buf *bytes.Buffer) {
 	}
 }
 
+// unescapeBusLabel reverses escapeBusLabel,
+// e.g., "dbus_2eservice" becomes "dbus.service".
+func unescapeBusLabel(s string) string {
+	if s == "_" {
+		return ""
+	}
+
+	var (
+		buf strings.Builder
+		b   [1]byte
+	)
+	buf.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '_' && i+2 < len(s) {
+			if _, err := hex.Decode(b[:], []byte(s[i+1:i+3])); err == nil {
+				buf.WriteByte(b[0])
+				i += 2
+				continue
+			}
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
 func shouldEscape(i int, c byte) bool {
 	switch {
 	case i > 0 && '0' <= c && c <= '9':
@@ -40,6 +40,10 @@ func TestEscapeBusLabel(t *testing.T) {
 		if want != got {
 			t.Errorf("expected %q got %q", want, got)
 		}
+
+		if unescaped := unescapeBusLabel(got); name != unescaped {
+			t.Errorf("expected %q to be unescaped to %q got %q", got, name, unescaped)
+		}
 	}
 }
 
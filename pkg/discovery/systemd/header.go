@@ -100,7 +100,7 @@ const (
 
 // decodeHeader decodes a message header from conn into h.
 // The string converter conv helps to reduce allocs when decoding header fields.
-// A caller can ignore the header fields with the skipFields flag.
+// A caller can ignore the header fields of method replies with the skipFields flag.
 // Note, all fields of h must be overwritten because h is reused.
 //
 // The signature of the header is "yyyyuua(yv)".
@@ -139,7 +139,9 @@ func decodeHeader(dec *decoder, conv *stringConverter, h *header, skipFields boo
 	// Read the header fields where the body signature is stored.
 	// A caller might already know the signature from the spec
 	// and choose not to decode the fields as an optimization.
-	if skipFields {
+	// The fields of signals are always decoded,
+	// because the signal name and the object path are stored there.
+	if skipFields && h.Type != msgTypeSignal {
 		if _, err = dec.ReadN(h.FieldsLen); err != nil {
 			return fmt.Errorf("message header: %w", err)
 		}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"strings"
 )
 
 // Unit represents a currently loaded systemd unit.
@@ -50,6 +51,79 @@ type Unit struct {
 	JobPath string
 }
 
+// Service represents the properties of a systemd service unit
+// that are needed to attribute processes to it.
+type Service struct {
+	// Name is the primary unit name, e.g., "nginx.service".
+	Name string
+	// Description is the human readable description.
+	Description string
+	// SubState is the sub state, e.g., "running".
+	SubState string
+	// Slice is the slice the unit belongs to, e.g., "system.slice".
+	Slice string
+	// ControlGroup is the cgroup of the unit, e.g., "/system.slice/nginx.service".
+	ControlGroup string
+	// MainPID is the main PID of the service, zero if it isn't running.
+	MainPID uint32
+	// ExecStart are the commands executed to start the service.
+	ExecStart []ExecCommand
+}
+
+// ExecCommand is a command executed by systemd, e.g., to start a service.
+type ExecCommand struct {
+	// Path is the absolute path of the executable.
+	Path string
+	// Args are the arguments including the zeroth one.
+	Args []string
+}
+
+// Signals about units that a Client receives once subscribed.
+const (
+	// SignalUnitNew is sent when a unit is loaded.
+	SignalUnitNew = "UnitNew"
+	// SignalUnitRemoved is sent when a unit is unloaded.
+	SignalUnitRemoved = "UnitRemoved"
+	// SignalPropertiesChanged is sent when the properties of a unit change,
+	// e.g., its state or main PID.
+	SignalPropertiesChanged = "PropertiesChanged"
+)
+
+// Signal represents a D-Bus signal about a unit.
+type Signal struct {
+	// Member is the signal name, e.g., SignalUnitNew.
+	Member string
+	// Unit is the name of the unit the signal is about, e.g., "dbus.service".
+	Unit string
+}
+
+// ReplyError is returned when a method call was answered with an error reply,
+// e.g., because of an invalid unit name.
+// Unlike other errors, the connection remains usable.
+type ReplyError struct {
+	// Message is the error message of the reply.
+	Message string
+}
+
+func (e *ReplyError) Error() string {
+	return e.Message
+}
+
+// D-Bus names of the message bus and systemd.
+const (
+	busName             = "org.freedesktop.DBus"
+	busPath             = "/org/freedesktop/DBus"
+	propertiesInterface = "org.freedesktop.DBus.Properties"
+	systemdName         = "org.freedesktop.systemd1"
+	systemdPath         = "/org/freedesktop/systemd1"
+	managerInterface    = "org.freedesktop.systemd1.Manager"
+	unitInterface       = "org.freedesktop.systemd1.Unit"
+	serviceInterface    = "org.freedesktop.systemd1.Service"
+	// unitPathPrefix is the prefix of unit object paths
+	// which are followed by the escaped unit name.
+	unitPathPrefix = "/org/freedesktop/systemd1/unit/"
+)
+
 // Predicate is used to filter out a decoded struct
 // based on its field index and a value.
 // This helps to reduce memory consumption
@@ -92,6 +166,10 @@ type messageDecoder struct {
 	// SkipHeaderFields indicates to the decoder that
 	// the header fields shouldn't be decoded thus reducing allocs.
 	SkipHeaderFields bool
+	// OnSignal is called with the signals about units
+	// that came before the expected reply.
+	// If it isn't set, the signals are discarded.
+	OnSignal func(Signal)
 
 	// The following fields are reused to reduce memory allocs.
 	bodyReader io.LimitedReader
@@ -143,49 +221,9 @@ func (d *messageDecoder) DecodeHello(conn io.Reader) (string, error) {
 // The pointer to Unit struct in f must not be retained,
 // because its fields change on each f call.
 func (d *messageDecoder) DecodeListUnits(conn io.Reader, p Predicate, f func(*Unit)) error {
-	d.Dec.Reset(conn)
-
-	// Decode the message header (16 bytes).
-	//
-	// Then read the message header where the body signature is stored.
-	// The header usually occupies 61 bytes.
-	// Since we already know the signature from the spec,
-	// the header is discarded.
-	//
-	// Note, the length of the header must be a multiple of 8,
-	// allowing the body to begin on an 8-byte boundary.
-	// If the header does not naturally end on an 8-byte boundary,
-	// up to 7 bytes of alignment padding is added.
-	err := decodeHeader(d.Dec, d.Conv, &d.hdr, d.SkipHeaderFields)
+	err := d.decodeReplyHeader(conn)
 	if err != nil {
-		return fmt.Errorf("message header: %w", err)
-	}
-
-	// Read the message body limited by the body length.
-	// For example, if it is 35714 bytes,
-	// we should stop reading at offset 35794,
-	// because the body starts at offset 80,
-	// i.e., offset 35794 = 16 head + 61 header + 3 padding + 35714 body.
-	d.bodyReader.R = conn
-	d.bodyReader.N = int64(d.hdr.BodyLen)
-	d.Dec.Reset(&d.bodyReader)
-
-	switch d.hdr.Type {
-	// Decode an error reply.
-	case msgTypeError:
-		s, err := d.Dec.String()
-		if err != nil {
-			return fmt.Errorf("decode error reply: %w", err)
-		}
-		return fmt.Errorf(d.Conv.String(s))
-	// Discard the signal that came before the expected reply,
-	// i.e., "name acquired" signal.
-	case msgTypeSignal:
-		if _, err = d.Dec.ReadN(d.hdr.BodyLen); err != nil {
-			return fmt.Errorf("discard signal body: %w", err)
-		}
-		// Decode the following message.
-		return d.DecodeListUnits(conn, p, f)
+		return err
 	}
 
 	// ListUnits has a body signature "a(ssssssouso)" which is
@@ -211,6 +249,266 @@ func (d *messageDecoder) DecodeListUnits(conn io.Reader, p Predicate, f func(*Un
 	}
 }
 
+// decodeReplyHeader decodes the header of a method reply
+// and prepares the decoder to read the reply body.
+//
+// Signals that came before the expected reply,
+// e.g., "name acquired" signal, are passed to OnSignal.
+// An error reply is returned as ReplyError.
+func (d *messageDecoder) decodeReplyHeader(conn io.Reader) error {
+	for {
+		d.Dec.Reset(conn)
+
+		// Decode the message header (16 bytes).
+		//
+		// Then read the message header where the body signature is stored.
+		// The header usually occupies 61 bytes.
+		// Since we already know the signature from the spec,
+		// the header is discarded.
+		//
+		// Note, the length of the header must be a multiple of 8,
+		// allowing the body to begin on an 8-byte boundary.
+		// If the header does not naturally end on an 8-byte boundary,
+		// up to 7 bytes of alignment padding is added.
+		err := decodeHeader(d.Dec, d.Conv, &d.hdr, d.SkipHeaderFields)
+		if err != nil {
+			return fmt.Errorf("message header: %w", err)
+		}
+
+		// Read the message body limited by the body length.
+		// For example, if it is 35714 bytes,
+		// we should stop reading at offset 35794,
+		// because the body starts at offset 80,
+		// i.e., offset 35794 = 16 head + 61 header + 3 padding + 35714 body.
+		d.bodyReader.R = conn
+		d.bodyReader.N = int64(d.hdr.BodyLen)
+		d.Dec.Reset(&d.bodyReader)
+
+		switch d.hdr.Type {
+		// Decode an error reply, e.g., invalid unit name.
+		case msgTypeError:
+			s, err := d.Dec.String()
+			if err != nil {
+				return fmt.Errorf("decode error reply: %w", err)
+			}
+			err = &ReplyError{Message: d.Conv.String(s)}
+			if discardErr := d.discardBody(); discardErr != nil {
+				return fmt.Errorf("discard error reply body: %w", discardErr)
+			}
+			return err
+		case msgTypeSignal:
+			if err = d.decodeSignal(); err != nil {
+				return err
+			}
+			// Decode the following message.
+			continue
+		}
+
+		return nil
+	}
+}
+
+// DecodeSignal decodes a message that isn't a reply to a method call.
+// The signals about units are passed to OnSignal,
+// other messages are discarded.
+func (d *messageDecoder) DecodeSignal(conn io.Reader) error {
+	d.Dec.Reset(conn)
+
+	err := decodeHeader(d.Dec, d.Conv, &d.hdr, d.SkipHeaderFields)
+	if err != nil {
+		return fmt.Errorf("message header: %w", err)
+	}
+
+	d.bodyReader.R = conn
+	d.bodyReader.N = int64(d.hdr.BodyLen)
+	d.Dec.Reset(&d.bodyReader)
+
+	if d.hdr.Type != msgTypeSignal {
+		return d.discardBody()
+	}
+	return d.decodeSignal()
+}
+
+// decodeSignal decodes the body of a signal whose header was just decoded
+// and passes it to OnSignal if it is about a unit.
+func (d *messageDecoder) decodeSignal() error {
+	var (
+		sig         Signal
+		iface, path string
+	)
+	for _, f := range d.hdr.Fields {
+		switch f.Code {
+		case fieldMember:
+			sig.Member = f.S
+		case fieldInterface:
+			iface = f.S
+		case fieldPath:
+			path = f.S
+		}
+	}
+
+	if d.OnSignal != nil {
+		switch {
+		// UnitNew and UnitRemoved have a body signature "so",
+		// i.e., the unit name and its object path.
+		case iface == managerInterface && (sig.Member == SignalUnitNew || sig.Member == SignalUnitRemoved):
+			s, err := d.Dec.String()
+			if err != nil {
+				return fmt.Errorf("decode unit name: %w", err)
+			}
+			sig.Unit = d.Conv.String(s)
+		// PropertiesChanged is emitted by the unit object,
+		// so the unit name is found in the object path.
+		// The changed properties aren't decoded,
+		// since the caller is expected to fetch the ones it needs.
+		case iface == propertiesInterface && sig.Member == SignalPropertiesChanged && strings.HasPrefix(path, unitPathPrefix):
+			sig.Unit = unescapeBusLabel(path[len(unitPathPrefix):])
+		}
+	}
+
+	if err := d.discardBody(); err != nil {
+		return fmt.Errorf("discard signal body: %w", err)
+	}
+	if sig.Unit != "" {
+		d.OnSignal(sig)
+	}
+
+	return nil
+}
+
+// discardBody discards the remaining bytes of the message body.
+func (d *messageDecoder) discardBody() error {
+	if d.bodyReader.N <= 0 {
+		return nil
+	}
+
+	_, err := d.Dec.ReadN(uint32(d.bodyReader.N))
+	return err
+}
+
+// DecodeEmptyReply decodes a reply to a method
+// that doesn't return anything, e.g., AddMatch.
+func (d *messageDecoder) DecodeEmptyReply(conn io.Reader) error {
+	if err := d.decodeReplyHeader(conn); err != nil {
+		return err
+	}
+
+	return d.discardBody()
+}
+
+// DecodeStringProperty decodes a reply from
+// org.freedesktop.DBus.Properties.Get method
+// for a property of type STRING or OBJECT_PATH, e.g., ControlGroup.
+func (d *messageDecoder) DecodeStringProperty(conn io.Reader) (string, error) {
+	err := d.decodeReplyHeader(conn)
+	if err != nil {
+		return "", err
+	}
+
+	var sign []byte
+	if sign, err = d.Dec.Signature(); err != nil {
+		return "", fmt.Errorf("decode signature: %w", err)
+	}
+	if len(sign) != 1 || (sign[0] != typeString && sign[0] != typeObjectPath) {
+		return "", fmt.Errorf("unexpected signature %q", sign)
+	}
+
+	var s []byte
+	if s, err = d.Dec.String(); err != nil {
+		return "", fmt.Errorf("decode string: %w", err)
+	}
+
+	return d.Conv.String(s), d.discardBody()
+}
+
+// execCommandsSignature is the signature of exec command properties such as ExecStart.
+// Each struct holds the path, the arguments,
+// whether a failure is ignored, the start and exit timestamps,
+// the PID, the exit code and status of the last run.
+const execCommandsSignature = "a(sasbttttuii)"
+
+// DecodeExecProperty decodes a reply from
+// org.freedesktop.DBus.Properties.Get method
+// for an exec command property, e.g., ExecStart.
+func (d *messageDecoder) DecodeExecProperty(conn io.Reader) ([]ExecCommand, error) {
+	err := d.decodeReplyHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var sign []byte
+	if sign, err = d.Dec.Signature(); err != nil {
+		return nil, fmt.Errorf("decode signature: %w", err)
+	}
+	if string(sign) != execCommandsSignature {
+		return nil, fmt.Errorf("unexpected signature %q", sign)
+	}
+
+	var arrLen uint32
+	if arrLen, err = d.Dec.Uint32(); err != nil {
+		return nil, fmt.Errorf("decode array length: %w", err)
+	}
+	// The padding to the first struct is present even if the array is empty,
+	// and it is not included in the array length.
+	if err = d.Dec.Align(8); err != nil {
+		return nil, fmt.Errorf("discard array padding: %w", err)
+	}
+
+	var cmds []ExecCommand
+	for arrEnd := d.Dec.offset + arrLen; d.Dec.offset < arrEnd; {
+		cmd, err := decodeExecCommand(d.Dec, d.Conv)
+		if err != nil {
+			return nil, fmt.Errorf("decode exec command: %w", err)
+		}
+		cmds = append(cmds, cmd)
+	}
+
+	return cmds, d.discardBody()
+}
+
+// decodeExecCommand decodes "(sasbttttuii)" struct
+// keeping only the path and the arguments.
+func decodeExecCommand(d *decoder, conv *stringConverter) (ExecCommand, error) {
+	var cmd ExecCommand
+	if err := d.Align(8); err != nil {
+		return cmd, err
+	}
+
+	s, err := d.String()
+	if err != nil {
+		return cmd, err
+	}
+	cmd.Path = conv.String(s)
+
+	var argsLen uint32
+	if argsLen, err = d.Uint32(); err != nil {
+		return cmd, err
+	}
+	for argsEnd := d.offset + argsLen; d.offset < argsEnd; {
+		if s, err = d.String(); err != nil {
+			return cmd, err
+		}
+		cmd.Args = append(cmd.Args, conv.String(s))
+	}
+
+	// Discard "bttttuii" describing the last run.
+	if _, err = d.Uint32(); err != nil {
+		return cmd, err
+	}
+	for i := 0; i < 4; i++ {
+		if _, err = d.Uint64(); err != nil {
+			return cmd, err
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = d.Uint32(); err != nil {
+			return cmd, err
+		}
+	}
+
+	return cmd, nil
+}
+
 type sentinelError string
 
 func (e sentinelError) Error() string { return string(e) }
@@ -273,33 +571,9 @@ func decodeUnit(d *decoder, conv *stringConverter, p Predicate, unit *Unit) erro
 // DecodeMainPID decodes MainPID property reply from systemd
 // org.freedesktop.DBus.Properties.Get method.
 func (d *messageDecoder) DecodeMainPID(conn io.Reader) (uint32, error) {
-	d.Dec.Reset(conn)
-
-	err := decodeHeader(d.Dec, d.Conv, &d.hdr, d.SkipHeaderFields)
+	err := d.decodeReplyHeader(conn)
 	if err != nil {
-		return 0, fmt.Errorf("message header: %w", err)
-	}
-
-	d.bodyReader.R = conn
-	d.bodyReader.N = int64(d.hdr.BodyLen)
-	d.Dec.Reset(&d.bodyReader)
-
-	switch d.hdr.Type {
-	// Decode an error reply, e.g., invalid unit name.
-	case msgTypeError:
-		s, err := d.Dec.String()
-		if err != nil {
-			return 0, fmt.Errorf("decode error reply: %w", err)
-		}
-		return 0, fmt.Errorf(d.Conv.String(s))
-	// Discard the signal that came before the expected reply,
-	// i.e., "name acquired" signal.
-	case msgTypeSignal:
-		if _, err = d.Dec.ReadN(d.hdr.BodyLen); err != nil {
-			return 0, fmt.Errorf("discard signal body: %w", err)
-		}
-		// Decode the following message.
-		return d.DecodeMainPID(conn)
+		return 0, err
 	}
 
 	// Discard known signature "u".
@@ -394,13 +668,37 @@ func (e *messageEncoder) EncodeListUnits(conn io.Writer, msgSerial uint32) error
 // EncodeMainPID encodes MainPID property request for the given unit name,
 // e.g., "dbus.service".
 func (e *messageEncoder) EncodeMainPID(conn io.Writer, unitName string, msgSerial uint32) error {
+	return e.EncodeGetProperty(conn, unitName, serviceInterface, "MainPID", msgSerial)
+}
+
+// EncodeGetProperty encodes a request to org.freedesktop.DBus.Properties.Get method
+// for the property of the given unit name and interface,
+// e.g., "ControlGroup" of "org.freedesktop.systemd1.Service" of "dbus.service".
+func (e *messageEncoder) EncodeGetProperty(conn io.Writer, unitName, iface, propName string, msgSerial uint32) error {
 	// Escape an object path to send a call to,
 	// e.g., /org/freedesktop/systemd1/unit/dbus_2eservice.
 	e.buf.Reset()
-	e.buf.WriteString("/org/freedesktop/systemd1/unit/")
+	e.buf.WriteString(unitPathPrefix)
 	escapeBusLabel(unitName, &e.buf)
 	objPath := e.Conv.String(e.buf.Bytes())
 
+	return e.encodeMethodCall(conn, msgSerial, systemdName, objPath, propertiesInterface, "Get", iface, propName)
+}
+
+// EncodeAddMatch encodes a request to org.freedesktop.DBus.AddMatch method
+// which asks the message bus to route the signals matching the rule to the client.
+func (e *messageEncoder) EncodeAddMatch(conn io.Writer, rule string, msgSerial uint32) error {
+	return e.encodeMethodCall(conn, msgSerial, busName, busPath, busName, "AddMatch", rule)
+}
+
+// EncodeSubscribe encodes a request to systemd Subscribe method
+// which enables the signals about units.
+func (e *messageEncoder) EncodeSubscribe(conn io.Writer, msgSerial uint32) error {
+	return e.encodeMethodCall(conn, msgSerial, systemdName, systemdPath, managerInterface, "Subscribe")
+}
+
+// encodeMethodCall encodes a method call whose arguments are strings.
+func (e *messageEncoder) encodeMethodCall(conn io.Writer, msgSerial uint32, dest, objPath, iface, member string, args ...string) error {
 	// Reset the encoder to encode the header and the body.
 	e.buf.Reset()
 	e.Enc.Reset(&e.buf)
@@ -412,25 +710,27 @@ func (e *messageEncoder) EncodeMainPID(conn io.Writer, unitName string, msgSeria
 		Serial:    msgSerial,
 		Fields: []headerField{
 			{Signature: "o", S: objPath, Code: fieldPath},
-			{Signature: "s", S: "org.freedesktop.systemd1", Code: fieldDestination},
-			{Signature: "s", S: "Get", Code: fieldMember},
-			{Signature: "s", S: "org.freedesktop.DBus.Properties", Code: fieldInterface},
-			{Signature: "g", S: "ss", Code: fieldSignature},
+			{Signature: "s", S: dest, Code: fieldDestination},
+			{Signature: "s", S: member, Code: fieldMember},
+			{Signature: "s", S: iface, Code: fieldInterface},
 		},
 	}
+	if len(args) > 0 {
+		h.Fields = append(h.Fields, headerField{
+			Signature: "g",
+			S:         strings.Repeat("s", len(args)),
+			Code:      fieldSignature,
+		})
+	}
 	err := encodeHeader(e.Enc, &h)
 	if err != nil {
 		return fmt.Errorf("message header: %w", err)
 	}
 
-	// Encode message body with a known signature "ss".
-	const (
-		iface    = "org.freedesktop.systemd1.Service"
-		propName = "MainPID"
-	)
 	bodyOffset := e.Enc.Offset()
-	e.Enc.String(iface)
-	e.Enc.String(propName)
+	for _, arg := range args {
+		e.Enc.String(arg)
+	}
 
 	// Overwrite the h.BodyLen with an actual length of the message body.
 	const headerBodyLenOffset = 4
@@ -0,0 +1,189 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/discovery/systemd"
+)
+
+// fakeSystemdClient serves services from memory,
+// signals are sent through a channel.
+type fakeSystemdClient struct {
+	mtx      sync.Mutex
+	services map[string]*systemd.Service
+	signals  chan systemd.Signal
+	// fail makes the next ReadSignals call fail.
+	fail   bool
+	resets int
+}
+
+func (c *fakeSystemdClient) ListUnits(p systemd.Predicate, f func(*systemd.Unit)) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, svc := range c.services {
+		f(&systemd.Unit{Name: svc.Name, SubState: svc.SubState})
+	}
+	return nil
+}
+
+func (c *fakeSystemdClient) Service(name string) (*systemd.Service, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	svc, ok := c.services[name]
+	if !ok {
+		return nil, &systemd.ReplyError{Message: "Unit " + name + " not loaded."}
+	}
+	cp := *svc
+	return &cp, nil
+}
+
+func (c *fakeSystemdClient) Subscribe() error { return nil }
+
+func (c *fakeSystemdClient) ReadSignals(timeout time.Duration) ([]systemd.Signal, error) {
+	c.mtx.Lock()
+	fail := c.fail
+	c.fail = false
+	c.mtx.Unlock()
+	if fail {
+		return nil, errors.New("connection reset by peer")
+	}
+
+	select {
+	case s := <-c.signals:
+		return []systemd.Signal{s}, nil
+	case <-time.After(timeout):
+		return nil, nil
+	}
+}
+
+func (c *fakeSystemdClient) Reset() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.resets++
+	return nil
+}
+
+func (c *fakeSystemdClient) Close() error { return nil }
+
+// update changes the services without sending a signal.
+func (c *fakeSystemdClient) update(services ...*systemd.Service) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, svc := range services {
+		if svc.SubState == "" {
+			delete(c.services, svc.Name)
+			continue
+		}
+		c.services[svc.Name] = svc
+	}
+}
+
+func TestSystemdDiscoverer(t *testing.T) {
+	client := &fakeSystemdClient{
+		services: map[string]*systemd.Service{
+			"nginx.service": {
+				Name:         "nginx.service",
+				Description:  "A high performance web server",
+				SubState:     "running",
+				Slice:        "system.slice",
+				ControlGroup: "/system.slice/nginx.service",
+				MainPID:      100,
+				ExecStart: []systemd.ExecCommand{
+					{Path: "/usr/sbin/nginx", Args: []string{"/usr/sbin/nginx", "-g", "daemon on;"}},
+				},
+			},
+			"backup.service": {Name: "backup.service", SubState: "exited"},
+		},
+		signals: make(chan systemd.Signal),
+	}
+	cgroups := map[string][]int{
+		"/system.slice/nginx.service": {100, 101, 102},
+		"/system.slice/redis.service": {200},
+	}
+	var cgroupsMtx sync.Mutex
+
+	d := &SystemdDiscoverer{
+		logger: log.NewNopLogger(),
+		newClient: func() (systemdClient, error) {
+			return client, nil
+		},
+		cgroupPIDs: func(path string) ([]int, error) {
+			cgroupsMtx.Lock()
+			defer cgroupsMtx.Unlock()
+			return cgroups[path], nil
+		},
+		units:  map[string]*systemd.Service{},
+		groups: map[string]*MultiTargetGroup{},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up := make(chan []Group)
+	go d.Run(ctx, up) //nolint:errcheck
+
+	// All the processes in the cgroup are attributed to the unit.
+	groups := receiveGroups(t, up)
+	require.Len(t, groups, 1)
+	require.Equal(t, model.LabelSet{
+		"systemd_unit":               "nginx.service",
+		"systemd_slice":              "system.slice",
+		"systemd_unit_control_group": "/system.slice/nginx.service",
+		"systemd_unit_exec_start":    "/usr/sbin/nginx -g daemon on;",
+		"systemd_unit_description":   "A high performance web server",
+	}, groups["nginx.service"].Labels())
+	require.Equal(t, map[int]model.LabelSet{100: {}, 101: {}, 102: {}}, groups["nginx.service"].Targets)
+
+	// A new unit is picked up once it is announced.
+	client.update(&systemd.Service{
+		Name:         "redis.service",
+		SubState:     "running",
+		ControlGroup: "/system.slice/redis.service",
+	})
+	client.signals <- systemd.Signal{Member: systemd.SignalUnitNew, Unit: "redis.service"}
+	groups = receiveGroups(t, up)
+	require.Len(t, groups, 1)
+	require.Equal(t, map[int]model.LabelSet{200: {}}, groups["redis.service"].Targets)
+
+	// Signals about other unit types are ignored, stopped units are removed.
+	client.signals <- systemd.Signal{Member: systemd.SignalPropertiesChanged, Unit: "nginx.socket"}
+	client.update(&systemd.Service{Name: "redis.service", SubState: "dead"})
+	client.signals <- systemd.Signal{Member: systemd.SignalPropertiesChanged, Unit: "redis.service"}
+	groups = receiveGroups(t, up)
+	require.Equal(t, map[string]*MultiTargetGroup{"redis.service": {source: "redis.service"}}, groups)
+
+	// Units are listed again after reconnecting, since signals might have been lost.
+	client.update(&systemd.Service{Name: "nginx.service"})
+	client.mtx.Lock()
+	client.fail = true
+	client.mtx.Unlock()
+	groups = receiveGroups(t, up)
+	require.Equal(t, map[string]*MultiTargetGroup{"nginx.service": {source: "nginx.service"}}, groups)
+	client.mtx.Lock()
+	require.Equal(t, 1, client.resets)
+	client.mtx.Unlock()
+}
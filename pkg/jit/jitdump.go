@@ -86,6 +86,8 @@ type JRCodeLoad struct {
 	CodeIndex uint64    // unique identifier for the jitted code
 	Name      string    // function name in ASCII
 	Code      []byte    // raw byte encoding of the jitted code
+
+	UnwindingInfo *JRCodeUnwindingInfo `json:"-"` // unwinding information of the jitted code, from the record preceding this one, if any
 }
 
 // JRCodeMove represents a JITCodeMove record.
@@ -428,6 +430,8 @@ func (p *jitDumpParser) parse(dump *JITDump) error {
 		dump.UnwindingInfo = dump.UnwindingInfo[:0]
 	}
 
+	// The unwinding information record describes the code of the code load record that follows it.
+	var unwindingInfo *JRCodeUnwindingInfo
 	for {
 		prefix, err := p.parseJRPrefix()
 		if errors.Is(err, io.EOF) {
@@ -450,6 +454,8 @@ func (p *jitDumpParser) parse(dump *JITDump) error {
 			if err != nil {
 				return fmt.Errorf("failed to read JIT Code Load: %w", isUnexpectedIOError(err))
 			}
+			jr.UnwindingInfo = unwindingInfo
+			unwindingInfo = nil
 			dump.CodeLoads = append(dump.CodeLoads, jr)
 		case JITCodeMove:
 			jr, err := p.parseJRCodeMove(prefix)
@@ -471,6 +477,7 @@ func (p *jitDumpParser) parse(dump *JITDump) error {
 			if err != nil {
 				return fmt.Errorf("failed to read JIT Code Unwinding Info: %w", isUnexpectedIOError(err))
 			}
+			unwindingInfo = jr
 			dump.UnwindingInfo = append(dump.UnwindingInfo, jr)
 		default:
 			// skip unknown record (we have read them)
@@ -0,0 +1,326 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// DMIDir holds the DMI data of the machine exported by the kernel.
+	DMIDir = "/sys/class/dmi/id"
+
+	cloudRequestTimeout = 5 * time.Second
+)
+
+// DMI holds the DMI data used to detect the cloud a machine runs in,
+// keyed by the file name in /sys/class/dmi/id, e.g. sys_vendor.
+type DMI map[string]string
+
+// CloudInstance is the instance metadata of a cloud machine.
+type CloudInstance struct {
+	Region       string
+	Zone         string
+	InstanceType string
+	InstanceID   string
+}
+
+// CloudPlatform detects a cloud and queries its instance metadata endpoint.
+type CloudPlatform interface {
+	// Name is the value of the cloud_provider label.
+	Name() string
+	// Detect returns true if the machine runs in the cloud.
+	Detect(dmi DMI) bool
+	// DefaultURL is the base URL of the instance metadata endpoint.
+	DefaultURL() string
+	// Instance queries the instance metadata endpoint at the base URL.
+	Instance(ctx context.Context, client *http.Client, baseURL string) (*CloudInstance, error)
+}
+
+// CloudPlatforms returns the supported clouds.
+func CloudPlatforms() []CloudPlatform {
+	return []CloudPlatform{awsPlatform{}, gcpPlatform{}, azurePlatform{}}
+}
+
+type cloudProvider struct {
+	StatelessProvider
+
+	// done is closed once the instance metadata has been resolved or failed to.
+	done chan struct{}
+}
+
+func (p *cloudProvider) ShouldCache() bool {
+	// Uses its own cache.
+	return false
+}
+
+// Cloud provides the region, zone, instance type and instance ID of the cloud machine
+// the agent runs on. The cloud is detected from the DMI data in dmiDir, and the
+// instance metadata endpoint, at baseURL if it is not empty, is queried once in
+// the background. Processes have no cloud labels until it answers, and none at
+// all if it fails to.
+func Cloud(logger log.Logger, dmiDir, baseURL string, platforms ...CloudPlatform) Provider {
+	var (
+		mtx    sync.RWMutex
+		labels model.LabelSet
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		lset, err := cloudLabels(dmiDir, baseURL, platforms)
+		if err != nil {
+			level.Warn(logger).Log("msg", "failed to query cloud instance metadata, cloud labels are disabled", "err", err)
+			return
+		}
+		mtx.Lock()
+		labels = lset
+		mtx.Unlock()
+	}()
+
+	return &cloudProvider{
+		StatelessProvider: StatelessProvider{"cloud", func(ctx context.Context, _ int) (model.LabelSet, error) {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			mtx.RLock()
+			defer mtx.RUnlock()
+			return labels, nil
+		}},
+		done: done,
+	}
+}
+
+// cloudLabels detects the cloud and returns the labels of the instance, none if
+// the machine does not run in a supported cloud.
+func cloudLabels(dmiDir, baseURL string, platforms []CloudPlatform) (model.LabelSet, error) {
+	client := &http.Client{Timeout: cloudRequestTimeout}
+	dmi := readDMI(dmiDir)
+	for _, p := range platforms {
+		if !p.Detect(dmi) {
+			continue
+		}
+
+		url := baseURL
+		if url == "" {
+			url = p.DefaultURL()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cloudRequestTimeout)
+		instance, err := p.Instance(ctx, client, strings.TrimSuffix(url, "/"))
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to query %s instance metadata: %w", p.Name(), err)
+		}
+
+		labels := model.LabelSet{"cloud_provider": model.LabelValue(p.Name())}
+		for name, value := range map[model.LabelName]string{
+			"cloud_region":        instance.Region,
+			"cloud_zone":          instance.Zone,
+			"cloud_instance_type": instance.InstanceType,
+			"cloud_instance_id":   instance.InstanceID,
+		} {
+			if value != "" {
+				labels[name] = model.LabelValue(value)
+			}
+		}
+		return labels, nil
+	}
+	return model.LabelSet{}, nil
+}
+
+// readDMI reads the DMI data, files that are missing or not readable are skipped.
+func readDMI(dir string) DMI {
+	dmi := DMI{}
+	for _, name := range []string{"sys_vendor", "product_name", "product_version", "bios_vendor", "chassis_asset_tag"} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		dmi[name] = strings.TrimSpace(string(b))
+	}
+	return dmi
+}
+
+// getMetadata sends a GET request with the given headers and returns the body.
+func getMetadata(ctx context.Context, client *http.Client, url string, header http.Header) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header = header
+	return doMetadataRequest(client, req)
+}
+
+func doMetadataRequest(client *http.Client, req *http.Request) (string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: unexpected status %s", req.URL.Path, resp.Status)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// awsPlatform queries the EC2 instance metadata service, with a session token if IMDSv2 is available.
+type awsPlatform struct{}
+
+func (awsPlatform) Name() string { return "aws" }
+
+func (awsPlatform) Detect(dmi DMI) bool {
+	return dmi["sys_vendor"] == "Amazon EC2" ||
+		strings.Contains(strings.ToLower(dmi["bios_vendor"]), "amazon") ||
+		// Xen based instances.
+		strings.Contains(strings.ToLower(dmi["product_version"]), "amazon")
+}
+
+func (awsPlatform) DefaultURL() string { return "http://169.254.169.254" }
+
+func (awsPlatform) Instance(ctx context.Context, client *http.Client, baseURL string) (*CloudInstance, error) {
+	header := http.Header{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, baseURL+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	// Fall back to IMDSv1 if no token can be obtained.
+	if token, err := doMetadataRequest(client, req); err == nil {
+		header.Set("X-aws-ec2-metadata-token", token)
+	}
+
+	instance := &CloudInstance{}
+	for path, dst := range map[string]*string{
+		"placement/region":            &instance.Region,
+		"placement/availability-zone": &instance.Zone,
+		"instance-type":               &instance.InstanceType,
+		"instance-id":                 &instance.InstanceID,
+	} {
+		v, err := getMetadata(ctx, client, baseURL+"/latest/meta-data/"+path, header)
+		if err != nil {
+			return nil, err
+		}
+		*dst = v
+	}
+	return instance, nil
+}
+
+// gcpPlatform queries the Compute Engine metadata server.
+type gcpPlatform struct{}
+
+func (gcpPlatform) Name() string { return "gcp" }
+
+func (gcpPlatform) Detect(dmi DMI) bool {
+	return dmi["product_name"] == "Google Compute Engine" || dmi["sys_vendor"] == "Google"
+}
+
+func (gcpPlatform) DefaultURL() string { return "http://metadata.google.internal" }
+
+func (gcpPlatform) Instance(ctx context.Context, client *http.Client, baseURL string) (*CloudInstance, error) {
+	header := http.Header{}
+	header.Set("Metadata-Flavor", "Google")
+
+	var zone, machineType, id string
+	for path, dst := range map[string]*string{
+		"zone":         &zone,
+		"machine-type": &machineType,
+		"id":           &id,
+	} {
+		v, err := getMetadata(ctx, client, baseURL+"/computeMetadata/v1/instance/"+path, header)
+		if err != nil {
+			return nil, err
+		}
+		*dst = v
+	}
+
+	// The zone is returned as projects/<project number>/zones/<zone>,
+	// and the machine type as projects/<project number>/machineTypes/<type>.
+	zone = zone[strings.LastIndex(zone, "/")+1:]
+	instance := &CloudInstance{
+		Zone:         zone,
+		InstanceType: machineType[strings.LastIndex(machineType, "/")+1:],
+		InstanceID:   id,
+	}
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		instance.Region = zone[:i]
+	}
+	return instance, nil
+}
+
+// azurePlatform queries the Azure Instance Metadata Service.
+type azurePlatform struct{}
+
+func (azurePlatform) Name() string { return "azure" }
+
+func (azurePlatform) Detect(dmi DMI) bool {
+	// The asset tag set on all Azure virtual machines.
+	return dmi["chassis_asset_tag"] == "7783-7084-3265-9085-8269-3286-77"
+}
+
+func (azurePlatform) DefaultURL() string { return "http://169.254.169.254" }
+
+func (azurePlatform) Instance(ctx context.Context, client *http.Client, baseURL string) (*CloudInstance, error) {
+	header := http.Header{}
+	header.Set("Metadata", "true")
+
+	body, err := getMetadata(ctx, client, baseURL+"/metadata/instance/compute?api-version=2021-02-01&format=json", header)
+	if err != nil {
+		return nil, err
+	}
+
+	var compute struct {
+		Location string `json:"location"`
+		Zone     string `json:"zone"`
+		VMSize   string `json:"vmSize"`
+		VMID     string `json:"vmId"`
+	}
+	if err := json.Unmarshal([]byte(body), &compute); err != nil {
+		return nil, fmt.Errorf("failed to decode compute metadata: %w", err)
+	}
+	if compute.Location == "" {
+		return nil, errors.New("no location in compute metadata")
+	}
+
+	instance := &CloudInstance{
+		Region:       compute.Location,
+		InstanceType: compute.VMSize,
+		InstanceID:   compute.VMID,
+	}
+	// Availability zones are numbered per region.
+	if compute.Zone != "" {
+		instance.Zone = compute.Location + "-" + compute.Zone
+	}
+	return instance, nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeInstanceMetadata stands in for the instance metadata endpoints of all the clouds.
+func fakeInstanceMetadata(t *testing.T, requests *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Write([]byte("token")) //nolint:errcheck
+	})
+	for path, value := range map[string]string{
+		"placement/region":            "eu-west-1",
+		"placement/availability-zone": "eu-west-1b",
+		"instance-type":               "m5.large",
+		"instance-id":                 "i-0123456789abcdef0",
+	} {
+		value := value
+		mux.HandleFunc("/latest/meta-data/"+path, func(w http.ResponseWriter, r *http.Request) {
+			// IMDSv2 only.
+			if r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+				http.Error(w, "", http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(value)) //nolint:errcheck
+		})
+	}
+	for path, value := range map[string]string{
+		"zone":         "projects/123456789/zones/us-central1-a",
+		"machine-type": "projects/123456789/machineTypes/e2-standard-4",
+		"id":           "4520031799277581759",
+	} {
+		value := value
+		mux.HandleFunc("/computeMetadata/v1/instance/"+path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Metadata-Flavor") != "Google" {
+				http.Error(w, "", http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(value)) //nolint:errcheck
+		})
+	}
+	mux.HandleFunc("/metadata/instance/compute", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"location":"westeurope","zone":"2","vmSize":"Standard_D2s_v3","vmId":"02aab8a4-74ef-476e-8182-f6d2ba4166a6"}`)) //nolint:errcheck
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func writeDMI(t *testing.T, dmi DMI) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, value := range dmi {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(value+"\n"), 0o444))
+	}
+	return dir
+}
+
+func TestCloud(t *testing.T) {
+	for name, tc := range map[string]struct {
+		dmi  DMI
+		want model.LabelSet
+	}{
+		"aws": {
+			dmi: DMI{"sys_vendor": "Amazon EC2", "product_name": "m5.large"},
+			want: model.LabelSet{
+				"cloud_provider":      "aws",
+				"cloud_region":        "eu-west-1",
+				"cloud_zone":          "eu-west-1b",
+				"cloud_instance_type": "m5.large",
+				"cloud_instance_id":   "i-0123456789abcdef0",
+			},
+		},
+		"gcp": {
+			dmi: DMI{"sys_vendor": "Google", "product_name": "Google Compute Engine"},
+			want: model.LabelSet{
+				"cloud_provider":      "gcp",
+				"cloud_region":        "us-central1",
+				"cloud_zone":          "us-central1-a",
+				"cloud_instance_type": "e2-standard-4",
+				"cloud_instance_id":   "4520031799277581759",
+			},
+		},
+		"azure": {
+			dmi: DMI{"sys_vendor": "Microsoft Corporation", "chassis_asset_tag": "7783-7084-3265-9085-8269-3286-77"},
+			want: model.LabelSet{
+				"cloud_provider":      "azure",
+				"cloud_region":        "westeurope",
+				"cloud_zone":          "westeurope-2",
+				"cloud_instance_type": "Standard_D2s_v3",
+				"cloud_instance_id":   "02aab8a4-74ef-476e-8182-f6d2ba4166a6",
+			},
+		},
+		"not a cloud": {
+			dmi:  DMI{"sys_vendor": "LENOVO", "product_name": "20XW0026GE"},
+			want: model.LabelSet{},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var requests atomic.Int32
+			srv := fakeInstanceMetadata(t, &requests)
+			p := Cloud(log.NewNopLogger(), writeDMI(t, tc.dmi), srv.URL, CloudPlatforms()...)
+			<-p.(*cloudProvider).done
+
+			lset, err := p.Labels(context.Background(), 1)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, lset)
+
+			// The endpoint is only queried once.
+			n := requests.Load()
+			lset, err = p.Labels(context.Background(), 2)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, lset)
+			require.Equal(t, n, requests.Load())
+		})
+	}
+}
+
+func TestCloudUnavailable(t *testing.T) {
+	var requests atomic.Int32
+	srv := fakeInstanceMetadata(t, &requests)
+	srv.Close()
+
+	p := Cloud(log.NewNopLogger(), writeDMI(t, DMI{"sys_vendor": "Amazon EC2"}), srv.URL, CloudPlatforms()...)
+	<-p.(*cloudProvider).done
+
+	// Processes are labelled without the cloud labels, the endpoint is not queried again.
+	n := requests.Load()
+	lset, err := p.Labels(context.Background(), 1)
+	require.NoError(t, err)
+	require.Empty(t, lset)
+	require.Equal(t, n, requests.Load())
+}
+
+func TestCloudDoesNotBlock(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(block) })
+
+	p := Cloud(log.NewNopLogger(), writeDMI(t, DMI{"sys_vendor": "Amazon EC2"}), srv.URL, CloudPlatforms()...)
+	lset, err := p.Labels(context.Background(), 1)
+	require.NoError(t, err)
+	require.Empty(t, lset)
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package metadata
+
+import (
+	"context"
+	"debug/buildinfo"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/parca-dev/parca-agent/pkg/cache"
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
+)
+
+type goBuildInfoProvider struct {
+	StatelessProvider
+}
+
+func (p *goBuildInfoProvider) ShouldCache() bool {
+	// Uses its own cache.
+	return false
+}
+
+// GoBuildInfo provides the Go version, the main module and
+// the version control information embedded in Go binaries.
+func GoBuildInfo(reg prometheus.Registerer, objFilePool *objectfile.Pool) Provider {
+	// Keyed by build ID, a binary replaced in place is looked up again.
+	cache := cache.NewLRUCache[string, model.LabelSet](
+		prometheus.WrapRegistererWith(prometheus.Labels{"cache": "metadata_go_buildinfo"}, reg),
+		512,
+	)
+	return &goBuildInfoProvider{
+		StatelessProvider{"go_buildinfo", func(ctx context.Context, pid int) (model.LabelSet, error) {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			path, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+			if err != nil {
+				return nil, fmt.Errorf("failed to get path for process %d: %w", pid, err)
+			}
+
+			obj, err := objFilePool.Open(filepath.Join(fmt.Sprintf("/proc/%d/root", pid), path))
+			if err != nil {
+				return nil, fmt.Errorf("failed to open ELF file for process %d: %w", pid, err)
+			}
+
+			key := obj.Path + ":" + obj.BuildID
+			if cachedLabels, ok := cache.Get(key); ok {
+				return cachedLabels, nil
+			}
+
+			labels, err := goBuildInfoLabels(obj)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read Go build info for process %d: %w", pid, err)
+			}
+			cache.Add(key, labels)
+			return labels, nil
+		}},
+	}
+}
+
+// goBuildInfoLabels returns the labels from the .go.buildinfo section,
+// or no labels if the object file is not a Go binary.
+func goBuildInfoLabels(obj *objectfile.ObjectFile) (model.LabelSet, error) {
+	ef, release, err := obj.ELF()
+	if err != nil {
+		return nil, err
+	}
+	isGo := ef.Section(".go.buildinfo") != nil
+	release()
+	if !isGo {
+		return model.LabelSet{}, nil
+	}
+
+	r, release, err := obj.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	bi, err := buildinfo.Read(r)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := model.LabelSet{}
+	add := func(name model.LabelName, value string) {
+		if value != "" {
+			labels[name] = model.LabelValue(value)
+		}
+	}
+	add("go_version", bi.GoVersion)
+	add("go_module_path", bi.Main.Path)
+	add("go_module_version", bi.Main.Version)
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			add("go_vcs_revision", s.Value)
+		case "vcs.time":
+			add("go_vcs_time", s.Value)
+		case "vcs.modified":
+			add("go_vcs_modified", s.Value)
+		}
+	}
+	return labels, nil
+}
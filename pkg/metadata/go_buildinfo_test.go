@@ -0,0 +1,61 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
+)
+
+func TestGoBuildInfo(t *testing.T) {
+	ofp := objectfile.NewPool(log.NewNopLogger(), prometheus.NewRegistry(), 10, 0)
+	t.Cleanup(func() {
+		ofp.Close()
+	})
+	p := GoBuildInfo(prometheus.NewRegistry(), ofp)
+
+	// The test binary is a Go binary.
+	bi, ok := debug.ReadBuildInfo()
+	require.True(t, ok)
+	lset, err := p.Labels(context.Background(), os.Getpid())
+	require.NoError(t, err)
+	require.Equal(t, model.LabelValue(runtime.Version()), lset["go_version"])
+	require.Equal(t, model.LabelValue(bi.Main.Path), lset["go_module_path"])
+
+	// Other binaries have no labels.
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep not found")
+	}
+	cmd := exec.Command(sleep, "10")
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		cmd.Process.Kill() //nolint:errcheck
+		cmd.Wait()         //nolint:errcheck
+	})
+	lset, err = p.Labels(context.Background(), cmd.Process.Pid)
+	require.NoError(t, err)
+	require.Empty(t, lset)
+}
@@ -17,12 +17,14 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/procfs"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/relabel"
 	"go.opentelemetry.io/otel/attribute"
@@ -31,6 +33,7 @@ import (
 
 	"github.com/parca-dev/parca-agent/pkg/cache"
 	"github.com/parca-dev/parca-agent/pkg/metadata"
+	"github.com/parca-dev/parca-agent/pkg/process"
 )
 
 type Cache[K comparable, V any] interface {
@@ -41,9 +44,11 @@ type Cache[K comparable, V any] interface {
 }
 
 // Manager is responsible for aggregating, mutating, and serving process labels.
+// Labels are cached by process identity, a process reusing the PID of another one gets its own labels.
 type Manager struct {
 	logger log.Logger
 	tracer trace.Tracer
+	ids    *process.IDResolver
 
 	providers     []metadata.Provider
 	providerCache Cache[string, model.LabelSet]
@@ -58,6 +63,7 @@ func NewManager(
 	logger log.Logger,
 	tracer trace.Tracer,
 	reg prometheus.Registerer,
+	procFS procfs.FS,
 	providers []metadata.Provider,
 	relabelConfigs []*relabel.Config,
 	cacheDisabled bool,
@@ -80,9 +86,16 @@ func NewManager(
 			10*6*profilingDuration,
 		)
 	}
+	// Identities are kept as long as the labels of the providers.
+	ids := process.NewIDResolver(
+		prometheus.WrapRegistererWith(prometheus.Labels{"cache": "label_process_id"}, reg),
+		procFS,
+		10*6*profilingDuration,
+	)
 	return &Manager{
 		logger:    logger,
 		tracer:    tracer,
+		ids:       ids,
 		providers: providers,
 
 		mtx:            &sync.RWMutex{},
@@ -104,7 +117,7 @@ func (m *Manager) ApplyConfig(relabelConfigs []*relabel.Config) error {
 
 // labelSet fetches process specific labels to the profile.
 // Returns nil if set is dropped.
-func (m *Manager) labelSet(ctx context.Context, pid int) (model.LabelSet, error) {
+func (m *Manager) labelSet(ctx context.Context, id process.ID) (model.LabelSet, error) {
 	if ctx.Err() != nil {
 		return nil, ctx.Err()
 	}
@@ -113,7 +126,7 @@ func (m *Manager) labelSet(ctx context.Context, pid int) (model.LabelSet, error)
 	defer span.End()
 
 	labelSet := model.LabelSet{
-		"pid": model.LabelValue(strconv.Itoa(pid)),
+		"pid": model.LabelValue(strconv.Itoa(id.PID)),
 	}
 
 	for _, provider := range m.providers {
@@ -121,7 +134,7 @@ func (m *Manager) labelSet(ctx context.Context, pid int) (model.LabelSet, error)
 		shouldCache := provider.ShouldCache()
 		if shouldCache {
 			span.SetAttributes(attribute.Bool("cache", true))
-			key := providerCacheKey(provider.Name(), pid)
+			key := providerCacheKey(provider.Name(), id)
 			if lbls, ok := m.providerCache.Get(key); ok {
 				labelSet = labelSet.Merge(lbls)
 				span.End()
@@ -131,7 +144,7 @@ func (m *Manager) labelSet(ctx context.Context, pid int) (model.LabelSet, error)
 
 		// Add service discovery metadata, such as the Kubernetes pod where the
 		// process is running, among others.
-		lbl, err := provider.Labels(ctx, pid)
+		lbl, err := provider.Labels(ctx, id.PID)
 		if err != nil {
 			// NOTICE: Can be too noisy. Keeping this for debugging purposes.
 			// level.Debug(p.logger).Log("msg", "failed to get metadata", "provider", provider.Name(), "err", err)
@@ -144,7 +157,7 @@ func (m *Manager) labelSet(ctx context.Context, pid int) (model.LabelSet, error)
 
 		if shouldCache {
 			// Stateless providers are cached for a longer period of time.
-			m.providerCache.Add(providerCacheKey(provider.Name(), pid), labelSet)
+			m.providerCache.Add(providerCacheKey(provider.Name(), id), labelSet)
 		}
 	}
 
@@ -158,7 +171,8 @@ func (m *Manager) Labels(ctx context.Context, pid int) (labels.Labels, error) {
 	ctx, span := m.tracer.Start(ctx, "LabelManager.Labels")
 	defer span.End()
 
-	labelSet, ok := m.getIfCached(pid)
+	id := m.ids.ID(pid)
+	labelSet, ok := m.getIfCached(id)
 	if ok {
 		if labelSet == nil {
 			return nil, nil
@@ -166,7 +180,7 @@ func (m *Manager) Labels(ctx context.Context, pid int) (labels.Labels, error) {
 		return labelSetToLabels(labelSet), nil
 	}
 
-	labelSet, err := m.labelSet(ctx, pid)
+	labelSet, err := m.labelSet(ctx, id)
 	if err != nil {
 		return nil, err
 	}
@@ -181,25 +195,26 @@ func (m *Manager) Labels(ctx context.Context, pid int) (labels.Labels, error) {
 	if !keep {
 		return nil, nil
 	}
-	return lbls, nil
+	return labelSetToLabels(dropMetaLabels(labelsToLabelSet(lbls))), nil
 }
 
 // Fetch fetches process specific labels to the profile.
 // This method is intended to be used by process info manager to fetch certain labels as early as possible.
 // It bypasses relabeling and top-level caching.
 func (m *Manager) Fetch(ctx context.Context, pid int) error {
-	_, err := m.labelSet(ctx, pid)
+	_, err := m.labelSet(ctx, m.ids.ID(pid))
 	return err
 }
 
 // LabelSet returns a model.LabelSet with relabel configs applied.
 func (m *Manager) LabelSet(ctx context.Context, pid int) (model.LabelSet, error) {
-	labelSet, ok := m.getIfCached(pid)
+	id := m.ids.ID(pid)
+	labelSet, ok := m.getIfCached(id)
 	if ok {
 		return labelSet, nil
 	}
 
-	labelSet, err := m.labelSet(ctx, pid)
+	labelSet, err := m.labelSet(ctx, id)
 	if err != nil {
 		return nil, err
 	}
@@ -207,14 +222,15 @@ func (m *Manager) LabelSet(ctx context.Context, pid int) (model.LabelSet, error)
 	if len(m.relabelConfigs) > 0 {
 		lbls, keep := m.processRelabel(labelSetToLabels(labelSet))
 		if !keep {
-			m.labelCache.Add(labelCacheKey(pid), model.LabelSet{})
+			m.labelCache.Add(labelCacheKey(id), model.LabelSet{})
 			return nil, nil
 		}
 
 		labelSet = labelsToLabelSet(lbls)
 	}
+	labelSet = dropMetaLabels(labelSet)
 
-	m.labelCache.Add(labelCacheKey(pid), labelSet)
+	m.labelCache.Add(labelCacheKey(id), labelSet)
 	return labelSet, nil
 }
 
@@ -225,28 +241,41 @@ func (m *Manager) processRelabel(lbls labels.Labels) (labels.Labels, bool) {
 	return relabel.Process(lbls, m.relabelConfigs...)
 }
 
-func labelCacheKey(pid int) string {
-	return strconv.Itoa(pid)
+func labelCacheKey(id process.ID) string {
+	return id.String()
 }
 
-func providerCacheKey(provider string, pid int) string {
-	return fmt.Sprintf("%s:%d", provider, pid)
+func providerCacheKey(provider string, id process.ID) string {
+	return fmt.Sprintf("%s:%s", provider, id)
 }
 
 // getIfCached retrieved a labelSet if it has been cached.
-func (m *Manager) getIfCached(pid int) (model.LabelSet, bool) {
-	if labelSet, ok := m.labelCache.Get(labelCacheKey(pid)); ok {
+func (m *Manager) getIfCached(id process.ID) (model.LabelSet, bool) {
+	if labelSet, ok := m.labelCache.Get(labelCacheKey(id)); ok {
 		return labelSet, true
 	}
 	return nil, false
 }
 
+// dropMetaLabels removes the labels that are only available to relabel configs,
+// e.g. the annotations of Kubernetes pods.
+func dropMetaLabels(labelSet model.LabelSet) model.LabelSet {
+	res := make(model.LabelSet, len(labelSet))
+	for name, value := range labelSet {
+		if !strings.HasPrefix(string(name), model.MetaLabelPrefix) {
+			res[name] = value
+		}
+	}
+	return res
+}
+
 // labelSetToLabels converts a model.LabelSet to labels.Labels.
 func labelSetToLabels(labelSet model.LabelSet) labels.Labels {
 	b := labels.NewScratchBuilder(len(labelSet))
 	for name, value := range labelSet {
 		b.Add(string(name), string(value))
 	}
+	b.Sort()
 	return b.Labels()
 }
 
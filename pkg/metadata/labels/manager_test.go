@@ -15,12 +15,16 @@ package labels_test
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/procfs"
 	promlabels "github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/stretchr/testify/require"
@@ -37,6 +41,7 @@ func TestManager(t *testing.T) {
 		log.NewNopLogger(),
 		trace.NewNoopTracerProvider().Tracer("test"),
 		prometheus.NewRegistry(),
+		fakeProcFS(t),
 		[]metadata.Provider{
 			metadata.Target("test", map[string]string{}),
 		},
@@ -96,3 +101,137 @@ func TestManager(t *testing.T) {
 	require.NoError(t, err)
 	require.Empty(t, lbs)
 }
+
+type metaProvider struct{}
+
+func (metaProvider) Name() string      { return "meta" }
+func (metaProvider) ShouldCache() bool { return true }
+func (metaProvider) Labels(context.Context, int) (model.LabelSet, error) {
+	return model.LabelSet{
+		"namespace": "default",
+		"__meta_kubernetes_pod_annotation_example_com_team": "payments",
+	}, nil
+}
+
+func TestManagerDropsMetaLabels(t *testing.T) {
+	t.Parallel()
+
+	lm := labels.NewManager(
+		log.NewNopLogger(),
+		trace.NewNoopTracerProvider().Tracer("test"),
+		prometheus.NewRegistry(),
+		fakeProcFS(t),
+		[]metadata.Provider{metaProvider{}},
+		[]*relabel.Config{
+			{
+				SourceLabels: model.LabelNames{"__meta_kubernetes_pod_annotation_example_com_team"},
+				Separator:    ";",
+				Regex:        relabel.MustNewRegexp(`(.+)`),
+				Replacement:  "$1",
+				TargetLabel:  "team",
+				Action:       relabel.Replace,
+			},
+		},
+		false,
+		time.Second,
+	)
+
+	expected := model.LabelSet{
+		"namespace": "default",
+		"pid":       "1",
+		"team":      "payments",
+	}
+	for i := 0; i < 2; i++ {
+		ls, err := lm.LabelSet(context.TODO(), 1)
+		require.NoError(t, err)
+		require.Equal(t, expected, ls)
+
+		lbs, err := lm.Labels(context.TODO(), 1)
+		require.NoError(t, err)
+		require.Equal(t, promlabels.FromMap(map[string]string{
+			"namespace": "default",
+			"pid":       "1",
+			"team":      "payments",
+		}), lbs)
+	}
+
+	// Meta labels are dropped without relabel configs too.
+	require.NoError(t, lm.ApplyConfig(nil))
+	ls, err := lm.LabelSet(context.TODO(), 2)
+	require.NoError(t, err)
+	require.Equal(t, model.LabelSet{"namespace": "default", "pid": "2"}, ls)
+}
+
+func fakeProcFS(t *testing.T) procfs.FS {
+	t.Helper()
+
+	fs, err := procfs.NewFS(t.TempDir())
+	require.NoError(t, err)
+	return fs
+}
+
+// writeStat writes the stat file of a fake process.
+func writeStat(t *testing.T, root string, pid int, startTime uint64) {
+	t.Helper()
+
+	dir := filepath.Join(root, fmt.Sprint(pid))
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	stat := fmt.Sprintf("%d (app) S 1 %d %d 0 -1 4194560 0 0 0 0 0 0 0 0 20 0 1 0 %d 1000000 100 18446744073709551615 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0 0 0 0 0 0 0 0 0\n", pid, pid, pid, startTime)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0o644))
+}
+
+// countingProvider labels processes with the number of lookups.
+type countingProvider struct {
+	calls int
+}
+
+func (p *countingProvider) Name() string      { return "counting" }
+func (p *countingProvider) ShouldCache() bool { return true }
+func (p *countingProvider) Labels(context.Context, int) (model.LabelSet, error) {
+	p.calls++
+	return model.LabelSet{"lookup": model.LabelValue(fmt.Sprint(p.calls))}, nil
+}
+
+func TestManagerPIDReuse(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	fs, err := procfs.NewFS(root)
+	require.NoError(t, err)
+	provider := &countingProvider{}
+	lm := labels.NewManager(
+		log.NewNopLogger(),
+		trace.NewNoopTracerProvider().Tracer("test"),
+		prometheus.NewRegistry(),
+		fs,
+		[]metadata.Provider{provider},
+		nil,
+		false,
+		time.Minute,
+	)
+
+	writeStat(t, root, 1234, 100)
+	ls, err := lm.LabelSet(context.TODO(), 1234)
+	require.NoError(t, err)
+	require.Equal(t, model.LabelSet{"pid": "1234", "lookup": "1"}, ls)
+
+	// Cached as long as the process lives.
+	ls, err = lm.LabelSet(context.TODO(), 1234)
+	require.NoError(t, err)
+	require.Equal(t, model.LabelSet{"pid": "1234", "lookup": "1"}, ls)
+
+	// A new process reusing the PID does not get the labels of the previous one,
+	// once its identity is refreshed.
+	writeStat(t, root, 1234, 200)
+	time.Sleep(time.Second)
+	ls, err = lm.LabelSet(context.TODO(), 1234)
+	require.NoError(t, err)
+	require.Equal(t, model.LabelSet{"pid": "1234", "lookup": "2"}, ls)
+
+	// The labels of a process that has exited are still found.
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "1234")))
+	time.Sleep(time.Second)
+	ls, err = lm.LabelSet(context.TODO(), 1234)
+	require.NoError(t, err)
+	require.Equal(t, model.LabelSet{"pid": "1234", "lookup": "2"}, ls)
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/procfs"
+
+	"github.com/parca-dev/parca-agent/pkg/cache"
+	"github.com/parca-dev/parca-agent/pkg/config"
+	"github.com/parca-dev/parca-agent/pkg/process"
+)
+
+type processLabelsProvider struct {
+	StatelessProvider
+}
+
+func (p *processLabelsProvider) ShouldCache() bool {
+	// Uses its own cache.
+	return false
+}
+
+// ProcessLabels provides labels from the environment variables and
+// the command line of processes, as allowed by the config.
+func ProcessLabels(reg prometheus.Registerer, procfs procfs.FS, cfg *config.ProcessLabelsConfig) Provider {
+	cache := cache.NewLRUCache[process.ID, model.LabelSet](
+		prometheus.WrapRegistererWith(prometheus.Labels{"cache": "metadata_process_labels"}, reg),
+		1024,
+	)
+	return &processLabelsProvider{
+		StatelessProvider{"process_labels", func(ctx context.Context, pid int) (model.LabelSet, error) {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			p, err := procfs.Proc(pid)
+			if err != nil {
+				return nil, fmt.Errorf("failed to instantiate procfs for PID %d: %w", pid, err)
+			}
+
+			// Cached by process identity, a process reusing the PID is looked up again.
+			id, err := process.NewID(p)
+			if err != nil {
+				return nil, err
+			}
+			if cachedLabels, ok := cache.Get(id); ok {
+				return cachedLabels, nil
+			}
+
+			labels := model.LabelSet{}
+			if len(cfg.Environ) > 0 {
+				environ, err := p.Environ()
+				if err != nil {
+					return nil, fmt.Errorf("failed to get environment for PID %d: %w", pid, err)
+				}
+				for _, kv := range environ {
+					k, v, ok := strings.Cut(kv, "=")
+					if !ok || v == "" {
+						continue
+					}
+					if name, ok := cfg.Environ[k]; ok {
+						labels[name] = model.LabelValue(v)
+					}
+				}
+			}
+
+			if len(cfg.Cmdline) > 0 {
+				args, err := p.CmdLine()
+				if err != nil {
+					return nil, fmt.Errorf("failed to get command line for PID %d: %w", pid, err)
+				}
+				cmdline := strings.Join(args, " ")
+				for _, c := range cfg.Cmdline {
+					indexes := c.Regex.FindStringSubmatchIndex(cmdline)
+					if indexes == nil {
+						continue
+					}
+					if v := c.Regex.ExpandString(nil, c.Replacement, cmdline, indexes); len(v) > 0 {
+						labels[c.TargetLabel] = model.LabelValue(v)
+					}
+				}
+			}
+
+			cache.Add(id, labels)
+			return labels, nil
+		}},
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/procfs"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/config"
+)
+
+// writeProc writes the procfs files of a fake process.
+func writeProc(t *testing.T, root string, pid int, startTime uint64, environ, cmdline []string) {
+	t.Helper()
+
+	dir := filepath.Join(root, fmt.Sprint(pid))
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+
+	stat := fmt.Sprintf("%d (app) S 1 %d %d 0 -1 4194560 0 0 0 0 0 0 0 0 20 0 1 0 %d 1000000 100 18446744073709551615 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0 0 0 0 0 0 0 0 0\n", pid, pid, pid, startTime)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "environ"), []byte(strings.Join(environ, "\x00")+"\x00"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cmdline"), []byte(strings.Join(cmdline, "\x00")+"\x00"), 0o644))
+}
+
+func TestProcessLabels(t *testing.T) {
+	root := t.TempDir()
+	fs, err := procfs.NewFS(root)
+	require.NoError(t, err)
+
+	cfg, err := config.Load(`metadata:
+  process_labels:
+    environ:
+      APP_VERSION: app_version
+      DEPLOY_ENV: env
+    cmdline:
+    - regex: '.*--region[= ](\S+).*'
+      target_label: region
+    - regex: '.*-Dservice\.name=(\S+).*'
+      target_label: service
+      replacement: java-$1
+`)
+	require.NoError(t, err)
+	p := ProcessLabels(prometheus.NewRegistry(), fs, cfg.Metadata.ProcessLabels)
+
+	writeProc(t, root, 1234, 100,
+		[]string{"APP_VERSION=1.2.3", "DEPLOY_ENV=", "DATABASE_PASSWORD=hunter2", "PATH=/usr/bin"},
+		[]string{"/usr/bin/app", "--region", "eu-west-1", "--token=secret"},
+	)
+	lset, err := p.Labels(context.Background(), 1234)
+	require.NoError(t, err)
+	require.Equal(t, model.LabelSet{"app_version": "1.2.3", "region": "eu-west-1"}, lset)
+
+	// Labels are cached as long as the process lives.
+	writeProc(t, root, 1234, 100, []string{"APP_VERSION=1.2.4"}, nil)
+	lset, err = p.Labels(context.Background(), 1234)
+	require.NoError(t, err)
+	require.Equal(t, model.LabelSet{"app_version": "1.2.3", "region": "eu-west-1"}, lset)
+
+	// A process reusing the PID is looked up again.
+	writeProc(t, root, 1234, 200,
+		[]string{"DEPLOY_ENV=production"},
+		[]string{"java", "-Dservice.name=checkout", "-jar", "app.jar"},
+	)
+	lset, err = p.Labels(context.Background(), 1234)
+	require.NoError(t, err)
+	require.Equal(t, model.LabelSet{"env": "production", "service": "java-checkout"}, lset)
+}
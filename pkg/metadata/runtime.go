@@ -0,0 +1,199 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package metadata
+
+import (
+	"context"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/procfs"
+
+	"github.com/parca-dev/parca-agent/pkg/cache"
+	"github.com/parca-dev/parca-agent/pkg/namespace"
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
+	"github.com/parca-dev/parca-agent/pkg/runtime"
+	"github.com/parca-dev/parca-agent/pkg/runtime/java"
+)
+
+// Runtime provides the language runtime of processes and its version.
+// The executable is looked at first, then the shared libraries embedding a runtime.
+func Runtime(logger log.Logger, procfs procfs.FS, reg prometheus.Registerer, objFilePool *objectfile.Pool, nsCache *namespace.Cache) Provider {
+	javaCache := java.NewHSPerfDataCache(logger, reg, nsCache)
+	// Keyed by file, so that processes running the same binary share the
+	// result, nil if the binary belongs to no runtime.
+	cache := cache.NewLRUCache[runtimeCacheKey, *runtime.Runtime](
+		prometheus.WrapRegistererWith(prometheus.Labels{"cache": "metadata_runtime"}, reg),
+		512,
+	)
+	detect := func(pid int, path string, f func(string, *elf.File) (*runtime.Runtime, error)) (*runtime.Runtime, error) {
+		path = filepath.Join(fmt.Sprintf("/proc/%d/root", pid), path)
+		key, err := newRuntimeCacheKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+		if rt, ok := cache.Get(key); ok {
+			return rt, nil
+		}
+
+		obj, err := objFilePool.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open ELF file for process %d: %w", pid, err)
+		}
+
+		ef, release, err := obj.ELF()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get ELF file for process %d: %w", pid, err)
+		}
+		defer release()
+
+		rt, err := f(path, ef)
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine the runtime of %s: %w", path, err)
+		}
+		cache.Add(key, rt)
+		return rt, nil
+	}
+
+	return &StatelessProvider{"runtime", func(ctx context.Context, pid int) (model.LabelSet, error) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		javaProcess, err := javaCache.IsJavaProcess(pid)
+		if err != nil {
+			level.Debug(logger).Log("msg", "failed to determine if process is a java process", "pid", pid, "err", err)
+		}
+		if javaProcess {
+			return javaLabels(logger, javaCache, pid), nil
+		}
+
+		p, err := procfs.Proc(pid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to instantiate procfs for PID %d: %w", pid, err)
+		}
+
+		// Avoid opening the executable of the most common interpreter.
+		comm, err := p.Comm()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get comm for PID %d: %w", pid, err)
+		}
+		if strings.HasPrefix(comm, "python") {
+			return runtimeLabels(&runtime.Runtime{Name: runtime.Python}), nil
+		}
+
+		executable, err := p.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get executable for PID %d: %w", pid, err)
+		}
+
+		rt, err := detect(pid, executable, runtime.ForExecutable)
+		if err != nil {
+			return nil, err
+		}
+		if rt != nil {
+			return runtimeLabels(rt), nil
+		}
+
+		maps, err := p.ProcMaps()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get memory mappings for PID %d: %w", pid, err)
+		}
+		seen := map[string]struct{}{}
+		for _, m := range maps {
+			if !runtime.IsRuntimeLibrary(m.Pathname) {
+				continue
+			}
+			if _, ok := seen[m.Pathname]; ok {
+				continue
+			}
+			seen[m.Pathname] = struct{}{}
+
+			rt, err := detect(pid, m.Pathname, runtime.ForLibrary)
+			if err != nil {
+				return nil, err
+			}
+			if rt != nil {
+				return runtimeLabels(rt), nil
+			}
+		}
+
+		return nil, nil
+	}}
+}
+
+// runtimeCacheKey identifies a file across processes and mount namespaces.
+// The change time tells files apart that were replaced in place and reuse the
+// inode.
+type runtimeCacheKey struct {
+	device       uint64
+	inode        uint64
+	creationTime syscall.Timespec
+}
+
+func newRuntimeCacheKey(path string) (runtimeCacheKey, error) {
+	fileinfo, err := os.Stat(path)
+	if err != nil {
+		return runtimeCacheKey{}, err
+	}
+
+	stat, ok := fileinfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return runtimeCacheKey{}, errors.New("fileinfo didn't have stat_t")
+	}
+
+	return runtimeCacheKey{
+		device:       stat.Dev,
+		inode:        stat.Ino,
+		creationTime: stat.Ctim,
+	}, nil
+}
+
+func runtimeLabels(rt *runtime.Runtime) model.LabelSet {
+	labels := model.LabelSet{
+		"runtime": model.LabelValue(rt.Name),
+	}
+	if rt.Version != "" {
+		labels["runtime_version"] = model.LabelValue(rt.Version)
+	}
+	return labels
+}
+
+// javaLabels returns the labels of a JVM from its hsperfdata file.
+func javaLabels(logger log.Logger, javaCache *java.HSPerfDataCache, pid int) model.LabelSet {
+	pd, err := javaCache.PerfData(pid)
+	if err != nil {
+		level.Debug(logger).Log("msg", "failed to read hsperfdata", "pid", pid, "err", err)
+		return runtimeLabels(&runtime.Runtime{Name: runtime.Java})
+	}
+
+	labels := runtimeLabels(&runtime.Runtime{Name: runtime.Java, Version: pd.Version()})
+	if mainClass := pd.MainClass(); mainClass != "" {
+		labels["java_main_class"] = model.LabelValue(mainClass)
+	}
+	if gc := pd.GC(); gc != "" {
+		labels["java_gc"] = model.LabelValue(gc)
+	}
+	return labels
+}
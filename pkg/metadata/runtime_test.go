@@ -0,0 +1,45 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuntimeCacheKey(t *testing.T) {
+	dir := t.TempDir()
+	executable := filepath.Join(dir, "python3")
+	require.NoError(t, os.WriteFile(executable, []byte("ELF"), 0o755))
+	// The same executable as seen from another process' root.
+	require.NoError(t, os.Symlink(dir, filepath.Join(dir, "root")))
+	other := filepath.Join(dir, "node")
+	require.NoError(t, os.WriteFile(other, []byte("ELF"), 0o755))
+
+	key, err := newRuntimeCacheKey(executable)
+	require.NoError(t, err)
+	sameKey, err := newRuntimeCacheKey(filepath.Join(dir, "root", "python3"))
+	require.NoError(t, err)
+	require.Equal(t, key, sameKey)
+
+	otherKey, err := newRuntimeCacheKey(other)
+	require.NoError(t, err)
+	require.NotEqual(t, key, otherKey)
+
+	_, err = newRuntimeCacheKey(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
@@ -74,6 +74,34 @@ func (p *ServiceDiscoveryProvider) Labels(ctx context.Context, pid int) (model.L
 	return model.LabelSet{}, errors.New("not found")
 }
 
+// Targets returns the labels of the discovered targets by PID.
+// The returned map must not be modified.
+func (p *ServiceDiscoveryProvider) Targets() map[int]model.LabelSet {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.state
+}
+
+// TargetSettings returns the settings that the target of the process asked for,
+// e.g. through the annotations of its pod.
+func (p *ServiceDiscoveryProvider) TargetSettings(ctx context.Context, pid int) discovery.TargetSettings {
+	lset, err := p.Labels(ctx, pid)
+	if err != nil {
+		return discovery.DefaultTargetSettings
+	}
+
+	settings, err := discovery.TargetSettingsFromLabels(lset)
+	if err != nil {
+		level.Debug(p.logger).Log("msg", "invalid target settings", "pid", pid, "err", err)
+	}
+	return settings
+}
+
+// DebuginfoUploadEnabled returns whether the debuginfo of the process may be uploaded.
+func (p *ServiceDiscoveryProvider) DebuginfoUploadEnabled(ctx context.Context, pid int) bool {
+	return p.TargetSettings(ctx, pid).DebuginfoUpload
+}
+
 // ServiceDiscovery metadata provider.
 func ServiceDiscovery(logger log.Logger, ch <-chan map[string][]discovery.Group, psTree *process.Tree) *ServiceDiscoveryProvider {
 	return &ServiceDiscoveryProvider{
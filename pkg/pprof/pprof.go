@@ -152,8 +152,9 @@ func (m *Manager) NewConverter(
 }
 
 const (
-	threadIDLabel   = "thread_id"
-	threadNameLabel = "thread_name"
+	threadIDLabel       = "thread_id"
+	threadNameLabel     = "thread_name"
+	stackTruncatedLabel = "stack_truncated"
 )
 
 // Convert converts a profile to a pprof profile. It is intended to only be
@@ -216,6 +217,9 @@ func (c *Converter) Convert(ctx context.Context, rawData []profile.RawSample) (*
 		if threadName != "" {
 			pprofSample.Label[threadNameLabel] = append(pprofSample.Label[threadNameLabel], threadName)
 		}
+		if sample.Truncated {
+			pprofSample.Label[stackTruncatedLabel] = append(pprofSample.Label[stackTruncatedLabel], "true")
+		}
 
 		c.result.Sample = append(c.result.Sample, pprofSample)
 	}
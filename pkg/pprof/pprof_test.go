@@ -0,0 +1,48 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pprof
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/procfs"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/ksym"
+	"github.com/parca-dev/parca-agent/pkg/profile"
+)
+
+func TestConvertStackTruncated(t *testing.T) {
+	logger := log.NewNopLogger()
+	reg := prometheus.NewRegistry()
+	m := NewManager(logger, reg, ksym.NewKsym(logger, reg, t.TempDir(), fstest.MapFS{}), nil, nil, nil, false)
+
+	pfs, err := procfs.NewFS(t.TempDir())
+	require.NoError(t, err)
+
+	p, err := m.NewConverter(pfs, 1, nil, time.Now(), 1e7).Convert(context.Background(), []profile.RawSample{
+		{TID: 1, Value: 1},
+		{TID: 1, Value: 2, Truncated: true},
+	})
+	require.NoError(t, err)
+	require.Len(t, p.Sample, 2)
+	require.NotContains(t, p.Sample[0].Label, stackTruncatedLabel)
+	require.Equal(t, []string{"true"}, p.Sample[1].Label[stackTruncatedLabel])
+	require.Equal(t, []string{"1"}, p.Sample[1].Label[threadIDLabel])
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package process
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/procfs"
+
+	"github.com/parca-dev/parca-agent/pkg/cache"
+)
+
+// idRefreshInterval is how long a resolved identity is used before the stat of
+// the process is read again. The lookups of a profile happen within it.
+const idRefreshInterval = time.Second
+
+// ID identifies a process. PIDs are reused on busy hosts,
+// the start time tells apart the processes that were given the same PID.
+type ID struct {
+	PID int
+	// StartTime is the time the process started after system boot in clock ticks,
+	// as in the 22nd field of /proc/[pid]/stat.
+	StartTime uint64
+}
+
+// NewID returns the identity of the given process.
+func NewID(proc procfs.Proc) (ID, error) {
+	stat, err := proc.Stat()
+	if err != nil {
+		return ID{}, fmt.Errorf("failed to get stat for PID %d: %w", proc.PID, err)
+	}
+	return ID{PID: proc.PID, StartTime: stat.Starttime}, nil
+}
+
+// IDForPID returns the identity of the process with the given PID.
+// If the process can not be looked up, e.g. because it has exited,
+// the identity only holds the PID.
+func IDForPID(fs procfs.FS, pid int) ID {
+	proc, err := fs.Proc(pid)
+	if err != nil {
+		return ID{PID: pid}
+	}
+	id, err := NewID(proc)
+	if err != nil {
+		return ID{PID: pid}
+	}
+	return id
+}
+
+func (id ID) String() string {
+	return fmt.Sprintf("%d:%d", id.PID, id.StartTime)
+}
+
+type resolvedID struct {
+	id         ID
+	resolvedAt time.Time
+}
+
+// IDResolver resolves PIDs to process identities. It remembers the latest
+// identity of every PID, so that the processes that have exited since they
+// were sampled still resolve to the identity their information is cached with.
+type IDResolver struct {
+	fs procfs.FS
+
+	refreshInterval time.Duration
+	latest          *cache.LRUCacheWithTTL[int, resolvedID]
+}
+
+// NewIDResolver returns a resolver that remembers the identities of processes
+// for the given retention after they were last looked up.
+func NewIDResolver(reg prometheus.Registerer, fs procfs.FS, retention time.Duration) *IDResolver {
+	return &IDResolver{
+		fs:              fs,
+		refreshInterval: idRefreshInterval,
+		latest: cache.NewLRUCacheWithTTL[int, resolvedID](
+			reg,
+			4096,
+			retention,
+			cache.CacheWithTTLOptions{
+				RemoveExpiredOnAdd: true,
+			},
+		),
+	}
+}
+
+// ID returns the identity of the process with the given PID. If the process
+// can not be looked up anymore, it returns the latest identity seen for the
+// PID, or an identity that only holds the PID if there is none.
+func (r *IDResolver) ID(pid int) ID {
+	now := time.Now()
+	latest, ok := r.latest.Get(pid)
+	if ok && now.Sub(latest.resolvedAt) < r.refreshInterval {
+		return latest.id
+	}
+
+	id := IDForPID(r.fs, pid)
+	if id.StartTime == 0 {
+		if !ok {
+			return id
+		}
+		// The process has exited.
+		id = latest.id
+	}
+	r.latest.Add(pid, resolvedID{id: id, resolvedAt: now})
+	return id
+}
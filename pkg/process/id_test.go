@@ -0,0 +1,83 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package process
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/procfs"
+	"github.com/stretchr/testify/require"
+)
+
+// writeStat writes the stat file of a process to the proc file system at root.
+func writeStat(t *testing.T, root string, pid int, comm string, startTime uint64) {
+	t.Helper()
+
+	dir := filepath.Join(root, fmt.Sprint(pid))
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	stat := fmt.Sprintf("%d (%s) S 1 %d %d 0 -1 4194560 0 0 0 0 0 0 0 0 20 0 1 0 %d 1000000 100 18446744073709551615 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0 0 0 0 0 0 0 0 0\n", pid, comm, pid, pid, startTime)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0o644))
+}
+
+func TestIDForPID(t *testing.T) {
+	root := t.TempDir()
+	fs, err := procfs.NewFS(root)
+	require.NoError(t, err)
+	writeStat := func(pid int, comm string, startTime uint64) {
+		writeStat(t, root, pid, comm, startTime)
+	}
+
+	// The comm can contain spaces and parentheses.
+	writeStat(1234, "web (worker) 1", 100)
+	first := IDForPID(fs, 1234)
+	require.Equal(t, ID{PID: 1234, StartTime: 100}, first)
+
+	// A new process reusing the PID has a different identity.
+	writeStat(1234, "cron", 200)
+	second := IDForPID(fs, 1234)
+	require.Equal(t, ID{PID: 1234, StartTime: 200}, second)
+	require.NotEqual(t, first.String(), second.String())
+
+	// Processes that can not be looked up only have a PID.
+	require.Equal(t, ID{PID: 4321}, IDForPID(fs, 4321))
+}
+
+func TestIDResolver(t *testing.T) {
+	root := t.TempDir()
+	fs, err := procfs.NewFS(root)
+	require.NoError(t, err)
+	r := NewIDResolver(nil, fs, time.Minute)
+
+	writeStat(t, root, 1234, "web", 100)
+	require.Equal(t, ID{PID: 1234, StartTime: 100}, r.ID(1234))
+
+	// The stat is not read again right away.
+	writeStat(t, root, 1234, "cron", 200)
+	require.Equal(t, ID{PID: 1234, StartTime: 100}, r.ID(1234))
+
+	// A new process reusing the PID is seen once the identity is refreshed.
+	r.refreshInterval = 0
+	require.Equal(t, ID{PID: 1234, StartTime: 200}, r.ID(1234))
+
+	// Processes that have exited keep their latest identity.
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "1234")))
+	require.Equal(t, ID{PID: 1234, StartTime: 200}, r.ID(1234))
+
+	// Processes that were never seen only have a PID.
+	require.Equal(t, ID{PID: 4321}, r.ID(4321))
+}
@@ -45,6 +45,11 @@ type DebuginfoManager interface {
 	Close() error
 }
 
+// DebuginfoUploadPolicy decides whether the debuginfo of a process may be uploaded.
+type DebuginfoUploadPolicy interface {
+	DebuginfoUploadEnabled(ctx context.Context, pid int) bool
+}
+
 // TODO: Unify PID types.
 type LabelManager interface {
 	Fetch(ctx context.Context, pid int) error
@@ -120,14 +125,17 @@ type InfoManager struct {
 	tracer  trace.Tracer
 	metrics *metrics
 
-	cache                     Cache[int, Info]
+	// cache is keyed by process identity, a process reusing a PID gets its own mappings.
+	cache                     Cache[ID, Info]
 	shouldInitiateUploadCache Cache[string, struct{}]
 	uploadInflight            *xsync.MapOf[string, struct{}]
 
+	ids              *IDResolver
 	procFS           procfs.FS
 	objFilePool      *objectfile.Pool
 	mapManager       *MapManager
 	debuginfoManager DebuginfoManager
+	uploadPolicy     DebuginfoUploadPolicy
 	labelManager     LabelManager
 
 	uploadJobQueue chan *uploadJob
@@ -142,6 +150,7 @@ func NewInfoManager(
 	objFilePool *objectfile.Pool,
 	mm *MapManager,
 	dim DebuginfoManager,
+	uploadPolicy DebuginfoUploadPolicy,
 	lm LabelManager,
 	profilingDuration time.Duration,
 	cacheTTL time.Duration,
@@ -150,7 +159,7 @@ func NewInfoManager(
 		logger:  logger,
 		tracer:  tracer,
 		metrics: newMetrics(reg),
-		cache: cache.NewLRUCacheWithTTL[int, Info](
+		cache: cache.NewLRUCacheWithTTL[ID, Info](
 			prometheus.WrapRegistererWith(prometheus.Labels{"cache": "process_info"}, reg),
 			1024,
 			12*profilingDuration,
@@ -163,11 +172,18 @@ func NewInfoManager(
 			1024,
 			cacheTTL,
 		),
+		// Identities are kept as long as the process information.
+		ids: NewIDResolver(
+			prometheus.WrapRegistererWith(prometheus.Labels{"cache": "process_info_id"}, reg),
+			proceFS,
+			12*profilingDuration,
+		),
 		uploadInflight:   xsync.NewMapOf[struct{}](),
 		procFS:           proceFS,
 		objFilePool:      objFilePool,
 		mapManager:       mm,
 		debuginfoManager: dim,
+		uploadPolicy:     uploadPolicy,
 		labelManager:     lm,
 
 		uploadJobQueue: make(chan *uploadJob, 128),
@@ -213,9 +229,10 @@ func (im *InfoManager) Fetch(ctx context.Context, pid int) (Info, error) {
 func (im *InfoManager) fetch(ctx context.Context, pid int) (info Info, err error) { //nolint:nonamedreturns
 	// Cache will keep the value as long as the process is sends to the event channel.
 	// See the cache initialization for the eviction policy and the eviction TTL.
-	info, exists := im.cache.Peek(pid)
+	id := im.ids.ID(pid)
+	info, exists := im.cache.Peek(id)
 	if exists {
-		im.ensureDebuginfoUploaded(ctx, info.Mappings)
+		im.ensureDebuginfoUploaded(ctx, pid, info.Mappings)
 		return info, nil
 	}
 
@@ -258,7 +275,7 @@ func (im *InfoManager) fetch(ctx context.Context, pid int) (info Info, err error
 	}
 
 	// Upload debug information of the discovered object files.
-	im.ensureDebuginfoUploaded(ctx, mappings)
+	im.ensureDebuginfoUploaded(ctx, pid, mappings)
 
 	// No matter what happens with the debug information, we should continue.
 	// And cache other process information.
@@ -267,7 +284,7 @@ func (im *InfoManager) fetch(ctx context.Context, pid int) (info Info, err error
 		pid:      pid,
 		Mappings: mappings,
 	}
-	im.cache.Add(pid, info)
+	im.cache.Add(id, info)
 
 	now = time.Now()
 	defer func() {
@@ -287,7 +304,7 @@ func (im *InfoManager) Info(ctx context.Context, pid int) (Info, error) {
 
 	im.metrics.get.Inc()
 
-	info, ok := im.cache.Get(pid)
+	info, ok := im.cache.Get(im.ids.ID(pid))
 	if ok {
 		return info, nil
 	}
@@ -297,10 +314,14 @@ func (im *InfoManager) Info(ctx context.Context, pid int) (Info, error) {
 
 // ensureDebuginfoUploaded extracts the debug information of the given mappings and uploads them to the debuginfo manager.
 // It is a best effort operation, so it will continue even if it fails to ensure debug information of a mapping uploaded.
-func (im *InfoManager) ensureDebuginfoUploaded(ctx context.Context, mappings Mappings) {
+// Processes can opt out of the upload through the upload policy.
+func (im *InfoManager) ensureDebuginfoUploaded(ctx context.Context, pid int, mappings Mappings) {
 	if im.debuginfoManager == nil {
 		return
 	}
+	if im.uploadPolicy != nil && !im.uploadPolicy.DebuginfoUploadEnabled(ctx, pid) {
+		return
+	}
 
 	for _, m := range mappings {
 		if !m.containsDebuginfoToUpload {
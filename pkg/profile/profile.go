@@ -27,6 +27,8 @@ type RawSample struct {
 	UserStack   []uint64
 	KernelStack []uint64
 	Value       uint64
+	// Truncated is set if the user stack had more frames than were walked.
+	Truncated bool
 }
 
 type RawData []ProcessRawData
@@ -0,0 +1,211 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cpu
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+
+	"github.com/parca-dev/parca-agent/pkg/cgroup"
+	"github.com/parca-dev/parca-agent/pkg/config"
+)
+
+// Always need to be in sync with CGROUP_FILTER_* in the BPF program.
+const (
+	cgroupFilterNone  uint8 = 0
+	cgroupFilterAllow uint8 = 1
+	cgroupFilterDeny  uint8 = 2
+)
+
+// CgroupFilter keeps the cgroup filter of the BPF program in sync with the
+// cgroups of the discovered targets selected by the config.
+type CgroupFilter struct {
+	logger log.Logger
+
+	// targets returns the discovered targets by PID.
+	targets  func() map[int]model.LabelSet
+	cgroupID func(pid int) (uint64, error)
+
+	mtx      *sync.Mutex
+	mode     config.CgroupFilterMode
+	matchers []config.LabelMatchers
+
+	// Cgroup IDs of the discovered targets by PID.
+	cgroupIDs map[int]uint64
+	// Cgroup IDs that are currently in the BPF map.
+	filtered map[uint64]struct{}
+}
+
+// NewCgroupFilter creates a new CgroupFilter, a nil config disables the filter.
+func NewCgroupFilter(logger log.Logger, cfg *config.CgroupFilterConfig, targets func() map[int]model.LabelSet) *CgroupFilter {
+	f := &CgroupFilter{
+		logger:    logger,
+		targets:   targets,
+		cgroupID:  cgroupIDForPID,
+		mtx:       &sync.Mutex{},
+		cgroupIDs: map[int]uint64{},
+		filtered:  map[uint64]struct{}{},
+	}
+	if cfg != nil {
+		f.mode = cfg.Mode
+		f.matchers = cfg.Targets
+	}
+	return f
+}
+
+// ApplyConfig updates the targets that are selected by the filter.
+// The mode of the filter is part of the BPF program and can not be changed.
+func (f *CgroupFilter) ApplyConfig(cfg *config.CgroupFilterConfig) error {
+	var (
+		mode     config.CgroupFilterMode
+		matchers []config.LabelMatchers
+	)
+	if cfg != nil {
+		mode = cfg.Mode
+		matchers = cfg.Targets
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if mode != f.mode {
+		return errors.New("changing the cgroup filter mode requires a restart")
+	}
+	f.matchers = matchers
+	return nil
+}
+
+// bpfMode returns the mode as understood by the BPF program.
+func (f *CgroupFilter) bpfMode() uint8 {
+	if f == nil {
+		return cgroupFilterNone
+	}
+	switch f.mode {
+	case config.CgroupFilterAllow:
+		return cgroupFilterAllow
+	case config.CgroupFilterDeny:
+		return cgroupFilterDeny
+	default:
+		return cgroupFilterNone
+	}
+}
+
+func (f *CgroupFilter) run(ctx context.Context, maps *bpfMaps) {
+	if f.bpfMode() == cgroupFilterNone {
+		return
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		f.sync(maps)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync adds the selected cgroups to the BPF map and removes the ones that are not selected anymore.
+func (f *CgroupFilter) sync(maps *bpfMaps) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	selected := f.selected()
+	for id := range selected {
+		if _, ok := f.filtered[id]; ok {
+			continue
+		}
+		if err := maps.addCgroupToFilter(id); err != nil {
+			level.Warn(f.logger).Log("msg", "failed to update cgroup filter", "err", err)
+			continue
+		}
+		f.filtered[id] = struct{}{}
+	}
+	for id := range f.filtered {
+		if _, ok := selected[id]; ok {
+			continue
+		}
+		if err := maps.removeCgroupFromFilter(id); err != nil {
+			level.Warn(f.logger).Log("msg", "failed to update cgroup filter", "err", err)
+			continue
+		}
+		delete(f.filtered, id)
+	}
+}
+
+// selected returns the cgroup IDs of the discovered targets matching any of the matchers.
+// It must be called with the lock held.
+func (f *CgroupFilter) selected() map[uint64]struct{} {
+	targets := f.targets()
+
+	// Forget the cgroups of targets that are gone, their PIDs might be reused.
+	for pid := range f.cgroupIDs {
+		if _, ok := targets[pid]; !ok {
+			delete(f.cgroupIDs, pid)
+		}
+	}
+
+	selected := map[uint64]struct{}{}
+	for pid, lset := range targets {
+		if !matchesAny(f.matchers, lset) {
+			continue
+		}
+
+		id, ok := f.cgroupIDs[pid]
+		if !ok {
+			var err error
+			id, err = f.cgroupID(pid)
+			if err != nil {
+				level.Debug(f.logger).Log("msg", "failed to find cgroup of target", "pid", pid, "err", err)
+				continue
+			}
+			f.cgroupIDs[pid] = id
+		}
+		selected[id] = struct{}{}
+	}
+	return selected
+}
+
+func matchesAny(matchers []config.LabelMatchers, lset model.LabelSet) bool {
+	for _, m := range matchers {
+		if m.Matches(lset) {
+			return true
+		}
+	}
+	return false
+}
+
+// cgroupIDForPID returns the cgroup v2 ID of the given process.
+func cgroupIDForPID(pid int) (uint64, error) {
+	_, cgroupPathV2, err := cgroup.Paths(pid)
+	if err != nil {
+		return 0, err
+	}
+	path, err := cgroup.PathV2AddMountpoint(cgroupPathV2)
+	if err != nil {
+		return 0, err
+	}
+	return cgroup.ID(path)
+}
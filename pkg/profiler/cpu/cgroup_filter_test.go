@@ -0,0 +1,63 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cpu
+
+import (
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/config"
+)
+
+func TestCgroupFilterSelected(t *testing.T) {
+	targets := map[int]model.LabelSet{
+		1: {"namespace": "production", "pod": "checkout-1"},
+		2: {"namespace": "production", "pod": "checkout-2"},
+		3: {"namespace": "batch", "pod": "nightly"},
+		4: {"systemd_unit": "postgresql.service"},
+	}
+
+	f := NewCgroupFilter(log.NewNopLogger(), &config.CgroupFilterConfig{
+		Mode: config.CgroupFilterAllow,
+		Targets: []config.LabelMatchers{
+			{"namespace": relabel.MustNewRegexp("production")},
+			{"systemd_unit": relabel.MustNewRegexp("postgresql.service")},
+		},
+	}, func() map[int]model.LabelSet { return targets })
+	f.cgroupID = func(pid int) (uint64, error) {
+		// Both checkout pods share a cgroup.
+		return map[int]uint64{1: 100, 2: 100, 3: 300, 4: 400}[pid], nil
+	}
+
+	require.Equal(t, cgroupFilterAllow, f.bpfMode())
+	require.Equal(t, map[uint64]struct{}{100: {}, 400: {}}, f.selected())
+
+	require.Error(t, f.ApplyConfig(&config.CgroupFilterConfig{Mode: config.CgroupFilterDeny}))
+	require.NoError(t, f.ApplyConfig(&config.CgroupFilterConfig{
+		Mode:    config.CgroupFilterAllow,
+		Targets: []config.LabelMatchers{{"namespace": relabel.MustNewRegexp("batch")}},
+	}))
+
+	delete(targets, 1)
+	require.Equal(t, map[uint64]struct{}{300: {}}, f.selected())
+	require.NotContains(t, f.cgroupIDs, 1)
+
+	var disabled *CgroupFilter
+	require.Equal(t, cgroupFilterNone, disabled.bpfMode())
+}
@@ -34,6 +34,9 @@ import (
 	"unsafe"
 
 	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/features"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
@@ -42,8 +45,10 @@ import (
 	"golang.org/x/sys/unix"
 
 	"github.com/parca-dev/parca-agent/pkg/byteorder"
+	"github.com/parca-dev/parca-agent/pkg/config"
 	"github.com/parca-dev/parca-agent/pkg/cpuinfo"
 	"github.com/parca-dev/parca-agent/pkg/metadata/labels"
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
 	"github.com/parca-dev/parca-agent/pkg/pprof"
 	"github.com/parca-dev/parca-agent/pkg/profile"
 	"github.com/parca-dev/parca-agent/pkg/profiler"
@@ -59,21 +64,38 @@ var (
 )
 
 const (
-	stackDepth       = 127 // Always needs to be sync with MAX_STACK_DEPTH in BPF program.
-	doubleStackDepth = stackDepth * 2
-
-	programName              = "profile_cpu"
-	dwarfUnwinderProgramName = "walk_user_stacktrace_impl"
-	configKey                = "unwinder_config"
+	stackDepth     = 512 // Always needs to be sync with MAX_STACK_DEPTH in BPF program.
+	perfStackDepth = 127 // Always needs to be sync with MAX_PERF_STACK_DEPTH in BPF program.
+	// Deepest stack walked on kernels without bpf_loop, which is
+	// (MAX_TAIL_CALLS + 1) * MAX_STACK_DEPTH_PER_PROGRAM in the BPF program.
+	tailCallStackDepth = 480
+
+	programName                  = "profile_cpu"
+	dwarfUnwinderProgramName     = "walk_user_stacktrace_impl"
+	dwarfUnwinderLoopProgramName = "walk_user_stacktrace_loop"
+	configKey                    = "unwinder_config"
 )
 
+// MaxStackDepth is the maximum number of frames of the user stacks walked
+// with DWARF unwind information.
+const MaxStackDepth = stackDepth
+
 type Config struct {
 	FilterProcesses   bool
 	VerboseLogging    bool
 	MixedStackWalking bool
+	CgroupFilterMode  uint8
+	MaxStackDepth     uint32
 }
 
-type combinedStack [doubleStackDepth]uint64
+// combinedStack is a user stack followed by a kernel stack.
+type combinedStack [stackDepth + perfStackDepth]uint64
+
+// stackSample identifies the samples of a thread with the same stacks.
+type stackSample struct {
+	stack     combinedStack
+	truncated bool
+}
 
 type CPU struct {
 	logger  log.Logger
@@ -104,13 +126,34 @@ type CPU struct {
 	lastProfileStartedAt           time.Time
 
 	debugProcessNames     []string
+	debugProcessMatchers  []*regexp.Regexp
 	dwarfUnwindingDisable bool
 
+	// Rules deciding how each process is profiled, and the settings written
+	// to the BPF program for the processes that do not use the defaults.
+	targetRules   []*config.TargetRule
+	targetConfigs map[int]targetConfig
+
+	// File descriptors of the perf events the BPF program is attached to,
+	// used to update the sampling frequency at runtime.
+	perfEventFds []int
+
 	memlockRlimit     uint64
 	bpfLoggingVerbose bool
 
 	mixedUnwinding    bool
 	verboseBpfLogging bool
+	// Frames walked with DWARF unwind information before the stack is
+	// recorded as truncated.
+	maxStackDepth uint32
+
+	cgroupFilter   *CgroupFilter
+	targetSettings TargetSettingsProvider
+
+	// Separate debug files, for the .debug_frame section of executables that have none.
+	debugFiles *debugFiles
+	// Unwind tables generated in previous runs, nil if disabled.
+	unwindTableCache *unwind.TableCache
 
 	// Notify that the BPF program was loaded.
 	bpfProgramLoaded chan bool
@@ -132,6 +175,12 @@ func NewCPUProfiler(
 	disableDWARFUnwinding bool,
 	mixedUnwinding bool,
 	verboseBpfLogging bool,
+	maxStackDepth uint32,
+	cgroupFilter *CgroupFilter,
+	targetSettings TargetSettingsProvider,
+	objFilePool *objectfile.Pool,
+	debugFileFinder DebugFileFinder,
+	unwindTableCache *unwind.TableCache,
 	bpfProgramLoaded chan bool,
 ) *CPU {
 	return &CPU{
@@ -159,10 +208,20 @@ func NewCPUProfiler(
 		memlockRlimit: memlockRlimit,
 
 		debugProcessNames: debugProcessNames,
+		targetConfigs:     map[int]targetConfig{},
 
 		dwarfUnwindingDisable: disableDWARFUnwinding,
 		mixedUnwinding:        mixedUnwinding,
 		bpfLoggingVerbose:     verboseBpfLogging,
+		maxStackDepth:         maxStackDepth,
+		cgroupFilter:          cgroupFilter,
+		targetSettings:        targetSettings,
+
+		debugFiles: &debugFiles{
+			objFilePool: objFilePool,
+			finder:      debugFileFinder,
+		},
+		unwindTableCache: unwindTableCache,
 
 		bpfProgramLoaded: bpfProgramLoaded,
 	}
@@ -191,12 +250,77 @@ func (p *CPU) ProcessLastErrors() map[int]error {
 }
 
 func (p *CPU) debugProcesses() bool {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
 	return len(p.debugProcessNames) > 0
 }
 
+// ApplyConfig updates the sampling frequency and the process name matchers
+// without reloading the BPF program.
+func (p *CPU) ApplyConfig(samplingFrequency uint64, debugProcessNames []string) error {
+	if samplingFrequency == 0 {
+		return errors.New("cpu sampling frequency must be greater than zero")
+	}
+
+	matchers, err := compileMatchers(debugProcessNames)
+	if err != nil {
+		return err
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	// Whether processes are filtered is decided when the BPF program is loaded.
+	if p.bpfMaps != nil && (len(p.debugProcessNames) > 0) != (len(debugProcessNames) > 0) {
+		return errors.New("enabling or disabling process filtering requires a restart")
+	}
+
+	if samplingFrequency != p.profilingSamplingFrequency {
+		for _, fd := range p.perfEventFds {
+			if err := setPerfEventSampleFrequency(fd, samplingFrequency); err != nil {
+				return fmt.Errorf("update perf event sampling frequency: %w", err)
+			}
+		}
+		level.Info(p.logger).Log("msg", "cpu sampling frequency updated", "old", p.profilingSamplingFrequency, "new", samplingFrequency)
+		p.profilingSamplingFrequency = samplingFrequency
+	}
+
+	p.debugProcessNames = debugProcessNames
+	p.debugProcessMatchers = matchers
+	return nil
+}
+
+// setPerfEventSampleFrequency changes the frequency of a perf event opened in frequency mode.
+func setPerfEventSampleFrequency(fd int, frequency uint64) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.PERF_EVENT_IOC_PERIOD, uintptr(unsafe.Pointer(&frequency)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func compileMatchers(exps []string) ([]*regexp.Regexp, error) {
+	matchers := make([]*regexp.Regexp, 0, len(exps))
+	for _, exp := range exps {
+		regex, err := regexp.Compile(exp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile regex: %w", err)
+		}
+		matchers = append(matchers, regex)
+	}
+	return matchers, nil
+}
+
+func (p *CPU) samplingFrequency() uint64 {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.profilingSamplingFrequency
+}
+
 // loadBpfProgram loads the BPF program and maps adjusting the unwind shards to
-// the highest possible value.
-func loadBpfProgram(logger log.Logger, reg prometheus.Registerer, mixedUnwinding, debugEnabled, dwarfUnwindDisabled, verboseBpfLogging bool, memlockRlimit uint64) (*bpf.Module, *bpfMaps, error) {
+// the highest possible value. The unwinder using bpf_loop is only loaded if
+// the kernel supports it.
+func loadBpfProgram(logger log.Logger, reg prometheus.Registerer, mixedUnwinding, debugEnabled, dwarfUnwindDisabled, verboseBpfLogging bool, cgroupFilterMode uint8, maxStackDepth uint32, bpfLoop bool, memlockRlimit uint64) (*bpf.Module, *bpfMaps, error) {
 	var lerr error
 
 	maxLoadAttempts := 10
@@ -251,14 +375,25 @@ func loadBpfProgram(logger log.Logger, reg prometheus.Registerer, mixedUnwinding
 		}
 
 		level.Info(logger).Log("msg", "Attempting to create unwind shards", "count", unwindShards)
-		if err := bpfMaps.adjustMapSizes(debugEnabled, unwindShards); err != nil {
+		if err := bpfMaps.adjustMapSizes(debugEnabled, unwindShards, maxStackDepth); err != nil {
 			return nil, nil, fmt.Errorf("failed to adjust map sizes: %w", err)
 		}
 
-		if err := m.InitGlobalVariable(configKey, Config{FilterProcesses: debugEnabled, VerboseLogging: verboseBpfLogging, MixedStackWalking: mixedUnwinding}); err != nil {
+		if err := m.InitGlobalVariable(configKey, Config{FilterProcesses: debugEnabled, VerboseLogging: verboseBpfLogging, MixedStackWalking: mixedUnwinding, CgroupFilterMode: cgroupFilterMode, MaxStackDepth: maxStackDepth}); err != nil {
 			return nil, nil, fmt.Errorf("init global variable: %w", err)
 		}
 
+		if !bpfLoop {
+			// The verifier rejects programs calling unknown helpers.
+			prog, err := m.GetProgram(dwarfUnwinderLoopProgramName)
+			if err != nil {
+				return nil, nil, fmt.Errorf("get bpf program: %w", err)
+			}
+			if err := prog.SetAutoload(false); err != nil {
+				return nil, nil, fmt.Errorf("disable bpf program: %w", err)
+			}
+		}
+
 		lerr = m.BPFLoadObject()
 		if lerr == nil {
 			return m, bpfMaps, nil
@@ -298,9 +433,7 @@ func (p *CPU) addUnwindTableForProcess(pid int) {
 	err = p.bpfMaps.addUnwindTableForProcess(pid, nil, true)
 	if err != nil {
 		//nolint: gocritic
-		if errors.Is(err, ErrNeedMoreProfilingRounds) {
-			level.Debug(p.logger).Log("msg", "PersistUnwindTable called to soon", "err", err)
-		} else if errors.Is(err, os.ErrNotExist) {
+		if errors.Is(err, os.ErrNotExist) {
 			level.Debug(p.logger).Log("msg", "failed to add unwind table due to a procfs race", "pid", pid, "err", err)
 		} else if errors.Is(err, errTooManyExecutableMappings) {
 			level.Warn(p.logger).Log("msg", "failed to add unwind table due to having too many executable mappings", "pid", pid, "err", err)
@@ -450,6 +583,12 @@ func bpfCheck() error {
 	return result
 }
 
+// bpfLoopSupported returns whether the kernel has the bpf_loop helper, which
+// was added in 5.17.
+func bpfLoopSupported() bool {
+	return features.HaveProgramHelper(ebpf.PerfEvent, asm.FnLoop) == nil
+}
+
 func (p *CPU) Run(ctx context.Context) error {
 	level.Debug(p.logger).Log("msg", "starting cpu profiler")
 
@@ -458,28 +597,44 @@ func (p *CPU) Run(ctx context.Context) error {
 		return fmt.Errorf("bpf check: %w", err)
 	}
 
-	var matchers []*regexp.Regexp
-	if p.debugProcesses() {
+	matchers, err := compileMatchers(p.debugProcessNames)
+	if err != nil {
+		return err
+	}
+	if len(matchers) > 0 {
 		level.Info(p.logger).Log("msg", "process names specified, debugging processes", "matchers", strings.Join(p.debugProcessNames, ", "))
-		for _, exp := range p.debugProcessNames {
-			regex, err := regexp.Compile(exp)
-			if err != nil {
-				return fmt.Errorf("failed to compile regex: %w", err)
-			}
-			matchers = append(matchers, regex)
-		}
 	}
+	p.mtx.Lock()
+	p.debugProcessMatchers = matchers
+	p.mtx.Unlock()
 
 	debugEnabled := len(matchers) > 0
 
-	m, bpfMaps, err := loadBpfProgram(p.logger, p.reg, p.mixedUnwinding, debugEnabled, p.dwarfUnwindingDisable, p.bpfLoggingVerbose, p.memlockRlimit)
+	// Stacks are walked in a single program with bpf_loop if possible, or
+	// in a chain of tail calls that can only walk so many frames otherwise.
+	bpfLoop := bpfLoopSupported()
+	unwinderProgramName := dwarfUnwinderLoopProgramName
+	maxStackDepth := p.maxStackDepth
+	if !bpfLoop {
+		unwinderProgramName = dwarfUnwinderProgramName
+		if maxStackDepth > tailCallStackDepth {
+			level.Warn(p.logger).Log("msg", "bpf_loop is not supported by the kernel, stacks will be truncated after fewer frames", "max_stack_depth", tailCallStackDepth)
+			maxStackDepth = tailCallStackDepth
+		}
+	}
+
+	m, bpfMaps, err := loadBpfProgram(p.logger, p.reg, p.mixedUnwinding, debugEnabled, p.dwarfUnwindingDisable, p.bpfLoggingVerbose, p.cgroupFilter.bpfMode(), maxStackDepth, bpfLoop, p.memlockRlimit)
 	if err != nil {
 		return fmt.Errorf("load bpf program: %w", err)
 	}
 	defer m.Close()
 
 	p.bpfProgramLoaded <- true
+	p.mtx.Lock()
+	bpfMaps.debugFiles = p.debugFiles
+	bpfMaps.tableCache = p.unwindTableCache
 	p.bpfMaps = bpfMaps
+	p.mtx.Unlock()
 
 	// Get bpf metrics
 	agentProc, err := procfs.Self() // pid of parca-agent
@@ -488,52 +643,10 @@ func (p *CPU) Run(ctx context.Context) error {
 	}
 
 	p.reg.MustRegister(newBPFMetricsCollector(p, m, agentProc.PID))
+	p.reg.MustRegister(newUnwindTableStoreCollector(bpfMaps))
 
-	// Period is the number of events between sampled occurrences.
-	// By default we sample at 19Hz (19 times per second),
-	// which is every ~0.05s or 52,631,578 nanoseconds (1 Hz = 1e9 ns).
-	samplingPeriod := int64(1e9 / p.profilingSamplingFrequency)
-	cpus := cpuinfo.NumCPU()
-
-	for i := 0; i < cpus; i++ {
-		fd, err := unix.PerfEventOpen(&unix.PerfEventAttr{
-			Type:   unix.PERF_TYPE_SOFTWARE,
-			Config: unix.PERF_COUNT_SW_CPU_CLOCK,
-			Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
-			Sample: p.profilingSamplingFrequency,
-			Bits:   unix.PerfBitDisabled | unix.PerfBitFreq,
-		}, -1 /* pid */, i /* cpu id */, -1 /* group */, 0 /* flags */)
-		if err != nil {
-			return fmt.Errorf("open perf event: %w", err)
-		}
-
-		// Do not close this fd manually as it will result in an error in the
-		// best case, if the FD doesn't exist and in the worst case it will
-		// close the wrong FD.
-		//
-		// The `Close` method on the module calls `bpf_link__destroy`, which calls
-		// the link's `detach` function[2], that eventually, through the `bpf_link__detach_fd`
-		// function it closes the link's FD[3].
-		// [1]: https://github.com/aquasecurity/libbpfgo/blob/64458ba5a32013dda2d4f88838dde8456922333d/libbpfgo.go#L420
-		// [2]: https://github.com/libbpf/libbpf/blob/master/src/libbpf.c#L9762
-		// [3]: https://github.com/libbpf/libbpf/blob/master/src/libbpf.c#L9785
-
-		prog, err := m.GetProgram(programName)
-		if err != nil {
-			return fmt.Errorf("get bpf program: %w", err)
-		}
-
-		// Because this is fd based, even if our program crashes or is ended
-		// without proper shutdown, things get cleaned up appropriately.
-		_, err = prog.AttachPerfEvent(fd)
-		// Do not call `link.Destroy()`[1] as closing the module takes care of
-		// it[2].
-		// [1]: https://github.com/aquasecurity/libbpfgo/blob/64458ba5a32013dda2d4f88838dde8456922333d/libbpfgo.go#L240
-		// [2]: https://github.com/aquasecurity/libbpfgo/blob/64458ba5a32013dda2d4f88838dde8456922333d/libbpfgo.go#L420
-
-		if err != nil {
-			return fmt.Errorf("attach perf event: %w", err)
-		}
+	if err := p.attachPerfEvents(m); err != nil {
+		return err
 	}
 
 	// Record start time for first profile.
@@ -541,7 +654,7 @@ func (p *CPU) Run(ctx context.Context) error {
 	p.lastProfileStartedAt = time.Now()
 	p.mtx.Unlock()
 
-	prog, err := m.GetProgram(dwarfUnwinderProgramName)
+	prog, err := m.GetProgram(unwinderProgramName)
 	if err != nil {
 		return fmt.Errorf("get bpf program: %w", err)
 	}
@@ -565,7 +678,10 @@ func (p *CPU) Run(ctx context.Context) error {
 	}
 
 	// Update the debug pids map.
-	go p.watchProcesses(ctx, pfs, matchers)
+	go p.watchProcesses(ctx, pfs)
+
+	// Update the cgroup filter map.
+	go p.cgroupFilter.run(ctx, p.bpfMaps)
 
 	// Process BPF events.
 	var (
@@ -589,11 +705,7 @@ func (p *CPU) Run(ctx context.Context) error {
 		// that the current in-flight shard hasn't been written to the BPF map, yet.
 		err := p.bpfMaps.PersistUnwindTable()
 		if err != nil {
-			if errors.Is(err, ErrNeedMoreProfilingRounds) {
-				level.Debug(p.logger).Log("msg", "PersistUnwindTable called to soon", "err", err)
-			} else {
-				level.Error(p.logger).Log("msg", "PersistUnwindTable failed", "err", err)
-			}
+			level.Error(p.logger).Log("msg", "PersistUnwindTable failed", "err", err)
 		}
 	})
 
@@ -636,6 +748,20 @@ func (p *CPU) Run(ctx context.Context) error {
 			}
 		}
 
+		// Keep the unwind tables of the sampled processes from being evicted.
+		sampledPIDs := make([]int, 0, len(groupedRawData))
+		for pid := range groupedRawData {
+			sampledPIDs = append(sampledPIDs, pid)
+		}
+		p.bpfMaps.unwindTablesSampled(sampledPIDs)
+		// The unwind tables of the JIT code of the sampled processes follow the code they load and move.
+		p.bpfMaps.refreshJitUnwindTables(sampledPIDs)
+
+		// Period is the number of events between sampled occurrences.
+		// By default we sample at 19Hz (19 times per second),
+		// which is every ~0.05s or 52,631,578 nanoseconds (1 Hz = 1e9 ns).
+		samplingPeriod := int64(1e9 / p.samplingFrequency())
+
 		processLastErrors := map[int]error{}
 		for pid, perProcessRawData := range groupedRawData {
 			processLastErrors[pid] = nil
@@ -648,12 +774,33 @@ func (p *CPU) Run(ctx context.Context) error {
 				continue
 			}
 
+			labelSet, err := pi.Labels(ctx)
+			if err != nil {
+				level.Warn(p.logger).Log("msg", "failed to get process labels", "pid", pid, "err", err)
+				processLastErrors[pid] = err
+				continue
+			}
+			if len(labelSet) == 0 {
+				level.Debug(p.logger).Log("msg", "profile dropped", "pid", pid)
+				continue
+			}
+
+			targetConfig, err := p.applyTargetRules(pid, labelSet, p.targetSettingsFor(ctx, pid))
+			if err != nil {
+				level.Debug(p.logger).Log("msg", "target settings rejected", "pid", pid, "err", err)
+				processLastErrors[pid] = err
+			}
+			if targetConfig.excluded() {
+				p.metrics.profileDrop.WithLabelValues(profileDropReasonExcluded).Inc()
+				continue
+			}
+
 			pprof, err := p.profileConverter.NewConverter(
 				pfs,
 				pid,
 				pi.Mappings.ExecutableSections(),
 				p.LastProfileStartedAt(),
-				samplingPeriod,
+				targetConfig.samplingPeriod(samplingPeriod),
 			).Convert(ctx, perProcessRawData.RawSamples)
 			if err != nil {
 				level.Warn(p.logger).Log("msg", "failed to convert profile to pprof", "pid", pid, "err", err)
@@ -661,16 +808,6 @@ func (p *CPU) Run(ctx context.Context) error {
 				continue
 			}
 
-			labelSet, err := pi.Labels(ctx)
-			if err != nil {
-				level.Warn(p.logger).Log("msg", "failed to get process labels", "pid", pid, "err", err)
-				processLastErrors[pid] = err
-				continue
-			}
-			if len(labelSet) == 0 {
-				level.Debug(p.logger).Log("msg", "profile dropped", "pid", pid)
-				continue
-			}
 			// Add the profiler name as a label.
 			// Uses labels.Merge under the hood, so it re-allocates the label set.
 			// If we want to drop/disable a profiler, we should do it with another mechanism besides relabelling.
@@ -682,12 +819,67 @@ func (p *CPU) Run(ctx context.Context) error {
 				continue
 			}
 		}
+		p.pruneTargetConfigs(pfs)
 		p.report(err, processLastErrors)
 	}
 }
 
+// attachPerfEvents opens a perf event on every CPU and attaches the BPF program to it.
+func (p *CPU) attachPerfEvents(m *bpf.Module) error {
+	cpus := cpuinfo.NumCPU()
+
+	// The lock is held while the perf events are opened so that the sampling
+	// frequency can not be changed before all of them are recorded.
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for i := 0; i < cpus; i++ {
+		fd, err := unix.PerfEventOpen(&unix.PerfEventAttr{
+			Type:   unix.PERF_TYPE_SOFTWARE,
+			Config: unix.PERF_COUNT_SW_CPU_CLOCK,
+			Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+			Sample: p.profilingSamplingFrequency,
+			Bits:   unix.PerfBitDisabled | unix.PerfBitFreq,
+		}, -1 /* pid */, i /* cpu id */, -1 /* group */, 0 /* flags */)
+		if err != nil {
+			return fmt.Errorf("open perf event: %w", err)
+		}
+		p.perfEventFds = append(p.perfEventFds, fd)
+
+		// Do not close this fd manually as it will result in an error in the
+		// best case, if the FD doesn't exist and in the worst case it will
+		// close the wrong FD.
+		//
+		// The `Close` method on the module calls `bpf_link__destroy`, which calls
+		// the link's `detach` function[2], that eventually, through the `bpf_link__detach_fd`
+		// function it closes the link's FD[3].
+		// [1]: https://github.com/aquasecurity/libbpfgo/blob/64458ba5a32013dda2d4f88838dde8456922333d/libbpfgo.go#L420
+		// [2]: https://github.com/libbpf/libbpf/blob/master/src/libbpf.c#L9762
+		// [3]: https://github.com/libbpf/libbpf/blob/master/src/libbpf.c#L9785
+
+		prog, err := m.GetProgram(programName)
+		if err != nil {
+			return fmt.Errorf("get bpf program: %w", err)
+		}
+
+		// Because this is fd based, even if our program crashes or is ended
+		// without proper shutdown, things get cleaned up appropriately.
+		_, err = prog.AttachPerfEvent(fd)
+		// Do not call `link.Destroy()`[1] as closing the module takes care of
+		// it[2].
+		// [1]: https://github.com/aquasecurity/libbpfgo/blob/64458ba5a32013dda2d4f88838dde8456922333d/libbpfgo.go#L240
+		// [2]: https://github.com/aquasecurity/libbpfgo/blob/64458ba5a32013dda2d4f88838dde8456922333d/libbpfgo.go#L420
+
+		if err != nil {
+			return fmt.Errorf("attach perf event: %w", err)
+		}
+	}
+
+	return nil
+}
+
 // TODO(kakkoyun): Combine with process information discovery.
-func (p *CPU) watchProcesses(ctx context.Context, pfs procfs.FS, matchers []*regexp.Regexp) {
+func (p *CPU) watchProcesses(ctx context.Context, pfs procfs.FS) {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
@@ -723,6 +915,10 @@ func (p *CPU) watchProcesses(ctx context.Context, pfs procfs.FS, matchers []*reg
 		if p.debugProcesses() {
 			level.Debug(p.logger).Log("msg", "debug process matchers found, starting process watcher")
 
+			p.mtx.RLock()
+			matchers := p.debugProcessMatchers
+			p.mtx.RUnlock()
+
 			for _, thread := range allThreads() {
 				comm, err := thread.Comm()
 				if err != nil {
@@ -801,7 +997,7 @@ type profileKey struct {
 
 // obtainProfiles collects profiles from the BPF maps.
 func (p *CPU) obtainRawData(ctx context.Context) (profile.RawData, error) {
-	rawData := map[profileKey]map[combinedStack]uint64{}
+	rawData := map[profileKey]map[stackSample]uint64{}
 
 	it := p.bpfMaps.stackCounts.Iterator()
 	for it.Next() {
@@ -824,14 +1020,15 @@ func (p *CPU) obtainRawData(ctx context.Context) (profile.RawData, error) {
 		// Profile aggregation key.
 		pKey := profileKey{pid: key.PID, tid: key.TID}
 
-		// Twice the stack depth because we have a user and a potential Kernel stack.
+		// We have a user and a potential Kernel stack.
 		// Read order matters, since we read from the key buffer.
 		stack := combinedStack{}
+		truncated := false
 
 		var userErr error
 		if key.walkedWithDwarf() {
 			// Stacks retrieved with our dwarf unwind information unwinder.
-			userErr = p.bpfMaps.readUserStackWithDwarf(key.UserStackIDDWARF, &stack)
+			truncated, userErr = p.bpfMaps.readUserStackWithDwarf(key.UserStackIDDWARF, &stack)
 			if userErr != nil {
 				p.metrics.stackDrop.WithLabelValues(labelStackDropReasonUserDWARF).Inc()
 				if errors.Is(userErr, errUnrecoverable) {
@@ -905,11 +1102,14 @@ func (p *CPU) obtainRawData(ctx context.Context) (profile.RawData, error) {
 		perThreadData, ok := rawData[pKey]
 		if !ok {
 			// We haven't seen this id yet.
-			perThreadData = map[combinedStack]uint64{}
+			perThreadData = map[stackSample]uint64{}
 			rawData[pKey] = perThreadData
 		}
 
-		perThreadData[stack] += value
+		if truncated {
+			p.metrics.stackTruncated.Add(float64(value))
+		}
+		perThreadData[stackSample{stack: stack, truncated: truncated}] += value
 	}
 	if it.Err() != nil {
 		p.metrics.stackDrop.WithLabelValues(labelStackDropReasonIterator).Inc()
@@ -928,7 +1128,7 @@ func (p *CPU) obtainRawData(ctx context.Context) (profile.RawData, error) {
 // stacks. Since the input data is a map of maps, we can assume that they're
 // already unique and there are no duplicates, which is why at this point we
 // can just transform them into plain slices and structs.
-func preprocessRawData(rawData map[profileKey]map[combinedStack]uint64) profile.RawData {
+func preprocessRawData(rawData map[profileKey]map[stackSample]uint64) profile.RawData {
 	res := make(profile.RawData, 0, len(rawData))
 	for pKey, perThreadRawData := range rawData {
 		p := profile.ProcessRawData{
@@ -936,7 +1136,8 @@ func preprocessRawData(rawData map[profileKey]map[combinedStack]uint64) profile.
 			RawSamples: make([]profile.RawSample, 0, len(perThreadRawData)),
 		}
 
-		for stack, count := range perThreadRawData {
+		for sample, count := range perThreadRawData {
+			stack := sample.stack
 			kernelStackDepth := 0
 			userStackDepth := 0
 
@@ -965,6 +1166,7 @@ func preprocessRawData(rawData map[profileKey]map[combinedStack]uint64) profile.
 				UserStack:   userStack,
 				KernelStack: kernelStack,
 				Value:       count,
+				Truncated:   sample.truncated,
 			})
 		}
 
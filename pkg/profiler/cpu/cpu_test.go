@@ -15,11 +15,13 @@
 package cpu
 
 import (
+	"sync"
 	"syscall"
 	"testing"
 	"unsafe"
 
 	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/go-kit/log"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 
@@ -36,7 +38,7 @@ func SetUpBpfProgram(t *testing.T) (*bpf.Module, error) {
 	logger := logger.NewLogger("debug", logger.LogFormatLogfmt, "parca-cpu-test")
 
 	memLock := uint64(1200 * 1024 * 1024) // ~1.2GiB
-	m, _, err := loadBpfProgram(logger, prometheus.NewRegistry(), true, true, false, true, memLock)
+	m, _, err := loadBpfProgram(logger, prometheus.NewRegistry(), true, true, false, true, cgroupFilterNone, stackDepth, bpfLoopSupported(), memLock)
 	require.NoError(t, err)
 	require.NotNil(t, m)
 
@@ -170,3 +172,24 @@ func TestGetValueAndDeleteBatchExactElements(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 1, len(values))
 }
+
+func TestApplyConfig(t *testing.T) {
+	p := &CPU{
+		logger:                     log.NewNopLogger(),
+		mtx:                        &sync.RWMutex{},
+		profilingSamplingFrequency: 19,
+	}
+
+	require.Error(t, p.ApplyConfig(0, nil))
+	require.Error(t, p.ApplyConfig(19, []string{"("}))
+
+	require.NoError(t, p.ApplyConfig(97, []string{"parca.*"}))
+	require.Equal(t, uint64(97), p.samplingFrequency())
+	require.True(t, p.debugProcesses())
+	require.Len(t, p.debugProcessMatchers, 1)
+
+	// Once the BPF program is loaded, process filtering can not be toggled.
+	p.bpfMaps = &bpfMaps{}
+	require.Error(t, p.ApplyConfig(97, nil))
+	require.NoError(t, p.ApplyConfig(97, []string{"parca-agent"}))
+}
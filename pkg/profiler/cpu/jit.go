@@ -0,0 +1,149 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cpu
+
+import (
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/parca-dev/parca-agent/pkg/jit"
+	"github.com/parca-dev/parca-agent/pkg/process"
+	"github.com/parca-dev/parca-agent/pkg/stack/unwind"
+)
+
+var jitdumpSeed = maphash.MakeSeed()
+
+// jitdumps are the jitdump files of a process.
+type jitdumps struct {
+	paths []string
+	// key identifies the unwind table of the JIT code of the process in the
+	// unwind table store. It changes as records are written to the files.
+	key string
+}
+
+// jitdumpState returns the jitdump files at the given paths of the process, and
+// the key of the unwind table of their current contents. The key is empty if
+// the process has no jitdump files.
+func jitdumpState(id process.ID, paths []string) jitdumps {
+	if len(paths) == 0 {
+		return jitdumps{}
+	}
+
+	var key strings.Builder
+	fmt.Fprintf(&key, "jitdump:%d:%d", id.PID, id.StartTime)
+	for _, p := range paths {
+		info, err := os.Stat(path.Join("/proc", fmt.Sprintf("%d", id.PID), "root", p))
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&key, ":%s:%d:%d", p, info.Size(), info.ModTime().UnixNano())
+	}
+	return jitdumps{paths: paths, key: key.String()}
+}
+
+// processHash returns the hash of the executable mappings of a process, along with
+// the state of its jitdump files, which changes when JIT code is loaded or moved.
+func processHash(executableMappings unwind.ExecutableMappings, jitdumps jitdumps) (uint64, error) {
+	hash, err := executableMappings.Hash()
+	if err != nil {
+		return 0, err
+	}
+	if jitdumps.key == "" {
+		return hash, nil
+	}
+	return hash ^ maphash.String(jitdumpSeed, jitdumps.key), nil
+}
+
+// generateJITUnwindTable produces the compact unwind table of the JIT code of the
+// process, from the unwinding information of the code in its jitdump files.
+func (m *bpfMaps) generateJITUnwindTable(pid int, paths []string) (unwind.CompactUnwindTable, error) {
+	var ut unwind.CompactUnwindTable
+	for _, p := range paths {
+		fullPath := path.Join("/proc", fmt.Sprintf("%d", pid), "root", p)
+		dump, err := m.readJitdump(fullPath)
+		if err != nil {
+			level.Debug(m.logger).Log("msg", "failed to read jitdump", "pid", pid, "jitdump", p, "err", err)
+			continue
+		}
+
+		table, err := unwind.BuildJITCompactUnwindTable(dump, m.expressions)
+		if err != nil {
+			level.Debug(m.logger).Log("msg", "failed to build JIT unwind table", "pid", pid, "jitdump", p, "err", err)
+			continue
+		}
+		ut = append(ut, table...)
+	}
+	sort.Sort(ut)
+
+	// The rows may refer to expressions that were just compiled.
+	if err := m.persistExpressions(); err != nil {
+		return ut, err
+	}
+
+	level.Debug(m.logger).Log("msg", "found JIT unwind entries", "pid", pid, "len", len(ut))
+	return ut, nil
+}
+
+// readJitdump reads the jitdump file at fullPath.
+func (m *bpfMaps) readJitdump(fullPath string) (*jit.JITDump, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dump := &jit.JITDump{}
+	err = jit.LoadJITDump(m.logger, f, dump)
+	// The runtime may be writing a record, the ones before it are complete.
+	if errors.Is(err, io.ErrUnexpectedEOF) && dump.CodeLoads != nil {
+		return dump, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dump, nil
+}
+
+// refreshJitUnwindTables updates the process information of the sampled
+// processes with JIT code, whose unwind tables change as code is added
+// to their jitdump files.
+func (m *bpfMaps) refreshJitUnwindTables(pids []int) {
+	m.mutex.Lock()
+	var jitPIDs []int
+	for _, pid := range pids {
+		if _, ok := m.jitProcesses[pid]; ok {
+			jitPIDs = append(jitPIDs, pid)
+		}
+	}
+	m.mutex.Unlock()
+
+	if len(jitPIDs) == 0 {
+		return
+	}
+	for _, pid := range jitPIDs {
+		m.refreshProcessInfo(pid)
+	}
+	if err := m.PersistUnwindTable(); err != nil {
+		level.Error(m.logger).Log("msg", "failed to persist unwind table", "err", err)
+	}
+}
@@ -18,13 +18,13 @@ import "C"
 
 import (
 	"bytes"
+	"context"
 	"debug/elf"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"os"
 	"path"
-	"sort"
 	"sync"
 	"syscall"
 	"unsafe"
@@ -39,6 +39,8 @@ import (
 	"github.com/parca-dev/parca-agent/pkg/buildid"
 	"github.com/parca-dev/parca-agent/pkg/cache"
 	"github.com/parca-dev/parca-agent/pkg/elfreader"
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
+	"github.com/parca-dev/parca-agent/pkg/process"
 	"github.com/parca-dev/parca-agent/pkg/profiler"
 	"github.com/parca-dev/parca-agent/pkg/stack/unwind"
 )
@@ -51,17 +53,24 @@ const (
 	unwindInfoChunksMapName = "unwind_info_chunks"
 	dwarfStackTracesMapName = "dwarf_stack_traces"
 	unwindTablesMapName     = "unwind_tables"
+	dwarfExpressionsMapName = "dwarf_expressions"
 	processInfoMapName      = "process_info"
+	targetConfigsMapName    = "target_configs"
+	cgroupFilterMapName     = "cgroup_filter"
 	programsMapName         = "programs"
 	perCPUStatsMapName      = "percpu_stats"
 
 	// With the current compact rows, the max items we can store in the kernels
 	// we have tested is 262k per map, which we rounded it down to 250k.
-	maxUnwindShards       = 50         // How many unwind table shards we have.
-	maxUnwindTableSize    = 250 * 1000 // Always needs to be sync with MAX_UNWIND_TABLE_SIZE in the BPF program.
-	maxMappingsPerProcess = 250        // Always need to be in sync with MAX_MAPPINGS_PER_PROCESS.
-	maxUnwindTableChunks  = 30         // Always need to be in sync with MAX_UNWIND_TABLE_CHUNKS.
-	maxProcesses          = 5000       // Always need to be in sync with MAX_PROCESSES.
+	maxUnwindShards       = 50 // How many unwind table shards we have.
+	maxUnwindTableSize    = unwind.MaxUnwindTableSize
+	maxMappingsPerProcess = 250 // Always need to be in sync with MAX_MAPPINGS_PER_PROCESS.
+	maxUnwindTableChunks  = unwind.MaxUnwindTableChunks
+	maxProcesses          = 5000 // Always need to be in sync with MAX_PROCESSES.
+	maxExecutables        = 5000 // Always need to be in sync with the unwind_info_chunks size.
+	maxDwarfExpressions   = 1024 // Always need to be in sync with MAX_DWARF_EXPRESSIONS.
+
+	maxStackTraces = 64000 // Always need to be in sync with MAX_STACK_TRACES_ENTRIES.
 
 	/*
 		TODO: once we generate the bindings automatically, remove this.
@@ -106,8 +115,22 @@ const (
 			s16 rbp_offset;
 		} stack_unwind_row_t;
 	*/
-	compactUnwindRowSizeBytes                = 14
-	minRoundsBeforeRedoingUnwindInfo         = 5
+	compactUnwindRowSizeBytes = unwind.CompactUnwindRowSizeBytes
+	/*
+		typedef struct {
+			u8 opcode;
+			u8 reg;
+			u8 _padding[6];
+			s64 operand;
+		} dwarf_expression_op_t;
+
+		typedef struct {
+			u64 len;
+			dwarf_expression_op_t ops[MAX_DWARF_EXPRESSION_OPS];
+		} dwarf_expression_t;
+	*/
+	dwarfExpressionOpSizeBytes               = 16
+	dwarfExpressionSizeBytes                 = 8 + unwind.MaxExpressionOps*dwarfExpressionOpSizeBytes
 	minRoundsBeforeRedoingProcessInformation = 5
 	maxCachedProcesses                       = 10_0000
 )
@@ -150,7 +173,6 @@ var (
 	errUnwindFailed              = errors.New("stack ID is 0, probably stack unwinding failed")
 	errUnrecoverable             = errors.New("unrecoverable error")
 	errTooManyExecutableMappings = errors.New("too many executable mappings")
-	ErrNeedMoreProfilingRounds   = errors.New("not enough profiling rounds with this unwind info")
 )
 
 func clearBpfMap(bpfMap *bpf.BPFMap) error {
@@ -194,32 +216,38 @@ type bpfMaps struct {
 	stackTraces      *bpf.BPFMap
 	dwarfStackTraces *bpf.BPFMap
 	processInfo      *bpf.BPFMap
+	targetConfigs    *bpf.BPFMap
+	cgroupFilter     *bpf.BPFMap
 
-	unwindShards *bpf.BPFMap
-	unwindTables *bpf.BPFMap
-	programs     *bpf.BPFMap
+	unwindShards     *bpf.BPFMap
+	unwindTables     *bpf.BPFMap
+	dwarfExpressions *bpf.BPFMap
+	programs         *bpf.BPFMap
 
 	// Unwind stuff 🔬
-	processCache      *processCache
-	mappingInfoMemory profiler.EfficientBuffer
-
-	buildIDMapping map[string]uint64
-	// Which shard we are using
+	processCache *processCache
+	debugFiles   *debugFiles
+	tableCache   *unwind.TableCache
+	// DWARF expressions compiled for the unwind tables, the ones
+	// after persistedExpressions have yet to be written to their map.
+	expressions          *unwind.ExpressionTable
+	persistedExpressions int
+	mappingInfoMemory    profiler.EfficientBuffer
+
+	// Where the unwind tables of the executables are in the shards.
+	unwindTableStore *unwindTableStore
 	maxUnwindShards  uint64
-	shardIndex       uint64
-	executableID     uint64
-	unwindInfoMemory profiler.EfficientBuffer
-	// Account where we are within a shard
-	lowIndex  uint64
-	highIndex uint64
+	// Shards written since the last persistUnwindTable call, and the ones
+	// that were ever written to their BPF map.
+	dirtyShards   map[uint64][]byte
+	writtenShards map[uint64]struct{}
+	// Keys of the unwind tables of the JIT code of the processes that have
+	// one, by PID.
+	jitProcesses map[int]string
 	// Other stats
 	totalEntries       uint64
 	uniqueMappings     uint64
 	referencedMappings uint64
-	// Counters to ensure we don't clear the unwind info too
-	// quickly if we run out of shards.
-	waitingToResetUnwindInfo              bool
-	profilingRoundsWithoutUnwindInfoReset int64
 	// Counters to ensure we don't clear the process info too
 	// quickly if we run out of space.
 	waitingToResetProcessInfo              bool
@@ -235,19 +263,42 @@ func min[T constraints.Ordered](a, b T) T {
 	return b
 }
 
+// processCache holds the hash of the executable mappings
+// of the processes whose information is in the process_info BPF map.
+// It is keyed by PID like the BPF map, the start time tells whether
+// the entry belongs to an exited process that had the same PID.
 type processCache struct {
-	*cache.LRUCache[int, uint64]
+	*cache.LRUCache[int, processCacheEntry]
+}
+
+type processCacheEntry struct {
+	startTime uint64
+	mapsHash  uint64
 }
 
 func newProcessCache(logger log.Logger, reg prometheus.Registerer) *processCache {
 	return &processCache{
-		cache.NewLRUCache[int, uint64](
+		cache.NewLRUCache[int, processCacheEntry](
 			prometheus.WrapRegistererWith(prometheus.Labels{"cache": "cpu_map"}, reg),
 			maxCachedProcesses,
 		),
 	}
 }
 
+// get returns the hash of the executable mappings of the process,
+// the entry of a previous process with the same PID is ignored.
+func (c *processCache) get(id process.ID) (uint64, bool) {
+	e, ok := c.Get(id.PID)
+	if !ok || e.startTime != id.StartTime {
+		return 0, false
+	}
+	return e.mapsHash, true
+}
+
+func (c *processCache) add(id process.ID, mapsHash uint64) {
+	c.Add(id.PID, processCacheEntry{startTime: id.StartTime, mapsHash: mapsHash})
+}
+
 // close closes the cache and makes sure the stats counter is unregistered.
 func (c *processCache) close() error {
 	// Close the cache and that unregisters the stats counter before closing the cache,
@@ -264,22 +315,20 @@ func initializeMaps(logger log.Logger, reg prometheus.Registerer, m *bpf.Module,
 	}
 
 	mappingInfoMemory := make([]byte, 0, mappingInfoSizeBytes)
-	unwindInfoMemory := make([]byte, maxUnwindTableSize*compactUnwindRowSizeBytes)
 
 	maps := &bpfMaps{
 		logger:            log.With(logger, "component", "bpf_maps"),
 		module:            m,
 		byteOrder:         byteOrder,
 		processCache:      newProcessCache(logger, reg),
+		expressions:       unwind.NewExpressionTable(maxDwarfExpressions),
 		mappingInfoMemory: mappingInfoMemory,
-		unwindInfoMemory:  unwindInfoMemory,
-		buildIDMapping:    make(map[string]uint64),
+		dirtyShards:       make(map[uint64][]byte),
+		writtenShards:     make(map[uint64]struct{}),
+		jitProcesses:      make(map[int]string),
 		mutex:             sync.Mutex{},
 	}
-
-	if err := maps.resetInFlightBuffer(); err != nil {
-		level.Error(logger).Log("msg", "resetInFlightBuffer failed", "err", err)
-	}
+	maps.unwindTableStore = newUnwindTableStore(0, maxUnwindTableSize, maxExecutables, processAlive)
 
 	return maps, nil
 }
@@ -289,10 +338,11 @@ func (m *bpfMaps) close() error {
 	return m.processCache.close()
 }
 
-// adjustMapSizes updates the amount of unwind shards.
+// adjustMapSizes updates the amount of unwind shards, and sizes the DWARF
+// walked stacks after the maximum stack depth.
 //
 // Note: It must be called before `BPFLoadObject()`.
-func (m *bpfMaps) adjustMapSizes(debugEnabled bool, unwindTableShards uint32) error {
+func (m *bpfMaps) adjustMapSizes(debugEnabled bool, unwindTableShards, maxStackDepth uint32) error {
 	unwindTables, err := m.module.GetMap(unwindTablesMapName)
 	if err != nil {
 		return fmt.Errorf("get unwind tables map: %w", err)
@@ -305,6 +355,22 @@ func (m *bpfMaps) adjustMapSizes(debugEnabled bool, unwindTableShards uint32) er
 	}
 
 	m.maxUnwindShards = uint64(unwindTableShards)
+	m.unwindTableStore = newUnwindTableStore(m.maxUnwindShards, maxUnwindTableSize, maxExecutables, processAlive)
+
+	// Adjust dwarf_stack_traces size. Its values only hold the frames that are
+	// walked, and it takes as much memory as maxStackTraces stacks of the
+	// default depth, whatever the depth.
+	dwarfStackTraces, err := m.module.GetMap(dwarfStackTracesMapName)
+	if err != nil {
+		return fmt.Errorf("get dwarf stack traces map: %w", err)
+	}
+	if err := dwarfStackTraces.SetValueSize(dwarfStackTraceSize(maxStackDepth)); err != nil {
+		return fmt.Errorf("set dwarf stack traces value size for %d frames: %w", maxStackDepth, err)
+	}
+	dwarfStackTracesEntries := dwarfStackTracesSize(maxStackDepth)
+	if err := dwarfStackTraces.Resize(dwarfStackTracesEntries); err != nil {
+		return fmt.Errorf("resize dwarf stack traces map to %d elements: %w", dwarfStackTracesEntries, err)
+	}
 
 	// Adjust debug_pids size.
 	if debugEnabled {
@@ -319,6 +385,19 @@ func (m *bpfMaps) adjustMapSizes(debugEnabled bool, unwindTableShards uint32) er
 	return nil
 }
 
+// dwarfStackTraceSize returns the size of a stack_trace_t of the BPF program
+// holding up to maxStackDepth frames.
+func dwarfStackTraceSize(maxStackDepth uint32) uint32 {
+	return 8 + 8 + maxStackDepth*8
+}
+
+// dwarfStackTracesSize returns the number of stacks of up to maxStackDepth
+// frames that fit in the memory of maxStackTraces stacks of perfStackDepth
+// frames.
+func dwarfStackTracesSize(maxStackDepth uint32) uint32 {
+	return uint32(uint64(maxStackTraces) * uint64(dwarfStackTraceSize(perfStackDepth)) / uint64(dwarfStackTraceSize(maxStackDepth)))
+}
+
 func (m *bpfMaps) create() error {
 	debugPIDs, err := m.module.GetMap(debugPIDsMapName)
 	if err != nil {
@@ -345,6 +424,11 @@ func (m *bpfMaps) create() error {
 		return fmt.Errorf("get unwind tables map: %w", err)
 	}
 
+	dwarfExpressions, err := m.module.GetMap(dwarfExpressionsMapName)
+	if err != nil {
+		return fmt.Errorf("get dwarf expressions map: %w", err)
+	}
+
 	dwarfStackTraces, err := m.module.GetMap(dwarfStackTracesMapName)
 	if err != nil {
 		return fmt.Errorf("get dwarf stack traces map: %w", err)
@@ -355,13 +439,26 @@ func (m *bpfMaps) create() error {
 		return fmt.Errorf("get process info map: %w", err)
 	}
 
+	targetConfigs, err := m.module.GetMap(targetConfigsMapName)
+	if err != nil {
+		return fmt.Errorf("get target configs map: %w", err)
+	}
+
+	cgroupFilter, err := m.module.GetMap(cgroupFilterMapName)
+	if err != nil {
+		return fmt.Errorf("get cgroup filter map: %w", err)
+	}
+
 	m.debugPIDs = debugPIDs
 	m.stackCounts = stackCounts
 	m.stackTraces = stackTraces
 	m.unwindShards = unwindShards
 	m.unwindTables = unwindTables
+	m.dwarfExpressions = dwarfExpressions
 	m.dwarfStackTraces = dwarfStackTraces
 	m.processInfo = processInfo
+	m.targetConfigs = targetConfigs
+	m.cgroupFilter = cgroupFilter
 
 	return nil
 }
@@ -399,6 +496,41 @@ func (m *bpfMaps) setDebugPIDs(pids []int) error {
 	return nil
 }
 
+// setTargetConfig sets the profiling settings of the given process.
+func (m *bpfMaps) setTargetConfig(pid int, cfg targetConfig) error {
+	pid32 := int32(pid)
+	if err := m.targetConfigs.Update(unsafe.Pointer(&pid32), unsafe.Pointer(&cfg)); err != nil {
+		return fmt.Errorf("failure setting target config for pid %d: %w", pid, err)
+	}
+	return nil
+}
+
+// deleteTargetConfig removes the profiling settings of the given process.
+func (m *bpfMaps) deleteTargetConfig(pid int) error {
+	pid32 := int32(pid)
+	if err := m.targetConfigs.DeleteKey(unsafe.Pointer(&pid32)); err != nil && !errors.Is(err, syscall.ENOENT) {
+		return fmt.Errorf("failure deleting target config for pid %d: %w", pid, err)
+	}
+	return nil
+}
+
+// addCgroupToFilter adds the cgroup with the given v2 ID to the cgroup filter.
+func (m *bpfMaps) addCgroupToFilter(id uint64) error {
+	one := uint8(1)
+	if err := m.cgroupFilter.Update(unsafe.Pointer(&id), unsafe.Pointer(&one)); err != nil {
+		return fmt.Errorf("failure adding cgroup %d to filter: %w", id, err)
+	}
+	return nil
+}
+
+// removeCgroupFromFilter removes the cgroup with the given v2 ID from the cgroup filter.
+func (m *bpfMaps) removeCgroupFromFilter(id uint64) error {
+	if err := m.cgroupFilter.DeleteKey(unsafe.Pointer(&id)); err != nil && !errors.Is(err, syscall.ENOENT) {
+		return fmt.Errorf("failure removing cgroup %d from filter: %w", id, err)
+	}
+	return nil
+}
+
 // readUserStack reads the user stack trace from the stacktraces ebpf map into the given buffer.
 func (m *bpfMaps) readUserStack(userStackID int32, stack *combinedStack) error {
 	if userStackID == 0 {
@@ -410,44 +542,53 @@ func (m *bpfMaps) readUserStack(userStackID int32, stack *combinedStack) error {
 		return fmt.Errorf("read user stack trace, %w: %w", err, errMissing)
 	}
 
-	if err := binary.Read(bytes.NewBuffer(stackBytes), m.byteOrder, stack[:stackDepth]); err != nil {
+	if err := binary.Read(bytes.NewBuffer(stackBytes), m.byteOrder, stack[:perfStackDepth]); err != nil {
 		return fmt.Errorf("read user stack bytes, %w: %w", err, errUnrecoverable)
 	}
 
 	return nil
 }
 
-// readUserStackWithDwarf reads the DWARF walked user stack traces into the given buffer.
-func (m *bpfMaps) readUserStackWithDwarf(userStackID int32, stack *combinedStack) error {
+// readUserStackWithDwarf reads the DWARF walked user stack traces into the given buffer,
+// and returns whether the stack was deeper than the frames that were walked.
+func (m *bpfMaps) readUserStackWithDwarf(userStackID int32, stack *combinedStack) (bool, error) {
 	if userStackID == 0 {
-		return errUnwindFailed
-	}
-
-	type dwarfStacktrace struct {
-		Len   uint64
-		Addrs [stackDepth]uint64
+		return false, errUnwindFailed
 	}
 
 	stackBytes, err := m.dwarfStackTraces.GetValue(unsafe.Pointer(&userStackID))
 	if err != nil {
-		return fmt.Errorf("read user stack trace, %w: %w", err, errMissing)
+		return false, fmt.Errorf("read user stack trace, %w: %w", err, errMissing)
 	}
 
-	var dwarfStack dwarfStacktrace
-	if err := binary.Read(bytes.NewBuffer(stackBytes), m.byteOrder, &dwarfStack); err != nil {
-		return fmt.Errorf("read user stack bytes, %w: %w", err, errUnrecoverable)
+	return decodeDwarfStack(stackBytes, m.byteOrder, stack)
+}
+
+// decodeDwarfStack decodes a DWARF walked user stack trace, as the BPF program
+// writes it, into the given buffer, and returns whether it was truncated.
+func decodeDwarfStack(stackBytes []byte, byteOrder binary.ByteOrder, stack *combinedStack) (bool, error) {
+	// The map only holds the frames up to the maximum stack depth, see dwarfStackTraceSize.
+	if len(stackBytes) < 16 {
+		return false, fmt.Errorf("read user stack bytes, short stack of %d bytes: %w", len(stackBytes), errUnrecoverable)
+	}
+	length := byteOrder.Uint64(stackBytes)
+	truncated := byteOrder.Uint64(stackBytes[8:])
+	addrs := stackBytes[16:]
+	if length > uint64(len(addrs)/8) {
+		return false, fmt.Errorf("read user stack bytes, %d frames in %d bytes: %w", length, len(addrs), errUnrecoverable)
 	}
 
 	userStack := stack[:stackDepth]
 
-	for i, addr := range dwarfStack.Addrs {
-		if i >= stackDepth || i >= int(dwarfStack.Len) || addr == 0 {
+	for i := 0; i < stackDepth && i < int(length); i++ {
+		addr := byteOrder.Uint64(addrs[i*8:])
+		if addr == 0 {
 			break
 		}
 		userStack[i] = addr
 	}
 
-	return nil
+	return truncated != 0, nil
 }
 
 // readKernelStack reads the kernel stack trace from the stacktraces ebpf map into the given buffer.
@@ -499,7 +640,7 @@ func (m *bpfMaps) cleanStacks() error {
 }
 
 func (m *bpfMaps) finalizeProfileLoop() error {
-	m.profilingRoundsWithoutUnwindInfoReset++
+	m.unwindTableStore.finishRound()
 	m.profilingRoundsWithoutProcessInfoReset++
 	return m.cleanStacks()
 }
@@ -511,14 +652,6 @@ func (m *bpfMaps) cleanProcessInfo() error {
 	return nil
 }
 
-func (m *bpfMaps) cleanShardInfo() error {
-	// unwindShards
-	if err := clearBpfMap(m.unwindShards); err != nil {
-		return err
-	}
-	return nil
-}
-
 func (m *bpfMaps) resetMappingInfoBuffer() error {
 	// Extend length to match the capacity.
 	m.mappingInfoMemory = m.mappingInfoMemory[:cap(m.mappingInfoMemory)]
@@ -538,25 +671,31 @@ func (m *bpfMaps) resetMappingInfoBuffer() error {
 func (m *bpfMaps) refreshProcessInfo(pid int) {
 	level.Debug(m.logger).Log("msg", "refreshing process info", "pid", pid)
 
-	cachedHash, _ := m.processCache.Get(pid)
-
 	proc, err := procfs.NewProc(pid)
 	if err != nil {
 		return
 	}
+	id, err := process.NewID(proc)
+	if err != nil {
+		return
+	}
+	// The process information of a new process that reused the PID is always refreshed.
+	cachedHash, _ := m.processCache.get(id)
+
 	mappings, err := proc.ProcMaps()
 	if err != nil {
 		return
 	}
 	executableMappings := unwind.ListExecutableMappings(mappings)
-	currentHash, err := executableMappings.Hash()
+	// The unwind table of the JIT code changes as code is added to the jitdump files.
+	currentHash, err := processHash(executableMappings, jitdumpState(id, unwind.ListJitDumps(mappings)))
 	if err != nil {
 		level.Error(m.logger).Log("msg", "executableMappings hash failed", "err", err)
 		return
 	}
 
 	if cachedHash != currentHash {
-		err := m.addUnwindTableForProcess(pid, executableMappings, false)
+		err := m.addUnwindTableForProcess(pid, mappings, false)
 		if err != nil {
 			level.Error(m.logger).Log("msg", "addUnwindTableForProcess failed", "err", err)
 		}
@@ -567,33 +706,37 @@ func (m *bpfMaps) refreshProcessInfo(pid int) {
 // 2. For each section, generate compact table
 // 3. Add table to maps
 // 4. Add map metadata to process
-func (m *bpfMaps) addUnwindTableForProcess(pid int, executableMappings unwind.ExecutableMappings, checkCache bool) error {
-	// Notes:
-	//	- perhaps we could cache based on `start_at` (but parsing this procfs file properly
-	// is challenging if the process name contains spaces, etc).
-	//  - PIDs can be recycled.
+func (m *bpfMaps) addUnwindTableForProcess(pid int, mappings []*procfs.ProcMap, checkCache bool) error {
+	// Note: PIDs can be recycled, the process information is cached by process identity
+	// so that the entry of a new process overwrites the one of the exited process.
 
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	proc, err := procfs.NewProc(pid)
+	if err != nil {
+		return err
+	}
+	id, err := process.NewID(proc)
+	if err != nil {
+		return err
+	}
+
 	if checkCache {
-		if _, exists := m.processCache.Get(pid); exists {
+		if _, exists := m.processCache.get(id); exists {
 			level.Debug(m.logger).Log("msg", "process already cached", "pid", pid)
 			return nil
 		}
 	}
 
-	if executableMappings == nil {
-		proc, err := procfs.NewProc(pid)
+	if mappings == nil {
+		mappings, err = proc.ProcMaps()
 		if err != nil {
 			return err
 		}
-		mappings, err := proc.ProcMaps()
-		if err != nil {
-			return err
-		}
-		executableMappings = unwind.ListExecutableMappings(mappings)
 	}
+	executableMappings := unwind.ListExecutableMappings(mappings)
+	jitdumps := jitdumpState(id, unwind.ListJitDumps(mappings))
 
 	// Clean up the mapping information.
 	if err := m.resetMappingInfoBuffer(); err != nil {
@@ -617,11 +760,29 @@ func (m *bpfMaps) addUnwindTableForProcess(pid int, executableMappings unwind.Ex
 	// .len
 	mappingInfoMemory.PutUint64(uint64(len(executableMappings)))
 
+	// Build IDs of the executables of the process, whose unwind tables
+	// must not be evicted while loading the ones of the other executables.
+	executables := map[string]struct{}{}
+
+	// The unwind table of the JIT code, from the jitdump files, is shared
+	// by the JIT mappings.
+	var jitExecutableID uint64
+	if jitdumps.key != "" && executableMappings.HasJitted() {
+		executable, err := m.loadUnwindTable(jitdumps.key, "jitdump", func() (unwind.CompactUnwindTable, error) {
+			return m.generateJITUnwindTable(pid, jitdumps.paths)
+		}, executables)
+		if err != nil {
+			return err
+		}
+		jitExecutableID = executable.id
+		executables[jitdumps.key] = struct{}{}
+	}
+
 	for _, executableMapping := range executableMappings {
 		if executableMapping.IsJitDump() {
 			continue
 		}
-		if err := m.setUnwindTableForMapping(&mappingInfoMemory, pid, executableMapping); err != nil {
+		if err := m.setUnwindTableForMapping(&mappingInfoMemory, pid, executableMapping, jitExecutableID, executables); err != nil {
 			return fmt.Errorf("setUnwindTableForMapping for executable %s starting at 0x%x failed: %w", executableMapping.Executable, executableMapping.StartAddr, err)
 		}
 	}
@@ -646,6 +807,7 @@ func (m *bpfMaps) addUnwindTableForProcess(pid int, executableMappings unwind.Ex
 			}
 
 			m.processCache.Purge()
+			m.unwindTableStore.removeProcesses()
 			cleanErr := m.cleanProcessInfo()
 			level.Info(m.logger).Log("msg", "resetting process information", "cleanErr", cleanErr)
 
@@ -655,61 +817,165 @@ func (m *bpfMaps) addUnwindTableForProcess(pid int, executableMappings unwind.Ex
 		return fmt.Errorf("update processInfo: %w", err)
 	}
 
-	mapsHash, err := executableMappings.Hash()
+	mapsHash, err := processHash(executableMappings, jitdumps)
 	if err != nil {
 		return fmt.Errorf("maps hash: %w", err)
 	}
-	m.processCache.Add(pid, mapsHash)
+	m.processCache.add(id, mapsHash)
+
+	buildIDs := make([]string, 0, len(executables))
+	for buildID := range executables {
+		buildIDs = append(buildIDs, buildID)
+	}
+	m.unwindTableStore.setProcess(id, buildIDs)
+
+	// The unwind table of the previous state of the jitdump files is no
+	// longer used, as the key changes when records are written to them.
+	previousJITKey := m.jitProcesses[pid]
+	if jitExecutableID != 0 {
+		m.jitProcesses[pid] = jitdumps.key
+	} else {
+		delete(m.jitProcesses, pid)
+	}
+	if previousJITKey != "" && previousJITKey != m.jitProcesses[pid] {
+		if executable, ok := m.unwindTableStore.remove(previousJITKey); ok {
+			if err := m.evictUnwindTables([]*storedExecutable{executable}); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-// generateCompactUnwindTable produces the compact unwidn table for a given
-// executable.
-func (m *bpfMaps) generateCompactUnwindTable(fullExecutablePath string, mapping *unwind.ExecutableMapping) (unwind.CompactUnwindTable, error) {
-	var ut unwind.CompactUnwindTable
+// DebugFileFinder finds the separate debug file of an object file.
+type DebugFileFinder interface {
+	Find(ctx context.Context, root string, obj *objectfile.ObjectFile) (string, error)
+}
+
+// debugFiles looks up the separate debug files of executables,
+// whose .debug_frame section is used when the executable has none.
+type debugFiles struct {
+	objFilePool *objectfile.Pool
+	finder      DebugFileFinder
+}
+
+// find returns the path of the separate debug file of the given executable of the process,
+// or an empty string if there is none.
+func (d *debugFiles) find(pid int, executable string) string {
+	if d == nil || d.objFilePool == nil || d.finder == nil {
+		return ""
+	}
+
+	root := path.Join("/proc/", fmt.Sprintf("%d", pid), "/root/")
+	executablePath := path.Join(root, executable)
+	// The debug file is not read if the executable has its own .debug_frame.
+	if hasDebugFrame(executablePath) {
+		return ""
+	}
 
-	// Fetch FDEs.
-	fdes, err := unwind.ReadFDEs(fullExecutablePath)
+	obj, err := d.objFilePool.Open(executablePath)
 	if err != nil {
-		return ut, err
+		return ""
+	}
+
+	debugPath, err := d.finder.Find(context.TODO(), root, obj)
+	if err != nil {
+		return ""
+	}
+	return debugPath
+}
+
+// hasDebugFrame returns whether the given ELF file has a .debug_frame section.
+func hasDebugFrame(path string) bool {
+	f, err := elf.Open(path)
+	if err != nil {
+		return false
 	}
+	defer f.Close()
 
-	// Sort them, as this will ensure that the generated table
-	// is also sorted. Sorting fewer elements will be faster.
-	sort.Sort(fdes)
+	sec := f.Section(".debug_frame")
+	return sec != nil && sec.Type != elf.SHT_NOBITS
+}
+
+// generateCompactUnwindTable produces the compact unwidn table for a given
+// executable, or reads it from the unwind table cache.
+func (m *bpfMaps) generateCompactUnwindTable(fullExecutablePath, buildID string, pid int, mapping *unwind.ExecutableMapping) (unwind.CompactUnwindTable, error) {
+	debugPath := m.debugFiles.find(pid, mapping.Executable)
+	// The table also has the rows of the .debug_frame of the debug file, if any.
+	cacheKey := buildID
+	if debugPath != "" {
+		cacheKey += "+debug"
+	}
+	if buildID != "" {
+		if ut, ok := m.tableCache.Get(cacheKey, m.expressions); ok {
+			// The rows may refer to expressions that were just added.
+			if err := m.persistExpressions(); err != nil {
+				return ut, err
+			}
+			level.Debug(m.logger).Log("msg", "found cached unwind entries", "executable", mapping.Executable, "len", len(ut))
+			return ut, nil
+		}
+	}
 
-	// Generate the compact unwind table.
-	ut, err = unwind.BuildCompactUnwindTable(fdes)
+	ut, err := unwind.GenerateCompactUnwindTable(fullExecutablePath, debugPath, m.expressions)
 	if err != nil {
 		return ut, err
 	}
 
-	// This should not be necessary, as per the sorting above, but
-	// just in case :).
-	sort.Sort(ut)
+	// The rows may refer to expressions that were just compiled.
+	if err := m.persistExpressions(); err != nil {
+		return ut, err
+	}
 
 	// Now we have a full compact unwind table that we have to split in different BPF maps.
 	level.Debug(m.logger).Log("msg", "found unwind entries", "executable", mapping.Executable, "len", len(ut))
 
+	if buildID != "" {
+		if err := m.tableCache.Put(cacheKey, ut, m.expressions); err != nil {
+			level.Warn(m.logger).Log("msg", "failed to cache unwind table", "executable", mapping.Executable, "err", err)
+		}
+	}
+
 	return ut, nil
 }
 
-// writeUnwindTableRow writes a compact unwind table row to the provided slice.
-//
-// Note: we are avoiding `binary.Write` and prefer to use the lower level APIs
-// to avoid allocations and CPU spent in the reflection code paths as well as
-// in the allocations for the intermediate buffers.
-func (m *bpfMaps) writeUnwindTableRow(rowSlice *profiler.EfficientBuffer, row unwind.CompactUnwindTableRow) {
-	// .pc
-	rowSlice.PutUint64(row.Pc())
-	// .cfa_type
-	rowSlice.PutUint8(row.CfaType())
-	// .rbp_type
-	rowSlice.PutUint8(row.RbpType())
-	// .cfa_offset
-	rowSlice.PutInt16(row.CfaOffset())
-	// .rbp_offset
-	rowSlice.PutInt16(row.RbpOffset())
+// persistExpressions writes the compiled DWARF expressions that were not
+// written yet to their BPF map.
+func (m *bpfMaps) persistExpressions() error {
+	expressions := m.expressions.Expressions()
+	if m.persistedExpressions == len(expressions) {
+		return nil
+	}
+
+	buf := make([]byte, dwarfExpressionSizeBytes)
+	for i := m.persistedExpressions; i < len(expressions); i++ {
+		m.writeExpression(buf, expressions[i])
+		index := uint32(i)
+		if err := m.dwarfExpressions.Update(unsafe.Pointer(&index), unsafe.Pointer(&buf[0])); err != nil {
+			return fmt.Errorf("update dwarf expressions: %w", err)
+		}
+	}
+	m.persistedExpressions = len(expressions)
+	return nil
+}
+
+// writeExpression writes a compiled DWARF expression to the provided buffer,
+// as dwarf_expression_t in the BPF program.
+func (m *bpfMaps) writeExpression(buf []byte, expression unwind.Expression) {
+	for i := range buf {
+		buf[i] = 0
+	}
+	// .len
+	m.byteOrder.PutUint64(buf, uint64(len(expression)))
+	for i, op := range expression {
+		opBuf := buf[8+i*dwarfExpressionOpSizeBytes:]
+		// .opcode
+		opBuf[0] = uint8(op.Opcode)
+		// .reg
+		opBuf[1] = op.Reg
+		// .operand
+		m.byteOrder.PutUint64(opBuf[8:], uint64(op.Operand))
+	}
 }
 
 // writeMapping writes the memory mapping information to the provided buffer.
@@ -729,42 +995,6 @@ func (m *bpfMaps) writeMapping(buf *profiler.EfficientBuffer, loadAddress, start
 	buf.PutUint64(type_)
 }
 
-// mappingID returns the internal identifier for a memory mapping.
-//
-// It will either return the already produced ID or generate a new
-// one while indicating whether it was already seen or not.
-//
-// This allows us to reuse the unwind tables for the mappings we
-// see.
-func (m *bpfMaps) mappingID(buildID string) (uint64, bool) {
-	_, alreadySeenMapping := m.buildIDMapping[buildID]
-	if alreadySeenMapping {
-		level.Debug(m.logger).Log("msg", "mapping caching, seen before", "buildID", buildID)
-		m.referencedMappings += 1
-	} else {
-		level.Debug(m.logger).Log("msg", "mapping caching, new", "buildID", buildID)
-		m.buildIDMapping[buildID] = m.executableID
-	}
-
-	return m.buildIDMapping[buildID], alreadySeenMapping
-}
-
-// resetInFlightBuffer zeroes and resets the length of the
-// in-flight shard.
-func (m *bpfMaps) resetInFlightBuffer() error {
-	// Extend length to match the capacity.
-	m.unwindInfoMemory = m.unwindInfoMemory[:cap(m.unwindInfoMemory)]
-
-	// Zero it.
-	for i := 0; i < cap(m.unwindInfoMemory); i++ {
-		m.unwindInfoMemory[i] = 0
-	}
-
-	// Reset slice's len.
-	m.unwindInfoMemory = m.unwindInfoMemory[:0]
-	return nil
-}
-
 // PersistUnwindTable calls persistUnwindTable but holding the mutex
 // to ensure that shared state is mutated safely.
 //
@@ -777,134 +1007,53 @@ func (m *bpfMaps) PersistUnwindTable() error {
 	return m.persistUnwindTable()
 }
 
-// persistUnwindTable writes the current in-flight, writable shard
-// to the corresponding BPF map's shard.
+// persistUnwindTable writes the unwind table shards that were written to
+// since the last call to the corresponding BPF map's shards.
 //
-// Note: as of now, this must be called in two situations:
-//   - In the callsite, once we are done with generating the unwind
-//     tables (see PersistUnwindTable).
-//   - Whenever the current in-flight shard is full, before we wipe
-//     it and start reusing it.
+// Note: as of now, this must be called in the callsite, once we are done
+// with generating the unwind tables (see PersistUnwindTable).
 func (m *bpfMaps) persistUnwindTable() error {
-	totalRows := len(m.unwindInfoMemory) / compactUnwindRowSizeBytes
-	if totalRows > maxUnwindTableSize {
-		panic("totalRows > maxUnwindTableSize should never happen")
-	}
-	level.Debug(m.logger).Log("msg", "PersistUnwindTable called", "live unwind rows", totalRows)
-
-	if totalRows == 0 {
-		return nil
-	}
-
-	shardIndex := m.shardIndex
-
-	err := m.unwindTables.Update(unsafe.Pointer(&shardIndex), unsafe.Pointer(&m.unwindInfoMemory[0]))
-	if err != nil {
-		if errors.Is(err, syscall.E2BIG) {
-			// If we need to wipe all state because we run out of shards, let's only do it after few
-			// profiling rounds.
-			//
-			// It's the responsibility of the caller to ensure that the processes to be profiled have
-			// a fair ordering.
-			if m.profilingRoundsWithoutUnwindInfoReset < minRoundsBeforeRedoingUnwindInfo {
-				level.Debug(m.logger).Log("msg", "not enough profile loops, we need to wait to reset unwind info")
-				m.waitingToResetUnwindInfo = true
-				return ErrNeedMoreProfilingRounds
-			}
-
-			if m.waitingToResetUnwindInfo {
-				level.Debug(m.logger).Log("msg", "no need to wait anymore to reset unwind info")
-				m.waitingToResetUnwindInfo = false
-				m.profilingRoundsWithoutUnwindInfoReset = 0
-			}
+	level.Debug(m.logger).Log("msg", "PersistUnwindTable called", "shards", len(m.dirtyShards))
 
-			if err := m.resetUnwindState(); err != nil {
-				level.Error(m.logger).Log("msg", "resetUnwindState failed", "err", err)
-				return err
-			}
-			return nil
+	for shard, buf := range m.dirtyShards {
+		shardIndex := shard
+		if err := m.unwindTables.Update(unsafe.Pointer(&shardIndex), unsafe.Pointer(&buf[0])); err != nil {
+			return fmt.Errorf("update unwind tables: %w", err)
 		}
-		return fmt.Errorf("update unwind tables: %w", err)
+		m.writtenShards[shard] = struct{}{}
+		delete(m.dirtyShards, shard)
 	}
 
 	return nil
 }
 
-func (m *bpfMaps) resetUnwindState() error {
-	m.processCache.Purge()
-	m.buildIDMapping = make(map[string]uint64)
-	m.shardIndex = 0
-	m.executableID = 0
-	if err := m.resetInFlightBuffer(); err != nil {
-		level.Error(m.logger).Log("msg", "resetInFlightBuffer failed", "err", err)
-	}
-
-	m.lowIndex = 0
-	m.highIndex = 0
-	// Other stats
-	m.totalEntries = 0
-	m.uniqueMappings = 0
-	m.referencedMappings = 0
-
-	if err := m.cleanProcessInfo(); err != nil {
-		level.Error(m.logger).Log("msg", "cleanProcessInfo failed", "err", err)
-		return err
-	}
-	if err := m.cleanShardInfo(); err != nil {
-		level.Error(m.logger).Log("msg", "cleanShardInfo failed", "err", err)
-		return err
-	}
-	if err := m.cleanStacks(); err != nil {
-		level.Error(m.logger).Log("msg", "cleanStacks failed", "err", err)
-		return err
-	}
+// unwindTableStoreStats returns the stats of the unwind table store.
+func (m *bpfMaps) unwindTableStoreStats() unwindTableStoreStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-	return nil
+	return m.unwindTableStore.stats()
 }
 
-// availableEntries returns how many entries we have left
-// in the in-flight shard.
-func (m *bpfMaps) availableEntries() uint64 {
-	return maxUnwindTableSize - m.highIndex
-}
+// unwindTablesSampled records that the processes with the given PIDs were sampled,
+// the unwind tables of their executables are the last to be evicted.
+func (m *bpfMaps) unwindTablesSampled(pids []int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-// assertInvariants checks that some invariants that should
-// always be true during the execution of the program are held.
-func (m *bpfMaps) assertInvariants() {
-	if m.highIndex > maxUnwindTableSize {
-		panic(fmt.Sprintf("m.highIndex (%d)> 250k, this should never happen", m.highIndex))
-	}
-	tableSize := len(m.unwindInfoMemory) / compactUnwindRowSizeBytes
-	if tableSize > maxUnwindTableSize {
-		panic(fmt.Sprintf("unwindInfoBuf has %d entries, more than the 250k max", tableSize))
-	}
-	if m.availableEntries() == 0 {
-		panic("no space left in the in-flight shard, this should never happen")
+	for _, pid := range pids {
+		m.unwindTableStore.sampled(pid)
 	}
 }
 
-// allocateNewShard uses a new shard. This must be called whenever we ran out of space
-// in the current "live" shard, or when we want to avoid splitting a function's unwind
-// information.
-func (m *bpfMaps) allocateNewShard() error {
-	err := m.persistUnwindTable()
+// processAlive returns whether the process is still running.
+func processAlive(id process.ID) bool {
+	proc, err := procfs.NewProc(id.PID)
 	if err != nil {
-		return fmt.Errorf("failed to write unwind table: %w", err)
-	}
-
-	if err := m.resetInFlightBuffer(); err != nil {
-		level.Error(m.logger).Log("msg", "resetInFlightBuffer failed", "err", err)
+		return false
 	}
-
-	m.shardIndex++
-	m.lowIndex = 0
-	m.highIndex = 0
-
-	if m.shardIndex == m.maxUnwindShards {
-		level.Debug(m.logger).Log("msg", "next shard persist will reset the unwind info")
-	}
-
-	return nil
+	current, err := process.NewID(proc)
+	return err == nil && current == id
 }
 
 // setUnwindTableForMapping sets all the necessary metadata and unwind tables, if needed
@@ -913,29 +1062,33 @@ func (m *bpfMaps) allocateNewShard() error {
 //   - Continue appending information to the executable mapping information for a process.
 //   - Add mapping information.
 //   - If unwind table is already present, we are done here, otherwise, we generate the
-//     unwind table for this executable and write to the in-flight shard.
+//     unwind table for this executable and write it to the unwind table shards.
+//
+// JIT mappings refer to the unwind table of the JIT code with jitExecutableID.
+// The build IDs of the executables with a table are added to executables.
 //
 // Notes:
 //
 // - This function is *not* safe to be called concurrently, the caller, addUnwindTableForProcess
 // uses a mutex to ensure safe data access.
-func (m *bpfMaps) setUnwindTableForMapping(buf *profiler.EfficientBuffer, pid int, mapping *unwind.ExecutableMapping) error {
-	level.Debug(m.logger).Log("msg", "setUnwindTable called", "shards", m.shardIndex, "max shards", m.maxUnwindShards, "sum of unwind rows", m.totalEntries)
+func (m *bpfMaps) setUnwindTableForMapping(buf *profiler.EfficientBuffer, pid int, mapping *unwind.ExecutableMapping, jitExecutableID uint64, executables map[string]struct{}) error {
+	level.Debug(m.logger).Log("msg", "setUnwindTable called", "max shards", m.maxUnwindShards, "sum of unwind rows", m.totalEntries)
 
 	// Deal with mappings that are not filed backed. They don't have unwind
 	// information.
 	if mapping.IsNotFileBacked() {
-		var type_ uint64
+		var type_, executableID uint64
 		if mapping.IsJitted() {
 			level.Debug(m.logger).Log("msg", "jit section", "pid", pid)
 			type_ = mappingTypeJitted
+			executableID = jitExecutableID
 		}
 		if mapping.IsSpecial() {
 			level.Debug(m.logger).Log("msg", "special section", "pid", pid)
 			type_ = mappingTypeSpecial
 		}
 
-		m.writeMapping(buf, mapping.LoadAddr, mapping.StartAddr, mapping.EndAddr, uint64(0), type_)
+		m.writeMapping(buf, mapping.LoadAddr, mapping.StartAddr, mapping.EndAddr, executableID, type_)
 		return nil
 	}
 
@@ -976,173 +1129,157 @@ func (m *bpfMaps) setUnwindTableForMapping(buf *profiler.EfficientBuffer, pid in
 		adjustedLoadAddress = mapping.LoadAddr
 	}
 
-	level.Debug(m.logger).Log("msg", "adding memory mappings in for executable", "executableID", m.executableID, "buildID", buildID, "executable", mapping.Executable)
+	level.Debug(m.logger).Log("msg", "adding memory mappings in for executable", "buildID", buildID, "executable", mapping.Executable)
 
-	// Add the memory mapping information.
-	foundexecutableID, mappingAlreadySeen := m.mappingID(buildID)
+	executable, err := m.loadUnwindTable(buildID, mapping.Executable, func() (unwind.CompactUnwindTable, error) {
+		return m.generateCompactUnwindTable(fullExecutablePath, buildID, pid, mapping)
+	}, executables)
+	if err != nil {
+		return err
+	}
+	executables[buildID] = struct{}{}
 
-	m.writeMapping(buf, adjustedLoadAddress, mapping.StartAddr, mapping.EndAddr, foundexecutableID, uint64(0))
+	// Add the memory mapping information.
+	m.writeMapping(buf, adjustedLoadAddress, mapping.StartAddr, mapping.EndAddr, executable.id, uint64(0))
+	return nil
+}
 
-	// Generated and add the unwind table, if needed.
-	if !mappingAlreadySeen {
-		unwindShardsValBuf := new(bytes.Buffer)
-		unwindShardsValBuf.Grow(unwindShardsSizeBytes)
+// loadUnwindTable returns the executable with the given build ID from the unwind
+// table store, generating its unwind table with generate and loading it if it is
+// not there yet. The tables of the executables in keep are never evicted to make room.
+func (m *bpfMaps) loadUnwindTable(buildID, executableName string, generate func() (unwind.CompactUnwindTable, error), keep map[string]struct{}) (*storedExecutable, error) {
+	if executable, ok := m.unwindTableStore.get(buildID); ok {
+		level.Debug(m.logger).Log("msg", "unwind table already loaded", "buildID", buildID)
+		m.referencedMappings++
+		return executable, nil
+	}
 
-		// Generate the unwind table.
-		// PERF(javierhonduco): Not reusing a buffer here yet, let's profile and decide whether this
-		// change would be worth it.
-		ut, err := m.generateCompactUnwindTable(fullExecutablePath, mapping)
-		if err != nil {
-			if errors.Is(err, unwind.ErrNoFDEsFound) {
-				// is it ok to return here?
-				return nil
-			}
-			if errors.Is(err, unwind.ErrEhFrameSectionNotFound) {
-				// is it ok to return here?
-				return nil
-			}
-			return nil
+	// Executables without unwind information, or whose table can never fit,
+	// are stored without a table, so that it is not looked for again. Other
+	// failures are not stored, to be retried.
+	ut, err := generate()
+	if err != nil {
+		if !errors.Is(err, unwind.ErrFrameSectionNotFound) && !errors.Is(err, unwind.ErrNoFDEsFound) {
+			return nil, fmt.Errorf("failed to generate unwind table for %s: %w", executableName, err)
 		}
+		level.Debug(m.logger).Log("msg", "no unwind information", "executable", executableName, "err", err)
+		ut = nil
+	}
 
-		if len(ut) == 0 {
-			return nil
+	executable, evicted, err := m.unwindTableStore.add(buildID, ut, keep)
+	if evictErr := m.evictUnwindTables(evicted); evictErr != nil {
+		return nil, evictErr
+	}
+	if err != nil {
+		if !errors.Is(err, errUnwindTableTooLarge) {
+			return nil, fmt.Errorf("failed to load unwind table for %s: %w", executableName, err)
 		}
+		level.Warn(m.logger).Log("msg", "failed to load unwind table", "executable", executableName, "rows", len(ut), "err", err)
+		if executable, _, err = m.unwindTableStore.add(buildID, nil, keep); err != nil {
+			return nil, err
+		}
+	}
+	if len(executable.chunks) == 0 {
+		return executable, nil
+	}
 
-		chunkIndex := 0
-
-		var (
-			currentChunk unwind.CompactUnwindTable
-			restChunks   unwind.CompactUnwindTable
-		)
-
-		restChunks = ut
-
-		for {
-			if m.waitingToResetUnwindInfo {
-				return ErrNeedMoreProfilingRounds
-			}
-			maxThreshold := min(len(restChunks), int(m.availableEntries()))
-
-			if maxThreshold == 0 {
-				level.Debug(m.logger).Log("msg", "done with the last chunk")
-				break
-			}
-
-			// Find the end of the last function and split the unwind table
-			// at that index.
-			currentChunkCandidate := restChunks[:maxThreshold]
-			threshold := maxThreshold
-			for i := maxThreshold - 1; i >= 0; i-- {
-				if currentChunkCandidate[i].IsEndOfFDEMarker() {
-					break
-				}
-				threshold--
-			}
-
-			// We couldn't find a full function in the current unwind information.
-			// As we can't split an unwind table mid-function, let's create a new
-			// shard.
-			if threshold == 0 {
-				level.Info(m.logger).Log("msg", "creating a new shard to avoid splitting the unwind table for a function")
-				if err := m.allocateNewShard(); err != nil {
-					return err
-				}
-				continue
-			}
-
-			currentChunk = restChunks[:threshold]
-			restChunks = restChunks[threshold:]
-
-			if currentChunk[0].IsEndOfFDEMarker() {
-				level.Error(m.logger).Log("msg", "First row of a chunk should not be a marker")
-			}
-
-			if !currentChunk[len(currentChunk)-1].IsEndOfFDEMarker() {
-				level.Error(m.logger).Log("msg", "Last row of a chunk should always be a marker")
-			}
-
-			m.assertInvariants()
-
-			if chunkIndex >= maxUnwindTableChunks {
-				level.Error(m.logger).Log("msg", "have more chunks than the max", "chunks", chunkIndex, "maxChunks", maxUnwindTableChunks)
-				// TODO(javierhonduco): not returning an error right now, but let's handle this later on.
-			}
-
-			level.Debug(m.logger).Log("current chunk size", len(currentChunk))
-			level.Debug(m.logger).Log("rest of chunk size", len(restChunks))
-
-			m.totalEntries += uint64(len(currentChunk))
+	level.Debug(m.logger).Log("msg", "loading unwind table", "executableID", executable.id, "executable", executableName, "rows", len(ut), "chunks", len(executable.chunks))
 
-			m.highIndex += uint64(len(currentChunk))
-			level.Debug(m.logger).Log("lowindex", m.lowIndex)
-			level.Debug(m.logger).Log("highIndex", m.highIndex)
+	unwindShardsValBuf := new(bytes.Buffer)
+	unwindShardsValBuf.Grow(unwindShardsSizeBytes)
 
-			// Add shard information.
+	rest := ut
+	for _, chunk := range executable.chunks {
+		rows := rest[:chunk.Rows()]
+		rest = rest[len(rows):]
 
-			level.Debug(m.logger).Log("executableID", m.executableID, "executable", mapping.Executable, "current shard", chunkIndex)
+		if err := m.writeUnwindTableRows(chunk.ShardIndex, chunk.LowIndex, rows); err != nil {
+			return nil, err
+		}
 
-			// Dealing with the first chunk, we must add the lowest known PC.
-			minPc := currentChunk[0].Pc()
-			if minPc == 0 {
-				panic("maxPC can't be zero")
-			}
-			// .low_pc
-			if err := binary.Write(unwindShardsValBuf, m.byteOrder, minPc); err != nil {
-				return fmt.Errorf("write shards .low_pc bytes: %w", err)
-			}
+		// .low_pc
+		if err := binary.Write(unwindShardsValBuf, m.byteOrder, chunk.LowPC); err != nil {
+			return nil, fmt.Errorf("write shards .low_pc bytes: %w", err)
+		}
+		// .high_pc
+		if err := binary.Write(unwindShardsValBuf, m.byteOrder, chunk.HighPC); err != nil {
+			return nil, fmt.Errorf("write shards .high_pc bytes: %w", err)
+		}
+		// .shard_index
+		if err := binary.Write(unwindShardsValBuf, m.byteOrder, chunk.ShardIndex); err != nil {
+			return nil, fmt.Errorf("write shards .shard_index bytes: %w", err)
+		}
+		// .low_index
+		if err := binary.Write(unwindShardsValBuf, m.byteOrder, chunk.LowIndex); err != nil {
+			return nil, fmt.Errorf("write shards .low_index bytes: %w", err)
+		}
+		// .high_index
+		if err := binary.Write(unwindShardsValBuf, m.byteOrder, chunk.HighIndex); err != nil {
+			return nil, fmt.Errorf("write shards .high_index bytes: %w", err)
+		}
+	}
+	// The remaining chunks are zeroed, which marks the last chunk.
+	unwindShardsValBuf.Write(make([]byte, unwindShardsSizeBytes-unwindShardsValBuf.Len()))
 
-			// Dealing with the last chunk, we must add the highest known PC.
-			maxPc := currentChunk[len(currentChunk)-1].Pc()
-			// .high_pc
-			if err := binary.Write(unwindShardsValBuf, m.byteOrder, maxPc); err != nil {
-				return fmt.Errorf("write shards .high_pc bytes: %w", err)
-			}
+	executableID := executable.id
+	if err := m.unwindShards.Update(
+		unsafe.Pointer(&executableID),
+		unsafe.Pointer(&unwindShardsValBuf.Bytes()[0])); err != nil {
+		return nil, fmt.Errorf("failed to update unwind shard: %w", err)
+	}
 
-			// .shard_index
-			if err := binary.Write(unwindShardsValBuf, m.byteOrder, m.shardIndex); err != nil {
-				return fmt.Errorf("write shards .shard_index bytes: %w", err)
-			}
+	m.totalEntries += uint64(len(ut))
+	m.uniqueMappings++
+	return executable, nil
+}
 
-			// .low_index
-			if err := binary.Write(unwindShardsValBuf, m.byteOrder, m.lowIndex); err != nil {
-				return fmt.Errorf("write shards .low_index bytes: %w", err)
-			}
-			// .high_index
-			if err := binary.Write(unwindShardsValBuf, m.byteOrder, m.highIndex); err != nil {
-				return fmt.Errorf("write shards .high_index bytes: %w", err)
-			}
+// evictUnwindTables removes the unwind tables of the evicted executables from
+// the BPF maps. The processes that referenced them lose their process
+// information, which is added again the next time they are sampled.
+func (m *bpfMaps) evictUnwindTables(evicted []*storedExecutable) error {
+	for _, executable := range evicted {
+		level.Debug(m.logger).Log("msg", "evicting unwind table", "executableID", executable.id, "buildID", executable.buildID, "references", len(executable.refs))
 
-			m.lowIndex = m.highIndex
+		executableID := executable.id
+		if err := m.unwindShards.DeleteKey(unsafe.Pointer(&executableID)); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("failed to delete unwind shard: %w", err)
+		}
 
-			// Write unwind table.
-			for _, row := range currentChunk {
-				// Get a slice of the bytes we need for this row.
-				rowSlice := m.unwindInfoMemory.Slice(compactUnwindRowSizeBytes)
-				m.writeUnwindTableRow(&rowSlice, row)
+		for id := range executable.refs {
+			pid := id.PID
+			if err := m.processInfo.DeleteKey(unsafe.Pointer(&pid)); err != nil && !errors.Is(err, syscall.ENOENT) {
+				return fmt.Errorf("failed to delete process info: %w", err)
 			}
+			m.processCache.Remove(pid)
+			m.unwindTableStore.removeProcess(pid)
+			delete(m.jitProcesses, pid)
+		}
 
-			// We ran out of space in the current shard. Let's allocate a new one.
-			if m.availableEntries() == 0 {
-				level.Info(m.logger).Log("msg", "creating a new shard as we ran out of space")
+		m.totalEntries -= executable.rows
+		m.uniqueMappings--
+	}
+	return nil
+}
 
-				if err := m.allocateNewShard(); err != nil {
-					return err
-				}
+// writeUnwindTableRows writes the rows to the given shard starting at the given row.
+// The shard is written to its BPF map by persistUnwindTable.
+func (m *bpfMaps) writeUnwindTableRows(shard, low uint64, rows unwind.CompactUnwindTable) error {
+	buf, ok := m.dirtyShards[shard]
+	if !ok {
+		buf = make([]byte, maxUnwindTableSize*compactUnwindRowSizeBytes)
+		// Other tables can be stored in the shard.
+		if _, written := m.writtenShards[shard]; written {
+			shardIndex := shard
+			if err := m.unwindTables.GetValueReadInto(unsafe.Pointer(&shardIndex), &buf); err != nil {
+				return fmt.Errorf("failed to read unwind table shard %d: %w", shard, err)
 			}
-
-			chunkIndex++
 		}
-
-		executableID := m.executableID
-		if err := m.unwindShards.Update(
-			unsafe.Pointer(&executableID),
-			unsafe.Pointer(&unwindShardsValBuf.Bytes()[0])); err != nil {
-			return fmt.Errorf("failed to update unwind shard: %w", err)
-		}
-
-		m.executableID++
-		m.uniqueMappings++
+		m.dirtyShards[shard] = buf
 	}
 
+	for i, row := range rows {
+		offset := (low + uint64(i)) * compactUnwindRowSizeBytes
+		row.PutBinary(buf[offset : offset+compactUnwindRowSizeBytes])
+	}
 	return nil
 }
@@ -0,0 +1,151 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpu
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/objectfile"
+	"github.com/parca-dev/parca-agent/pkg/process"
+	"github.com/parca-dev/parca-agent/pkg/stack/unwind"
+)
+
+func TestProcessCachePIDReuse(t *testing.T) {
+	c := newProcessCache(log.NewNopLogger(), prometheus.NewRegistry())
+	t.Cleanup(func() {
+		require.NoError(t, c.close())
+	})
+
+	c.add(process.ID{PID: 1234, StartTime: 100}, 0xcafe)
+	hash, ok := c.get(process.ID{PID: 1234, StartTime: 100})
+	require.True(t, ok)
+	require.Equal(t, uint64(0xcafe), hash)
+
+	// The process information of the exited process must not be reused.
+	_, ok = c.get(process.ID{PID: 1234, StartTime: 200})
+	require.False(t, ok)
+
+	// The new process replaces the entry, the BPF map is keyed by PID too.
+	c.add(process.ID{PID: 1234, StartTime: 200}, 0xbeef)
+	_, ok = c.get(process.ID{PID: 1234, StartTime: 100})
+	require.False(t, ok)
+	hash, ok = c.get(process.ID{PID: 1234, StartTime: 200})
+	require.True(t, ok)
+	require.Equal(t, uint64(0xbeef), hash)
+}
+
+func TestWriteExpression(t *testing.T) {
+	m := &bpfMaps{byteOrder: binary.LittleEndian}
+	buf := make([]byte, dwarfExpressionSizeBytes)
+	// Leftovers of a previous expression must be cleared.
+	for i := range buf {
+		buf[i] = 0xff
+	}
+
+	m.writeExpression(buf, unwind.Expression{
+		{Opcode: unwind.ExpressionOpBreg, Reg: 7, Operand: -8},
+		{Opcode: unwind.ExpressionOpDeref},
+	})
+
+	want := make([]byte, dwarfExpressionSizeBytes)
+	binary.LittleEndian.PutUint64(want, 2)
+	want[8] = uint8(unwind.ExpressionOpBreg)
+	want[9] = 7
+	binary.LittleEndian.PutUint64(want[16:], uint64(0xfffffffffffffff8))
+	want[24] = uint8(unwind.ExpressionOpDeref)
+	require.Equal(t, want, buf)
+}
+
+func TestDecodeDwarfStack(t *testing.T) {
+	stackBytes := func(length, truncated uint64, addrs ...uint64) []byte {
+		b := binary.LittleEndian.AppendUint64(nil, length)
+		b = binary.LittleEndian.AppendUint64(b, truncated)
+		for i := 0; i < stackDepth; i++ {
+			var addr uint64
+			if i < len(addrs) {
+				addr = addrs[i]
+			}
+			b = binary.LittleEndian.AppendUint64(b, addr)
+		}
+		return b
+	}
+
+	// Only the first len addresses are part of the stack.
+	var stack combinedStack
+	truncated, err := decodeDwarfStack(stackBytes(2, 0, 0x1000, 0x2000, 0x3000), binary.LittleEndian, &stack)
+	require.NoError(t, err)
+	require.False(t, truncated)
+	require.Equal(t, []uint64{0x1000, 0x2000, 0}, stack[:3])
+
+	stack = combinedStack{}
+	truncated, err = decodeDwarfStack(stackBytes(3, 1, 0x1000, 0x2000, 0x3000), binary.LittleEndian, &stack)
+	require.NoError(t, err)
+	require.True(t, truncated)
+	require.Equal(t, []uint64{0x1000, 0x2000, 0x3000, 0}, stack[:4])
+
+	// The values only hold up to the maximum stack depth.
+	stack = combinedStack{}
+	truncated, err = decodeDwarfStack(stackBytes(2, 1, 0x1000, 0x2000)[:dwarfStackTraceSize(2)], binary.LittleEndian, &stack)
+	require.NoError(t, err)
+	require.True(t, truncated)
+	require.Equal(t, []uint64{0x1000, 0x2000, 0}, stack[:3])
+
+	_, err = decodeDwarfStack(stackBytes(1, 0)[:16], binary.LittleEndian, &stack)
+	require.ErrorIs(t, err, errUnrecoverable)
+}
+
+func TestDwarfStackTracesSize(t *testing.T) {
+	require.Equal(t, uint32(maxStackTraces), dwarfStackTracesSize(perfStackDepth))
+	// Deeper stacks take the same memory.
+	require.Equal(t, uint32(16062), dwarfStackTracesSize(stackDepth))
+	require.LessOrEqual(t,
+		uint64(dwarfStackTracesSize(stackDepth))*uint64(dwarfStackTraceSize(stackDepth)),
+		uint64(maxStackTraces)*uint64(dwarfStackTraceSize(perfStackDepth)),
+	)
+}
+
+type countingFinder struct {
+	calls int
+}
+
+func (f *countingFinder) Find(context.Context, string, *objectfile.ObjectFile) (string, error) {
+	f.calls++
+	return "/usr/lib/debug/.build-id/ab/cdef.debug", nil
+}
+
+func TestDebugFilesFind(t *testing.T) {
+	finder := &countingFinder{}
+	d := &debugFiles{
+		objFilePool: objectfile.NewPool(log.NewNopLogger(), prometheus.NewRegistry(), 10, 0),
+		finder:      finder,
+	}
+
+	withDebugFrame, err := filepath.Abs("../../buildid/testdata/rust")
+	require.NoError(t, err)
+	require.Equal(t, "", d.find(os.Getpid(), withDebugFrame))
+	require.Equal(t, 0, finder.calls)
+
+	withoutDebugFrame, err := filepath.Abs("../../objectfile/testdata/fib")
+	require.NoError(t, err)
+	require.Equal(t, "/usr/lib/debug/.build-id/ab/cdef.debug", d.find(os.Getpid(), withoutDebugFrame))
+	require.Equal(t, 1, finder.calls)
+}
@@ -38,6 +38,7 @@ const (
 	labelStackDropReasonIterator         = "iterator"
 
 	profileDropReasonProcessInfo = "process_info"
+	profileDropReasonExcluded    = "excluded"
 )
 
 type metrics struct {
@@ -49,6 +50,7 @@ type metrics struct {
 	// stack level
 	stackDrop       *prometheus.CounterVec
 	readMapAttempts *prometheus.CounterVec
+	stackTruncated  prometheus.Counter
 }
 
 func newMetrics(reg prometheus.Registerer) *metrics {
@@ -85,6 +87,13 @@ func newMetrics(reg prometheus.Registerer) *metrics {
 			},
 			[]string{"stack", "action", "status"},
 		),
+		stackTruncated: promauto.With(reg).NewCounter(
+			prometheus.CounterOpts{
+				Name:        "parca_agent_profiler_stack_truncated_total",
+				Help:        "Total number of samples whose stacks were deeper than the maximum stack depth.",
+				ConstLabels: map[string]string{"type": "cpu"},
+			},
+		),
 		profileDrop: promauto.With(reg).NewCounterVec(
 			prometheus.CounterOpts{
 				Name:        "parca_agent_profiler_profiles_drop_total",
@@ -121,6 +130,7 @@ func newMetrics(reg prometheus.Registerer) *metrics {
 	m.readMapAttempts.WithLabelValues(labelKernel, labelKernelUnwind, labelFailed)
 
 	m.profileDrop.WithLabelValues(profileDropReasonProcessInfo)
+	m.profileDrop.WithLabelValues(profileDropReasonExcluded)
 
 	return m
 }
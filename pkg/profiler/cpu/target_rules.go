@@ -0,0 +1,208 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cpu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/procfs"
+
+	"github.com/parca-dev/parca-agent/pkg/config"
+	"github.com/parca-dev/parca-agent/pkg/discovery"
+)
+
+// targetSettingsProfilerName is the name of the profiler in the settings of targets.
+const targetSettingsProfilerName = "cpu"
+
+// TargetSettingsProvider returns the settings that the target of a process asked for,
+// e.g. through the annotations of its pod.
+type TargetSettingsProvider interface {
+	TargetSettings(ctx context.Context, pid int) discovery.TargetSettings
+}
+
+// targetConfig mirrors target_config_t in the BPF program.
+type targetConfig struct {
+	Excluded       uint8
+	SamplingWeight uint8
+}
+
+// errSamplingFrequencyTooHigh is returned for targets that ask for a higher
+// sampling frequency than the agent and the target rules allow. Samples can
+// only be dropped, the frequency of a target can not be raised.
+var errSamplingFrequencyTooHigh = errors.New("sampling frequency can not be raised above the one the agent and the target rules allow")
+
+// defaultTargetConfig is used for processes that do not match any rule,
+// the BPF program applies it to every process without an entry.
+var defaultTargetConfig = targetConfig{SamplingWeight: config.MaxSamplingWeight}
+
+func (c targetConfig) excluded() bool {
+	return c.Excluded != 0
+}
+
+// samplingPeriod returns the sampling period of the process, which grows
+// as less of its samples are kept.
+func (c targetConfig) samplingPeriod(period int64) int64 {
+	if c.SamplingWeight == 0 || c.SamplingWeight >= config.MaxSamplingWeight {
+		return period
+	}
+	return period * config.MaxSamplingWeight / int64(c.SamplingWeight)
+}
+
+// targetConfigFor returns the settings of the first rule matching the labels.
+func targetConfigFor(rules []*config.TargetRule, lset model.LabelSet) targetConfig {
+	for _, r := range rules {
+		if !r.Matches(lset) {
+			continue
+		}
+		if r.Action == config.TargetRuleExclude {
+			return targetConfig{Excluded: 1}
+		}
+		return targetConfig{SamplingWeight: r.SamplingWeight}
+	}
+	return defaultTargetConfig
+}
+
+// withSettings applies the settings the target asked for on top of the rules.
+// Targets can opt out of profiling or lower their sampling frequency. Asking
+// to sample more often than the agent and the rules allow is rejected, with
+// an error, and the settings of the rules are kept.
+func (c targetConfig) withSettings(s discovery.TargetSettings, samplingFrequency uint64) (targetConfig, error) {
+	if !s.Profile || !s.ProfilerEnabled(targetSettingsProfilerName) {
+		return targetConfig{Excluded: 1}, nil
+	}
+	if c.excluded() || s.SamplingFrequency == 0 {
+		return c, nil
+	}
+	if allowed := c.samplingFrequency(samplingFrequency); s.SamplingFrequency > allowed {
+		return c, fmt.Errorf("%w: asked for %dHz, at most %dHz", errSamplingFrequencyTooHigh, s.SamplingFrequency, allowed)
+	}
+
+	weight := uint8(s.SamplingFrequency * config.MaxSamplingWeight / samplingFrequency)
+	if weight == 0 {
+		weight = 1
+	}
+	if weight < c.SamplingWeight {
+		c.SamplingWeight = weight
+	}
+	return c, nil
+}
+
+// samplingFrequency returns the frequency at which the samples of the process are kept.
+func (c targetConfig) samplingFrequency(samplingFrequency uint64) uint64 {
+	if c.excluded() {
+		return 0
+	}
+	return (samplingFrequency*uint64(c.SamplingWeight) + config.MaxSamplingWeight/2) / config.MaxSamplingWeight
+}
+
+func (p *CPU) targetSettingsFor(ctx context.Context, pid int) discovery.TargetSettings {
+	if p.targetSettings == nil {
+		return discovery.DefaultTargetSettings
+	}
+	return p.targetSettings.TargetSettings(ctx, pid)
+}
+
+// ProcessSamplingFrequency returns the effective sampling frequency of the process,
+// after the target rules and its settings have been applied. It is 0 for excluded processes.
+func (p *CPU) ProcessSamplingFrequency(pid int) uint64 {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	cfg, ok := p.targetConfigs[pid]
+	if !ok {
+		cfg = defaultTargetConfig
+	}
+	return cfg.samplingFrequency(p.profilingSamplingFrequency)
+}
+
+// SetTargetRules replaces the rules that decide per process whether it is
+// profiled and which share of its samples is kept.
+func (p *CPU) SetTargetRules(rules []*config.TargetRule) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if reflect.DeepEqual(p.targetRules, rules) {
+		return
+	}
+	p.targetRules = rules
+
+	// Excluded processes are not sampled anymore, so they would never be
+	// evaluated against the new rules unless their settings are dropped.
+	for pid := range p.targetConfigs {
+		if p.bpfMaps != nil {
+			if err := p.bpfMaps.deleteTargetConfig(pid); err != nil {
+				level.Warn(p.logger).Log("msg", "failed to delete target config", "pid", pid, "err", err)
+				continue
+			}
+		}
+		delete(p.targetConfigs, pid)
+	}
+}
+
+// applyTargetRules evaluates the target rules against the labels of the process,
+// applies the settings of its target and updates them in the BPF program if they changed.
+// The returned error tells why settings of the target were rejected.
+func (p *CPU) applyTargetRules(pid int, lset model.LabelSet, settings discovery.TargetSettings) (targetConfig, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	cfg, settingsErr := targetConfigFor(p.targetRules, lset).withSettings(settings, p.profilingSamplingFrequency)
+	prev, ok := p.targetConfigs[pid]
+	if !ok {
+		prev = defaultTargetConfig
+	}
+	if cfg == prev {
+		return cfg, settingsErr
+	}
+
+	if cfg == defaultTargetConfig {
+		if err := p.bpfMaps.deleteTargetConfig(pid); err != nil {
+			level.Warn(p.logger).Log("msg", "failed to delete target config", "pid", pid, "err", err)
+			return cfg, settingsErr
+		}
+		delete(p.targetConfigs, pid)
+		return cfg, settingsErr
+	}
+
+	if err := p.bpfMaps.setTargetConfig(pid, cfg); err != nil {
+		level.Warn(p.logger).Log("msg", "failed to set target config", "pid", pid, "err", err)
+		return cfg, settingsErr
+	}
+	p.targetConfigs[pid] = cfg
+	return cfg, settingsErr
+}
+
+// pruneTargetConfigs removes the settings of processes that exited,
+// so that a process reusing the PID is evaluated from scratch.
+func (p *CPU) pruneTargetConfigs(pfs procfs.FS) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for pid := range p.targetConfigs {
+		if _, err := pfs.Proc(pid); err == nil {
+			continue
+		}
+		if err := p.bpfMaps.deleteTargetConfig(pid); err != nil {
+			level.Debug(p.logger).Log("msg", "failed to delete target config", "pid", pid, "err", err)
+			continue
+		}
+		delete(p.targetConfigs, pid)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cpu
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/config"
+	"github.com/parca-dev/parca-agent/pkg/discovery"
+)
+
+func TestTargetConfigFor(t *testing.T) {
+	rules := []*config.TargetRule{
+		{
+			Match:          map[model.LabelName]relabel.Regexp{"namespace": relabel.MustNewRegexp("batch-.*")},
+			Action:         config.TargetRuleExclude,
+			SamplingWeight: config.MaxSamplingWeight,
+		},
+		{
+			Match:          map[model.LabelName]relabel.Regexp{"systemd_unit": relabel.MustNewRegexp("checkout.service")},
+			Action:         config.TargetRuleInclude,
+			SamplingWeight: config.MaxSamplingWeight,
+		},
+		{
+			Action:         config.TargetRuleInclude,
+			SamplingWeight: 25,
+		},
+	}
+
+	excluded := targetConfigFor(rules, model.LabelSet{"namespace": "batch-nightly"})
+	require.True(t, excluded.excluded())
+
+	checkout := targetConfigFor(rules, model.LabelSet{"systemd_unit": "checkout.service"})
+	require.Equal(t, defaultTargetConfig, checkout)
+	require.Equal(t, int64(1000), checkout.samplingPeriod(1000))
+
+	other := targetConfigFor(rules, model.LabelSet{"comm": "cron"})
+	require.False(t, other.excluded())
+	require.Equal(t, uint8(25), other.SamplingWeight)
+	require.Equal(t, int64(4000), other.samplingPeriod(1000))
+
+	require.Equal(t, defaultTargetConfig, targetConfigFor(nil, model.LabelSet{"comm": "cron"}))
+}
+
+func TestTargetConfigWithSettings(t *testing.T) {
+	const samplingFrequency = 19
+
+	withSettings := func(c targetConfig, s discovery.TargetSettings) targetConfig {
+		t.Helper()
+		c, err := c.withSettings(s, samplingFrequency)
+		require.NoError(t, err)
+		return c
+	}
+
+	settings := discovery.DefaultTargetSettings
+	require.Equal(t, defaultTargetConfig, withSettings(defaultTargetConfig, settings))
+
+	settings.Profile = false
+	require.True(t, withSettings(defaultTargetConfig, settings).excluded())
+
+	settings = discovery.DefaultTargetSettings
+	settings.Profilers = []string{"offcpu"}
+	require.True(t, withSettings(defaultTargetConfig, settings).excluded())
+	settings.Profilers = []string{"cpu", "offcpu"}
+	require.False(t, withSettings(defaultTargetConfig, settings).excluded())
+
+	// Targets can lower their sampling frequency, but not raise it.
+	settings = discovery.DefaultTargetSettings
+	settings.SamplingFrequency = 9
+	lowered := withSettings(defaultTargetConfig, settings)
+	require.Equal(t, uint8(47), lowered.SamplingWeight)
+	require.Equal(t, uint64(9), lowered.samplingFrequency(samplingFrequency))
+
+	settings.SamplingFrequency = samplingFrequency
+	require.Equal(t, defaultTargetConfig, withSettings(defaultTargetConfig, settings))
+
+	settings.SamplingFrequency = 97
+	cfg, err := defaultTargetConfig.withSettings(settings, samplingFrequency)
+	require.ErrorIs(t, err, errSamplingFrequencyTooHigh)
+	require.Equal(t, defaultTargetConfig, cfg)
+
+	// The target can not sample more often than its rule allows either.
+	settings.SamplingFrequency = 9
+	cfg, err = targetConfig{SamplingWeight: 25}.withSettings(settings, samplingFrequency)
+	require.ErrorIs(t, err, errSamplingFrequencyTooHigh)
+	require.Equal(t, uint8(25), cfg.SamplingWeight)
+
+	settings.SamplingFrequency = 3
+	require.Equal(t, uint8(15), withSettings(targetConfig{SamplingWeight: 25}, settings).SamplingWeight)
+	require.True(t, withSettings(targetConfig{Excluded: 1}, settings).excluded())
+	require.Equal(t, uint64(0), targetConfig{Excluded: 1}.samplingFrequency(samplingFrequency))
+}
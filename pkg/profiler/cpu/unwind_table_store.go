@@ -0,0 +1,334 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpu
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/parca-dev/parca-agent/pkg/process"
+	"github.com/parca-dev/parca-agent/pkg/stack/unwind"
+)
+
+var (
+	errUnwindTableTooLarge = errors.New("unwind table does not fit in the unwind table shards")
+	errUnwindTableNoSpace  = errors.New("not enough space left in the unwind table shards")
+)
+
+// Executables without an unwind table are forgotten after not being sampled
+// for this many profiling rounds.
+const chunklessExecutableRounds = 10
+
+// storedExecutable is an executable in the unwind table store.
+type storedExecutable struct {
+	buildID string
+	id      uint64
+	// Executables without unwind information have no chunks.
+	chunks []unwind.UnwindTableChunk
+	rows   uint64
+	// Processes that map the executable.
+	refs map[process.ID]struct{}
+	// Profiling round the executable was last sampled in.
+	lastSampled uint64
+}
+
+type storedProcess struct {
+	id       process.ID
+	buildIDs []string
+}
+
+// unwindTableStore keeps track of where the unwind tables of executables are
+// in the unwind table shards. The table of an executable is loaded once per
+// build ID and shared by all the processes that map it, which reference it.
+// Once the shards run out of space, the tables of unreferenced executables and
+// then of the ones that were sampled the least recently are evicted.
+//
+// It is not safe for concurrent use.
+type unwindTableStore struct {
+	maxExecutables int
+	// alive tells whether a process is still running.
+	alive func(process.ID) bool
+
+	shards      *unwind.ShardAllocator
+	executables map[string]*storedExecutable // Keyed by build ID.
+	// Executables that have an unwind table.
+	loaded    int
+	processes map[int]*storedProcess // Keyed by PID.
+	nextID    uint64
+	round     uint64
+
+	// Stats.
+	rows      uint64
+	evictions uint64
+}
+
+func newUnwindTableStore(shards, shardSize uint64, maxExecutables int, alive func(process.ID) bool) *unwindTableStore {
+	return &unwindTableStore{
+		maxExecutables: maxExecutables,
+		alive:          alive,
+		shards:         unwind.NewShardAllocator(shards, shardSize),
+		executables:    map[string]*storedExecutable{},
+		processes:      map[int]*storedProcess{},
+		// The ID 0 is the one of the JIT mappings without an unwind table.
+		nextID: 1,
+	}
+}
+
+// get returns the executable with the given build ID.
+func (s *unwindTableStore) get(buildID string) (*storedExecutable, bool) {
+	e, ok := s.executables[buildID]
+	return e, ok
+}
+
+// add stores the unwind table of the executable with the given build ID,
+// a nil table if it has no unwind information. The tables of other executables
+// are evicted if needed, except for the ones in keep, and returned.
+func (s *unwindTableStore) add(buildID string, table unwind.CompactUnwindTable, keep map[string]struct{}) (*storedExecutable, []*storedExecutable, error) {
+	e := &storedExecutable{
+		buildID:     buildID,
+		id:          s.nextID,
+		rows:        uint64(len(table)),
+		refs:        map[process.ID]struct{}{},
+		lastSampled: s.round,
+	}
+
+	var evicted []*storedExecutable
+	if len(table) > 0 {
+		if uint64(len(table)) > s.shards.Capacity() {
+			return nil, nil, errUnwindTableTooLarge
+		}
+
+		pruned := false
+		for {
+			if s.loaded < s.maxExecutables {
+				if chunks, ok := s.shards.Allocate(table); ok {
+					e.chunks = chunks
+					break
+				}
+			}
+
+			// Make room. References of exited processes are dropped first,
+			// to find out which executables are no longer used.
+			if !pruned {
+				s.pruneProcesses()
+				pruned = true
+			}
+			victim := s.victim(keep)
+			if victim == nil {
+				return nil, evicted, errUnwindTableNoSpace
+			}
+			s.evict(victim)
+			evicted = append(evicted, victim)
+		}
+		s.loaded++
+		s.rows += e.rows
+	}
+
+	s.nextID++
+	s.executables[buildID] = e
+	return e, evicted, nil
+}
+
+// victim returns the executable whose table should be evicted next, or nil if
+// there is none. Unreferenced executables go first, then the least recently sampled.
+func (s *unwindTableStore) victim(keep map[string]struct{}) *storedExecutable {
+	var victim *storedExecutable
+	for buildID, e := range s.executables {
+		if len(e.chunks) == 0 {
+			continue
+		}
+		if _, ok := keep[buildID]; ok {
+			continue
+		}
+		if victim == nil {
+			victim = e
+			continue
+		}
+		referenced, victimReferenced := len(e.refs) > 0, len(victim.refs) > 0
+		switch {
+		case referenced != victimReferenced:
+			if !referenced {
+				victim = e
+			}
+		case e.lastSampled != victim.lastSampled:
+			if e.lastSampled < victim.lastSampled {
+				victim = e
+			}
+		case e.id < victim.id:
+			victim = e
+		}
+	}
+	return victim
+}
+
+// evict removes the executable to make room for others.
+func (s *unwindTableStore) evict(e *storedExecutable) {
+	if len(e.chunks) > 0 {
+		s.evictions++
+	}
+	s.release(e)
+}
+
+// remove removes the executable with the given build ID, if stored.
+func (s *unwindTableStore) remove(buildID string) (*storedExecutable, bool) {
+	e, ok := s.executables[buildID]
+	if !ok {
+		return nil, false
+	}
+	s.release(e)
+	return e, true
+}
+
+// release removes the executable and frees the rows of its table.
+func (s *unwindTableStore) release(e *storedExecutable) {
+	for _, chunk := range e.chunks {
+		s.shards.Release(chunk)
+	}
+	if len(e.chunks) > 0 {
+		s.loaded--
+		s.rows -= e.rows
+	}
+	delete(s.executables, e.buildID)
+}
+
+// setProcess sets the executables the process references, replacing
+// the ones of the previous process with the same PID.
+func (s *unwindTableStore) setProcess(id process.ID, buildIDs []string) {
+	s.removeProcess(id.PID)
+	for _, buildID := range buildIDs {
+		if e, ok := s.executables[buildID]; ok {
+			e.refs[id] = struct{}{}
+		}
+	}
+	s.processes[id.PID] = &storedProcess{id: id, buildIDs: buildIDs}
+}
+
+// removeProcess drops the references of the process with the given PID.
+func (s *unwindTableStore) removeProcess(pid int) {
+	p, ok := s.processes[pid]
+	if !ok {
+		return
+	}
+	for _, buildID := range p.buildIDs {
+		if e, ok := s.executables[buildID]; ok {
+			delete(e.refs, p.id)
+		}
+	}
+	delete(s.processes, pid)
+}
+
+// removeProcesses drops the references of all the processes.
+func (s *unwindTableStore) removeProcesses() {
+	for pid := range s.processes {
+		s.removeProcess(pid)
+	}
+}
+
+// pruneProcesses drops the references of the processes that exited.
+func (s *unwindTableStore) pruneProcesses() {
+	for pid, p := range s.processes {
+		if !s.alive(p.id) {
+			s.removeProcess(pid)
+		}
+	}
+}
+
+// sampled records that the process with the given PID was sampled in the
+// current profiling round.
+func (s *unwindTableStore) sampled(pid int) {
+	p, ok := s.processes[pid]
+	if !ok {
+		return
+	}
+	for _, buildID := range p.buildIDs {
+		if e, ok := s.executables[buildID]; ok {
+			e.lastSampled = s.round
+		}
+	}
+}
+
+// finishRound starts a new profiling round. The executables without an unwind
+// table that were not sampled recently are forgotten.
+func (s *unwindTableStore) finishRound() {
+	s.round++
+	for _, e := range s.executables {
+		if len(e.chunks) == 0 && s.round-e.lastSampled > chunklessExecutableRounds {
+			s.release(e)
+		}
+	}
+}
+
+var (
+	descUnwindTableStoreExecutables = prometheus.NewDesc(
+		"parca_agent_unwind_table_store_executables",
+		"Executables whose unwind table is loaded.",
+		nil, nil,
+	)
+	descUnwindTableStoreRows = prometheus.NewDesc(
+		"parca_agent_unwind_table_store_rows",
+		"Unwind table rows loaded.",
+		nil, nil,
+	)
+	descUnwindTableStoreCapacityRows = prometheus.NewDesc(
+		"parca_agent_unwind_table_store_capacity_rows",
+		"Unwind table rows that can be loaded.",
+		nil, nil,
+	)
+	descUnwindTableStoreEvictions = prometheus.NewDesc(
+		"parca_agent_unwind_table_store_evictions_total",
+		"Total number of unwind tables evicted to make room for others.",
+		nil, nil,
+	)
+)
+
+type unwindTableStoreStats struct {
+	executables  int
+	rows         uint64
+	capacityRows uint64
+	evictions    uint64
+}
+
+func (s *unwindTableStore) stats() unwindTableStoreStats {
+	return unwindTableStoreStats{
+		executables:  s.loaded,
+		rows:         s.rows,
+		capacityRows: s.shards.Capacity(),
+		evictions:    s.evictions,
+	}
+}
+
+// unwindTableStoreCollector collects the stats of the unwind table store.
+type unwindTableStoreCollector struct {
+	maps *bpfMaps
+}
+
+func newUnwindTableStoreCollector(maps *bpfMaps) *unwindTableStoreCollector {
+	return &unwindTableStoreCollector{maps: maps}
+}
+
+func (c *unwindTableStoreCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descUnwindTableStoreExecutables
+	ch <- descUnwindTableStoreRows
+	ch <- descUnwindTableStoreCapacityRows
+	ch <- descUnwindTableStoreEvictions
+}
+
+func (c *unwindTableStoreCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.maps.unwindTableStoreStats()
+	ch <- prometheus.MustNewConstMetric(descUnwindTableStoreExecutables, prometheus.GaugeValue, float64(stats.executables))
+	ch <- prometheus.MustNewConstMetric(descUnwindTableStoreRows, prometheus.GaugeValue, float64(stats.rows))
+	ch <- prometheus.MustNewConstMetric(descUnwindTableStoreCapacityRows, prometheus.GaugeValue, float64(stats.capacityRows))
+	ch <- prometheus.MustNewConstMetric(descUnwindTableStoreEvictions, prometheus.CounterValue, float64(stats.evictions))
+}
@@ -0,0 +1,262 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpu
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
+	"github.com/parca-dev/parca-agent/pkg/process"
+	"github.com/parca-dev/parca-agent/pkg/stack/unwind"
+)
+
+// testUnwindTable returns an unwind table with a function per element of
+// rows, with that many rows plus the end of function marker.
+func testUnwindTable(t *testing.T, rows ...int) unwind.CompactUnwindTable {
+	t.Helper()
+
+	entry := func(section, body []byte) []byte {
+		for (len(body)+4)%8 != 0 {
+			body = append(body, frame.DW_CFA_nop)
+		}
+		section = binary.LittleEndian.AppendUint32(section, uint32(len(body)))
+		return append(section, body...)
+	}
+
+	cie := binary.LittleEndian.AppendUint32(nil, 0) // CIE id.
+	cie = append(cie, 1)                            // Version.
+	cie = append(cie, "zR"...)
+	cie = append(cie, 0,
+		1,    // Code alignment factor.
+		0x78, // Data alignment factor, -8.
+		16,   // Return address register.
+		1,    // Augmentation data length.
+		0x03, // Pointer encoding, udata4.
+	)
+	section := entry(nil, cie)
+
+	begin := uint32(0x1000)
+	for _, n := range rows {
+		instructions := []byte{frame.DW_CFA_def_cfa, 7, 8}
+		for i := 1; i < n; i++ {
+			instructions = append(instructions, frame.DW_CFA_advance_loc|1, frame.DW_CFA_def_cfa_offset, byte(8*(i+1)))
+		}
+
+		body := binary.LittleEndian.AppendUint32(nil, uint32(len(section)+4)) // CIE pointer.
+		body = binary.LittleEndian.AppendUint32(body, begin)
+		body = binary.LittleEndian.AppendUint32(body, 0x10)
+		body = append(body, 0) // Augmentation data length.
+		body = append(body, instructions...)
+		section = entry(section, body)
+		begin += 0x10
+	}
+
+	fdes, err := frame.Parse(section, binary.LittleEndian, 0, 8, 0x100)
+	require.NoError(t, err)
+	table, err := unwind.BuildCompactUnwindTable(fdes)
+	require.NoError(t, err)
+
+	want := 0
+	for _, n := range rows {
+		want += n + 1
+	}
+	require.Len(t, table, want)
+	return table
+}
+
+func alwaysAlive(process.ID) bool { return true }
+
+func TestUnwindTableStoreShared(t *testing.T) {
+	s := newUnwindTableStore(2, 10, 10, alwaysAlive)
+
+	libc, evicted, err := s.add("libc", testUnwindTable(t, 3, 3), nil)
+	require.NoError(t, err)
+	require.Empty(t, evicted)
+	require.Equal(t, []unwind.UnwindTableChunk{
+		{LowPC: 0x1000, HighPC: 0x1020, ShardIndex: 0, LowIndex: 0, HighIndex: 8},
+	}, libc.chunks)
+
+	// Executables without unwind information are stored without rows.
+	static, _, err := s.add("static", nil, nil)
+	require.NoError(t, err)
+	require.Empty(t, static.chunks)
+	require.NotEqual(t, libc.id, static.id)
+
+	first := process.ID{PID: 1, StartTime: 1}
+	second := process.ID{PID: 2, StartTime: 1}
+	s.setProcess(first, []string{"libc", "static"})
+	s.setProcess(second, []string{"libc"})
+
+	got, ok := s.get("libc")
+	require.True(t, ok)
+	require.Same(t, libc, got)
+	require.Len(t, libc.refs, 2)
+
+	// A new process with a recycled PID replaces the references of the old one.
+	s.setProcess(process.ID{PID: 1, StartTime: 2}, []string{"static"})
+	require.Len(t, libc.refs, 1)
+	require.Len(t, static.refs, 1)
+
+	s.removeProcess(2)
+	require.Empty(t, libc.refs)
+
+	require.Equal(t, unwindTableStoreStats{executables: 1, rows: 8, capacityRows: 20}, s.stats())
+}
+
+func TestUnwindTableStoreChunks(t *testing.T) {
+	s := newUnwindTableStore(2, 10, 10, alwaysAlive)
+
+	_, _, err := s.add("a", testUnwindTable(t, 5), nil)
+	require.NoError(t, err)
+
+	// The table is split between functions, in the largest free ranges first.
+	b, _, err := s.add("b", testUnwindTable(t, 4, 3, 2), nil)
+	require.NoError(t, err)
+	require.Equal(t, []unwind.UnwindTableChunk{
+		{LowPC: 0x1000, HighPC: 0x1020, ShardIndex: 1, LowIndex: 0, HighIndex: 9},
+		{LowPC: 0x1020, HighPC: 0x1030, ShardIndex: 0, LowIndex: 6, HighIndex: 9},
+	}, b.chunks)
+
+	// Functions are never split.
+	_, _, err = s.add("c", testUnwindTable(t, 2), map[string]struct{}{"a": {}, "b": {}})
+	require.ErrorIs(t, err, errUnwindTableNoSpace)
+
+	_, _, err = s.add("d", testUnwindTable(t, 10, 10), nil)
+	require.ErrorIs(t, err, errUnwindTableTooLarge)
+}
+
+func TestUnwindTableStoreEviction(t *testing.T) {
+	s := newUnwindTableStore(1, 12, 10, alwaysAlive)
+
+	for _, buildID := range []string{"a", "b", "c"} {
+		_, _, err := s.add(buildID, testUnwindTable(t, 3), nil)
+		require.NoError(t, err)
+	}
+	s.setProcess(process.ID{PID: 1}, []string{"a"})
+	s.setProcess(process.ID{PID: 2}, []string{"b"})
+	s.setProcess(process.ID{PID: 3}, []string{"c"})
+	s.finishRound()
+	s.sampled(1)
+	s.sampled(3)
+	s.finishRound()
+	s.sampled(1)
+
+	// "b" is the least recently sampled, "c" the next one.
+	_, evicted, err := s.add("d", testUnwindTable(t, 3, 3), nil)
+	require.NoError(t, err)
+	require.Len(t, evicted, 2)
+	require.Equal(t, "b", evicted[0].buildID)
+	require.Equal(t, "c", evicted[1].buildID)
+	_, ok := s.get("b")
+	require.False(t, ok)
+
+	// Unreferenced executables go first, and the executables of the
+	// process being loaded are kept.
+	s.removeProcess(1)
+	_, evicted, err = s.add("e", testUnwindTable(t, 2), map[string]struct{}{"a": {}})
+	require.NoError(t, err)
+	require.Len(t, evicted, 1)
+	require.Equal(t, "d", evicted[0].buildID)
+
+	_, evicted, err = s.add("f", testUnwindTable(t, 11), map[string]struct{}{"a": {}})
+	require.ErrorIs(t, err, errUnwindTableNoSpace)
+	require.Len(t, evicted, 1)
+	require.Equal(t, "e", evicted[0].buildID)
+
+	require.Equal(t, unwindTableStoreStats{executables: 1, rows: 4, capacityRows: 12, evictions: 4}, s.stats())
+}
+
+func TestUnwindTableStoreExitedProcesses(t *testing.T) {
+	exited := process.ID{PID: 2}
+	s := newUnwindTableStore(1, 8, 10, func(id process.ID) bool { return id != exited })
+
+	_, _, err := s.add("a", testUnwindTable(t, 3), nil)
+	require.NoError(t, err)
+	_, _, err = s.add("b", testUnwindTable(t, 3), nil)
+	require.NoError(t, err)
+	s.setProcess(process.ID{PID: 1}, []string{"a"})
+	s.setProcess(exited, []string{"b"})
+	s.finishRound()
+	s.sampled(exited.PID)
+
+	// "b" was sampled more recently, but its process exited.
+	_, evicted, err := s.add("c", testUnwindTable(t, 3), nil)
+	require.NoError(t, err)
+	require.Len(t, evicted, 1)
+	require.Equal(t, "b", evicted[0].buildID)
+	require.NotContains(t, s.processes, exited.PID)
+}
+
+func TestUnwindTableStoreMaxExecutables(t *testing.T) {
+	s := newUnwindTableStore(1, 100, 2, alwaysAlive)
+
+	for _, buildID := range []string{"a", "b", "c"} {
+		_, _, err := s.add(buildID, testUnwindTable(t, 1), nil)
+		require.NoError(t, err)
+	}
+	_, ok := s.get("a")
+	require.False(t, ok)
+	require.Equal(t, 2, s.stats().executables)
+}
+
+func TestUnwindTableStoreChunklessExpiry(t *testing.T) {
+	s := newUnwindTableStore(1, 8, 10, alwaysAlive)
+
+	_, _, err := s.add("static", nil, nil)
+	require.NoError(t, err)
+	_, _, err = s.add("sampled", nil, nil)
+	require.NoError(t, err)
+	s.setProcess(process.ID{PID: 1}, []string{"sampled"})
+
+	// Executables that do not fit are not stored.
+	_, _, err = s.add("a", testUnwindTable(t, 3, 3), nil)
+	require.NoError(t, err)
+	_, _, err = s.add("b", testUnwindTable(t, 3), map[string]struct{}{"a": {}})
+	require.ErrorIs(t, err, errUnwindTableNoSpace)
+	_, ok := s.get("b")
+	require.False(t, ok)
+
+	for i := 0; i <= chunklessExecutableRounds; i++ {
+		s.sampled(1)
+		s.finishRound()
+	}
+	_, ok = s.get("static")
+	require.False(t, ok)
+	_, ok = s.get("sampled")
+	require.True(t, ok)
+	_, ok = s.get("a")
+	require.True(t, ok)
+	require.Equal(t, uint64(0), s.stats().evictions)
+}
+
+func TestUnwindTableStoreRemove(t *testing.T) {
+	s := newUnwindTableStore(1, 8, 10, alwaysAlive)
+
+	_, _, err := s.add("jitdump:1:1:a", testUnwindTable(t, 3, 3), nil)
+	require.NoError(t, err)
+	removed, ok := s.remove("jitdump:1:1:a")
+	require.True(t, ok)
+	require.Equal(t, "jitdump:1:1:a", removed.buildID)
+	_, ok = s.remove("jitdump:1:1:a")
+	require.False(t, ok)
+
+	// The rows of the removed table can be reused.
+	_, evicted, err := s.add("jitdump:1:1:b", testUnwindTable(t, 3, 3), nil)
+	require.NoError(t, err)
+	require.Empty(t, evicted)
+	require.Equal(t, unwindTableStoreStats{executables: 1, rows: 8, capacityRows: 8}, s.stats())
+}
@@ -0,0 +1,243 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package profiler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+
+	"github.com/parca-dev/parca-agent/pkg/profile"
+)
+
+const (
+	storeResultSuccess = "success"
+	storeResultError   = "error"
+)
+
+// Destination is a named profile store with its own relabeling rules.
+type Destination struct {
+	Name           string
+	Store          ProfileStore
+	RelabelConfigs []*relabel.Config
+}
+
+type fanoutMetrics struct {
+	writes        *prometheus.CounterVec
+	dropped       *prometheus.CounterVec
+	writeDuration *prometheus.HistogramVec
+}
+
+func newFanoutMetrics(reg prometheus.Registerer) *fanoutMetrics {
+	return &fanoutMetrics{
+		writes: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "parca_agent_profile_store_writes_total",
+				Help: "Total number of profiles written to a profile store.",
+			},
+			[]string{"store", "result"},
+		),
+		dropped: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "parca_agent_profile_store_dropped_total",
+				Help: "Total number of profiles dropped by the relabel configs of a profile store.",
+			},
+			[]string{"store"},
+		),
+		writeDuration: promauto.With(reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:                        "parca_agent_profile_store_write_duration_seconds",
+				Help:                        "Histogram of the time it takes to write a profile to a profile store.",
+				NativeHistogramBucketFactor: 1.1,
+			},
+			[]string{"store"},
+		),
+	}
+}
+
+// FanoutStore is a profile store that sends every profile to multiple destinations.
+// The profile is sent to the destinations concurrently, so a failing or slow
+// destination does not prevent or delay sending it to the others.
+type FanoutStore struct {
+	logger  log.Logger
+	metrics *fanoutMetrics
+
+	mtx          *sync.RWMutex
+	destinations []*Destination
+}
+
+// NewFanoutStore creates a new FanoutStore.
+func NewFanoutStore(logger log.Logger, reg prometheus.Registerer, destinations []*Destination) *FanoutStore {
+	m := newFanoutMetrics(reg)
+	for _, d := range destinations {
+		// Initialize the metrics so that they are reported even if no profile has been written yet.
+		m.writes.WithLabelValues(d.Name, storeResultSuccess)
+		m.writes.WithLabelValues(d.Name, storeResultError)
+		m.dropped.WithLabelValues(d.Name)
+	}
+
+	return &FanoutStore{
+		logger:       logger,
+		metrics:      m,
+		mtx:          &sync.RWMutex{},
+		destinations: destinations,
+	}
+}
+
+// ApplyConfig updates the relabel configs of the destinations with the given names,
+// destinations that are not part of the map keep their current relabel configs.
+// Destinations can not be added or removed at runtime.
+func (s *FanoutStore) ApplyConfig(relabelConfigs map[string][]*relabel.Config) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for name := range relabelConfigs {
+		if !s.hasDestination(name) {
+			return fmt.Errorf("unknown profile store %q, adding profile stores requires a restart", name)
+		}
+	}
+
+	destinations := make([]*Destination, 0, len(s.destinations))
+	for _, d := range s.destinations {
+		cfgs, ok := relabelConfigs[d.Name]
+		if !ok {
+			cfgs = d.RelabelConfigs
+		}
+		destinations = append(destinations, &Destination{
+			Name:           d.Name,
+			Store:          d.Store,
+			RelabelConfigs: cfgs,
+		})
+	}
+	s.destinations = destinations
+	return nil
+}
+
+func (s *FanoutStore) hasDestination(name string) bool {
+	for _, d := range s.destinations {
+		if d.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Store sends the profile to all destinations after applying their relabel configs.
+func (s *FanoutStore) Store(ctx context.Context, labelSet model.LabelSet, prof profile.Writer) error {
+	s.mtx.RLock()
+	destinations := s.destinations
+	s.mtx.RUnlock()
+
+	// The profile is encoded once for all the destinations.
+	prof = &sharedWriter{prof: prof}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(destinations))
+	for i, d := range destinations {
+		lset := labelSet
+		if len(d.RelabelConfigs) > 0 {
+			lbls, keep := relabel.Process(labels.FromMap(labelSetToMap(labelSet)), d.RelabelConfigs...)
+			if !keep {
+				s.metrics.dropped.WithLabelValues(d.Name).Inc()
+				continue
+			}
+			lset = make(model.LabelSet, len(lbls))
+			for _, l := range lbls {
+				lset[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+			}
+		}
+
+		wg.Add(1)
+		go func(i int, d *Destination, lset model.LabelSet) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := d.Store.Store(ctx, lset, prof)
+			s.metrics.writeDuration.WithLabelValues(d.Name).Observe(time.Since(start).Seconds())
+			if err != nil {
+				s.metrics.writes.WithLabelValues(d.Name, storeResultError).Inc()
+				level.Debug(s.logger).Log("msg", "failed to write profile to store", "store", d.Name, "err", err)
+				errs[i] = fmt.Errorf("store %s: %w", d.Name, err)
+				return
+			}
+			s.metrics.writes.WithLabelValues(d.Name, storeResultSuccess).Inc()
+		}(i, d, lset)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// sharedWriter encodes a profile once, so that it can be written to multiple
+// destinations concurrently.
+type sharedWriter struct {
+	prof profile.Writer
+
+	once sync.Once
+	data []byte
+	err  error
+}
+
+func (w *sharedWriter) encode() ([]byte, error) {
+	w.once.Do(func() {
+		buf := bytes.NewBuffer(nil)
+		w.err = w.prof.WriteUncompressed(buf)
+		w.data = buf.Bytes()
+	})
+	return w.data, w.err
+}
+
+func (w *sharedWriter) Write(out io.Writer) error {
+	data, err := w.encode()
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := zw.Write(data); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+func (w *sharedWriter) WriteUncompressed(out io.Writer) error {
+	data, err := w.encode()
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
+
+func labelSetToMap(ls model.LabelSet) map[string]string {
+	m := make(map[string]string, len(ls))
+	for k, v := range ls {
+		m[string(k)] = string(v)
+	}
+	return m
+}
@@ -0,0 +1,185 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package profiler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/pkg/profile"
+)
+
+type fakeWriter struct{}
+
+func (fakeWriter) Write(io.Writer) error             { return nil }
+func (fakeWriter) WriteUncompressed(io.Writer) error { return nil }
+
+type recordingStore struct {
+	err    error
+	stored []model.LabelSet
+}
+
+func (s *recordingStore) Store(_ context.Context, labels model.LabelSet, _ profile.Writer) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.stored = append(s.stored, labels)
+	return nil
+}
+
+func TestFanoutStore(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	regional := &recordingStore{}
+	central := &recordingStore{}
+	broken := &recordingStore{err: errors.New("unavailable")}
+
+	s := NewFanoutStore(log.NewNopLogger(), reg, []*Destination{
+		{Name: "regional", Store: regional},
+		{Name: "broken", Store: broken},
+		{
+			Name:  "central",
+			Store: central,
+			RelabelConfigs: []*relabel.Config{
+				{
+					SourceLabels: model.LabelNames{"namespace"},
+					Regex:        relabel.MustNewRegexp("production"),
+					Action:       relabel.Keep,
+				},
+				{
+					Regex:  relabel.MustNewRegexp("pid"),
+					Action: relabel.LabelDrop,
+				},
+			},
+		},
+	})
+
+	err := s.Store(context.Background(), model.LabelSet{"namespace": "production", "pid": "1"}, fakeWriter{})
+	require.ErrorContains(t, err, "store broken: unavailable")
+
+	err = s.Store(context.Background(), model.LabelSet{"namespace": "staging", "pid": "2"}, fakeWriter{})
+	require.ErrorContains(t, err, "store broken: unavailable")
+
+	require.Equal(t, []model.LabelSet{
+		{"namespace": "production", "pid": "1"},
+		{"namespace": "staging", "pid": "2"},
+	}, regional.stored)
+	require.Equal(t, []model.LabelSet{
+		{"namespace": "production"},
+	}, central.stored)
+
+	require.Equal(t, 2.0, testutil.ToFloat64(s.metrics.writes.WithLabelValues("regional", storeResultSuccess)))
+	require.Equal(t, 2.0, testutil.ToFloat64(s.metrics.writes.WithLabelValues("broken", storeResultError)))
+	require.Equal(t, 1.0, testutil.ToFloat64(s.metrics.writes.WithLabelValues("central", storeResultSuccess)))
+	require.Equal(t, 1.0, testutil.ToFloat64(s.metrics.dropped.WithLabelValues("central")))
+}
+
+func TestFanoutStoreApplyConfig(t *testing.T) {
+	store := &recordingStore{}
+	s := NewFanoutStore(log.NewNopLogger(), prometheus.NewRegistry(), []*Destination{
+		{Name: "central", Store: store},
+	})
+
+	require.Error(t, s.ApplyConfig(map[string][]*relabel.Config{"unknown": nil}))
+	require.NoError(t, s.ApplyConfig(map[string][]*relabel.Config{
+		"central": {{
+			SourceLabels: model.LabelNames{"pid"},
+			Regex:        relabel.MustNewRegexp("1"),
+			Action:       relabel.Drop,
+		}},
+	}))
+
+	require.NoError(t, s.Store(context.Background(), model.LabelSet{"pid": "1"}, fakeWriter{}))
+	require.NoError(t, s.Store(context.Background(), model.LabelSet{"pid": "2"}, fakeWriter{}))
+	require.Equal(t, []model.LabelSet{{"pid": "2"}}, store.stored)
+}
+
+// blockingStore blocks until unblock is closed.
+type blockingStore struct {
+	unblock chan struct{}
+}
+
+func (s *blockingStore) Store(_ context.Context, _ model.LabelSet, _ profile.Writer) error {
+	select {
+	case <-s.unblock:
+		return nil
+	case <-time.After(time.Second):
+		return errors.New("timed out")
+	}
+}
+
+// unblockingStore unblocks the given channel once it stored a profile.
+type unblockingStore struct {
+	unblock chan struct{}
+}
+
+func (s *unblockingStore) Store(context.Context, model.LabelSet, profile.Writer) error {
+	close(s.unblock)
+	return nil
+}
+
+func TestFanoutStoreConcurrent(t *testing.T) {
+	unblock := make(chan struct{})
+	s := NewFanoutStore(log.NewNopLogger(), prometheus.NewRegistry(), []*Destination{
+		{Name: "slow", Store: &blockingStore{unblock: unblock}},
+		{Name: "fast", Store: &unblockingStore{unblock: unblock}},
+	})
+
+	// The slow store does not delay writing to the fast one.
+	require.NoError(t, s.Store(context.Background(), model.LabelSet{"pid": "1"}, fakeWriter{}))
+}
+
+func TestSharedWriter(t *testing.T) {
+	w := &sharedWriter{prof: &pprofWriter{data: []byte("profile")}}
+
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, w.WriteUncompressed(buf))
+	require.Equal(t, "profile", buf.String())
+
+	buf.Reset()
+	require.NoError(t, w.Write(buf))
+	zr, err := gzip.NewReader(buf)
+	require.NoError(t, err)
+	data, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	require.Equal(t, "profile", string(data))
+	require.Equal(t, 1, w.prof.(*pprofWriter).encoded)
+}
+
+// pprofWriter writes the given data and counts how many times it was encoded.
+type pprofWriter struct {
+	data    []byte
+	encoded int
+}
+
+func (w *pprofWriter) Write(io.Writer) error { return errors.New("not implemented") }
+
+func (w *pprofWriter) WriteUncompressed(out io.Writer) error {
+	w.encoded++
+	_, err := out.Write(w.data)
+	return err
+}
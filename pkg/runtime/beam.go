@@ -0,0 +1,42 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package runtime
+
+import (
+	"debug/elf"
+	"path/filepath"
+	"regexp"
+)
+
+// The emulator is installed into a directory named after the ERTS version,
+// e.g. /usr/lib/erlang/erts-14.0.2/bin/beam.smp.
+var beamVersion = regexp.MustCompile(`erts-(\d+(?:\.\d+)+)`)
+
+// IsBEAM returns true if the executable is the Erlang virtual machine.
+func IsBEAM(path string) bool {
+	switch filepath.Base(path) {
+	case "beam.smp", "beam", "beam.emu.smp", "beam.jit.smp":
+		return true
+	}
+	return false
+}
+
+// BEAMVersion returns the ERTS version of the Erlang virtual machine.
+func BEAMVersion(path string, ef *elf.File) (string, error) {
+	if version := versionFromPath(path, beamVersion); version != "" {
+		return version, nil
+	}
+	return findInSection(ef, ".rodata", beamVersion)
+}
@@ -0,0 +1,45 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package runtime
+
+import (
+	"debug/elf"
+	"path/filepath"
+	"regexp"
+)
+
+var (
+	// The shared framework is installed into a directory named after the version,
+	// e.g. /usr/share/dotnet/shared/Microsoft.NETCore.App/7.0.5/libcoreclr.so.
+	dotNetPathVersion = regexp.MustCompile(`^(\d+\.\d+\.\d+(?:-[\w.]+)?)$`)
+	// The file version of the library, e.g. 7.0.523.17405 for 7.0.5.
+	dotNetVersion = regexp.MustCompile(`@\(#\)Version (\d+(?:\.\d+)+)`)
+)
+
+// DotNetVersion returns the version of the .NET runtime libcoreclr.so belongs to.
+// Self-contained applications ship the library next to their executable,
+// in that case the file version of the library is returned.
+func DotNetVersion(path string, ef *elf.File) (string, error) {
+	if version := versionFromPath(path, dotNetPathVersion); version != "" {
+		return version, nil
+	}
+	return findInSection(ef, ".rodata", dotNetVersion)
+}
+
+// isDotNetLibrary returns true for the CoreCLR library,
+// which is loaded by the dotnet host or by the app host of an application.
+func isDotNetLibrary(path string) bool {
+	return filepath.Base(path) == "libcoreclr.so"
+}
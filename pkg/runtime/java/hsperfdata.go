@@ -17,6 +17,7 @@ package java
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -25,6 +26,8 @@ import (
 	"sync"
 
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"golang.org/x/sync/singleflight"
 
@@ -38,8 +41,9 @@ type HSPerfDataCache struct {
 	fs     fs.FS
 	logger log.Logger
 
-	mu   *sync.Mutex
-	pids map[int]struct{}
+	mu *sync.Mutex
+	// pids are the paths of the hsperfdata files of the java processes found.
+	pids map[int]string
 
 	nsCache *namespace.Cache
 	sfg     *singleflight.Group
@@ -51,17 +55,24 @@ func (f *realfs) Open(name string) (fs.File, error) {
 	return os.Open(name)
 }
 
-func NewHSPerfDataCache(logger log.Logger, nsCache *namespace.Cache) *HSPerfDataCache {
-	return &HSPerfDataCache{
+// NewHSPerfDataCache creates a cache of the hsperfdata files of java processes,
+// and registers metrics about the heap and the garbage collectors of the JVMs found.
+func NewHSPerfDataCache(logger log.Logger, reg prometheus.Registerer, nsCache *namespace.Cache) *HSPerfDataCache {
+	c := &HSPerfDataCache{
 		fs:     &realfs{},
 		logger: logger,
 
 		mu:   &sync.Mutex{},
-		pids: make(map[int]struct{}),
+		pids: make(map[int]string),
 
 		nsCache: nsCache,
 		sfg:     &singleflight.Group{},
 	}
+	// Caches find the same JVMs, the metrics are reported by the first one.
+	if err := reg.Register(&hsperfdataCollector{c: c}); err != nil && !errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+		level.Warn(logger).Log("msg", "failed to register JVM metrics", "err", err)
+	}
+	return c
 }
 
 func (c *HSPerfDataCache) Exists(pid int) bool {
@@ -78,9 +89,52 @@ func (c *HSPerfDataCache) Exists(pid int) bool {
 // running in containers. Note that pids are assumed to be unique regardless
 // of username.
 func (c *HSPerfDataCache) IsJavaProcess(pid int) (bool, error) {
+	path, err := c.path(pid)
+	if err != nil {
+		return false, err
+	}
+	return path != "", nil
+}
+
+// PerfData reads the hsperfdata file of a java process.
+// The counters are updated by the JVM while it runs, the file is read on every call.
+func (c *HSPerfDataCache) PerfData(pid int) (*PerfData, error) {
+	path, err := c.path(pid)
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return nil, fmt.Errorf("no hsperfdata file found for PID %d", pid)
+	}
+
+	f, err := c.fs.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// The JVM exited.
+			c.mu.Lock()
+			delete(c.pids, pid)
+			c.mu.Unlock()
+		}
+		return nil, fmt.Errorf("failed to open hsperfdata file for PID %d: %w", pid, err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hsperfdata file for PID %d: %w", pid, err)
+	}
+	return ParsePerfData(data)
+}
+
+// path returns the path of the hsperfdata file of a process,
+// or an empty string if it is not a java process.
+func (c *HSPerfDataCache) path(pid int) (string, error) {
 	// Check if the pid is in the cache.
-	if c.Exists(pid) {
-		return true, nil
+	c.mu.Lock()
+	path, ok := c.pids[pid]
+	c.mu.Unlock()
+	if ok {
+		return path, nil
 	}
 
 	// Use singleflight to prevent concurrent requests for the same pid
@@ -89,18 +143,16 @@ func (c *HSPerfDataCache) IsJavaProcess(pid int) (bool, error) {
 		// List all directories that match the pattern /tmp/hsperfdata_*
 		dirs, err := filepath.Glob(hsperfdata)
 		if err != nil {
-			return false, fmt.Errorf("failed to list directories: %w", err)
+			return "", fmt.Errorf("failed to list directories: %w", err)
 		}
 
 		// Loop over all directories and search for the hsperfdata file for the given pid
 		for _, dir := range dirs {
 			hsperfdataPath := filepath.Join(dir, strconv.Itoa(pid))
-			if path, err := c.fs.Open(hsperfdataPath); err == nil {
-				defer path.Close()
-				c.mu.Lock()
-				c.pids[pid] = struct{}{}
-				c.mu.Unlock()
-				return true, nil
+			if f, err := c.fs.Open(hsperfdataPath); err == nil {
+				f.Close()
+				c.add(pid, hsperfdataPath)
+				return hsperfdataPath, nil
 			}
 		}
 
@@ -109,9 +161,9 @@ func (c *HSPerfDataCache) IsJavaProcess(pid int) (bool, error) {
 		nsPids, err := c.nsCache.Get(pid)
 		if err != nil {
 			if os.IsNotExist(err) || errors.Is(err, fs.ErrNotExist) {
-				return false, fmt.Errorf("%w when reading status", perf.ErrProcNotFound)
+				return "", fmt.Errorf("%w when reading status", perf.ErrProcNotFound)
 			}
-			return false, err
+			return "", err
 		}
 		// If we didn't find the pid in the root PID namespace, try to find it in the
 		// namespaces of the process. Store the namespace PID in the nsPID map to
@@ -125,31 +177,49 @@ func (c *HSPerfDataCache) IsJavaProcess(pid int) (bool, error) {
 
 		files, err := os.ReadDir(perfdataFiles)
 		if err != nil {
-			return false, fmt.Errorf("error reading %s: %w", perfdataFiles, err)
+			return "", fmt.Errorf("error reading %s: %w", perfdataFiles, err)
 		}
 
 		for _, f := range files {
 			if f.IsDir() {
 				if name := f.Name(); strings.HasPrefix(name, "hsperfdata") {
-					if path, err := c.fs.Open(filepath.Join(perfdataFiles, name, strconv.Itoa(nsPid))); err == nil {
-						defer path.Close()
-						c.mu.Lock()
-						c.pids[pid] = struct{}{}
-						c.mu.Unlock()
-						return true, nil
+					hsperfdataPath := filepath.Join(perfdataFiles, name, strconv.Itoa(nsPid))
+					if f, err := c.fs.Open(hsperfdataPath); err == nil {
+						f.Close()
+						c.add(pid, hsperfdataPath)
+						return hsperfdataPath, nil
 					}
 				}
 			}
 		}
-		return false, nil
+		return "", nil
 	})
 	if err != nil {
-		return false, err
+		return "", err
 	}
 
-	res, ok := val.(bool)
+	res, ok := val.(string)
 	if !ok {
-		return false, fmt.Errorf("failed to cast singleflight result to bool, %T", val)
+		return "", fmt.Errorf("failed to cast singleflight result to string, %T", val)
 	}
 	return res, nil
 }
+
+func (c *HSPerfDataCache) add(pid int, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pids[pid] = path
+}
+
+// javaPIDs returns the java processes found so far.
+func (c *HSPerfDataCache) javaPIDs() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pids := make([]int, 0, len(c.pids))
+	for pid := range c.pids {
+		pids = append(pids, pid)
+	}
+	return pids
+}
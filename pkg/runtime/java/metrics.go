@@ -0,0 +1,109 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The metrics are reported per JVM, labelled by PID and main class. The series
+// of a JVM go away once it exits, so its counters are never seen decreasing.
+var (
+	descJVMs = prometheus.NewDesc(
+		"parca_agent_jvms",
+		"Number of JVMs found.",
+		[]string{"main_class"}, nil,
+	)
+	descJVMHeapMax = prometheus.NewDesc(
+		"parca_agent_jvm_heap_max_bytes",
+		"Maximum size of the heap of the JVM.",
+		[]string{"pid", "main_class"}, nil,
+	)
+	descJVMHeapCommitted = prometheus.NewDesc(
+		"parca_agent_jvm_heap_committed_bytes",
+		"Size of the heap committed by the JVM.",
+		[]string{"pid", "main_class"}, nil,
+	)
+	descJVMHeapUsed = prometheus.NewDesc(
+		"parca_agent_jvm_heap_used_bytes",
+		"Size of the heap used by the JVM.",
+		[]string{"pid", "main_class"}, nil,
+	)
+	descJVMGCCollections = prometheus.NewDesc(
+		"parca_agent_jvm_gc_collections_total",
+		"Collections run by the garbage collector of the JVM.",
+		[]string{"pid", "main_class", "collector"}, nil,
+	)
+	descJVMGCSeconds = prometheus.NewDesc(
+		"parca_agent_jvm_gc_seconds_total",
+		"Time spent by the garbage collector of the JVM.",
+		[]string{"pid", "main_class", "collector"}, nil,
+	)
+)
+
+// hsperfdataCollector reports the counters of the JVMs found by the cache,
+// read from their hsperfdata files on every scrape.
+type hsperfdataCollector struct {
+	c *HSPerfDataCache
+}
+
+func (h *hsperfdataCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descJVMs
+	ch <- descJVMHeapMax
+	ch <- descJVMHeapCommitted
+	ch <- descJVMHeapUsed
+	ch <- descJVMGCCollections
+	ch <- descJVMGCSeconds
+}
+
+func (h *hsperfdataCollector) Collect(ch chan<- prometheus.Metric) {
+	jvms := map[string]int{}
+	for _, pid := range h.c.javaPIDs() {
+		// The hsperfdata file is left behind if the JVM is killed.
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); errors.Is(err, fs.ErrNotExist) {
+			h.c.mu.Lock()
+			delete(h.c.pids, pid)
+			h.c.mu.Unlock()
+			continue
+		}
+
+		pd, err := h.c.PerfData(pid)
+		if err != nil {
+			level.Debug(h.c.logger).Log("msg", "failed to read hsperfdata", "pid", pid, "err", err)
+			continue
+		}
+
+		mainClass := pd.MainClass()
+		p := strconv.Itoa(pid)
+		jvms[mainClass]++
+		ch <- prometheus.MustNewConstMetric(descJVMHeapMax, prometheus.GaugeValue, float64(pd.HeapMaxBytes()), p, mainClass)
+		ch <- prometheus.MustNewConstMetric(descJVMHeapCommitted, prometheus.GaugeValue, float64(pd.HeapCommittedBytes()), p, mainClass)
+		ch <- prometheus.MustNewConstMetric(descJVMHeapUsed, prometheus.GaugeValue, float64(pd.HeapUsedBytes()), p, mainClass)
+		for _, c := range pd.Collectors() {
+			ch <- prometheus.MustNewConstMetric(descJVMGCCollections, prometheus.CounterValue, float64(c.Invocations), p, mainClass, c.Name)
+			ch <- prometheus.MustNewConstMetric(descJVMGCSeconds, prometheus.CounterValue, c.Seconds, p, mainClass, c.Name)
+		}
+	}
+
+	for mainClass, n := range jvms {
+		ch <- prometheus.MustNewConstMetric(descJVMs, prometheus.GaugeValue, float64(n), mainClass)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"encoding/binary"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHSPerfDataMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c := NewHSPerfDataCache(log.NewNopLogger(), reg, nil)
+	// Creating another cache must not fail to register the metrics.
+	NewHSPerfDataCache(log.NewNopLogger(), reg, nil)
+
+	perfData := func(used, invocations int64) *fstest.MapFile {
+		return &fstest.MapFile{Data: writePerfData(binary.LittleEndian, map[string]any{
+			"sun.rt.javaCommand":               "com.example.Main",
+			"sun.os.hrt.frequency":             int64(1_000_000_000),
+			"sun.gc.generation.0.maxCapacity":  int64(1 << 20),
+			"sun.gc.generation.0.capacity":     int64(1 << 10),
+			"sun.gc.generation.0.space.0.used": used,
+			"sun.gc.collector.0.name":          "G1 incremental collections",
+			"sun.gc.collector.0.invocations":   invocations,
+			"sun.gc.collector.0.time":          int64(500_000_000),
+		})}
+	}
+	// Two JVMs running the same main class, the processes need to exist.
+	c.fs = fstest.MapFS{
+		"hsperfdata_a/1": perfData(100, 1),
+		"hsperfdata_a/2": perfData(200, 2),
+	}
+	c.pids = map[int]string{os.Getpid(): "hsperfdata_a/1", os.Getppid(): "hsperfdata_a/2"}
+
+	self, parent := strconv.Itoa(os.Getpid()), strconv.Itoa(os.Getppid())
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP parca_agent_jvm_gc_collections_total Collections run by the garbage collector of the JVM.
+# TYPE parca_agent_jvm_gc_collections_total counter
+parca_agent_jvm_gc_collections_total{collector="G1 incremental collections",main_class="com.example.Main",pid="`+self+`"} 1
+parca_agent_jvm_gc_collections_total{collector="G1 incremental collections",main_class="com.example.Main",pid="`+parent+`"} 2
+# HELP parca_agent_jvm_heap_used_bytes Size of the heap used by the JVM.
+# TYPE parca_agent_jvm_heap_used_bytes gauge
+parca_agent_jvm_heap_used_bytes{main_class="com.example.Main",pid="`+self+`"} 100
+parca_agent_jvm_heap_used_bytes{main_class="com.example.Main",pid="`+parent+`"} 200
+# HELP parca_agent_jvms Number of JVMs found.
+# TYPE parca_agent_jvms gauge
+parca_agent_jvms{main_class="com.example.Main"} 2
+`), "parca_agent_jvms", "parca_agent_jvm_heap_used_bytes", "parca_agent_jvm_gc_collections_total"))
+}
@@ -0,0 +1,196 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The layout of the hsperfdata file written by HotSpot,
+// see src/hotspot/share/runtime/perfMemory.hpp in the OpenJDK sources.
+const (
+	perfDataMagic = 0xcafec0c0
+	// perfDataPrologueSize is the size of the prologue
+	// with the magic, byte order, version, used, overflow, timestamp,
+	// entry offset and number of entries.
+	perfDataPrologueSize = 32
+	// perfDataEntryHeaderSize is the size of an entry header
+	// with the entry length, name offset, vector length, data type, flags,
+	// data units, data variability and data offset.
+	perfDataEntryHeaderSize = 20
+
+	perfDataBigEndian = 0
+
+	perfDataTypeByte = 'B'
+	perfDataTypeLong = 'J'
+)
+
+var errInvalidPerfData = errors.New("invalid hsperfdata")
+
+// PerfData holds the counters exported by a JVM through its hsperfdata file.
+type PerfData struct {
+	Strings map[string]string
+	Longs   map[string]int64
+}
+
+// ParsePerfData parses the content of an hsperfdata file.
+func ParsePerfData(data []byte) (*PerfData, error) {
+	if len(data) < perfDataPrologueSize {
+		return nil, fmt.Errorf("%w: file too short", errInvalidPerfData)
+	}
+	if magic := binary.BigEndian.Uint32(data); magic != perfDataMagic {
+		return nil, fmt.Errorf("%w: bad magic %#x", errInvalidPerfData, magic)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[4] == perfDataBigEndian {
+		order = binary.BigEndian
+	}
+	if major := data[5]; major != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", errInvalidPerfData, major)
+	}
+
+	pd := &PerfData{
+		Strings: map[string]string{},
+		Longs:   map[string]int64{},
+	}
+	offset := int(int32(order.Uint32(data[24:])))
+	entries := int(int32(order.Uint32(data[28:])))
+	for i := 0; i < entries; i++ {
+		if offset < 0 || offset+perfDataEntryHeaderSize > len(data) {
+			return nil, fmt.Errorf("%w: entry %d out of bounds", errInvalidPerfData, i)
+		}
+		entry := data[offset:]
+		length := int(int32(order.Uint32(entry)))
+		nameOffset := int(int32(order.Uint32(entry[4:])))
+		vectorLength := int(int32(order.Uint32(entry[8:])))
+		dataType := entry[12]
+		dataOffset := int(int32(order.Uint32(entry[16:])))
+		if length < perfDataEntryHeaderSize || length > len(entry) ||
+			nameOffset < perfDataEntryHeaderSize || nameOffset >= length ||
+			dataOffset < nameOffset || dataOffset > length {
+			return nil, fmt.Errorf("%w: entry %d malformed", errInvalidPerfData, i)
+		}
+		entry = entry[:length]
+		name := cString(entry[nameOffset:dataOffset])
+
+		switch {
+		case dataType == perfDataTypeLong && vectorLength == 0:
+			if dataOffset+8 > length {
+				return nil, fmt.Errorf("%w: entry %s malformed", errInvalidPerfData, name)
+			}
+			pd.Longs[name] = int64(order.Uint64(entry[dataOffset:]))
+		case dataType == perfDataTypeByte && vectorLength > 0:
+			if dataOffset+vectorLength > length {
+				return nil, fmt.Errorf("%w: entry %s malformed", errInvalidPerfData, name)
+			}
+			pd.Strings[name] = cString(entry[dataOffset : dataOffset+vectorLength])
+		}
+		offset += length
+	}
+
+	return pd, nil
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// Version returns the Java version, e.g. 17.0.8.
+func (pd *PerfData) Version() string {
+	if v := pd.Strings["java.property.java.version"]; v != "" {
+		return v
+	}
+	return pd.Strings["java.property.java.vm.version"]
+}
+
+// MainClass returns the main class or the jar file the JVM was started with.
+func (pd *PerfData) MainClass() string {
+	fields := strings.Fields(pd.Strings["sun.rt.javaCommand"])
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// GC returns the name of the garbage collection policy, e.g. GarbageFirst.
+func (pd *PerfData) GC() string {
+	return pd.Strings["sun.gc.policy.name"]
+}
+
+var (
+	generationMaxCapacity = regexp.MustCompile(`^sun\.gc\.generation\.\d+\.maxCapacity$`)
+	generationCapacity    = regexp.MustCompile(`^sun\.gc\.generation\.\d+\.capacity$`)
+	spaceUsed             = regexp.MustCompile(`^sun\.gc\.generation\.\d+\.space\.\d+\.used$`)
+)
+
+// HeapMaxBytes returns the maximum size of the heap.
+func (pd *PerfData) HeapMaxBytes() int64 {
+	return pd.sum(generationMaxCapacity)
+}
+
+// HeapCommittedBytes returns the size of the heap currently committed.
+func (pd *PerfData) HeapCommittedBytes() int64 {
+	return pd.sum(generationCapacity)
+}
+
+// HeapUsedBytes returns the size of the heap currently used.
+func (pd *PerfData) HeapUsedBytes() int64 {
+	return pd.sum(spaceUsed)
+}
+
+func (pd *PerfData) sum(re *regexp.Regexp) int64 {
+	var sum int64
+	for name, v := range pd.Longs {
+		if re.MatchString(name) {
+			sum += v
+		}
+	}
+	return sum
+}
+
+// Collector holds the statistics of a garbage collector.
+type Collector struct {
+	Name        string
+	Invocations int64
+	Seconds     float64
+}
+
+// Collectors returns the statistics of the garbage collectors.
+func (pd *PerfData) Collectors() []Collector {
+	freq := float64(pd.Longs["sun.os.hrt.frequency"])
+	var collectors []Collector
+	for i := 0; ; i++ {
+		prefix := fmt.Sprintf("sun.gc.collector.%d.", i)
+		name, ok := pd.Strings[prefix+"name"]
+		if !ok {
+			return collectors
+		}
+		c := Collector{
+			Name:        name,
+			Invocations: pd.Longs[prefix+"invocations"],
+		}
+		if freq > 0 {
+			c.Seconds = float64(pd.Longs[prefix+"time"]) / freq
+		}
+		collectors = append(collectors, c)
+	}
+}
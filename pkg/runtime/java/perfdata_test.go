@@ -0,0 +1,123 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writePerfData encodes entries the way HotSpot lays out an hsperfdata file,
+// values are either strings or int64s.
+func writePerfData(order binary.ByteOrder, entries map[string]any) []byte {
+	buf := make([]byte, perfDataPrologueSize)
+	binary.BigEndian.PutUint32(buf, perfDataMagic)
+	if order == binary.BigEndian {
+		buf[4] = perfDataBigEndian
+	} else {
+		buf[4] = 1
+	}
+	buf[5] = 2
+	order.PutUint32(buf[24:], perfDataPrologueSize)
+	order.PutUint32(buf[28:], uint32(len(entries)))
+
+	for name, v := range entries {
+		var (
+			dataType     byte
+			data         []byte
+			vectorLength int
+		)
+		switch v := v.(type) {
+		case string:
+			dataType = perfDataTypeByte
+			data = append([]byte(v), 0)
+			vectorLength = len(data)
+		case int64:
+			dataType = perfDataTypeLong
+			data = make([]byte, 8)
+			order.PutUint64(data, uint64(v))
+		}
+		nameOffset := perfDataEntryHeaderSize
+		// Data is aligned to 8 bytes.
+		dataOffset := (nameOffset + len(name) + 1 + 7) &^ 7
+		length := (dataOffset + len(data) + 7) &^ 7
+
+		entry := make([]byte, length)
+		order.PutUint32(entry, uint32(length))
+		order.PutUint32(entry[4:], uint32(nameOffset))
+		order.PutUint32(entry[8:], uint32(vectorLength))
+		entry[12] = dataType
+		order.PutUint32(entry[16:], uint32(dataOffset))
+		copy(entry[nameOffset:], name)
+		copy(entry[dataOffset:], data)
+		buf = append(buf, entry...)
+	}
+	return buf
+}
+
+func TestParsePerfData(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			pd, err := ParsePerfData(writePerfData(order, map[string]any{
+				"java.property.java.version":          "17.0.8",
+				"java.property.java.vm.version":       "17.0.8+7",
+				"sun.rt.javaCommand":                  "com.example.Main --port 8080",
+				"sun.gc.policy.name":                  "GarbageFirst",
+				"sun.os.hrt.frequency":                int64(1_000_000_000),
+				"sun.gc.generation.0.maxCapacity":     int64(1 << 30),
+				"sun.gc.generation.1.maxCapacity":     int64(1 << 30),
+				"sun.gc.generation.0.capacity":        int64(1 << 20),
+				"sun.gc.generation.1.capacity":        int64(1 << 21),
+				"sun.gc.generation.0.space.0.used":    int64(100),
+				"sun.gc.generation.0.space.1.used":    int64(200),
+				"sun.gc.generation.1.space.0.used":    int64(300),
+				"sun.gc.collector.0.name":             "G1 incremental collections",
+				"sun.gc.collector.0.invocations":      int64(12),
+				"sun.gc.collector.0.time":             int64(1_500_000_000),
+				"sun.gc.collector.1.name":             "G1 stop-the-world full collections",
+				"sun.gc.collector.1.invocations":      int64(0),
+				"sun.gc.generation.0.space.0.maxSize": int64(1 << 29),
+			}))
+			require.NoError(t, err)
+
+			require.Equal(t, "17.0.8", pd.Version())
+			require.Equal(t, "com.example.Main", pd.MainClass())
+			require.Equal(t, "GarbageFirst", pd.GC())
+			require.Equal(t, int64(2<<30), pd.HeapMaxBytes())
+			require.Equal(t, int64(3<<20), pd.HeapCommittedBytes())
+			require.Equal(t, int64(600), pd.HeapUsedBytes())
+			require.Equal(t, []Collector{
+				{Name: "G1 incremental collections", Invocations: 12, Seconds: 1.5},
+				{Name: "G1 stop-the-world full collections"},
+			}, pd.Collectors())
+		})
+	}
+}
+
+func TestParsePerfDataInvalid(t *testing.T) {
+	_, err := ParsePerfData([]byte{0xca, 0xfe})
+	require.ErrorIs(t, err, errInvalidPerfData)
+
+	data := writePerfData(binary.LittleEndian, map[string]any{"sun.rt.javaCommand": "Main"})
+	data[0] = 0
+	_, err = ParsePerfData(data)
+	require.ErrorIs(t, err, errInvalidPerfData)
+
+	// The entry runs past the end of the file.
+	data = writePerfData(binary.LittleEndian, map[string]any{"sun.rt.javaCommand": "Main"})
+	_, err = ParsePerfData(data[:len(data)-8])
+	require.ErrorIs(t, err, errInvalidPerfData)
+}
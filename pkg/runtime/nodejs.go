@@ -0,0 +1,57 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package runtime
+
+import (
+	"debug/elf"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Official builds embed the URL of their headers tarball.
+	nodeJSHeadersVersion = regexp.MustCompile(`node-v(\d+\.\d+\.\d+)-headers\.tar\.gz`)
+	// process.version, a string on its own.
+	nodeJSVersion = regexp.MustCompile(`\x00v(\d+\.\d+\.\d+)\x00`)
+)
+
+// IsNodeJS returns true if the binary embeds Node.js,
+// either the node executable or libnode.
+func IsNodeJS(ef *elf.File) (bool, error) {
+	return hasDefinedSymbol(ef, isNodeJSIdentifyingSymbol)
+}
+
+// NodeJSVersion returns the Node.js version embedded in the binary.
+func NodeJSVersion(ef *elf.File) (string, error) {
+	version, err := findInSection(ef, ".rodata", nodeJSHeadersVersion)
+	if err != nil || version != "" {
+		return version, err
+	}
+	return findInSection(ef, ".rodata", nodeJSVersion)
+}
+
+func isNodeJSLibrary(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), "libnode.so")
+}
+
+/*
+Node.js symbols to look for:
+
+	node::Start(int, char**): `_ZN4node5StartEiPPc`, exported for addons since 12.
+*/
+func isNodeJSIdentifyingSymbol(sym string) bool {
+	return strings.HasPrefix(sym, "_ZN4node5Start")
+}
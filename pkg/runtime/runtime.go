@@ -0,0 +1,207 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package runtime
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Names of the detected runtimes.
+const (
+	Python = "python"
+	Ruby   = "ruby"
+	Java   = "java"
+	NodeJS = "nodejs"
+	DotNet = "dotnet"
+	BEAM   = "beam"
+	Rust   = "rust"
+)
+
+// Runtime is the language runtime of a process.
+type Runtime struct {
+	Name string
+	// Version is empty if it could not be determined.
+	Version string
+}
+
+// ForExecutable detects the runtime an executable belongs to,
+// it returns nil if none is detected.
+func ForExecutable(path string, ef *elf.File) (*Runtime, error) {
+	python, err := IsPython(ef)
+	if err != nil {
+		return nil, err
+	}
+	if python {
+		return &Runtime{Name: Python}, nil
+	}
+
+	ruby, err := IsRuby(ef)
+	if err != nil {
+		return nil, err
+	}
+	if ruby {
+		return &Runtime{Name: Ruby}, nil
+	}
+
+	node, err := IsNodeJS(ef)
+	if err != nil {
+		return nil, err
+	}
+	if node {
+		version, err := NodeJSVersion(ef)
+		if err != nil {
+			return nil, err
+		}
+		return &Runtime{Name: NodeJS, Version: version}, nil
+	}
+
+	if IsBEAM(path) {
+		version, err := BEAMVersion(path, ef)
+		if err != nil {
+			return nil, err
+		}
+		return &Runtime{Name: BEAM, Version: version}, nil
+	}
+
+	rust, err := IsRust(ef)
+	if err != nil {
+		return nil, err
+	}
+	if rust {
+		version, err := RustVersion(ef)
+		if err != nil {
+			return nil, err
+		}
+		return &Runtime{Name: Rust, Version: version}, nil
+	}
+
+	return nil, nil //nolint:nilnil
+}
+
+// IsRuntimeLibrary returns true if the shared library
+// at the given path embeds a runtime.
+func IsRuntimeLibrary(path string) bool {
+	return isNodeJSLibrary(path) || isDotNetLibrary(path)
+}
+
+// ForLibrary detects the runtime a shared library belongs to,
+// it returns nil if none is detected.
+func ForLibrary(path string, ef *elf.File) (*Runtime, error) {
+	switch {
+	case isNodeJSLibrary(path):
+		version, err := NodeJSVersion(ef)
+		if err != nil {
+			return nil, err
+		}
+		return &Runtime{Name: NodeJS, Version: version}, nil
+	case isDotNetLibrary(path):
+		version, err := DotNetVersion(path, ef)
+		if err != nil {
+			return nil, err
+		}
+		return &Runtime{Name: DotNet, Version: version}, nil
+	}
+	return nil, nil //nolint:nilnil
+}
+
+// hasDefinedSymbol returns true if the binary defines a symbol
+// for which match returns true, references to symbols of other binaries are ignored.
+func hasDefinedSymbol(ef *elf.File, match func(string) bool) (bool, error) {
+	syms, err := ef.Symbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return false, fmt.Errorf("failed to get symbols: %w", err)
+	}
+	dynSyms, err := ef.DynamicSymbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return false, fmt.Errorf("failed to get dynamic symbols: %w", err)
+	}
+	for _, sym := range append(syms, dynSyms...) {
+		if sym.Section != elf.SHN_UNDEF && match(sym.Name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// findInSection returns the first submatch of re in the named section,
+// or an empty string if the section does not exist or does not match.
+func findInSection(ef *elf.File, name string, re *regexp.Regexp) (string, error) {
+	sec := ef.Section(name)
+	if sec == nil || sec.Type == elf.SHT_NOBITS {
+		return "", nil
+	}
+	v, err := find(sec.Open(), re)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s section: %w", name, err)
+	}
+	return v, nil
+}
+
+const (
+	findChunkSize = 1 << 20
+	// findOverlap is the longest match found across two chunks.
+	findOverlap = 256
+)
+
+// find returns the first submatch of re in r,
+// reading it in chunks since sections like .rodata can be large.
+func find(r io.Reader, re *regexp.Regexp) (string, error) {
+	buf := make([]byte, findOverlap+findChunkSize)
+	carried := 0
+	for {
+		n, err := io.ReadFull(r, buf[carried:])
+		eof := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !eof {
+			return "", err
+		}
+
+		data := buf[:carried+n]
+		loc := re.FindSubmatchIndex(data)
+		// A match running into the end of the chunk might be cut short,
+		// it is found again in the next chunk.
+		if loc != nil && (eof || loc[1] <= len(data)-findOverlap) {
+			return string(data[loc[2]:loc[3]]), nil
+		}
+		if eof {
+			return "", nil
+		}
+		// The next chunk starts with the match that was cut short, if any.
+		start := len(data) - findOverlap
+		if loc != nil && loc[0] < start {
+			start = loc[0]
+			// Longer matches are not supported.
+			if earliest := len(data) - 2*findOverlap; start < earliest {
+				start = earliest
+			}
+		}
+		carried = copy(buf, data[start:])
+	}
+}
+
+// versionFromPath returns the first submatch of re in the directories of path.
+func versionFromPath(path string, re *regexp.Regexp) string {
+	for _, dir := range strings.Split(filepath.Dir(path), "/") {
+		if m := re.FindStringSubmatch(dir); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"debug/elf"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFind(t *testing.T) {
+	// The first read ends right after "rustc version 1.72.1" in the padded data.
+	padding := strings.Repeat("\x00", findOverlap+findChunkSize-len("rustc version 1.72.1"))
+
+	for name, tc := range map[string]struct {
+		data string
+		want string
+	}{
+		"no match": {
+			data: padding + "rustc version 1.x",
+		},
+		"first chunk": {
+			data: "GCC: (Debian 12.2.0-14) 12.2.0\x00rustc version 1.72.0 (5680fa18f 2023-08-23)\x00",
+			want: "1.72.0",
+		},
+		"across chunks": {
+			data: padding + "rustc version 1.72.10\x00",
+			want: "1.72.10",
+		},
+		"across the chunk boundary": {
+			data: strings.Repeat("\x00", findChunkSize-5) + "rustc version 1.72.1\x00" + padding,
+			want: "1.72.1",
+		},
+		"last chunk": {
+			data: padding + padding + "rustc version 1.72.0\x00",
+			want: "1.72.0",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := find(strings.NewReader(tc.data), rustVersion)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestVersionFromPath(t *testing.T) {
+	require.Equal(t, "14.0.2", versionFromPath("/usr/lib/erlang/erts-14.0.2/bin/beam.smp", beamVersion))
+	require.Equal(t, "7.0.5", versionFromPath("/usr/share/dotnet/shared/Microsoft.NETCore.App/7.0.5/libcoreclr.so", dotNetPathVersion))
+	require.Equal(t, "8.0.0-rc.2.23479.6", versionFromPath("/usr/share/dotnet/shared/Microsoft.NETCore.App/8.0.0-rc.2.23479.6/libcoreclr.so", dotNetPathVersion))
+	require.Equal(t, "", versionFromPath("/app/libcoreclr.so", dotNetPathVersion))
+}
+
+func TestIsRuntimeLibrary(t *testing.T) {
+	require.True(t, IsRuntimeLibrary("/usr/lib/x86_64-linux-gnu/libnode.so.108"))
+	require.True(t, IsRuntimeLibrary("/usr/share/dotnet/shared/Microsoft.NETCore.App/7.0.5/libcoreclr.so"))
+	require.False(t, IsRuntimeLibrary("/usr/lib/x86_64-linux-gnu/libc.so.6"))
+}
+
+func TestForExecutable(t *testing.T) {
+	// The test binary is a Go binary, which has no runtime of its own.
+	path, err := os.Executable()
+	require.NoError(t, err)
+	ef, err := elf.Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		ef.Close()
+	})
+
+	rt, err := ForExecutable(path, ef)
+	require.NoError(t, err)
+	require.Nil(t, rt)
+}
@@ -0,0 +1,46 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package runtime
+
+import (
+	"debug/elf"
+	"regexp"
+)
+
+// rustc records its version in the .comment section, which survives stripping.
+var rustVersion = regexp.MustCompile(`rustc version (\d+\.\d+\.\d+)`)
+
+// IsRust returns true if the binary was built by rustc.
+func IsRust(ef *elf.File) (bool, error) {
+	version, err := RustVersion(ef)
+	if err != nil || version != "" {
+		return version != "", err
+	}
+	return hasDefinedSymbol(ef, isRustIdentifyingSymbol)
+}
+
+// RustVersion returns the version of rustc the binary was built by.
+func RustVersion(ef *elf.File) (string, error) {
+	return findInSection(ef, ".comment", rustVersion)
+}
+
+/*
+Rust symbols to look for, defined by the standard library:
+
+	`rust_begin_unwind`, `rust_panic`
+*/
+func isRustIdentifyingSymbol(sym string) bool {
+	return sym == "rust_begin_unwind" || sym == "rust_panic"
+}
@@ -15,7 +15,10 @@
 package unwind
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
 )
@@ -29,6 +32,9 @@ const (
 	cfaTypeRsp
 	cfaTypeExpression
 	cfaTypeEndFdeMarker
+	// The registers are restored from the ucontext of the signal frame
+	// the kernel pushes before running a signal handler.
+	cfaTypeSignalFrame
 )
 
 type bpfRbpType uint16
@@ -41,6 +47,10 @@ const (
 	rbpTypeUndefinedReturnAddress
 )
 
+// CompactUnwindRowSizeBytes is the size of a row of the unwind tables of the
+// BPF program.
+const CompactUnwindRowSizeBytes = 14
+
 // CompactUnwindTableRows encodes unwind information using 2x 64 bit words.
 type CompactUnwindTableRow struct {
 	pc                uint64
@@ -79,21 +89,102 @@ func (cutr *CompactUnwindTableRow) IsEndOfFDEMarker() bool {
 	return cutr.cfaType == uint8(cfaTypeEndFdeMarker)
 }
 
+// PutBinary writes the row to buf as the BPF program's stack_unwind_row_t,
+// which is packed, in CompactUnwindRowSizeBytes bytes.
+//
+// Note: we are avoiding `binary.Write` and prefer to use the lower level APIs
+// to avoid allocations and CPU spent in the reflection code paths as well as
+// in the allocations for the intermediate buffers.
+func (cutr *CompactUnwindTableRow) PutBinary(buf []byte) {
+	_ = buf[CompactUnwindRowSizeBytes-1]
+	// .pc
+	binary.LittleEndian.PutUint64(buf, cutr.pc)
+	// .cfa_type
+	buf[8] = cutr.cfaType
+	// .rbp_type
+	buf[9] = cutr.rbpType
+	// .cfa_offset
+	binary.LittleEndian.PutUint16(buf[10:], uint16(cutr.cfaOffset))
+	// .rbp_offset
+	binary.LittleEndian.PutUint16(buf[12:], uint16(cutr.rbpOffset))
+}
+
 type CompactUnwindTable []CompactUnwindTableRow
 
-func (t CompactUnwindTable) Len() int           { return len(t) }
-func (t CompactUnwindTable) Less(i, j int) bool { return t[i].pc < t[j].pc }
-func (t CompactUnwindTable) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t CompactUnwindTable) Len() int      { return len(t) }
+func (t CompactUnwindTable) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+
+func (t CompactUnwindTable) Less(i, j int) bool {
+	// The end of a function goes before the start of the next one.
+	if t[i].pc == t[j].pc {
+		return t[i].IsEndOfFDEMarker() && !t[j].IsEndOfFDEMarker()
+	}
+	return t[i].pc < t[j].pc
+}
+
+// GenerateCompactUnwindTable produces the compact unwind table of the executable
+// at path, sorted by program counter, as loaded by the agent. Its rows come from
+// the executable's .eh_frame and .debug_frame sections, see ReadFDEsWithDebugFile,
+// and from .gopclntab for the Go functions these do not cover.
+func GenerateCompactUnwindTable(path, debugPath string, expressions *ExpressionTable) (CompactUnwindTable, error) {
+	fdes, fdesErr := ReadFDEsWithDebugFile(path, debugPath)
+	if fdesErr != nil && !errors.Is(fdesErr, ErrFrameSectionNotFound) && !errors.Is(fdesErr, ErrNoFDEsFound) {
+		return nil, fdesErr
+	}
+
+	// Sort them, as this will ensure that the generated table
+	// is also sorted. Sorting fewer elements will be faster.
+	sort.Sort(fdes)
+
+	table, err := BuildCompactUnwindTableWithExpressions(fdes, expressions)
+	if err != nil {
+		return nil, err
+	}
+
+	// Go functions without DWARF unwind information, such as the ones of stripped
+	// binaries, are unwound with the stack pointer deltas of .gopclntab.
+	goTable, err := BuildGoCompactUnwindTable(path, fdes)
+	if err != nil && !errors.Is(err, ErrNoGoFunctionTable) && fdesErr == nil {
+		// The DWARF unwind information is enough to unwind most of the frames.
+		err = nil
+	}
+	if fdesErr != nil && len(goTable) == 0 {
+		return nil, errors.Join(fdesErr, err)
+	}
+	table = append(table, goTable...)
+
+	// The rows of the Go functions go in between the ones of the FDEs.
+	sort.Sort(table)
+	return table, nil
+}
 
 // BuildCompactUnwindTable produces a compact unwind table for the given
-// frame description entries.
+// frame description entries, see BuildCompactUnwindTableWithExpressions.
 func BuildCompactUnwindTable(fdes frame.FrameDescriptionEntries) (CompactUnwindTable, error) {
+	return BuildCompactUnwindTableWithExpressions(fdes, nil)
+}
+
+// BuildCompactUnwindTableWithExpressions produces a compact unwind table for the given
+// frame description entries. The DWARF expressions other than the PLT ones are compiled
+// and added to expressions, rows refer to them by identifier. Without an expression
+// table they are unsupported.
+func BuildCompactUnwindTableWithExpressions(fdes frame.FrameDescriptionEntries, expressions *ExpressionTable) (CompactUnwindTable, error) {
 	table := make(CompactUnwindTable, 0, 4*len(fdes)) // heuristic: we expect each function to have ~4 unwind entries.
 	for _, fde := range fdes {
+		signalFrame := fde.CIE != nil && fde.CIE.SignalFrame()
 		frameContext := frame.ExecuteDwarfProgram(fde, nil)
 		for insCtx := frameContext.Next(); frameContext.HasNext(); insCtx = frameContext.Next() {
 			row := unwindTableRow(insCtx)
-			compactRow, err := rowToCompactRow(row)
+			if signalFrame {
+				// The rules of signal trampolines restore every register from
+				// the signal frame, which the unwinder knows the layout of.
+				table = append(table, CompactUnwindTableRow{
+					pc:      row.Loc,
+					cfaType: uint8(cfaTypeSignalFrame),
+				})
+				continue
+			}
+			compactRow, err := rowToCompactRow(row, expressions)
 			if err != nil {
 				return CompactUnwindTable{}, err
 			}
@@ -108,8 +199,9 @@ func BuildCompactUnwindTable(fdes frame.FrameDescriptionEntries) (CompactUnwindT
 	return table, nil
 }
 
-// rowToCompactRow converts an unwind row to a compact row.
-func rowToCompactRow(row *UnwindTableRow) (CompactUnwindTableRow, error) {
+// rowToCompactRow converts an unwind row to a compact row. The offsets of
+// expression rules hold the identifier of the expression.
+func rowToCompactRow(row *UnwindTableRow, expressions *ExpressionTable) (CompactUnwindTableRow, error) {
 	var cfaType uint8
 	var rbpType uint8
 	var cfaOffset int16
@@ -127,7 +219,11 @@ func rowToCompactRow(row *UnwindTableRow) (CompactUnwindTableRow, error) {
 		cfaOffset = int16(row.CFA.Offset)
 	case frame.RuleExpression:
 		cfaType = uint8(cfaTypeExpression)
-		cfaOffset = int16(ExpressionIdentifier(row.CFA.Expression))
+		id := ExpressionIdentifier(row.CFA.Expression)
+		if id == ExpressionUnknown {
+			id = expressions.ID(row.CFA.Expression)
+		}
+		cfaOffset = int16(id)
 	default:
 		return CompactUnwindTableRow{}, fmt.Errorf("CFA rule is not valid: %d", row.CFA.Rule)
 	}
@@ -141,6 +237,7 @@ func rowToCompactRow(row *UnwindTableRow) (CompactUnwindTableRow, error) {
 		rbpType = uint8(rbpRuleRegister)
 	case frame.RuleExpression:
 		rbpType = uint8(rbpTypeExpression)
+		rbpOffset = int16(expressions.RegisterRuleID(row.RBP.Expression))
 	case frame.RuleUndefined:
 	case frame.RuleUnknown:
 	case frame.RuleSameVal:
@@ -172,7 +269,7 @@ func CompactUnwindTableRepresentation(unwindTable UnwindTable) (CompactUnwindTab
 	for i := range unwindTable {
 		row := unwindTable[i]
 
-		compactRow, err := rowToCompactRow(&row)
+		compactRow, err := rowToCompactRow(&row, nil)
 		if err != nil {
 			return CompactUnwindTable{}, err
 		}
@@ -0,0 +1,318 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/parca-dev/parca-agent/pkg/elfreader"
+)
+
+const (
+	// Offset of pr_reg, the registers of the thread, in elf_prstatus on x86_64.
+	prstatusRegsOffset = 112
+	// Indexes of the registers in user_regs_struct on x86_64.
+	userRegsRBP = 4
+	userRegsRIP = 16
+	userRegsRSP = 19
+	userRegsLen = 27
+
+	ntFile = 0x46494c45
+)
+
+var (
+	errNotCoreDump     = errors.New("not a core dump")
+	errNoThreadStatus  = errors.New("no thread status found in the core dump")
+	errBadCoreDumpNote = errors.New("malformed core dump note")
+	errNotInCoreDump   = errors.New("memory not in the core dump")
+)
+
+// CoreDump is a snapshot of a process read from an ELF core dump, with the
+// registers of its first thread, which is the one that received the signal.
+type CoreDump struct {
+	Registers Registers
+	// Files mapped in the process.
+	Files []CoreDumpFile
+
+	file     *elf.File
+	segments []*elf.Prog
+}
+
+// CoreDumpFile is a mapping of a file in the process, [Start, End).
+type CoreDumpFile struct {
+	Start, End uint64
+	// Offset of the mapping in the file.
+	Offset uint64
+	Path   string
+}
+
+// OpenCoreDump opens the core dump at path.
+func OpenCoreDump(path string) (*CoreDump, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open elf: %w", err)
+	}
+	core, err := newCoreDump(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return core, nil
+}
+
+func newCoreDump(f *elf.File) (*CoreDump, error) {
+	if f.Type != elf.ET_CORE || f.Machine != elf.EM_X86_64 {
+		return nil, errNotCoreDump
+	}
+
+	core := &CoreDump{file: f}
+	foundRegisters := false
+	for _, prog := range f.Progs {
+		switch prog.Type {
+		case elf.PT_LOAD:
+			core.segments = append(core.segments, prog)
+		case elf.PT_NOTE:
+			data, err := io.ReadAll(prog.Open())
+			if err != nil {
+				return nil, fmt.Errorf("failed to read notes: %w", err)
+			}
+			err = readNotes(data, f.ByteOrder, func(typ uint32, desc []byte) error {
+				switch {
+				case typ == uint32(elf.NT_PRSTATUS) && !foundRegisters:
+					if len(desc) < prstatusRegsOffset+userRegsLen*8 {
+						return errBadCoreDumpNote
+					}
+					reg := func(i int) uint64 {
+						return f.ByteOrder.Uint64(desc[prstatusRegsOffset+i*8:])
+					}
+					core.Registers = Registers{IP: reg(userRegsRIP), SP: reg(userRegsRSP), BP: reg(userRegsRBP)}
+					foundRegisters = true
+				case typ == ntFile:
+					files, err := readFileNote(desc, f.ByteOrder)
+					if err != nil {
+						return err
+					}
+					core.Files = append(core.Files, files...)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !foundRegisters {
+		return nil, errNoThreadStatus
+	}
+
+	sort.Slice(core.segments, func(i, j int) bool { return core.segments[i].Vaddr < core.segments[j].Vaddr })
+	return core, nil
+}
+
+// readNotes calls fn with the type and descriptor of each ELF note in data.
+func readNotes(data []byte, byteOrder binary.ByteOrder, fn func(typ uint32, desc []byte) error) error {
+	align := func(n uint32) int { return int((n + 3) &^ 3) }
+	for len(data) >= 12 {
+		nameSize, descSize, typ := byteOrder.Uint32(data), byteOrder.Uint32(data[4:]), byteOrder.Uint32(data[8:])
+		data = data[12:]
+		if align(nameSize) > len(data) {
+			return errBadCoreDumpNote
+		}
+		data = data[align(nameSize):]
+		if align(descSize) > len(data) {
+			return errBadCoreDumpNote
+		}
+		if err := fn(typ, data[:descSize]); err != nil {
+			return err
+		}
+		data = data[align(descSize):]
+	}
+	return nil
+}
+
+// readFileNote reads the files mapped in the process from the NT_FILE note.
+func readFileNote(desc []byte, byteOrder binary.ByteOrder) ([]CoreDumpFile, error) {
+	if len(desc) < 16 {
+		return nil, errBadCoreDumpNote
+	}
+	count, pageSize := byteOrder.Uint64(desc), byteOrder.Uint64(desc[8:])
+	desc = desc[16:]
+	if count > uint64(len(desc))/24 {
+		return nil, errBadCoreDumpNote
+	}
+
+	files := make([]CoreDumpFile, count)
+	for i := range files {
+		entry := desc[i*24:]
+		files[i] = CoreDumpFile{
+			Start:  byteOrder.Uint64(entry),
+			End:    byteOrder.Uint64(entry[8:]),
+			Offset: byteOrder.Uint64(entry[16:]) * pageSize,
+		}
+	}
+
+	names := bytes.Split(desc[count*24:], []byte{0})
+	if len(names) < len(files) {
+		return nil, errBadCoreDumpNote
+	}
+	for i := range files {
+		files[i].Path = string(names[i])
+	}
+	return files, nil
+}
+
+// Close closes the core dump.
+func (c *CoreDump) Close() error {
+	return c.file.Close()
+}
+
+// ReadMemory reads the 8 bytes at addr in the memory of the process.
+func (c *CoreDump) ReadMemory(addr uint64) (uint64, error) {
+	i := sort.Search(len(c.segments), func(i int) bool { return c.segments[i].Vaddr > addr })
+	if i == 0 {
+		return 0, fmt.Errorf("%w: %#x", errNotInCoreDump, addr)
+	}
+	// Segments can be partially dumped, such as the ones of read only file mappings.
+	segment := c.segments[i-1]
+	if addr+8 > segment.Vaddr+segment.Filesz {
+		return 0, fmt.Errorf("%w: %#x", errNotInCoreDump, addr)
+	}
+
+	buf := make([]byte, 8)
+	if _, err := segment.ReadAt(buf, int64(addr-segment.Vaddr)); err != nil {
+		return 0, err
+	}
+	return c.file.ByteOrder.Uint64(buf), nil
+}
+
+// ExecutableMappings returns the executable mappings of the process, with the
+// load address of file mappings set as ListExecutableMappings does.
+func (c *CoreDump) ExecutableMappings() ExecutableMappings {
+	var mappings ExecutableMappings
+	for _, segment := range c.segments {
+		if segment.Flags&elf.PF_X == 0 {
+			continue
+		}
+		mapping := &ExecutableMapping{
+			StartAddr: segment.Vaddr,
+			EndAddr:   segment.Vaddr + segment.Memsz,
+			mainExec:  len(mappings) == 0,
+		}
+		for i, file := range c.Files {
+			if file.Start != segment.Vaddr {
+				continue
+			}
+			mapping.Executable = file.Path
+			mapping.LoadAddr = file.Start
+			// The load address is the start of the first of the consecutive mappings of the file.
+			for j := i - 1; j >= 0 && c.Files[j].Path == file.Path; j-- {
+				mapping.LoadAddr = c.Files[j].Start
+			}
+			break
+		}
+		if mapping.IsJitDump() {
+			continue
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings
+}
+
+// LoadProcess returns the process information and unwind tables of a process
+// with the given executable mappings, as the agent loads them in the BPF maps.
+// The unwind tables are allocated in empty shards as the agent allocates them.
+// The executables are opened at the path returned by resolve, such as the one in the process'
+// root file system.
+func LoadProcess(mappings ExecutableMappings, resolve func(executable string) string) (ProcessInfo, *UnwindTables, error) {
+	var process ProcessInfo
+	tables := &UnwindTables{
+		Chunks: map[uint64][]UnwindTableChunk{},
+		Shards: map[uint64]CompactUnwindTable{},
+	}
+	if len(mappings) >= maxMappingsPerProcess {
+		return process, nil, fmt.Errorf("too many executable mappings: %d", len(mappings))
+	}
+
+	process.IsJitCompiler = mappings.HasJitted()
+	expressions := NewExpressionTable(MaxDwarfExpressions)
+	executableIDs := map[string]uint64{}
+	shards := NewShardAllocator(MaxUnwindTableChunks, MaxUnwindTableSize)
+	for _, mapping := range mappings {
+		if mapping.IsNotFileBacked() {
+			var typ uint64
+			if mapping.IsJitted() {
+				typ = MappingTypeJitted
+			}
+			if mapping.IsSpecial() {
+				typ = MappingTypeSpecial
+			}
+			process.Mappings = append(process.Mappings, Mapping{Begin: mapping.StartAddr, End: mapping.EndAddr, Type: typ})
+			continue
+		}
+
+		path := resolve(mapping.Executable)
+		loadAddress := mapping.LoadAddr
+		if mapping.IsMainObject() {
+			aslrElegible, err := elfreader.IsASLRElegible(path)
+			if err != nil {
+				return process, nil, err
+			}
+			if !aslrElegible {
+				loadAddress = 0
+			}
+		}
+
+		id, ok := executableIDs[path]
+		if !ok {
+			id = uint64(len(executableIDs))
+			executableIDs[path] = id
+
+			table, err := GenerateCompactUnwindTable(path, "", expressions)
+			if err != nil {
+				// As in the agent, executables without unwind information have no chunks.
+				table = nil
+			}
+			chunks, ok := shards.Allocate(table)
+			if !ok {
+				return process, nil, fmt.Errorf("%s: unwind table does not fit in the unwind table shards", mapping.Executable)
+			}
+			for _, chunk := range chunks {
+				rows := table[:chunk.Rows()]
+				table = table[len(rows):]
+				shard := tables.Shards[chunk.ShardIndex]
+				if n := int(chunk.HighIndex); len(shard) < n {
+					shard = append(shard, make(CompactUnwindTable, n-len(shard))...)
+				}
+				copy(shard[chunk.LowIndex:], rows)
+				tables.Shards[chunk.ShardIndex] = shard
+			}
+			tables.Chunks[id] = chunks
+		}
+
+		process.Mappings = append(process.Mappings, Mapping{
+			LoadAddress:  loadAddress,
+			Begin:        mapping.StartAddr,
+			End:          mapping.EndAddr,
+			ExecutableID: id,
+		})
+	}
+	tables.Expressions = expressions.Expressions()
+	return process, tables, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testSegment struct {
+	vaddr, memsz uint64
+	flags        elf.ProgFlag
+	data         []byte
+}
+
+// testCoreDump returns an x86_64 ELF core dump of a thread with the given
+// registers, files and memory segments.
+func testCoreDump(regs Registers, files []CoreDumpFile, segments []testSegment) []byte {
+	le := binary.LittleEndian
+	note := func(notes []byte, typ uint32, desc []byte) []byte {
+		notes = le.AppendUint32(notes, 5)
+		notes = le.AppendUint32(notes, uint32(len(desc)))
+		notes = le.AppendUint32(notes, typ)
+		notes = append(notes, "CORE\x00\x00\x00\x00"...)
+		notes = append(notes, desc...)
+		for len(notes)%4 != 0 {
+			notes = append(notes, 0)
+		}
+		return notes
+	}
+
+	prstatus := make([]byte, prstatusRegsOffset+userRegsLen*8+8)
+	le.PutUint64(prstatus[prstatusRegsOffset+userRegsRBP*8:], regs.BP)
+	le.PutUint64(prstatus[prstatusRegsOffset+userRegsRIP*8:], regs.IP)
+	le.PutUint64(prstatus[prstatusRegsOffset+userRegsRSP*8:], regs.SP)
+	notes := note(nil, uint32(elf.NT_PRSTATUS), prstatus)
+
+	fileNote := le.AppendUint64(nil, uint64(len(files)))
+	fileNote = le.AppendUint64(fileNote, 0x1000)
+	for _, f := range files {
+		fileNote = le.AppendUint64(fileNote, f.Start)
+		fileNote = le.AppendUint64(fileNote, f.End)
+		fileNote = le.AppendUint64(fileNote, f.Offset/0x1000)
+	}
+	for _, f := range files {
+		fileNote = append(append(fileNote, f.Path...), 0)
+	}
+	notes = note(notes, ntFile, fileNote)
+
+	const headerSize, progSize = 64, 56
+	phnum := 1 + len(segments)
+	offset := uint64(headerSize + progSize*phnum)
+
+	data := []byte{0x7f, 'E', 'L', 'F', byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)}
+	data = append(data, make([]byte, 9)...)
+	data = le.AppendUint16(data, uint16(elf.ET_CORE))
+	data = le.AppendUint16(data, uint16(elf.EM_X86_64))
+	data = le.AppendUint32(data, uint32(elf.EV_CURRENT))
+	data = le.AppendUint64(data, 0)          // Entry.
+	data = le.AppendUint64(data, headerSize) // Program headers.
+	data = le.AppendUint64(data, 0)          // Section headers.
+	data = le.AppendUint32(data, 0)          // Flags.
+	data = le.AppendUint16(data, headerSize)
+	data = le.AppendUint16(data, progSize)
+	data = le.AppendUint16(data, uint16(phnum))
+	data = le.AppendUint16(data, 64) // Section header size.
+	data = le.AppendUint16(data, 0)
+	data = le.AppendUint16(data, 0)
+
+	prog := func(data []byte, typ elf.ProgType, flags elf.ProgFlag, off, vaddr, filesz, memsz uint64) []byte {
+		data = le.AppendUint32(data, uint32(typ))
+		data = le.AppendUint32(data, uint32(flags))
+		for _, v := range []uint64{off, vaddr, 0, filesz, memsz, 1} {
+			data = le.AppendUint64(data, v)
+		}
+		return data
+	}
+	data = prog(data, elf.PT_NOTE, 0, offset, 0, uint64(len(notes)), 0)
+	offset += uint64(len(notes))
+	for _, s := range segments {
+		data = prog(data, elf.PT_LOAD, s.flags, offset, s.vaddr, uint64(len(s.data)), s.memsz)
+		offset += uint64(len(s.data))
+	}
+
+	data = append(data, notes...)
+	for _, s := range segments {
+		data = append(data, s.data...)
+	}
+	return data
+}
+
+func TestCoreDump(t *testing.T) {
+	require.Equal(t, 1, functionWithFrame(1)-1)
+
+	executable, err := os.Executable()
+	require.NoError(t, err)
+
+	// The test binary is not position independent, the addresses of its
+	// functions are the ones in the unwind table.
+	entry := uint64(reflect.ValueOf(functionWithFrame).Pointer())
+	page := entry &^ 0xfff
+
+	// A snapshot taken at the entry of the function, called from code without
+	// unwind information.
+	stack := make([]byte, 0x40)
+	binary.LittleEndian.PutUint64(stack[0x20:], 0x800)
+	regs := Registers{IP: entry, SP: 0x7fe0}
+	files := []CoreDumpFile{
+		{Start: 0x400000, End: page, Path: "/main"},
+		{Start: page, End: page + 0x1000, Offset: page - 0x400000, Path: "/main"},
+	}
+	segments := []testSegment{
+		{vaddr: page, memsz: 0x1000, flags: elf.PF_R | elf.PF_X},
+		{vaddr: 0x7fc0, memsz: 0x40, flags: elf.PF_R | elf.PF_W, data: stack},
+	}
+
+	path := filepath.Join(t.TempDir(), "core")
+	require.NoError(t, os.WriteFile(path, testCoreDump(regs, files, segments), 0o600))
+
+	core, err := OpenCoreDump(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { core.Close() })
+
+	require.Equal(t, regs, core.Registers)
+	require.Equal(t, files, core.Files)
+
+	v, err := core.ReadMemory(0x7fe0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0x800), v)
+	_, err = core.ReadMemory(0x7ffc)
+	require.ErrorIs(t, err, errNotInCoreDump)
+	// The code was not dumped.
+	_, err = core.ReadMemory(entry)
+	require.ErrorIs(t, err, errNotInCoreDump)
+
+	mappings := core.ExecutableMappings()
+	require.Len(t, mappings, 1)
+	require.Equal(t, ExecutableMapping{LoadAddr: 0x400000, StartAddr: page, EndAddr: page + 0x1000, Executable: "/main", mainExec: true}, *mappings[0])
+
+	process, tables, err := LoadProcess(mappings, func(string) string { return executable })
+	require.NoError(t, err)
+	require.Equal(t, []Mapping{{Begin: page, End: page + 0x1000}}, process.Mappings)
+	require.NotEmpty(t, tables.Chunks[0])
+
+	frames, err := NewProcessUnwinder(process, tables, false).Unwind(core.Registers, core.ReadMemory)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{entry}, frames)
+
+	_, err = OpenCoreDump(executable)
+	require.ErrorIs(t, err, errNotCoreDump)
+}
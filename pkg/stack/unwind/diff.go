@@ -0,0 +1,180 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"debug/elf"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TableDiff is the difference between the compact unwind tables of two builds of
+// an executable. Functions are matched by symbol name, or by address if they
+// have no symbol.
+type TableDiff struct {
+	Added     []string
+	Removed   []string
+	Changed   []FunctionDiff
+	Unchanged int
+}
+
+// Empty returns whether the tables have the same functions, with the same rows.
+func (d *TableDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// FunctionDiff are the rows of a function in the two tables, with their
+// program counters relative to the start of the function.
+type FunctionDiff struct {
+	Name     string
+	Old, New []string
+}
+
+// DiffCompactUnwindTables compares the compact unwind tables of the executables
+// at oldPath and newPath.
+func DiffCompactUnwindTables(oldPath, newPath string) (*TableDiff, error) {
+	oldFunctions, err := describeFunctions(oldPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", oldPath, err)
+	}
+	newFunctions, err := describeFunctions(newPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", newPath, err)
+	}
+
+	diff := &TableDiff{}
+	for name, oldRows := range oldFunctions {
+		newRows, ok := newFunctions[name]
+		if !ok {
+			diff.Removed = append(diff.Removed, name)
+			continue
+		}
+		if strings.Join(oldRows, "\n") == strings.Join(newRows, "\n") {
+			diff.Unchanged++
+			continue
+		}
+		diff.Changed = append(diff.Changed, FunctionDiff{Name: name, Old: oldRows, New: newRows})
+	}
+	for name := range newFunctions {
+		if _, ok := oldFunctions[name]; !ok {
+			diff.Added = append(diff.Added, name)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Name < diff.Changed[j].Name })
+	return diff, nil
+}
+
+// describeFunctions returns the rows of the functions of the compact unwind table
+// of the executable, described with FormatCompactUnwindTableRow, by function name.
+func describeFunctions(path string) (map[string][]string, error) {
+	obj, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open elf: %w", err)
+	}
+	defer obj.Close()
+	symbols := newFunctionSymbols(obj)
+
+	expressions := NewExpressionTable(MaxDwarfExpressions)
+	table, err := GenerateCompactUnwindTable(path, "", expressions)
+	if err != nil {
+		return nil, err
+	}
+
+	functions := map[string][]string{}
+	for _, f := range tableFunctions(table) {
+		name, ok := symbols.at(f.start)
+		if !ok {
+			name = fmt.Sprintf("%#x", f.start)
+		}
+		// Local functions can have the same name.
+		base := name
+		for i := 2; ; i++ {
+			if _, ok := functions[name]; !ok {
+				break
+			}
+			name = fmt.Sprintf("%s#%d", base, i)
+		}
+
+		rows := make([]string, 0, len(f.rows)+1)
+		for _, row := range f.rows {
+			rows = append(rows, fmt.Sprintf("+%#x %s", row.pc-f.start, FormatCompactUnwindTableRow(row, expressions.Expressions())))
+		}
+		rows = append(rows, fmt.Sprintf("+%#x end", f.end-f.start))
+		functions[name] = rows
+	}
+	return functions, nil
+}
+
+// FormatCompactUnwindTableRow describes the rules of the row, resolving the
+// compiled DWARF expressions it refers to with expressions.
+func FormatCompactUnwindTableRow(row CompactUnwindTableRow, expressions []Expression) string {
+	expression := func(id int16) string {
+		switch DwarfExpressionID(id) {
+		case ExpressionUnknown:
+			return "unknown expression"
+		case ExpressionPlt1:
+			return "plt1 expression"
+		case ExpressionPlt2:
+			return "plt2 expression"
+		}
+		i := int(id) - int(ExpressionCompiled)
+		if i < 0 || i >= len(expressions) {
+			return fmt.Sprintf("expression %d", id)
+		}
+		ops := make([]string, 0, len(expressions[i]))
+		for _, op := range expressions[i] {
+			ops = append(ops, fmt.Sprintf("%d:%d:%d", op.Opcode, op.Reg, op.Operand))
+		}
+		return fmt.Sprintf("expression [%s]", strings.Join(ops, " "))
+	}
+
+	var cfa string
+	switch BpfCfaType(row.cfaType) {
+	case cfaTypeRsp:
+		cfa = fmt.Sprintf("$rsp%+d", row.cfaOffset)
+	case cfaTypeRbp:
+		cfa = fmt.Sprintf("$rbp%+d", row.cfaOffset)
+	case cfaTypeExpression:
+		cfa = expression(row.cfaOffset)
+	case cfaTypeSignalFrame:
+		return "signal frame"
+	case cfaTypeEndFdeMarker:
+		return "end"
+	case cfaTypeUndefined:
+		cfa = "undefined"
+	default:
+		cfa = fmt.Sprintf("type %d", row.cfaType)
+	}
+
+	var rbp string
+	switch bpfRbpType(row.rbpType) {
+	case rbpRuleOffsetUnchanged:
+		rbp = "unchanged"
+	case rbpRuleOffset:
+		rbp = fmt.Sprintf("c%+d", row.rbpOffset)
+	case rbpRuleRegister:
+		rbp = "register"
+	case rbpTypeExpression:
+		rbp = expression(row.rbpOffset)
+	case rbpTypeUndefinedReturnAddress:
+		return fmt.Sprintf("CFA: %s RA: undefined", cfa)
+	default:
+		rbp = fmt.Sprintf("type %d", row.rbpType)
+	}
+	return fmt.Sprintf("CFA: %s RBP: %s", cfa, rbp)
+}
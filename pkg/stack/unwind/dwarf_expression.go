@@ -15,15 +15,25 @@
 package unwind
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
 	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
+	"github.com/parca-dev/parca-agent/internal/dwarf/util"
 )
 
 type DwarfExpressionID int16
 
+// Always needs to be in sync with the DWARF_EXPRESSION_* values in the BPF program.
 const (
 	ExpressionUnknown DwarfExpressionID = iota
 	ExpressionPlt1
 	ExpressionPlt2
+	// ExpressionCompiled is the identifier of the first expression
+	// of an ExpressionTable, the ones that follow are consecutive.
+	ExpressionCompiled
 )
 
 // DWARF expressions that we recognize.
@@ -90,3 +100,369 @@ func ExpressionIdentifier(expression []byte) DwarfExpressionID {
 
 	return ExpressionUnknown
 }
+
+const (
+	// MaxExpressionOps is the maximum number of operations of a compiled expression.
+	// Always needs to be in sync with MAX_DWARF_EXPRESSION_OPS in the BPF program.
+	MaxExpressionOps = 16
+	// MaxExpressionStackDepth is the maximum number of values on the stack while
+	// evaluating a compiled expression.
+	// Always needs to be in sync with MAX_DWARF_EXPRESSION_STACK in the BPF program.
+	MaxExpressionStackDepth = 8
+)
+
+// ExpressionOpcode is an operation of the bytecode DWARF expressions are compiled to.
+// Always needs to be in sync with the EXPRESSION_OP_* values in the BPF program.
+type ExpressionOpcode uint8
+
+const (
+	// ExpressionOpBreg pushes the value of the register plus the operand.
+	ExpressionOpBreg ExpressionOpcode = iota + 1
+	// ExpressionOpConst pushes the operand.
+	ExpressionOpConst
+	// ExpressionOpPlusConst adds the operand to the top of the stack.
+	ExpressionOpPlusConst
+	// ExpressionOpDeref replaces the top of the stack with the 8 bytes at that address.
+	ExpressionOpDeref
+	// ExpressionOpAnd pops two values and pushes their bitwise and.
+	ExpressionOpAnd
+	// ExpressionOpPlus pops two values and pushes their sum.
+	ExpressionOpPlus
+	// ExpressionOpGe pops two values and pushes 1 if the second one
+	// is greater than or equal to the top one, as signed integers, or 0.
+	ExpressionOpGe
+	// ExpressionOpShl pops two values and pushes the second one shifted left by the top one.
+	ExpressionOpShl
+)
+
+// ExpressionOp is an operation of a compiled expression.
+type ExpressionOp struct {
+	Opcode ExpressionOpcode
+	// Reg is the DWARF register number for ExpressionOpBreg.
+	Reg     uint8
+	Operand int64
+}
+
+// Expression is a DWARF expression compiled to the bytecode evaluated by the BPF unwinder.
+type Expression []ExpressionOp
+
+var errUnsupportedExpression = errors.New("unsupported DWARF expression")
+
+// expressionRegisters are the registers that compiled expressions can refer to.
+var expressionRegisters = map[byte]uint8{
+	frame.DW_OP_breg6:  frame.X86_64FramePointer,
+	frame.DW_OP_breg7:  frame.X86_64StackPointer,
+	frame.DW_OP_breg16: x86_64InstructionPointer,
+}
+
+// x86_64InstructionPointer is the DWARF register number of $rip.
+const x86_64InstructionPointer = 16
+
+// CompileExpression compiles the expression of a CFA rule to bytecode. The subset
+// of DWARF expressions found in CFA and register rules, such as the ones of signal
+// trampolines, is supported: register based addresses (DW_OP_breg*), literals and
+// constants, DW_OP_plus_uconst, DW_OP_deref, DW_OP_and, DW_OP_plus, DW_OP_ge and DW_OP_shl.
+func CompileExpression(expression []byte) (Expression, error) {
+	return compileExpression(expression, 0)
+}
+
+// CompileRegisterRuleExpression compiles the expression of a register rule to bytecode,
+// which starts with the CFA on the stack, see CompileExpression.
+func CompileRegisterRuleExpression(expression []byte) (Expression, error) {
+	return compileExpression(expression, 1)
+}
+
+func compileExpression(expression []byte, depth int) (Expression, error) {
+	var (
+		r   = bytes.NewReader(expression)
+		ops = make(Expression, 0, len(expression))
+	)
+	// emit appends the operation, checking the stack does not under or overflow.
+	emit := func(op ExpressionOp, pops, pushes int) error {
+		if len(ops) == MaxExpressionOps {
+			return fmt.Errorf("%w: more than %d operations", errUnsupportedExpression, MaxExpressionOps)
+		}
+		if depth < pops {
+			return fmt.Errorf("%w: stack underflow", errUnsupportedExpression)
+		}
+		depth += pushes - pops
+		if depth > MaxExpressionStackDepth {
+			return fmt.Errorf("%w: more than %d values on the stack", errUnsupportedExpression, MaxExpressionStackDepth)
+		}
+		ops = append(ops, op)
+		return nil
+	}
+
+	for r.Len() > 0 {
+		opcode, _ := r.ReadByte()
+
+		var err error
+		switch {
+		case opcode >= frame.DW_OP_breg0 && opcode <= frame.DW_OP_breg31:
+			reg, ok := expressionRegisters[opcode]
+			if !ok {
+				return nil, fmt.Errorf("%w: register %d", errUnsupportedExpression, opcode-frame.DW_OP_breg0)
+			}
+			offset, _ := util.DecodeSLEB128(r)
+			err = emit(ExpressionOp{Opcode: ExpressionOpBreg, Reg: reg, Operand: offset}, 0, 1)
+		case opcode >= frame.DW_OP_lit0 && opcode <= frame.DW_OP_lit31:
+			err = emit(ExpressionOp{Opcode: ExpressionOpConst, Operand: int64(opcode - frame.DW_OP_lit0)}, 0, 1)
+		case opcode == frame.DW_OP_const1u, opcode == frame.DW_OP_const2u, opcode == frame.DW_OP_const4u, opcode == frame.DW_OP_const8u,
+			opcode == frame.DW_OP_const1s, opcode == frame.DW_OP_const2s, opcode == frame.DW_OP_const4s, opcode == frame.DW_OP_const8s:
+			var c int64
+			c, err = readConst(r, opcode)
+			if err != nil {
+				return nil, err
+			}
+			err = emit(ExpressionOp{Opcode: ExpressionOpConst, Operand: c}, 0, 1)
+		case opcode == frame.DW_OP_constu:
+			c, _ := util.DecodeULEB128(r)
+			err = emit(ExpressionOp{Opcode: ExpressionOpConst, Operand: int64(c)}, 0, 1)
+		case opcode == frame.DW_OP_consts:
+			c, _ := util.DecodeSLEB128(r)
+			err = emit(ExpressionOp{Opcode: ExpressionOpConst, Operand: c}, 0, 1)
+		case opcode == frame.DW_OP_plus_uconst:
+			c, _ := util.DecodeULEB128(r)
+			err = emit(ExpressionOp{Opcode: ExpressionOpPlusConst, Operand: int64(c)}, 1, 1)
+		case opcode == frame.DW_OP_deref:
+			err = emit(ExpressionOp{Opcode: ExpressionOpDeref}, 1, 1)
+		case opcode == frame.DW_OP_and:
+			err = emit(ExpressionOp{Opcode: ExpressionOpAnd}, 2, 1)
+		case opcode == frame.DW_OP_plus:
+			err = emit(ExpressionOp{Opcode: ExpressionOpPlus}, 2, 1)
+		case opcode == frame.DW_OP_ge:
+			err = emit(ExpressionOp{Opcode: ExpressionOpGe}, 2, 1)
+		case opcode == frame.DW_OP_shl:
+			err = emit(ExpressionOp{Opcode: ExpressionOpShl}, 2, 1)
+		case opcode == frame.DW_OP_nop:
+		default:
+			return nil, fmt.Errorf("%w: opcode %#x", errUnsupportedExpression, opcode)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("%w: empty expression", errUnsupportedExpression)
+	}
+	return ops, nil
+}
+
+// readConst reads the operand of the fixed size DW_OP_const* operations.
+func readConst(r *bytes.Reader, opcode byte) (int64, error) {
+	var size int
+	//nolint:exhaustive
+	switch opcode {
+	case frame.DW_OP_const1u, frame.DW_OP_const1s:
+		size = 1
+	case frame.DW_OP_const2u, frame.DW_OP_const2s:
+		size = 2
+	case frame.DW_OP_const4u, frame.DW_OP_const4s:
+		size = 4
+	default:
+		size = 8
+	}
+	if r.Len() < size {
+		return 0, fmt.Errorf("%w: truncated constant", errUnsupportedExpression)
+	}
+
+	// DWARF expressions use the byte order of the target, x86_64 is little endian.
+	var c uint64
+	for i := 0; i < size; i++ {
+		b, _ := r.ReadByte()
+		c |= uint64(b) << (8 * i)
+	}
+	signed := opcode == frame.DW_OP_const1s || opcode == frame.DW_OP_const2s || opcode == frame.DW_OP_const4s
+	if signed {
+		// Sign extend.
+		shift := 64 - 8*size
+		return int64(c<<shift) >> shift, nil
+	}
+	return int64(c), nil
+}
+
+// ExpressionRegisters are the values of the registers compiled expressions can refer to.
+type ExpressionRegisters struct {
+	IP uint64
+	SP uint64
+	BP uint64
+}
+
+// Evaluate evaluates the expression of a CFA rule the way the BPF unwinder does.
+// Memory is read with readMemory.
+func (e Expression) Evaluate(regs ExpressionRegisters, readMemory func(addr uint64) (uint64, error)) (uint64, error) {
+	return e.evaluate(regs, nil, readMemory)
+}
+
+// EvaluateRegisterRule evaluates the expression of a register rule the way
+// the BPF unwinder does. The CFA is pushed onto the stack first, and the
+// result is the address the register is saved at.
+func (e Expression) EvaluateRegisterRule(regs ExpressionRegisters, cfa uint64, readMemory func(addr uint64) (uint64, error)) (uint64, error) {
+	return e.evaluate(regs, []uint64{cfa}, readMemory)
+}
+
+func (e Expression) evaluate(regs ExpressionRegisters, stack []uint64, readMemory func(addr uint64) (uint64, error)) (uint64, error) {
+	if len(e) > MaxExpressionOps {
+		return 0, fmt.Errorf("%w: more than %d operations", errUnsupportedExpression, MaxExpressionOps)
+	}
+
+	for _, op := range e {
+		var pops int
+		//nolint:exhaustive
+		switch op.Opcode {
+		case ExpressionOpPlusConst, ExpressionOpDeref:
+			pops = 1
+		case ExpressionOpAnd, ExpressionOpPlus, ExpressionOpGe, ExpressionOpShl:
+			pops = 2
+		}
+		if len(stack) < pops {
+			return 0, fmt.Errorf("%w: stack underflow", errUnsupportedExpression)
+		}
+
+		switch op.Opcode {
+		case ExpressionOpBreg:
+			var reg uint64
+			switch op.Reg {
+			case frame.X86_64FramePointer:
+				reg = regs.BP
+			case frame.X86_64StackPointer:
+				reg = regs.SP
+			case x86_64InstructionPointer:
+				reg = regs.IP
+			default:
+				return 0, fmt.Errorf("%w: register %d", errUnsupportedExpression, op.Reg)
+			}
+			stack = append(stack, reg+uint64(op.Operand))
+		case ExpressionOpConst:
+			stack = append(stack, uint64(op.Operand))
+		case ExpressionOpPlusConst:
+			stack[len(stack)-1] += uint64(op.Operand)
+		case ExpressionOpDeref:
+			v, err := readMemory(stack[len(stack)-1])
+			if err != nil {
+				return 0, fmt.Errorf("failed to read memory at %#x: %w", stack[len(stack)-1], err)
+			}
+			stack[len(stack)-1] = v
+		case ExpressionOpAnd, ExpressionOpPlus, ExpressionOpGe, ExpressionOpShl:
+			a, b := stack[len(stack)-2], stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			var v uint64
+			//nolint:exhaustive
+			switch op.Opcode {
+			case ExpressionOpAnd:
+				v = a & b
+			case ExpressionOpPlus:
+				v = a + b
+			case ExpressionOpGe:
+				if int64(a) >= int64(b) {
+					v = 1
+				}
+			case ExpressionOpShl:
+				v = a << b
+			}
+			stack[len(stack)-1] = v
+		default:
+			return 0, fmt.Errorf("%w: opcode %d", errUnsupportedExpression, op.Opcode)
+		}
+
+		if len(stack) > MaxExpressionStackDepth {
+			return 0, fmt.Errorf("%w: more than %d values on the stack", errUnsupportedExpression, MaxExpressionStackDepth)
+		}
+	}
+
+	if len(stack) == 0 {
+		return 0, fmt.Errorf("%w: empty stack", errUnsupportedExpression)
+	}
+	return stack[len(stack)-1], nil
+}
+
+// key returns a string that uniquely identifies the expression.
+func (e Expression) key() string {
+	buf := make([]byte, 0, len(e)*10)
+	for _, op := range e {
+		buf = append(buf, byte(op.Opcode), op.Reg)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(op.Operand))
+	}
+	return string(buf)
+}
+
+// ExpressionTable holds the compiled expressions unwind rows refer to, deduplicated
+// across executables, up to a maximum number of expressions. It is not safe for
+// concurrent use.
+type ExpressionTable struct {
+	// Keyed by the kind of rule followed by the expression.
+	ids map[string]DwarfExpressionID
+	// Keyed by the encoded compiled expression.
+	compiledIDs map[string]DwarfExpressionID
+	expressions []Expression
+	size        int
+}
+
+// NewExpressionTable returns a table of up to size expressions.
+func NewExpressionTable(size int) *ExpressionTable {
+	return &ExpressionTable{
+		ids:         map[string]DwarfExpressionID{},
+		compiledIDs: map[string]DwarfExpressionID{},
+		size:        size,
+	}
+}
+
+// ID returns the identifier of the given CFA rule expression, which is compiled
+// the first time it is seen. ExpressionUnknown is returned if the expression is
+// not supported or if the table is full.
+func (t *ExpressionTable) ID(expression []byte) DwarfExpressionID {
+	return t.id("c", expression, CompileExpression)
+}
+
+// RegisterRuleID returns the identifier of the given register rule expression, see ID.
+func (t *ExpressionTable) RegisterRuleID(expression []byte) DwarfExpressionID {
+	return t.id("r", expression, CompileRegisterRuleExpression)
+}
+
+func (t *ExpressionTable) id(kind string, expression []byte, compile func([]byte) (Expression, error)) DwarfExpressionID {
+	if t == nil {
+		return ExpressionUnknown
+	}
+	key := kind + string(expression)
+	if id, ok := t.ids[key]; ok {
+		return id
+	}
+
+	compiled, err := compile(expression)
+	if err != nil {
+		return ExpressionUnknown
+	}
+	id := t.Add(compiled)
+	if id != ExpressionUnknown {
+		t.ids[key] = id
+	}
+	return id
+}
+
+// Add returns the identifier of the given compiled expression, adding it
+// if it is not in the table yet. ExpressionUnknown is returned if the table
+// is full.
+func (t *ExpressionTable) Add(expression Expression) DwarfExpressionID {
+	if t == nil {
+		return ExpressionUnknown
+	}
+	key := expression.key()
+	if id, ok := t.compiledIDs[key]; ok {
+		return id
+	}
+	if len(t.expressions) >= t.size {
+		return ExpressionUnknown
+	}
+
+	id := ExpressionCompiled + DwarfExpressionID(len(t.expressions))
+	t.compiledIDs[key] = id
+	t.expressions = append(t.expressions, expression)
+	return id
+}
+
+// Expressions returns the compiled expressions, in identifier order
+// starting from ExpressionCompiled.
+func (t *ExpressionTable) Expressions() []Expression {
+	return t.expressions
+}
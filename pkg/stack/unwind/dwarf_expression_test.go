@@ -0,0 +1,216 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
+)
+
+// plt1Expression is the CFA expression of the PLT entries emitted by the GNU linker,
+// sp + 8 + ((((ip & 15) >= 11)) << 3.
+var plt1Expression = []byte{
+	frame.DW_OP_breg7, 8,
+	frame.DW_OP_breg16, 0,
+	frame.DW_OP_lit15,
+	frame.DW_OP_and,
+	frame.DW_OP_lit11,
+	frame.DW_OP_ge,
+	frame.DW_OP_lit3,
+	frame.DW_OP_shl,
+	frame.DW_OP_plus,
+}
+
+func TestEvaluateExpression(t *testing.T) {
+	memory := map[uint64]uint64{
+		0x7ffc1000 + 160: 0x7ffc2000,
+	}
+	readMemory := func(addr uint64) (uint64, error) {
+		v, ok := memory[addr]
+		if !ok {
+			return 0, errors.New("unmapped")
+		}
+		return v, nil
+	}
+
+	tests := []struct {
+		name       string
+		expression []byte
+		regs       ExpressionRegisters
+		// cfa is pushed first for register rules.
+		cfa     *uint64
+		want    uint64
+		wantErr bool
+	}{
+		{
+			name:       "PLT, first instructions",
+			expression: plt1Expression,
+			regs:       ExpressionRegisters{IP: 0x1005, SP: 0x7ffc1000},
+			want:       0x7ffc1000 + 8,
+		},
+		{
+			name:       "PLT, last instructions",
+			expression: plt1Expression,
+			regs:       ExpressionRegisters{IP: 0x100c, SP: 0x7ffc1000},
+			want:       0x7ffc1000 + 16,
+		},
+		{
+			// The CFA of __restore_rt in glibc, the stack pointer saved in the ucontext.
+			name:       "signal trampoline CFA",
+			expression: []byte{frame.DW_OP_breg7, 0xa0, 0x01, frame.DW_OP_deref},
+			regs:       ExpressionRegisters{SP: 0x7ffc1000},
+			want:       0x7ffc2000,
+		},
+		{
+			// The frame pointer of __restore_rt in glibc, saved in the ucontext.
+			name:       "signal trampoline frame pointer",
+			expression: []byte{frame.DW_OP_breg7, 0xf8, 0x00},
+			regs:       ExpressionRegisters{SP: 0x7ffc1000},
+			cfa:        func() *uint64 { cfa := uint64(0x7ffc2000); return &cfa }(),
+			want:       0x7ffc1000 + 120,
+		},
+		{
+			name:       "register rule relative to the CFA",
+			expression: []byte{frame.DW_OP_plus_uconst, 16},
+			cfa:        func() *uint64 { cfa := uint64(0x7ffc2000); return &cfa }(),
+			want:       0x7ffc2000 + 16,
+		},
+		{
+			name:       "signed constant",
+			expression: []byte{frame.DW_OP_breg6, 0, frame.DW_OP_const1s, 0xf8, frame.DW_OP_plus},
+			regs:       ExpressionRegisters{BP: 0x7ffc1000},
+			want:       0x7ffc1000 - 8,
+		},
+		{
+			name:       "four byte constant",
+			expression: []byte{frame.DW_OP_const4u, 0x78, 0x56, 0x34, 0x12},
+			want:       0x12345678,
+		},
+		{
+			name:       "unreadable memory",
+			expression: []byte{frame.DW_OP_breg7, 0, frame.DW_OP_deref},
+			regs:       ExpressionRegisters{SP: 0x1000},
+			wantErr:    true,
+		},
+		{
+			name:       "unsupported register",
+			expression: []byte{frame.DW_OP_breg0, 8},
+			wantErr:    true,
+		},
+		{
+			name:       "unsupported operation",
+			expression: []byte{frame.DW_OP_call_frame_cfa},
+			wantErr:    true,
+		},
+		{
+			name:       "stack underflow",
+			expression: []byte{frame.DW_OP_lit1, frame.DW_OP_plus},
+			wantErr:    true,
+		},
+		{
+			name: "too many operations",
+			expression: []byte{
+				frame.DW_OP_lit1, frame.DW_OP_lit1, frame.DW_OP_plus, frame.DW_OP_lit1, frame.DW_OP_plus,
+				frame.DW_OP_lit1, frame.DW_OP_plus, frame.DW_OP_lit1, frame.DW_OP_plus, frame.DW_OP_lit1,
+				frame.DW_OP_plus, frame.DW_OP_lit1, frame.DW_OP_plus, frame.DW_OP_lit1, frame.DW_OP_plus,
+				frame.DW_OP_lit1, frame.DW_OP_plus,
+			},
+			wantErr: true,
+		},
+		{
+			name: "stack too deep",
+			expression: []byte{
+				frame.DW_OP_lit1, frame.DW_OP_lit1, frame.DW_OP_lit1, frame.DW_OP_lit1, frame.DW_OP_lit1,
+				frame.DW_OP_lit1, frame.DW_OP_lit1, frame.DW_OP_lit1, frame.DW_OP_lit1,
+			},
+			wantErr: true,
+		},
+		{
+			name:       "truncated constant",
+			expression: []byte{frame.DW_OP_const2u, 1},
+			wantErr:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			compile := CompileExpression
+			if test.cfa != nil {
+				compile = CompileRegisterRuleExpression
+			}
+			expression, err := compile(test.expression)
+			if err == nil {
+				if test.cfa != nil {
+					var have uint64
+					have, err = expression.EvaluateRegisterRule(test.regs, *test.cfa, readMemory)
+					if err == nil {
+						require.Equal(t, test.want, have)
+					}
+				} else {
+					var have uint64
+					have, err = expression.Evaluate(test.regs, readMemory)
+					if err == nil {
+						require.Equal(t, test.want, have)
+					}
+				}
+			}
+			if test.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestExpressionTable(t *testing.T) {
+	restoreRtCFA := []byte{frame.DW_OP_breg7, 0xa0, 0x01, frame.DW_OP_deref}
+	restoreRtRBP := []byte{frame.DW_OP_breg7, 0xf8, 0x00}
+
+	table := NewExpressionTable(2)
+	require.Equal(t, ExpressionCompiled, table.ID(restoreRtCFA))
+	require.Equal(t, ExpressionUnknown, table.ID([]byte{frame.DW_OP_call_frame_cfa}))
+	require.Equal(t, ExpressionCompiled+1, table.RegisterRuleID(restoreRtRBP))
+	// Deduplicated.
+	require.Equal(t, ExpressionCompiled, table.ID(restoreRtCFA))
+	// Full.
+	require.Equal(t, ExpressionUnknown, table.ID([]byte{frame.DW_OP_breg6, 16}))
+
+	require.Equal(t, []Expression{
+		{{Opcode: ExpressionOpBreg, Reg: frame.X86_64StackPointer, Operand: 160}, {Opcode: ExpressionOpDeref}},
+		{{Opcode: ExpressionOpBreg, Reg: frame.X86_64StackPointer, Operand: 120}},
+	}, table.Expressions())
+
+	row, err := rowToCompactRow(&UnwindTableRow{
+		Loc: 123,
+		CFA: frame.DWRule{Rule: frame.RuleExpression, Expression: restoreRtCFA},
+		RBP: frame.DWRule{Rule: frame.RuleExpression, Expression: restoreRtRBP},
+		RA:  frame.DWRule{Rule: frame.RuleOffset, Offset: -8},
+	}, table)
+	require.NoError(t, err)
+	require.Equal(t, CompactUnwindTableRow{
+		pc:        123,
+		cfaType:   uint8(cfaTypeExpression),
+		rbpType:   uint8(rbpTypeExpression),
+		cfaOffset: int16(ExpressionCompiled),
+		rbpOffset: int16(ExpressionCompiled + 1),
+	}, row)
+
+	// The PLT expressions have their own identifiers.
+	require.Equal(t, ExpressionPlt1, ExpressionIdentifier(plt1Expression))
+}
@@ -105,14 +105,18 @@ func HasFramePointers(executable string) (bool, error) {
 	compiler := ainur.Compiler(f)
 	// Go 1.7 [0] enabled FP for x86_64. arm64 got them enabled in 1.12 [1].
 	//
-	// Note: we don't take into account applications that use cgo yet.
-	// If the non Go bits aren't compiled with frame pointers, too,
-	// unwinding will fail. In the future might add the unwind information
-	// for these bits of executable code.
+	// Executables with C code, as the ones using cgo, have an .eh_frame
+	// section, and the C code might not have frame pointers. These and the
+	// ones built with -gcflags=-d=framepointer=0 use the unwind tables, where
+	// the Go functions get their rows from .gopclntab.
 	//
 	// [0]: https://go.dev/doc/go1.7 (released on 2016-08-15).
 	// [1]: https://go.dev/doc/go1.12 (released on 2019-02-25).
 	if strings.Contains(compiler, "Go") {
+		if f.Section(".eh_frame") != nil || !goFramePointers(executable) {
+			return false, nil
+		}
+
 		versionString := strings.Split(compiler, "Go ")[1]
 		have, err := version.NewVersion(versionString)
 		if err != nil {
@@ -0,0 +1,473 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"bytes"
+	"debug/buildinfo"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
+)
+
+var (
+	ErrNoGoFunctionTable          = errors.New("no .gopclntab section found")
+	errBadGoFunctionTable         = errors.New("malformed .gopclntab")
+	errUnsupportedGoFunctionTable = errors.New("unsupported .gopclntab version")
+)
+
+// Magic numbers of the versions of the Go function table, as
+// in the pcHeader of src/runtime/symtab.go.
+const (
+	pclntabMagic12  = 0xfffffffb
+	pclntabMagic116 = 0xfffffffa
+	pclntabMagic118 = 0xfffffff0
+	pclntabMagic120 = 0xfffffff1
+)
+
+// goTopFrames are the functions the Go runtime starts goroutines and threads
+// with, where its traceback stops as well. They have no caller to unwind to.
+var goTopFrames = map[string]struct{}{
+	"runtime.goexit":  {},
+	"runtime.mstart":  {},
+	"runtime.rt0_go":  {},
+	"runtime.mstart0": {},
+}
+
+// goFunction is a function of the Go function table.
+type goFunction struct {
+	name       string
+	entry, end uint64
+	// Offset of the stack pointer from its value at the entry of the
+	// function, per range of program counters.
+	spDeltas []goSPDelta
+}
+
+type goSPDelta struct {
+	pc    uint64
+	delta int32
+}
+
+// pclntab is the Go function table, see src/runtime/symtab.go and
+// src/debug/gosym/pclntab.go.
+type pclntab struct {
+	order     binary.ByteOrder
+	version   uint32
+	quantum   uint64
+	ptrSize   int
+	textStart uint64
+
+	nfunctab    int
+	functab     []byte
+	funcdata    []byte
+	funcnametab []byte
+	pctab       []byte
+}
+
+// BuildGoCompactUnwindTable produces compact unwind table rows for the Go
+// functions of the executable, from the stack pointer deltas of its .gopclntab
+// section. Functions covered by the given FDEs, sorted by address, are skipped,
+// as the rows of their DWARF unwind information are more precise.
+func BuildGoCompactUnwindTable(path string, fdes frame.FrameDescriptionEntries) (CompactUnwindTable, error) {
+	obj, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open elf: %w", err)
+	}
+	defer obj.Close()
+
+	tab, err := readPclntab(obj)
+	if err != nil {
+		return nil, err
+	}
+	framePointers := goFramePointers(path)
+
+	functions, err := tab.functions()
+	if err != nil {
+		return nil, err
+	}
+
+	table := make(CompactUnwindTable, 0, 4*len(functions))
+	for _, f := range functions {
+		if fde, err := fdes.FDEForPC(f.entry); err == nil && fde.Cover(f.entry) {
+			continue
+		}
+		table = append(table, goFunctionRows(f, framePointers)...)
+	}
+	return table, nil
+}
+
+// goFunctionRows returns the rows of the given Go function, followed by the
+// end of function marker. Functions whose frame does not fit the rows are
+// left out. With framePointers, the frame pointer is restored from the stack,
+// Go functions with a frame save it right below their return address.
+func goFunctionRows(f goFunction, framePointers bool) CompactUnwindTable {
+	if _, ok := goTopFrames[f.name]; ok {
+		return CompactUnwindTable{
+			{pc: f.entry, cfaType: uint8(cfaTypeRsp), rbpType: uint8(rbpTypeUndefinedReturnAddress), cfaOffset: 8},
+			{pc: f.end, cfaType: uint8(cfaTypeEndFdeMarker)},
+		}
+	}
+
+	rows := make(CompactUnwindTable, 0, len(f.spDeltas)+1)
+	for _, d := range f.spDeltas {
+		// The return address is right above the frame.
+		cfaOffset := int64(d.delta) + 8
+		if d.delta < 0 || cfaOffset > math.MaxInt16 {
+			return nil
+		}
+
+		row := CompactUnwindTableRow{pc: d.pc, cfaType: uint8(cfaTypeRsp), cfaOffset: int16(cfaOffset)}
+		if framePointers && d.delta > 0 {
+			row.rbpType = uint8(rbpRuleOffset)
+			row.rbpOffset = -16
+		}
+		if len(rows) > 0 && rowsEqualRules(rows[len(rows)-1], row) {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return append(rows, CompactUnwindTableRow{pc: f.end, cfaType: uint8(cfaTypeEndFdeMarker)})
+}
+
+func rowsEqualRules(a, b CompactUnwindTableRow) bool {
+	return a.cfaType == b.cfaType && a.rbpType == b.rbpType && a.cfaOffset == b.cfaOffset && a.rbpOffset == b.rbpOffset
+}
+
+// readPclntab finds and parses the Go function table of the executable.
+func readPclntab(obj *elf.File) (*pclntab, error) {
+	var data []byte
+	if sec := obj.Section(".gopclntab"); sec != nil && sec.Type != elf.SHT_NOBITS {
+		var err error
+		data, err = sec.Data()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read .gopclntab section: %w", err)
+		}
+	} else {
+		if obj.Section(".go.buildinfo") == nil {
+			return nil, ErrNoGoFunctionTable
+		}
+		// Position independent executables keep the table in .data.rel.ro,
+		// between the runtime.pclntab and runtime.epclntab symbols.
+		var err error
+		data, err = symbolRange(obj, "runtime.pclntab", "runtime.epclntab")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var textStart uint64
+	if sec := obj.Section(".text"); sec != nil {
+		textStart = sec.Addr
+	}
+	if symbols, err := obj.Symbols(); err == nil {
+		for _, s := range symbols {
+			if s.Name == "runtime.text" {
+				textStart = s.Value
+				break
+			}
+		}
+	}
+
+	return parsePclntab(data, obj.ByteOrder, textStart)
+}
+
+// symbolRange returns the contents of the executable between two symbols.
+func symbolRange(obj *elf.File, start, end string) ([]byte, error) {
+	symbols, err := obj.Symbols()
+	if err != nil {
+		return nil, ErrNoGoFunctionTable
+	}
+	var startSym, endSym *elf.Symbol
+	for i := range symbols {
+		switch symbols[i].Name {
+		case start:
+			startSym = &symbols[i]
+		case end:
+			endSym = &symbols[i]
+		}
+	}
+	if startSym == nil || endSym == nil || endSym.Value < startSym.Value {
+		return nil, ErrNoGoFunctionTable
+	}
+	if int(startSym.Section) >= len(obj.Sections) {
+		return nil, ErrNoGoFunctionTable
+	}
+
+	sec := obj.Sections[startSym.Section]
+	data, err := sec.Data()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s section: %w", sec.Name, err)
+	}
+	low, high := startSym.Value-sec.Addr, endSym.Value-sec.Addr
+	if high > uint64(len(data)) {
+		return nil, ErrNoGoFunctionTable
+	}
+	return data[low:high], nil
+}
+
+// parsePclntab parses the header of the Go function table. The entries of
+// the functions of Go 1.18 and later are relative to textStart, unless the
+// table has it.
+func parsePclntab(data []byte, order binary.ByteOrder, textStart uint64) (*pclntab, error) {
+	if len(data) < 16 {
+		return nil, fmt.Errorf("%w: header too short", errBadGoFunctionTable)
+	}
+	if data[4] != 0 || data[5] != 0 {
+		return nil, fmt.Errorf("%w: bad header", errBadGoFunctionTable)
+	}
+
+	t := &pclntab{
+		order:   order,
+		version: order.Uint32(data),
+		quantum: uint64(data[6]),
+		ptrSize: int(data[7]),
+	}
+	if t.ptrSize != 4 && t.ptrSize != 8 {
+		return nil, fmt.Errorf("%w: bad pointer size %d", errBadGoFunctionTable, t.ptrSize)
+	}
+	if t.quantum == 0 {
+		return nil, fmt.Errorf("%w: bad instruction size quantum", errBadGoFunctionTable)
+	}
+
+	// Words of the header, after the first 8 bytes.
+	word := func(n int) (uint64, error) {
+		off := 8 + n*t.ptrSize
+		if off+t.ptrSize > len(data) {
+			return 0, fmt.Errorf("%w: header too short", errBadGoFunctionTable)
+		}
+		return t.uintptr(data[off:]), nil
+	}
+	// Parts of the table, at the offsets of the given header word.
+	part := func(n int) ([]byte, error) {
+		off, err := word(n)
+		if err != nil {
+			return nil, err
+		}
+		if off > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: offset out of bounds", errBadGoFunctionTable)
+		}
+		return data[off:], nil
+	}
+
+	nfunctab, err := word(0)
+	if err != nil {
+		return nil, err
+	}
+	t.nfunctab = int(nfunctab)
+
+	switch t.version {
+	case pclntabMagic118, pclntabMagic120:
+		start, err := word(2)
+		if err != nil {
+			return nil, err
+		}
+		if start != 0 {
+			textStart = start
+		}
+		t.textStart = textStart
+		if t.funcnametab, err = part(3); err != nil {
+			return nil, err
+		}
+		if t.pctab, err = part(6); err != nil {
+			return nil, err
+		}
+		if t.funcdata, err = part(7); err != nil {
+			return nil, err
+		}
+		t.functab = t.funcdata
+	case pclntabMagic116:
+		if t.funcnametab, err = part(2); err != nil {
+			return nil, err
+		}
+		if t.pctab, err = part(5); err != nil {
+			return nil, err
+		}
+		if t.funcdata, err = part(6); err != nil {
+			return nil, err
+		}
+		t.functab = t.funcdata
+	case pclntabMagic12:
+		t.funcnametab = data
+		t.pctab = data
+		t.funcdata = data
+		t.functab = data[8+t.ptrSize:]
+	default:
+		return nil, fmt.Errorf("%w: %#x", errUnsupportedGoFunctionTable, t.version)
+	}
+
+	functabSize := (2*t.nfunctab + 1) * t.functabFieldSize()
+	if t.nfunctab < 0 || functabSize > len(t.functab) {
+		return nil, fmt.Errorf("%w: function table out of bounds", errBadGoFunctionTable)
+	}
+	t.functab = t.functab[:functabSize]
+	return t, nil
+}
+
+func (t *pclntab) uintptr(b []byte) uint64 {
+	if t.ptrSize == 4 {
+		return uint64(t.order.Uint32(b))
+	}
+	return t.order.Uint64(b)
+}
+
+// textRelative returns whether the program counters of the table are offsets
+// from the start of the text, as since Go 1.18.
+func (t *pclntab) textRelative() bool {
+	return t.version == pclntabMagic118 || t.version == pclntabMagic120
+}
+
+// functabFieldSize returns the size of the fields of the function table.
+func (t *pclntab) functabFieldSize() int {
+	if t.textRelative() {
+		return 4
+	}
+	return t.ptrSize
+}
+
+// functab returns the nth field of the function table.
+func (t *pclntab) functabField(n int) uint64 {
+	size := t.functabFieldSize()
+	if size == 4 {
+		return uint64(t.order.Uint32(t.functab[n*size:]))
+	}
+	return t.uintptr(t.functab[n*size:])
+}
+
+// pc returns the program counter of the nth field of the function table.
+func (t *pclntab) pc(n int) uint64 {
+	pc := t.functabField(n)
+	if t.textRelative() {
+		pc += t.textStart
+	}
+	return pc
+}
+
+// functions returns the functions of the table with their stack pointer deltas.
+func (t *pclntab) functions() ([]goFunction, error) {
+	functions := make([]goFunction, 0, t.nfunctab)
+	for i := 0; i < t.nfunctab; i++ {
+		entry, end := t.pc(2*i), t.pc(2*i+2)
+		funcOff := t.functabField(2*i + 1)
+		if funcOff >= uint64(len(t.funcdata)) || end < entry {
+			return nil, fmt.Errorf("%w: function %d out of bounds", errBadGoFunctionTable, i)
+		}
+		fn := t.funcdata[funcOff:]
+
+		// The _func struct starts with the entry, followed by 4 byte
+		// fields: nameOff, args, deferreturn and pcsp.
+		entrySize := t.ptrSize
+		if t.textRelative() {
+			entrySize = 4
+		}
+		if len(fn) < entrySize+4*4 {
+			return nil, fmt.Errorf("%w: function %d out of bounds", errBadGoFunctionTable, i)
+		}
+		nameOff := t.order.Uint32(fn[entrySize:])
+		pcsp := t.order.Uint32(fn[entrySize+3*4:])
+
+		spDeltas, err := t.pcvalues(pcsp, entry, end)
+		if err != nil {
+			return nil, fmt.Errorf("function %d: %w", i, err)
+		}
+		functions = append(functions, goFunction{
+			name:     t.name(nameOff),
+			entry:    entry,
+			end:      end,
+			spDeltas: spDeltas,
+		})
+	}
+	return functions, nil
+}
+
+// name returns the function name at the given offset of the function name table.
+func (t *pclntab) name(off uint32) string {
+	if uint64(off) >= uint64(len(t.funcnametab)) {
+		return ""
+	}
+	name := t.funcnametab[off:]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	return string(name)
+}
+
+// pcvalues decodes the pc-value table at the given offset, with the value of
+// each range of program counters of the function.
+func (t *pclntab) pcvalues(off uint32, entry, end uint64) ([]goSPDelta, error) {
+	if off == 0 {
+		return nil, nil
+	}
+	if uint64(off) >= uint64(len(t.pctab)) {
+		return nil, fmt.Errorf("%w: pc-value table out of bounds", errBadGoFunctionTable)
+	}
+
+	p := t.pctab[off:]
+	var values []goSPDelta
+	pc, val := entry, int32(-1)
+	for first := true; ; first = false {
+		uvdelta, n := binary.Uvarint(p)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: bad pc-value table", errBadGoFunctionTable)
+		}
+		p = p[n:]
+		if uvdelta == 0 && !first {
+			return values, nil
+		}
+		pcdelta, n := binary.Uvarint(p)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: bad pc-value table", errBadGoFunctionTable)
+		}
+		p = p[n:]
+
+		// Values are zig-zag encoded deltas.
+		if uvdelta&1 != 0 {
+			uvdelta = ^(uvdelta >> 1)
+		} else {
+			uvdelta >>= 1
+		}
+		val += int32(uvdelta)
+		if pc < end {
+			values = append(values, goSPDelta{pc: pc, delta: val})
+		}
+		pc += pcdelta * t.quantum
+	}
+}
+
+// goFramePointers returns whether the Go code of the executable saves frame
+// pointers. Go enabled them on x86_64 in 1.7, they can be disabled with
+// -gcflags=-d=framepointer=0.
+func goFramePointers(path string) bool {
+	info, err := buildinfo.ReadFile(path)
+	if err != nil {
+		return true
+	}
+	return !strings.Contains(buildSetting(info, "-gcflags"), "framepointer=0")
+}
+
+func buildSetting(info *buildinfo.BuildInfo, key string) string {
+	for _, s := range info.Settings {
+		if s.Key == key {
+			return s.Value
+		}
+	}
+	return ""
+}
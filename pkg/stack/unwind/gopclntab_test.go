@@ -0,0 +1,169 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"encoding/binary"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testPclntab returns a Go 1.20 function table with a function per name,
+// each with the given pcsp table, laid out one after the other from textStart.
+func testPclntab(names []string, pcsps [][]byte, sizes []uint32) []byte {
+	const headerSize = 8 + 8*8
+
+	var funcnametab, pctab, funcdata []byte
+	pctab = append(pctab, 0) // Offset 0 means no table.
+
+	// Function table, followed by the _func structs.
+	functabSize := (2*len(names) + 1) * 4
+	functab := make([]byte, 0, functabSize)
+	var funcs []byte
+	var entry uint32
+	for i, name := range names {
+		nameOff := uint32(len(funcnametab))
+		funcnametab = append(append(funcnametab, name...), 0)
+		pcspOff := uint32(len(pctab))
+		pctab = append(pctab, pcsps[i]...)
+
+		functab = binary.LittleEndian.AppendUint32(functab, entry)
+		functab = binary.LittleEndian.AppendUint32(functab, uint32(functabSize+len(funcs)))
+
+		funcs = binary.LittleEndian.AppendUint32(funcs, entry)   // entryOff.
+		funcs = binary.LittleEndian.AppendUint32(funcs, nameOff) // nameOff.
+		funcs = binary.LittleEndian.AppendUint32(funcs, 0)       // args.
+		funcs = binary.LittleEndian.AppendUint32(funcs, 0)       // deferreturn.
+		funcs = binary.LittleEndian.AppendUint32(funcs, pcspOff) // pcsp.
+		entry += sizes[i]
+	}
+	functab = binary.LittleEndian.AppendUint32(functab, entry)
+	funcdata = append(functab, funcs...)
+
+	funcnameOff := uint64(headerSize)
+	pctabOff := funcnameOff + uint64(len(funcnametab))
+	funcdataOff := pctabOff + uint64(len(pctab))
+
+	data := binary.LittleEndian.AppendUint32(nil, pclntabMagic120)
+	data = append(data, 0, 0, 1, 8)
+	for _, word := range []uint64{uint64(len(names)), 0, 0, funcnameOff, 0, 0, pctabOff, funcdataOff} {
+		data = binary.LittleEndian.AppendUint64(data, word)
+	}
+	data = append(data, funcnametab...)
+	data = append(data, pctab...)
+	return append(data, funcdata...)
+}
+
+func TestParsePclntab(t *testing.T) {
+	// The stack pointer is 0 bytes away from its value at the entry until 0x4,
+	// then 8 until 0x1c, then 0 until the end at 0x20. The values are zig-zag
+	// encoded deltas from -1, each followed by the size of its range.
+	pcsp := []byte{2, 0x4, 16, 0x18, 15, 0x4, 0}
+
+	data := testPclntab([]string{"main.f", "runtime.goexit"}, [][]byte{pcsp, pcsp}, []uint32{0x20, 0x20})
+	tab, err := parsePclntab(data, binary.LittleEndian, 0x1000)
+	require.NoError(t, err)
+
+	functions, err := tab.functions()
+	require.NoError(t, err)
+	require.Equal(t, []goFunction{
+		{name: "main.f", entry: 0x1000, end: 0x1020, spDeltas: []goSPDelta{{0x1000, 0}, {0x1004, 8}, {0x101c, 0}}},
+		{name: "runtime.goexit", entry: 0x1020, end: 0x1040, spDeltas: []goSPDelta{{0x1020, 0}, {0x1024, 8}, {0x103c, 0}}},
+	}, functions)
+
+	require.Equal(t, CompactUnwindTable{
+		{pc: 0x1000, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x1004, cfaType: uint8(cfaTypeRsp), cfaOffset: 16, rbpType: uint8(rbpRuleOffset), rbpOffset: -16},
+		{pc: 0x101c, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x1020, cfaType: uint8(cfaTypeEndFdeMarker)},
+	}, goFunctionRows(functions[0], true))
+
+	require.Equal(t, CompactUnwindTable{
+		{pc: 0x1000, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x1004, cfaType: uint8(cfaTypeRsp), cfaOffset: 16},
+		{pc: 0x101c, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x1020, cfaType: uint8(cfaTypeEndFdeMarker)},
+	}, goFunctionRows(functions[0], false))
+
+	// There is nothing to unwind to past the functions goroutines start with.
+	require.Equal(t, CompactUnwindTable{
+		{pc: 0x1020, cfaType: uint8(cfaTypeRsp), rbpType: uint8(rbpTypeUndefinedReturnAddress), cfaOffset: 8},
+		{pc: 0x1040, cfaType: uint8(cfaTypeEndFdeMarker)},
+	}, goFunctionRows(functions[1], true))
+
+	_, err = parsePclntab(data[:20], binary.LittleEndian, 0x1000)
+	require.ErrorIs(t, err, errBadGoFunctionTable)
+
+	data[0] = 0
+	_, err = parsePclntab(data, binary.LittleEndian, 0x1000)
+	require.ErrorIs(t, err, errUnsupportedGoFunctionTable)
+}
+
+//go:noinline
+func functionWithFrame(n int) int {
+	var buf [64]int
+	for i := range buf {
+		buf[i] = n + i
+	}
+	return buf[n%len(buf)]
+}
+
+func TestBuildGoCompactUnwindTable(t *testing.T) {
+	require.Equal(t, 1, functionWithFrame(1)-1)
+
+	executable, err := os.Executable()
+	require.NoError(t, err)
+
+	table, err := BuildGoCompactUnwindTable(executable, nil)
+	require.NoError(t, err)
+	require.True(t, len(table) > 0)
+	require.True(t, table[len(table)-1].IsEndOfFDEMarker())
+
+	// The test binary is not position independent, as the agent's own,
+	// its addresses are the ones of the table.
+	entry := uint64(reflect.ValueOf(functionWithFrame).Pointer())
+	end := entry
+	for runtime.FuncForPC(uintptr(end)) == runtime.FuncForPC(uintptr(entry)) {
+		end++
+	}
+
+	var rows CompactUnwindTable
+	for _, row := range table {
+		// The end of a function is the entry of the next one.
+		if row.IsEndOfFDEMarker() && row.pc == end || !row.IsEndOfFDEMarker() && row.pc >= entry && row.pc < end {
+			rows = append(rows, row)
+		}
+	}
+	require.True(t, len(rows) >= 3)
+	require.Equal(t, CompactUnwindTableRow{pc: entry, cfaType: uint8(cfaTypeRsp), cfaOffset: 8}, rows[0])
+	require.Equal(t, CompactUnwindTableRow{pc: end, cfaType: uint8(cfaTypeEndFdeMarker)}, rows[len(rows)-1])
+
+	// The frame pointer is saved once the frame is set up.
+	var frameSize int16
+	for _, row := range rows[1 : len(rows)-1] {
+		require.Equal(t, uint8(cfaTypeRsp), row.cfaType)
+		if row.cfaOffset > 8 {
+			require.Equal(t, uint8(rbpRuleOffset), row.rbpType)
+			require.Equal(t, int16(-16), row.rbpOffset)
+		}
+		if row.cfaOffset > frameSize {
+			frameSize = row.cfaOffset
+		}
+	}
+	require.Greater(t, frameSize, int16(64*8))
+}
@@ -0,0 +1,186 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
+	"github.com/parca-dev/parca-agent/pkg/jit"
+)
+
+var errBadJITUnwindingInfo = errors.New("malformed JIT unwinding information")
+
+// jitFunction is a function of JIT code, at its current address.
+type jitFunction struct {
+	start, end uint64
+	// Address the code was loaded at, its unwind information refers to it.
+	loadAddr      uint64
+	timestamp     uint64
+	unwindingInfo *jit.JRCodeUnwindingInfo
+}
+
+// BuildJITCompactUnwindTable produces the compact unwind table, sorted by program
+// counter, of the JIT code of a jitdump file with unwinding information, such as
+// the one V8, .NET or LuaJIT emit. The code is at its current address, after
+// being moved. If code was loaded at the address of code loaded before, the
+// older code is gone. The code whose unwinding information cannot be read
+// is left out of the table.
+func BuildJITCompactUnwindTable(dump *jit.JITDump, expressions *ExpressionTable) (CompactUnwindTable, error) {
+	functions := jitFunctions(dump)
+
+	var table CompactUnwindTable
+	var errs []error
+	for _, f := range functions {
+		if f.unwindingInfo == nil {
+			continue
+		}
+		rows, err := jitFunctionRows(f, expressions)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("code at %#x: %w", f.start, err))
+			continue
+		}
+		table = append(table, rows...)
+	}
+	if len(table) == 0 && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	sort.Sort(table)
+	return table, nil
+}
+
+// jitFunctions returns the functions of the JIT code that is still around,
+// sorted by address.
+func jitFunctions(dump *jit.JITDump) []jitFunction {
+	byIndex := make(map[uint64]*jitFunction, len(dump.CodeLoads))
+	for _, load := range dump.CodeLoads {
+		byIndex[load.CodeIndex] = &jitFunction{
+			start:         load.CodeAddr,
+			end:           load.CodeAddr + load.CodeSize,
+			loadAddr:      load.CodeAddr,
+			timestamp:     load.Prefix.Timestamp,
+			unwindingInfo: load.UnwindingInfo,
+		}
+	}
+	for _, move := range dump.CodeMoves {
+		f, ok := byIndex[move.CodeIndex]
+		// The code was loaded again after it was moved.
+		if !ok || move.Prefix.Timestamp < f.timestamp {
+			continue
+		}
+		f.start, f.end = move.NewCodeAddr, move.NewCodeAddr+move.CodeSize
+		f.timestamp = move.Prefix.Timestamp
+	}
+
+	all := make([]*jitFunction, 0, len(byIndex))
+	for _, f := range byIndex {
+		all = append(all, f)
+	}
+	// Newer code replaces the older code at the same addresses.
+	sort.Slice(all, func(i, j int) bool { return all[i].timestamp > all[j].timestamp })
+
+	var functions []jitFunction
+	for _, f := range all {
+		if f.start >= f.end {
+			continue
+		}
+		i := sort.Search(len(functions), func(i int) bool { return functions[i].end > f.start })
+		if i < len(functions) && functions[i].start < f.end {
+			continue
+		}
+		functions = append(functions, jitFunction{})
+		copy(functions[i+1:], functions[i:])
+		functions[i] = *f
+	}
+	return functions
+}
+
+// jitFunctionRows returns the rows of the compact unwind table of a function of
+// JIT code. Its unwinding information is an .eh_frame section, followed by the
+// .eh_frame_hdr, laid out after the code when it was loaded, at the next 8 byte
+// aligned offset, as perf does when it writes the code to an ELF file.
+func jitFunctionRows(f jitFunction, expressions *ExpressionTable) (rows CompactUnwindTable, err error) {
+	info := f.unwindingInfo
+	if info.EHFrameHDRSize > uint64(len(info.UnwindingData)) {
+		return nil, errBadJITUnwindingInfo
+	}
+	ehFrame, err := ehFrameEntries(info.UnwindingData[:uint64(len(info.UnwindingData))-info.EHFrameHDRSize])
+	if err != nil {
+		return nil, err
+	}
+
+	// The frame package can raise in case of malformed unwind data.
+	defer func() {
+		if r := recover(); r != nil {
+			rows, err = nil, fmt.Errorf("%w: %v", errBadJITUnwindingInfo, r)
+		}
+	}()
+
+	size := f.end - f.start
+	ehFrameAddr := f.loadAddr + (size+7)&^7
+	fdes, err := frame.Parse(ehFrame, binary.LittleEndian, 0, 8, ehFrameAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse .eh_frame: %w", err)
+	}
+
+	// Only the entries of the code of the record are relevant.
+	live := fdes[:0]
+	for _, fde := range fdes {
+		if fde.Begin() >= f.loadAddr && fde.End() <= f.loadAddr+size {
+			live = append(live, fde)
+		}
+	}
+	sort.Sort(live)
+
+	rows, err = BuildCompactUnwindTableWithExpressions(live, expressions)
+	if err != nil {
+		return nil, err
+	}
+
+	// The code may have moved since it was loaded.
+	for i := range rows {
+		rows[i].pc = rows[i].pc - f.loadAddr + f.start
+	}
+	return rows, nil
+}
+
+// ehFrameEntries returns the whole CIEs and FDEs at the start of the .eh_frame
+// section, up to its zero terminator, if any. The bytes after them are padding.
+func ehFrameEntries(ehFrame []byte) ([]byte, error) {
+	end := 0
+	for len(ehFrame)-end >= 4 {
+		length := uint64(binary.LittleEndian.Uint32(ehFrame[end:]))
+		if length == 0 {
+			break
+		}
+		header := 4
+		if length == 0xffffffff {
+			// 64-bit DWARF format.
+			if len(ehFrame)-end < 12 {
+				return nil, errBadJITUnwindingInfo
+			}
+			length = binary.LittleEndian.Uint64(ehFrame[end+4:])
+			header = 12
+		}
+		if length > uint64(len(ehFrame)-end-header) {
+			return nil, errBadJITUnwindingInfo
+		}
+		end += header + int(length)
+	}
+	return ehFrame[:end], nil
+}
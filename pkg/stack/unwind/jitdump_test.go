@@ -0,0 +1,240 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
+	"github.com/parca-dev/parca-agent/pkg/jit"
+)
+
+// jitdumpWriter writes a little endian jitdump file.
+type jitdumpWriter struct {
+	buf       []byte
+	timestamp uint64
+}
+
+func newJitdumpWriter() *jitdumpWriter {
+	w := &jitdumpWriter{}
+	w.buf = append(w.buf, 'D', 'T', 'i', 'J')
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, jit.JITHeaderVersion)
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, 40) // Header size.
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, 62) // EM_X86_64.
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, 0)  // Padding.
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, 1)  // PID.
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, 0)  // Timestamp.
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, 0)  // Flags.
+	return w
+}
+
+func (w *jitdumpWriter) record(id jit.JITRecordType, body []byte) {
+	w.timestamp++
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(id))
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(16+len(body)))
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, w.timestamp)
+	w.buf = append(w.buf, body...)
+}
+
+// unwindingInfo writes the unwinding information of the code loaded next, an
+// .eh_frame section followed by an .eh_frame_hdr of the given size.
+func (w *jitdumpWriter) unwindingInfo(ehFrame []byte, ehFrameHdrSize int) {
+	data := append(ehFrame, make([]byte, ehFrameHdrSize)...)
+	body := binary.LittleEndian.AppendUint64(nil, uint64(len(data)))
+	body = binary.LittleEndian.AppendUint64(body, uint64(ehFrameHdrSize))
+	body = binary.LittleEndian.AppendUint64(body, uint64(len(data)))
+	w.record(jit.JITCodeUnwindingInfo, append(body, data...))
+}
+
+func (w *jitdumpWriter) codeLoad(addr, size, index uint64) {
+	body := binary.LittleEndian.AppendUint32(nil, 1) // PID.
+	body = binary.LittleEndian.AppendUint32(body, 1) // TID.
+	body = binary.LittleEndian.AppendUint64(body, addr)
+	body = binary.LittleEndian.AppendUint64(body, addr)
+	body = binary.LittleEndian.AppendUint64(body, size)
+	body = binary.LittleEndian.AppendUint64(body, index)
+	body = append(body, "jitted\x00"...)
+	w.record(jit.JITCodeLoad, append(body, make([]byte, size)...))
+}
+
+func (w *jitdumpWriter) codeMove(oldAddr, newAddr, size, index uint64) {
+	body := binary.LittleEndian.AppendUint32(nil, 1) // PID.
+	body = binary.LittleEndian.AppendUint32(body, 1) // TID.
+	body = binary.LittleEndian.AppendUint64(body, newAddr)
+	body = binary.LittleEndian.AppendUint64(body, oldAddr)
+	body = binary.LittleEndian.AppendUint64(body, newAddr)
+	body = binary.LittleEndian.AppendUint64(body, size)
+	body = binary.LittleEndian.AppendUint64(body, index)
+	w.record(jit.JITCodeMove, body)
+}
+
+func (w *jitdumpWriter) load(t *testing.T) *jit.JITDump {
+	t.Helper()
+	dump := &jit.JITDump{}
+	require.NoError(t, jit.LoadJITDump(log.NewNopLogger(), bytes.NewReader(w.buf), dump))
+	return dump
+}
+
+// framePointerInstructions set up a frame pointer after pushing the one of the caller.
+var framePointerInstructions = []byte{
+	frame.DW_CFA_def_cfa, 7, 8,
+	frame.DW_CFA_advance_loc | 1,
+	frame.DW_CFA_def_cfa_offset, 16,
+	frame.DW_CFA_offset | 6, 2, // rbp saved at CFA - 16.
+	frame.DW_CFA_advance_loc | 3,
+	frame.DW_CFA_def_cfa_register, 6,
+}
+
+func TestBuildJITCompactUnwindTable(t *testing.T) {
+	w := newJitdumpWriter()
+	// Code without a frame pointer, moved after being loaded.
+	w.unwindingInfo(ehFrame("zR", ehFrameFDE{begin: 0x9000, size: 0x40, instructions: []byte{frame.DW_CFA_def_cfa, 7, 8}}), 20)
+	w.codeLoad(0x9000, 0x40, 1)
+	// Code with a frame pointer.
+	w.unwindingInfo(ehFrame("zR", ehFrameFDE{begin: 0x9100, size: 0x80, instructions: framePointerInstructions}), 20)
+	w.codeLoad(0x9100, 0x80, 2)
+	// Code without unwinding information.
+	w.codeLoad(0x9200, 0x10, 3)
+	w.codeMove(0x9000, 0x9800, 0x40, 1)
+	// Code loaded where the code that was moved was.
+	w.unwindingInfo(ehFrame("zR", ehFrameFDE{begin: 0x9000, size: 0x20, instructions: []byte{frame.DW_CFA_def_cfa, 7, 16}}), 20)
+	w.codeLoad(0x9000, 0x20, 4)
+
+	expressions := NewExpressionTable(16)
+	table, err := BuildJITCompactUnwindTable(w.load(t), expressions)
+	require.NoError(t, err)
+	require.Equal(t, CompactUnwindTable{
+		{pc: 0x9000, cfaType: uint8(cfaTypeRsp), cfaOffset: 16},
+		{pc: 0x9020, cfaType: uint8(cfaTypeEndFdeMarker)},
+		{pc: 0x9100, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x9101, cfaType: uint8(cfaTypeRsp), cfaOffset: 16, rbpType: uint8(rbpRuleOffset), rbpOffset: -16},
+		{pc: 0x9104, cfaType: uint8(cfaTypeRbp), cfaOffset: 16, rbpType: uint8(rbpRuleOffset), rbpOffset: -16},
+		{pc: 0x9180, cfaType: uint8(cfaTypeEndFdeMarker)},
+		{pc: 0x9800, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x9840, cfaType: uint8(cfaTypeEndFdeMarker)},
+	}, table)
+
+	// Newer code replaces the code at the same addresses.
+	w.unwindingInfo(ehFrame("zR", ehFrameFDE{begin: 0x9100, size: 0x10, instructions: []byte{frame.DW_CFA_def_cfa, 7, 24}}), 20)
+	w.codeLoad(0x9100, 0x10, 5)
+	table, err = BuildJITCompactUnwindTable(w.load(t), expressions)
+	require.NoError(t, err)
+	require.Equal(t, CompactUnwindTable{
+		{pc: 0x9000, cfaType: uint8(cfaTypeRsp), cfaOffset: 16},
+		{pc: 0x9020, cfaType: uint8(cfaTypeEndFdeMarker)},
+		{pc: 0x9100, cfaType: uint8(cfaTypeRsp), cfaOffset: 24},
+		{pc: 0x9110, cfaType: uint8(cfaTypeEndFdeMarker)},
+		{pc: 0x9800, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x9840, cfaType: uint8(cfaTypeEndFdeMarker)},
+	}, table)
+}
+
+func TestBuildJITCompactUnwindTableMalformed(t *testing.T) {
+	w := newJitdumpWriter()
+	w.unwindingInfo([]byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4}, 0)
+	w.codeLoad(0x9000, 0x40, 1)
+
+	_, err := BuildJITCompactUnwindTable(w.load(t), NewExpressionTable(16))
+	require.ErrorIs(t, err, errBadJITUnwindingInfo)
+}
+
+// pcrelEHFrame returns an .eh_frame section at the given address with a
+// single CIE with pc-relative 4 byte pointers, followed by an FDE, as the
+// ones runtimes emit for their JIT code.
+func pcrelEHFrame(addr uint64, fde ehFrameFDE) []byte {
+	cie := ehFrame("zR", fde)
+	// Pointer encoding, pcrel | sdata4.
+	cie[16] = 0x1b
+
+	// The FDE is the second entry, the initial location follows its length
+	// and CIE pointer.
+	pcBeginOffset := 4 + binary.LittleEndian.Uint32(cie) + 8
+	binary.LittleEndian.PutUint32(cie[pcBeginOffset:], uint32(fde.begin-(addr+uint64(pcBeginOffset))))
+	return cie
+}
+
+func TestBuildJITCompactUnwindTableUnalignedCode(t *testing.T) {
+	const (
+		codeAddr = 0x9000
+		codeSize = 0x43
+	)
+	// The .eh_frame is at the next 8 byte aligned offset after the code,
+	// followed by the zero terminator and padding.
+	ehFrameData := pcrelEHFrame(codeAddr+0x48, ehFrameFDE{begin: codeAddr, size: codeSize, instructions: []byte{frame.DW_CFA_def_cfa, 7, 8}})
+	ehFrameData = append(ehFrameData, 0, 0, 0, 0, 0xaa, 0xaa)
+
+	w := newJitdumpWriter()
+	w.unwindingInfo(ehFrameData, 20)
+	w.codeLoad(codeAddr, codeSize, 1)
+
+	table, err := BuildJITCompactUnwindTable(w.load(t), NewExpressionTable(16))
+	require.NoError(t, err)
+	require.Equal(t, CompactUnwindTable{
+		{pc: 0x9000, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x9043, cfaType: uint8(cfaTypeEndFdeMarker)},
+	}, table)
+}
+
+func TestUnwindJitWithUnwindingInfo(t *testing.T) {
+	w := newJitdumpWriter()
+	w.unwindingInfo(ehFrame("zR", ehFrameFDE{begin: 0x9000, size: 0x100, instructions: framePointerInstructions}), 20)
+	w.codeLoad(0x9000, 0x100, 1)
+	// Code without unwinding information.
+	w.codeLoad(0x9100, 0x100, 2)
+
+	expressions := NewExpressionTable(16)
+	jitTable, err := BuildJITCompactUnwindTable(w.load(t), expressions)
+	require.NoError(t, err)
+
+	table := CompactUnwindTable{
+		{pc: 0x1000, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x1100, cfaType: uint8(cfaTypeEndFdeMarker)},
+	}
+	tables := &UnwindTables{
+		Chunks: map[uint64][]UnwindTableChunk{
+			1: {{LowPC: 0x1000, HighPC: 0x1100, HighIndex: uint64(len(table))}},
+			2: {{LowPC: 0x9000, HighPC: 0x9100, ShardIndex: 1, HighIndex: uint64(len(jitTable))}},
+		},
+		Shards: map[uint64]CompactUnwindTable{0: table, 1: jitTable},
+	}
+	process := ProcessInfo{
+		IsJitCompiler: true,
+		Mappings: []Mapping{
+			{Begin: 0x1000, End: 0x2000, ExecutableID: 1},
+			{Begin: 0x9000, End: 0xa000, ExecutableID: 2, Type: MappingTypeJitted},
+		},
+	}
+
+	// JIT code at 0x9010 was called from native code at 0x1050, whose caller
+	// has no unwind information.
+	memory := map[uint64]uint64{
+		0x7f00: 0, // Saved frame pointer of the frame at 0x9010.
+		0x7f08: 0x1050,
+		0x7f10: 0x800,
+	}
+
+	// The JIT code with unwinding information does not need mixed mode unwinding.
+	frames, err := NewProcessUnwinder(process, tables, false).Unwind(Registers{IP: 0x9010, SP: 0x7ef0, BP: 0x7f00}, stackMemory(memory))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0x9010, 0x1050}, frames)
+
+	// The rest of the JIT code does.
+	_, err = NewProcessUnwinder(process, tables, false).Unwind(Registers{IP: 0x9110, SP: 0x7ef0, BP: 0x7f00}, stackMemory(memory))
+	require.ErrorIs(t, err, errJitMixedModeDisabled)
+}
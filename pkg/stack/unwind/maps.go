@@ -130,8 +130,8 @@ func ListExecutableMappings(rawMappings []*procfs.ProcMap) ExecutableMappings {
 		if rawMapping.Perms.Execute {
 			var loadAddr uint64
 			// We need the load base address for stack unwinding with DWARF
-			// information. We don't know of any runtimes that emit said unwind
-			// information for JITed code, so we set it to zero.
+			// information. The unwind information of JITed code, from jitdump
+			// files, has absolute addresses, so we set it to zero.
 			if rawMappings[idx].Pathname != "" {
 				for revIdx := idx; revIdx >= 0; revIdx-- {
 					if rawMappings[revIdx].Pathname != rawMappings[idx].Pathname {
@@ -150,9 +150,8 @@ func ListExecutableMappings(rawMappings []*procfs.ProcMap) ExecutableMappings {
 			}
 
 			// Exclude jitdump from the results because we don't need these mappings.
-			// If in the future we add support for unwinding via the information present
-			// in these files, we can link this information to the corresponding code
-			// sections generated by the JIT.
+			// The unwind information present in these files is linked to the
+			// code sections generated by the JIT, see ListJitDumps.
 			if mapping.IsJitDump() {
 				continue
 			}
@@ -164,3 +163,22 @@ func ListExecutableMappings(rawMappings []*procfs.ProcMap) ExecutableMappings {
 
 	return result
 }
+
+// ListJitDumps returns the paths of the jitdump files mapped in the process, as
+// JIT compilers do for profilers to find them.
+func ListJitDumps(rawMappings []*procfs.ProcMap) []string {
+	var paths []string
+	seen := map[string]struct{}{}
+	for _, rawMapping := range rawMappings {
+		mapping := ExecutableMapping{Executable: rawMapping.Pathname}
+		if !mapping.IsJitDump() {
+			continue
+		}
+		if _, ok := seen[rawMapping.Pathname]; ok {
+			continue
+		}
+		seen[rawMapping.Pathname] = struct{}{}
+		paths = append(paths, rawMapping.Pathname)
+	}
+	return paths
+}
@@ -0,0 +1,165 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"sort"
+)
+
+// Sizes of the unwind table shards and chunks of the BPF program.
+const (
+	MaxUnwindTableSize   = 250 * 1000 // Always needs to be sync with MAX_UNWIND_TABLE_SIZE in the BPF program.
+	MaxUnwindTableChunks = 30         // Always need to be in sync with MAX_UNWIND_TABLE_CHUNKS.
+)
+
+// RowRange is a range of rows of an unwind table shard, [Low, High).
+type RowRange struct {
+	Low  uint64
+	High uint64
+}
+
+// UnwindTableChunk is the part of the unwind table of an executable for the
+// program counters [LowPC, HighPC], stored in the rows [LowIndex, HighIndex)
+// of a shard, as chunk_info_t in the BPF program.
+type UnwindTableChunk struct {
+	LowPC      uint64
+	HighPC     uint64
+	ShardIndex uint64
+	LowIndex   uint64
+	HighIndex  uint64
+}
+
+// Rows returns the number of rows of the chunk.
+func (c UnwindTableChunk) Rows() uint64 {
+	return c.HighIndex - c.LowIndex
+}
+
+// ShardAllocator keeps track of the free rows of the unwind table shards, and
+// decides where the agent loads unwind tables in them.
+//
+// It is not safe for concurrent use.
+type ShardAllocator struct {
+	shardSize uint64
+	// Free rows of every shard, sorted by index.
+	free [][]RowRange
+}
+
+// NewShardAllocator returns an allocator for the given number of empty shards
+// of shardSize rows.
+func NewShardAllocator(shards, shardSize uint64) *ShardAllocator {
+	free := make([][]RowRange, shards)
+	for i := range free {
+		free[i] = []RowRange{{Low: 0, High: shardSize}}
+	}
+	return &ShardAllocator{shardSize: shardSize, free: free}
+}
+
+// Capacity returns the number of rows of all the shards.
+func (a *ShardAllocator) Capacity() uint64 {
+	return uint64(len(a.free)) * a.shardSize
+}
+
+// Allocate finds room for the table in the free rows of the shards, largest
+// free ranges first, and returns the chunks the table is split in, in order.
+// Tables are split in at most MaxUnwindTableChunks chunks and never within a
+// function. It returns false if the table does not fit.
+func (a *ShardAllocator) Allocate(table CompactUnwindTable) ([]UnwindTableChunk, bool) {
+	type freeRange struct {
+		shard uint64
+		index int
+		rows  RowRange
+	}
+	var ranges []freeRange
+	for shard, free := range a.free {
+		for i, r := range free {
+			ranges = append(ranges, freeRange{shard: uint64(shard), index: i, rows: r})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].rows.High-ranges[i].rows.Low > ranges[j].rows.High-ranges[j].rows.Low
+	})
+
+	var chunks []UnwindTableChunk
+	used := map[uint64]map[int]uint64{} // Rows used per shard and free range.
+	rest := table
+	for _, r := range ranges {
+		if len(rest) == 0 {
+			break
+		}
+		if len(chunks) == MaxUnwindTableChunks {
+			return nil, false
+		}
+
+		n := uint64(len(rest))
+		if free := r.rows.High - r.rows.Low; free < n {
+			n = free
+		}
+		// Split after the last function that fits.
+		for n > 0 && !rest[n-1].IsEndOfFDEMarker() {
+			n--
+		}
+		if n == 0 {
+			continue
+		}
+
+		chunks = append(chunks, UnwindTableChunk{
+			LowPC:      rest[0].Pc(),
+			HighPC:     rest[n-1].Pc(),
+			ShardIndex: r.shard,
+			LowIndex:   r.rows.Low,
+			HighIndex:  r.rows.Low + n,
+		})
+		if used[r.shard] == nil {
+			used[r.shard] = map[int]uint64{}
+		}
+		used[r.shard][r.index] = n
+		rest = rest[n:]
+	}
+	if len(rest) > 0 {
+		return nil, false
+	}
+
+	for shard, ranges := range used {
+		free := a.free[shard][:0]
+		for i, r := range a.free[shard] {
+			r.Low += ranges[i]
+			if r.Low < r.High {
+				free = append(free, r)
+			}
+		}
+		a.free[shard] = free
+	}
+	return chunks, true
+}
+
+// Release adds the rows of the chunk back to the free rows of its shard.
+func (a *ShardAllocator) Release(chunk UnwindTableChunk) {
+	rows := RowRange{Low: chunk.LowIndex, High: chunk.HighIndex}
+	free := a.free[chunk.ShardIndex]
+	i := sort.Search(len(free), func(i int) bool { return free[i].Low >= rows.High })
+	free = append(free, RowRange{})
+	copy(free[i+1:], free[i:])
+	free[i] = rows
+
+	// Merge with the adjacent ranges.
+	if i+1 < len(free) && free[i].High == free[i+1].Low {
+		free[i].High = free[i+1].High
+		free = append(free[:i+1], free[i+2:]...)
+	}
+	if i > 0 && free[i-1].High == free[i].Low {
+		free[i-1].High = free[i].High
+		free = append(free[:i], free[i+1:]...)
+	}
+	a.free[chunk.ShardIndex] = free
+}
@@ -0,0 +1,34 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardAllocatorRelease(t *testing.T) {
+	a := NewShardAllocator(1, 10)
+	a.free[0] = []RowRange{{Low: 0, High: 2}, {Low: 8, High: 10}}
+
+	a.Release(UnwindTableChunk{LowIndex: 4, HighIndex: 6})
+	require.Equal(t, []RowRange{{Low: 0, High: 2}, {Low: 4, High: 6}, {Low: 8, High: 10}}, a.free[0])
+
+	a.Release(UnwindTableChunk{LowIndex: 2, HighIndex: 4})
+	require.Equal(t, []RowRange{{Low: 0, High: 6}, {Low: 8, High: 10}}, a.free[0])
+
+	a.Release(UnwindTableChunk{LowIndex: 6, HighIndex: 8})
+	require.Equal(t, []RowRange{{Low: 0, High: 10}}, a.free[0])
+}
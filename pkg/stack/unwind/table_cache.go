@@ -0,0 +1,475 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// tableCacheFormatVersion needs to be bumped whenever the format of the
+	// entries or the unwind tables generated for an executable change, the
+	// entries of other versions are discarded.
+	tableCacheFormatVersion = 2
+
+	tableCacheExtension = ".table"
+	// magic, version, checksum and payload length.
+	tableCacheHeaderSize = 4 + 4 + 4 + 8
+	// pc, reserved, cfa type, rbp type, cfa offset and rbp offset.
+	tableCacheRowSize = 8 + 2 + 1 + 1 + 2 + 2
+	// opcode, register and operand.
+	tableCacheOpSize = 1 + 1 + 8
+)
+
+var (
+	tableCacheMagic = [4]byte{'P', 'A', 'U', 'T'}
+	crc32Table      = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorruptTableCacheEntry = errors.New("corrupt unwind table cache entry")
+)
+
+const (
+	lvHit     = "hit"
+	lvMiss    = "miss"
+	lvCorrupt = "corrupt"
+)
+
+type tableCacheMetrics struct {
+	requests     *prometheus.CounterVec
+	evictions    prometheus.Counter
+	size         prometheus.Gauge
+	readBytes    prometheus.Counter
+	writtenBytes prometheus.Counter
+}
+
+func newTableCacheMetrics(reg prometheus.Registerer) *tableCacheMetrics {
+	m := &tableCacheMetrics{
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "parca_agent_unwind_table_cache_requests_total",
+			Help: "Total number of unwind table cache requests.",
+		}, []string{"result"}),
+		evictions: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "parca_agent_unwind_table_cache_evictions_total",
+			Help: "Total number of unwind tables evicted from the cache.",
+		}),
+		size: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "parca_agent_unwind_table_cache_size_bytes",
+			Help: "Size of the unwind tables in the cache.",
+		}),
+		readBytes: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "parca_agent_unwind_table_cache_read_bytes_total",
+			Help: "Total number of bytes read from the unwind table cache.",
+		}),
+		writtenBytes: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "parca_agent_unwind_table_cache_written_bytes_total",
+			Help: "Total number of bytes written to the unwind table cache.",
+		}),
+	}
+	m.requests.WithLabelValues(lvHit)
+	m.requests.WithLabelValues(lvMiss)
+	m.requests.WithLabelValues(lvCorrupt)
+	return m
+}
+
+type tableCacheEntry struct {
+	size     int64
+	lastUsed time.Time
+}
+
+// TableCache caches compact unwind tables on disk, keyed by the build ID of
+// their executable, so they don't have to be generated again after restarts.
+// Once the entries exceed the maximum size, the least recently used ones are
+// evicted. It's safe for concurrent use, and a nil cache caches nothing.
+type TableCache struct {
+	logger  log.Logger
+	metrics *tableCacheMetrics
+
+	dir     string
+	maxSize int64
+
+	mtx     sync.Mutex
+	size    int64
+	entries map[string]tableCacheEntry // Keyed by file name.
+}
+
+// NewTableCache returns a cache that stores up to maxSize bytes of unwind
+// tables in dir, which is created if it doesn't exist. The entries stored
+// by previous runs are kept.
+func NewTableCache(logger log.Logger, reg prometheus.Registerer, dir string, maxSize int64) (*TableCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create unwind table cache directory: %w", err)
+	}
+
+	c := &TableCache{
+		logger:  logger,
+		metrics: newTableCacheMetrics(reg),
+		dir:     dir,
+		maxSize: maxSize,
+		entries: map[string]tableCacheEntry{},
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read unwind table cache directory: %w", err)
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if !strings.HasSuffix(file.Name(), tableCacheExtension) {
+			// Leftovers of interrupted writes.
+			if err := os.Remove(filepath.Join(dir, file.Name())); err != nil {
+				level.Debug(logger).Log("msg", "failed to remove unwind table cache file", "file", file.Name(), "err", err)
+			}
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		c.entries[file.Name()] = tableCacheEntry{size: info.Size(), lastUsed: info.ModTime()}
+		c.size += info.Size()
+	}
+	c.evict()
+	c.metrics.size.Set(float64(c.size))
+
+	return c, nil
+}
+
+// fileName returns the name of the file of the entry for the given key.
+func (c *TableCache) fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + tableCacheExtension
+}
+
+// Get returns the unwind table cached for the given key. The expressions of the
+// table are added to expressions and its rows refer to their new identifiers.
+func (c *TableCache) Get(key string, expressions *ExpressionTable) (CompactUnwindTable, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	name := c.fileName(key)
+	entry, ok := c.entries[name]
+	if !ok {
+		c.metrics.requests.WithLabelValues(lvMiss).Inc()
+		return nil, false
+	}
+
+	path := filepath.Join(c.dir, name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		level.Debug(c.logger).Log("msg", "failed to read unwind table cache entry", "key", key, "err", err)
+		c.remove(name)
+		c.metrics.requests.WithLabelValues(lvMiss).Inc()
+		return nil, false
+	}
+	c.metrics.readBytes.Add(float64(len(data)))
+
+	table, err := decodeTableCacheEntry(data, expressions)
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "discarding unwind table cache entry", "key", key, "err", err)
+		c.remove(name)
+		c.metrics.requests.WithLabelValues(lvCorrupt).Inc()
+		return nil, false
+	}
+
+	now := time.Now()
+	entry.lastUsed = now
+	c.entries[name] = entry
+	if err := os.Chtimes(path, now, now); err != nil {
+		level.Debug(c.logger).Log("msg", "failed to update unwind table cache entry time", "key", key, "err", err)
+	}
+
+	c.metrics.requests.WithLabelValues(lvHit).Inc()
+	return table, true
+}
+
+// Put caches the unwind table for the given key along with the expressions
+// of expressions its rows refer to.
+func (c *TableCache) Put(key string, table CompactUnwindTable, expressions *ExpressionTable) error {
+	if c == nil {
+		return nil
+	}
+
+	data, err := encodeTableCacheEntry(table, expressions)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > c.maxSize {
+		return nil
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	// Write to a temporary file first so that entries are never partially written.
+	f, err := os.CreateTemp(c.dir, "*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create unwind table cache entry: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write unwind table cache entry: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write unwind table cache entry: %w", err)
+	}
+
+	name := c.fileName(key)
+	if err := os.Rename(f.Name(), filepath.Join(c.dir, name)); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write unwind table cache entry: %w", err)
+	}
+	c.metrics.writtenBytes.Add(float64(len(data)))
+
+	if previous, ok := c.entries[name]; ok {
+		c.size -= previous.size
+	}
+	c.entries[name] = tableCacheEntry{size: int64(len(data)), lastUsed: time.Now()}
+	c.size += int64(len(data))
+	c.evict()
+	c.metrics.size.Set(float64(c.size))
+
+	return nil
+}
+
+// remove removes the entry with the given file name. It must be called with the lock held.
+func (c *TableCache) remove(name string) {
+	if err := os.Remove(filepath.Join(c.dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		level.Debug(c.logger).Log("msg", "failed to remove unwind table cache entry", "file", name, "err", err)
+	}
+	c.size -= c.entries[name].size
+	delete(c.entries, name)
+	c.metrics.size.Set(float64(c.size))
+}
+
+// evict removes the least recently used entries until the cache fits in its
+// maximum size. It must be called with the lock held.
+func (c *TableCache) evict() {
+	if c.size <= c.maxSize {
+		return
+	}
+
+	names := make([]string, 0, len(c.entries))
+	for name := range c.entries {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return c.entries[names[i]].lastUsed.Before(c.entries[names[j]].lastUsed)
+	})
+
+	for _, name := range names {
+		if c.size <= c.maxSize {
+			break
+		}
+		c.remove(name)
+		c.metrics.evictions.Inc()
+	}
+}
+
+// encodeTableCacheEntry encodes an unwind table and the expressions its rows
+// refer to. The rows refer to the expressions by their index in the entry.
+//
+// An entry is made of a header with a magic number, the format version, the
+// CRC32 (Castagnoli) of the payload and its length, followed by the payload:
+// the number of expressions, each with its number of operations and the
+// operations, followed by the number of rows and the rows.
+func encodeTableCacheEntry(table CompactUnwindTable, expressions *ExpressionTable) ([]byte, error) {
+	// Identifiers in the entry of the expressions, by identifier in the expression table.
+	ids := map[DwarfExpressionID]DwarfExpressionID{}
+	var entryExpressions []Expression
+	entryID := func(id DwarfExpressionID) (DwarfExpressionID, error) {
+		if id < ExpressionCompiled {
+			return id, nil
+		}
+		if entryID, ok := ids[id]; ok {
+			return entryID, nil
+		}
+		index := int(id - ExpressionCompiled)
+		if expressions == nil || index >= len(expressions.Expressions()) {
+			return 0, fmt.Errorf("expression %d not found", id)
+		}
+		entryID := ExpressionCompiled + DwarfExpressionID(len(entryExpressions))
+		ids[id] = entryID
+		entryExpressions = append(entryExpressions, expressions.Expressions()[index])
+		return entryID, nil
+	}
+
+	rows := make([]byte, 0, len(table)*tableCacheRowSize)
+	for _, row := range table {
+		var err error
+		if row.cfaType == uint8(cfaTypeExpression) {
+			var id DwarfExpressionID
+			id, err = entryID(DwarfExpressionID(row.cfaOffset))
+			row.cfaOffset = int16(id)
+		}
+		if err == nil && row.rbpType == uint8(rbpTypeExpression) {
+			var id DwarfExpressionID
+			id, err = entryID(DwarfExpressionID(row.rbpOffset))
+			row.rbpOffset = int16(id)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		rows = binary.LittleEndian.AppendUint64(rows, row.pc)
+		rows = binary.LittleEndian.AppendUint16(rows, row._reservedDoNotUse)
+		rows = append(rows, row.cfaType, row.rbpType)
+		rows = binary.LittleEndian.AppendUint16(rows, uint16(row.cfaOffset))
+		rows = binary.LittleEndian.AppendUint16(rows, uint16(row.rbpOffset))
+	}
+
+	payload := binary.LittleEndian.AppendUint32(nil, uint32(len(entryExpressions)))
+	for _, expression := range entryExpressions {
+		payload = append(payload, uint8(len(expression)))
+		for _, op := range expression {
+			payload = append(payload, uint8(op.Opcode), op.Reg)
+			payload = binary.LittleEndian.AppendUint64(payload, uint64(op.Operand))
+		}
+	}
+	payload = binary.LittleEndian.AppendUint64(payload, uint64(len(table)))
+	payload = append(payload, rows...)
+
+	data := make([]byte, 0, tableCacheHeaderSize+len(payload))
+	data = append(data, tableCacheMagic[:]...)
+	data = binary.LittleEndian.AppendUint32(data, tableCacheFormatVersion)
+	data = binary.LittleEndian.AppendUint32(data, crc32.Checksum(payload, crc32Table))
+	data = binary.LittleEndian.AppendUint64(data, uint64(len(payload)))
+	return append(data, payload...), nil
+}
+
+// decodeTableCacheEntry decodes an entry encoded with encodeTableCacheEntry,
+// adding its expressions to expressions.
+func decodeTableCacheEntry(data []byte, expressions *ExpressionTable) (CompactUnwindTable, error) {
+	if len(data) < tableCacheHeaderSize {
+		return nil, fmt.Errorf("%w: truncated header", errCorruptTableCacheEntry)
+	}
+	if [4]byte(data[0:4]) != tableCacheMagic {
+		return nil, fmt.Errorf("%w: bad magic number", errCorruptTableCacheEntry)
+	}
+	if version := binary.LittleEndian.Uint32(data[4:8]); version != tableCacheFormatVersion {
+		return nil, fmt.Errorf("%w: version %d, expected %d", errCorruptTableCacheEntry, version, tableCacheFormatVersion)
+	}
+	checksum := binary.LittleEndian.Uint32(data[8:12])
+	payload := data[tableCacheHeaderSize:]
+	if length := binary.LittleEndian.Uint64(data[12:20]); length != uint64(len(payload)) {
+		return nil, fmt.Errorf("%w: payload of %d bytes, expected %d", errCorruptTableCacheEntry, len(payload), length)
+	}
+	if crc32.Checksum(payload, crc32Table) != checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", errCorruptTableCacheEntry)
+	}
+
+	// The checksum matches, so the payload was written by encodeTableCacheEntry,
+	// but the lengths are still checked in case of bugs.
+	errTruncated := fmt.Errorf("%w: truncated payload", errCorruptTableCacheEntry)
+	if len(payload) < 4 {
+		return nil, errTruncated
+	}
+	numExpressions := binary.LittleEndian.Uint32(payload)
+	payload = payload[4:]
+
+	// Identifiers in the expression table, by identifier in the entry.
+	ids := make([]DwarfExpressionID, 0, numExpressions)
+	for i := uint32(0); i < numExpressions; i++ {
+		if len(payload) < 1 {
+			return nil, errTruncated
+		}
+		numOps := int(payload[0])
+		payload = payload[1:]
+		if len(payload) < numOps*tableCacheOpSize {
+			return nil, errTruncated
+		}
+		expression := make(Expression, 0, numOps)
+		for j := 0; j < numOps; j++ {
+			expression = append(expression, ExpressionOp{
+				Opcode:  ExpressionOpcode(payload[0]),
+				Reg:     payload[1],
+				Operand: int64(binary.LittleEndian.Uint64(payload[2:10])),
+			})
+			payload = payload[tableCacheOpSize:]
+		}
+		ids = append(ids, expressions.Add(expression))
+	}
+	tableID := func(id DwarfExpressionID) (DwarfExpressionID, error) {
+		if id < ExpressionCompiled {
+			return id, nil
+		}
+		index := int(id - ExpressionCompiled)
+		if index >= len(ids) {
+			return 0, fmt.Errorf("%w: expression %d not found", errCorruptTableCacheEntry, id)
+		}
+		return ids[index], nil
+	}
+
+	if len(payload) < 8 {
+		return nil, errTruncated
+	}
+	numRows := binary.LittleEndian.Uint64(payload)
+	payload = payload[8:]
+	if uint64(len(payload)) != numRows*tableCacheRowSize {
+		return nil, errTruncated
+	}
+
+	table := make(CompactUnwindTable, 0, numRows)
+	for ; len(payload) > 0; payload = payload[tableCacheRowSize:] {
+		row := CompactUnwindTableRow{
+			pc:                binary.LittleEndian.Uint64(payload[0:8]),
+			_reservedDoNotUse: binary.LittleEndian.Uint16(payload[8:10]),
+			cfaType:           payload[10],
+			rbpType:           payload[11],
+			cfaOffset:         int16(binary.LittleEndian.Uint16(payload[12:14])),
+			rbpOffset:         int16(binary.LittleEndian.Uint16(payload[14:16])),
+		}
+		var err error
+		if row.cfaType == uint8(cfaTypeExpression) {
+			var id DwarfExpressionID
+			id, err = tableID(DwarfExpressionID(row.cfaOffset))
+			row.cfaOffset = int16(id)
+		}
+		if err == nil && row.rbpType == uint8(rbpTypeExpression) {
+			var id DwarfExpressionID
+			id, err = tableID(DwarfExpressionID(row.rbpOffset))
+			row.rbpOffset = int16(id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		table = append(table, row)
+	}
+
+	return table, nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
+)
+
+// testTableWithExpressions returns an unwind table with a CFA and a
+// frame pointer expression, compiled into expressions.
+func testTableWithExpressions(t *testing.T, expressions *ExpressionTable) CompactUnwindTable {
+	t.Helper()
+
+	cfa := expressions.ID([]byte{frame.DW_OP_breg7, 0xa0, 0x01, frame.DW_OP_deref})
+	rbp := expressions.RegisterRuleID([]byte{frame.DW_OP_plus_uconst, 16})
+	require.NotEqual(t, ExpressionUnknown, cfa)
+	require.NotEqual(t, ExpressionUnknown, rbp)
+
+	return CompactUnwindTable{
+		{pc: 0x1000, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x1001, cfaType: uint8(cfaTypeRbp), rbpType: uint8(rbpRuleOffset), cfaOffset: 16, rbpOffset: -16},
+		{pc: 0x1010, cfaType: uint8(cfaTypeExpression), cfaOffset: int16(ExpressionPlt1)},
+		{pc: 0x1020, cfaType: uint8(cfaTypeExpression), rbpType: uint8(rbpTypeExpression), cfaOffset: int16(cfa), rbpOffset: int16(rbp)},
+		{pc: 0x1030, cfaType: uint8(cfaTypeEndFdeMarker)},
+	}
+}
+
+func TestTableCacheRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewTableCache(log.NewNopLogger(), prometheus.NewRegistry(), dir, 1<<20)
+	require.NoError(t, err)
+
+	_, ok := c.Get("build-id", NewExpressionTable(16))
+	require.False(t, ok)
+
+	expressions := NewExpressionTable(16)
+	table := testTableWithExpressions(t, expressions)
+	require.NoError(t, c.Put("build-id", table, expressions))
+
+	// A new cache on the same directory, as after a restart, with an expression table
+	// where other expressions were added first.
+	reg := prometheus.NewRegistry()
+	c, err = NewTableCache(log.NewNopLogger(), reg, dir, 1<<20)
+	require.NoError(t, err)
+	newExpressions := NewExpressionTable(16)
+	other := newExpressions.ID([]byte{frame.DW_OP_breg6, 8})
+	require.Equal(t, ExpressionCompiled, other)
+
+	got, ok := c.Get("build-id", newExpressions)
+	require.True(t, ok)
+	require.Len(t, got, len(table))
+	require.Equal(t, table[:3], got[:3])
+	require.Equal(t, table[4], got[4])
+
+	// The expression rows refer to the expressions in the new table.
+	row := got[3]
+	require.Equal(t, uint8(cfaTypeExpression), row.cfaType)
+	require.Equal(t, uint8(rbpTypeExpression), row.rbpType)
+	require.Equal(t, expressions.Expressions()[table[3].cfaOffset-int16(ExpressionCompiled)], newExpressions.Expressions()[row.cfaOffset-int16(ExpressionCompiled)])
+	require.Equal(t, expressions.Expressions()[table[3].rbpOffset-int16(ExpressionCompiled)], newExpressions.Expressions()[row.rbpOffset-int16(ExpressionCompiled)])
+	require.Len(t, newExpressions.Expressions(), 3)
+
+	// Known expressions are not added again.
+	_, ok = c.Get("build-id", newExpressions)
+	require.True(t, ok)
+	require.Len(t, newExpressions.Expressions(), 3)
+	require.Equal(t, 2.0, testutil.ToFloat64(c.metrics.requests.WithLabelValues(lvHit)))
+}
+
+func TestTableCacheCorruption(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewTableCache(log.NewNopLogger(), prometheus.NewRegistry(), dir, 1<<20)
+	require.NoError(t, err)
+
+	expressions := NewExpressionTable(16)
+	require.NoError(t, c.Put("build-id", testTableWithExpressions(t, expressions), expressions))
+
+	path := filepath.Join(dir, c.fileName("build-id"))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	_, ok := c.Get("build-id", expressions)
+	require.False(t, ok)
+	require.Equal(t, 1.0, testutil.ToFloat64(c.metrics.requests.WithLabelValues(lvCorrupt)))
+	require.NoFileExists(t, path)
+	require.Equal(t, 0.0, testutil.ToFloat64(c.metrics.size))
+}
+
+func TestDecodeTableCacheEntry(t *testing.T) {
+	expressions := NewExpressionTable(16)
+	data, err := encodeTableCacheEntry(testTableWithExpressions(t, expressions), expressions)
+	require.NoError(t, err)
+
+	_, err = decodeTableCacheEntry(data, expressions)
+	require.NoError(t, err)
+
+	truncated := data[:len(data)-1]
+	_, err = decodeTableCacheEntry(truncated, expressions)
+	require.ErrorIs(t, err, errCorruptTableCacheEntry)
+
+	otherVersion := append([]byte{}, data...)
+	otherVersion[4]++
+	_, err = decodeTableCacheEntry(otherVersion, expressions)
+	require.ErrorIs(t, err, errCorruptTableCacheEntry)
+
+	_, err = decodeTableCacheEntry(data[:tableCacheHeaderSize-1], expressions)
+	require.ErrorIs(t, err, errCorruptTableCacheEntry)
+}
+
+func TestTableCacheEviction(t *testing.T) {
+	table := CompactUnwindTable{
+		{pc: 0x1000, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x1010, cfaType: uint8(cfaTypeEndFdeMarker)},
+	}
+	data, err := encodeTableCacheEntry(table, nil)
+	require.NoError(t, err)
+
+	// Room for two entries.
+	dir := t.TempDir()
+	c, err := NewTableCache(log.NewNopLogger(), prometheus.NewRegistry(), dir, int64(2*len(data)))
+	require.NoError(t, err)
+
+	require.NoError(t, c.Put("a", table, nil))
+	require.NoError(t, c.Put("b", table, nil))
+	_, ok := c.Get("a", nil)
+	require.True(t, ok)
+
+	// "b" is the least recently used entry.
+	require.NoError(t, c.Put("c", table, nil))
+	_, ok = c.Get("b", nil)
+	require.False(t, ok)
+	_, ok = c.Get("a", nil)
+	require.True(t, ok)
+	_, ok = c.Get("c", nil)
+	require.True(t, ok)
+	require.Equal(t, 1.0, testutil.ToFloat64(c.metrics.evictions))
+	require.Equal(t, float64(2*len(data)), testutil.ToFloat64(c.metrics.size))
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	// Entries larger than the cache are not stored.
+	c, err = NewTableCache(log.NewNopLogger(), prometheus.NewRegistry(), dir, int64(len(data)-1))
+	require.NoError(t, err)
+	files, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+	require.NoError(t, c.Put("a", table, nil))
+	_, ok = c.Get("a", nil)
+	require.False(t, ok)
+}
@@ -27,8 +27,8 @@ import (
 )
 
 var (
-	ErrNoFDEsFound            = errors.New("no FDEs found")
-	ErrEhFrameSectionNotFound = errors.New("failed to find .eh_frame section")
+	ErrNoFDEsFound          = errors.New("no FDEs found")
+	ErrFrameSectionNotFound = errors.New("failed to find .eh_frame or .debug_frame section")
 )
 
 type UnwindTableBuilder struct {
@@ -89,7 +89,7 @@ func (ptb *UnwindTableBuilder) PrintTable(writer io.Writer, path string, compact
 			}
 
 			if compact {
-				compactRow, err := rowToCompactRow(unwindRow)
+				compactRow, err := rowToCompactRow(unwindRow, nil)
 				if err != nil {
 					return err
 				}
@@ -142,7 +142,16 @@ func (ptb *UnwindTableBuilder) PrintTable(writer io.Writer, path string, compact
 	return nil
 }
 
+// ReadFDEs returns the FDEs of the executable at path, see ReadFDEsWithDebugFile.
 func ReadFDEs(path string) (frame.FrameDescriptionEntries, error) {
+	return ReadFDEsWithDebugFile(path, "")
+}
+
+// ReadFDEsWithDebugFile returns the FDEs of the executable at path. They are read
+// from its .eh_frame section, and from its .debug_frame section for the code
+// .eh_frame does not cover. If the executable has no .debug_frame section,
+// the one of the separate debug file at debugPath is used, if any.
+func ReadFDEsWithDebugFile(path, debugPath string) (frame.FrameDescriptionEntries, error) {
 	// TODO(kakkoyun): Migrate objectfile and pool.
 	obj, err := elf.Open(path)
 	if err != nil {
@@ -150,24 +159,36 @@ func ReadFDEs(path string) (frame.FrameDescriptionEntries, error) {
 	}
 	defer obj.Close()
 
-	sec := obj.Section(".eh_frame")
-	if sec == nil {
-		return nil, ErrEhFrameSectionNotFound
+	// TODO: Byte order of a DWARF section can be different.
+	ehFrameFDEs, err := readFrameSection(obj, ".eh_frame")
+	if err != nil {
+		return nil, err
 	}
 
-	// TODO: Consider using the debug_frame section as a fallback.
-	// TODO: Needs to support DWARF64 as well.
-	ehFrame, err := sec.Data()
+	debugFrameFDEs, err := readFrameSection(obj, ".debug_frame")
+	if err == nil && debugFrameFDEs == nil && debugPath != "" {
+		var debugObj *elf.File
+		debugObj, err = elf.Open(debugPath)
+		if err != nil {
+			err = fmt.Errorf("failed to open debug file: %w", err)
+		} else {
+			defer debugObj.Close()
+			debugFrameFDEs, err = readFrameSection(debugObj, ".debug_frame")
+		}
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to read .eh_frame section: %w", err)
+		// .debug_frame is only needed if there is no .eh_frame to fall back to.
+		if ehFrameFDEs == nil {
+			return nil, err
+		}
+		debugFrameFDEs = nil
 	}
 
-	// TODO: Byte order of a DWARF section can be different.
-	fdes, err := frame.Parse(ehFrame, obj.ByteOrder, 0, pointerSize(obj.Machine), sec.Addr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse frame data: %w", err)
+	if ehFrameFDEs == nil && debugFrameFDEs == nil {
+		return nil, ErrFrameSectionNotFound
 	}
 
+	fdes := ehFrameFDEs.Merge(debugFrameFDEs)
 	if len(fdes) == 0 {
 		return nil, ErrNoFDEsFound
 	}
@@ -175,6 +196,47 @@ func ReadFDEs(path string) (frame.FrameDescriptionEntries, error) {
 	return fdes, nil
 }
 
+// readFrameSection parses the .eh_frame or .debug_frame section of the given ELF file.
+// It returns nil if the file has no such section, or if its data is not present,
+// as in .eh_frame sections of separate debug files.
+func readFrameSection(obj *elf.File, name string) (frame.FrameDescriptionEntries, error) {
+	sec := obj.Section(name)
+	if sec == nil || sec.Type == elf.SHT_NOBITS {
+		return nil, nil
+	}
+
+	data, err := sec.Data()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s section: %w", name, err)
+	}
+
+	// .debug_frame is not loaded in memory, its pointers are absolute.
+	var ehFrameAddr uint64
+	if name == ".eh_frame" {
+		ehFrameAddr = sec.Addr
+	}
+
+	fdes, err := frame.Parse(data, obj.ByteOrder, 0, pointerSize(obj.Machine), ehFrameAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+
+	if ehFrameAddr != 0 {
+		return fdes, nil
+	}
+
+	// Entries of code discarded by the linker are left in .debug_frame
+	// with a zero, or all ones, start address.
+	liveFDEs := fdes[:0]
+	for _, fde := range fdes {
+		if fde.Begin() == 0 || fde.Begin() >= ^uint64(0)-1 {
+			continue
+		}
+		liveFDEs = append(liveFDEs, fde)
+	}
+	return liveFDEs, nil
+}
+
 func BuildUnwindTable(fdes frame.FrameDescriptionEntries) UnwindTable {
 	// The frame package can raise in case of malformed unwind data.
 	table := make(UnwindTable, 0, 4*len(fdes)) // heuristic
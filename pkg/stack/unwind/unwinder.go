@@ -0,0 +1,448 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Always needs to be in sync with the values in the BPF program.
+const (
+	maxStackDepth           = 512
+	maxStackDepthPerProgram = 15
+	maxTailCalls            = 31
+	maxMappingsPerProcess   = 250
+
+	// Offsets of the registers saved in the ucontext of the rt_sigframe the
+	// kernel pushes before running a signal handler, from the stack pointer in
+	// the signal trampoline once the handler has returned to it.
+	ucontextRBPOffset = 120
+	ucontextRSPOffset = 160
+	ucontextRIPOffset = 168
+)
+
+// DefaultMaxStackDepth is the number of frames walked by default, as with
+// --dwarf-unwinding-max-stack-depth.
+const DefaultMaxStackDepth = 127
+
+// Types of the mappings of a process, set by the agent.
+const (
+	MappingTypeJitted  = 1
+	MappingTypeSpecial = 2
+)
+
+var (
+	ErrStackTruncated = errors.New("stack truncated")
+
+	errPCNotCovered                  = errors.New("pc not covered by the unwind table and frame pointer is not zero")
+	errUnsupportedFramePointerAction = errors.New("unsupported frame pointer action")
+	errUnsupportedCFA                = errors.New("unsupported CFA")
+	errReturnAddressNotFound         = errors.New("return address not found")
+	errSignalFrameRegistersNotFound  = errors.New("registers of the signal frame not found")
+	errFramePointerNotFound          = errors.New("frame pointer not found")
+	errSpecialMapping                = errors.New("pc in a special mapping")
+	errShardNotFound                 = errors.New("unwind table shard not found")
+	errRowNotFound                   = errors.New("unwind table row not found")
+	errJitMixedModeDisabled          = errors.New("pc in a JIT mapping and mixed mode unwinding is disabled")
+	errJitMappingNotAdded            = errors.New("JIT mapping not added to the process information yet")
+	errJitStackNotRecorded           = errors.New("bottom of the stack reached in a JIT mapping, the stack is not recorded")
+)
+
+// Registers are the registers the unwinder keeps track of.
+type Registers struct {
+	IP uint64
+	SP uint64
+	BP uint64
+}
+
+// Mapping is an executable mapping of a process, as mapping_t in the BPF program.
+type Mapping struct {
+	LoadAddress  uint64
+	Begin        uint64
+	End          uint64
+	ExecutableID uint64
+	Type         uint64
+}
+
+// ProcessInfo are the executable mappings of a process, as process_info_t in
+// the BPF program.
+type ProcessInfo struct {
+	IsJitCompiler bool
+	Mappings      []Mapping
+}
+
+// UnwindTables are the unwind tables of executables, as stored in the BPF maps.
+type UnwindTables struct {
+	// Chunks of the unwind table of each executable by executable ID, as in unwind_info_chunks.
+	Chunks map[uint64][]UnwindTableChunk
+	// Shards by index, as in unwind_tables.
+	Shards map[uint64]CompactUnwindTable
+	// Compiled DWARF expressions the rows refer to, as in dwarf_expressions.
+	Expressions []Expression
+}
+
+// Unwinder is a model of the DWARF unwinder of the BPF program, see
+// walk_user_stacktrace_impl and walk_user_stacktrace_loop in bpf/cpu/cpu.bpf.c.
+// It follows the same rules on the same process information and unwind tables,
+// which allows to test unwind tables against snapshots of registers and stacks
+// without loading the BPF program.
+type Unwinder struct {
+	process     ProcessInfo
+	tables      *UnwindTables
+	mixedStacks bool
+
+	maxStackDepth int
+	bpfLoop       bool
+}
+
+// NewUnwinder returns an unwinder for the given compact unwind table, sorted by
+// program counter, and the compiled expressions its rows refer to. The table
+// covers the whole address space.
+func NewUnwinder(table CompactUnwindTable, expressions []Expression) *Unwinder {
+	var chunks []UnwindTableChunk
+	if len(table) > 0 {
+		chunks = append(chunks, UnwindTableChunk{
+			LowPC:     table[0].pc,
+			HighPC:    table[len(table)-1].pc,
+			HighIndex: uint64(len(table)),
+		})
+	}
+
+	process := ProcessInfo{Mappings: []Mapping{{End: math.MaxUint64}}}
+	tables := &UnwindTables{
+		Chunks:      map[uint64][]UnwindTableChunk{0: chunks},
+		Shards:      map[uint64]CompactUnwindTable{0: table},
+		Expressions: expressions,
+	}
+	return NewProcessUnwinder(process, tables, false)
+}
+
+// NewProcessUnwinder returns an unwinder for a process with the given process
+// information and unwind tables. JIT mappings are walked with frame pointers
+// if mixedStacks is set, as with --dwarf-unwinding-mixed.
+func NewProcessUnwinder(process ProcessInfo, tables *UnwindTables, mixedStacks bool) *Unwinder {
+	return &Unwinder{
+		process:     process,
+		tables:      tables,
+		mixedStacks: mixedStacks,
+
+		maxStackDepth: DefaultMaxStackDepth,
+	}
+}
+
+// SetStackDepth sets the number of frames walked before the stack is truncated,
+// up to 512, and whether they are walked with bpf_loop, as on kernels 5.17+,
+// or in tail calls, which can walk fewer frames.
+func (u *Unwinder) SetStackDepth(maxDepth int, bpfLoop bool) {
+	if maxDepth > maxStackDepth {
+		maxDepth = maxStackDepth
+	}
+	u.maxStackDepth = maxDepth
+	u.bpfLoop = bpfLoop
+}
+
+// unwindState is the state of the unwinder, as unwind_state_t in the BPF program.
+type unwindState struct {
+	regs         Registers
+	frames       []uint64
+	unwindingJit bool
+}
+
+func (s *unwindState) add(pc uint64) {
+	// As in the BPF program, the frames past the maximum depth are dropped.
+	if len(s.frames) < maxStackDepth {
+		s.frames = append(s.frames, pc)
+	}
+}
+
+// Unwind walks the stack starting from the given registers, reading memory
+// with readMemory, and returns the program counters of its frames. The frames
+// walked so far are returned along with errors. The BPF program does not
+// record the stack in that case, except for ErrStackTruncated, with which the
+// stack is recorded as truncated.
+func (u *Unwinder) Unwind(regs Registers, readMemory func(addr uint64) (uint64, error)) ([]uint64, error) {
+	state := &unwindState{regs: regs, frames: make([]uint64, 0, u.maxStackDepth)}
+	if u.bpfLoop {
+		// Some frames take more than one iteration.
+		done, err := u.walk(state, 2*u.maxStackDepth, readMemory)
+		if done || err != nil {
+			return state.frames, err
+		}
+		return state.frames, ErrStackTruncated
+	}
+	for tailCalls := 0; ; tailCalls++ {
+		done, err := u.walk(state, maxStackDepthPerProgram, readMemory)
+		if done || err != nil {
+			return state.frames, err
+		}
+		// The stack is walked in a tail call.
+		if tailCalls >= maxTailCalls {
+			return state.frames, ErrStackTruncated
+		}
+	}
+}
+
+// walk walks up to the given number of frames, as a run of the BPF program
+// does, and returns whether it is done with the stack.
+func (u *Unwinder) walk(state *unwindState, frames int, readMemory func(addr uint64) (uint64, error)) (bool, error) {
+	for i := 0; i < frames; i++ {
+		var row *CompactUnwindTableRow
+		mapping := u.findMapping(state.regs.IP)
+		switch {
+		case mapping != nil && mapping.Type == MappingTypeJitted:
+			// JIT code with unwind information from its jitdump file is unwound
+			// as native code, the rest with frame pointers.
+			if row = u.findJit(mapping, state.regs.IP); row != nil {
+				break
+			}
+			if !u.mixedStacks {
+				return true, errJitMixedModeDisabled
+			}
+			if len(state.frames) >= u.maxStackDepth {
+				return true, ErrStackTruncated
+			}
+			state.unwindingJit = true
+			if err := u.stepJit(state, readMemory); err != nil {
+				return true, err
+			}
+			continue
+		case mapping != nil && mapping.Type == MappingTypeSpecial:
+			return true, fmt.Errorf("%w: pc %#x", errSpecialMapping, state.regs.IP)
+		case mapping != nil:
+			var err error
+			if row, err = u.find(mapping, state.regs.IP); err != nil {
+				return true, err
+			}
+		}
+		if row == nil || row.IsEndOfFDEMarker() || row.rbpType == uint8(rbpTypeUndefinedReturnAddress) {
+			// As per the x86_64 ABI, the deepest frame has a zero frame pointer.
+			if state.regs.BP != 0 {
+				if u.process.IsJitCompiler {
+					return true, fmt.Errorf("%w: pc %#x", errJitMappingNotAdded, state.regs.IP)
+				}
+				return true, fmt.Errorf("%w: pc %#x", errPCNotCovered, state.regs.IP)
+			}
+			return true, nil
+		}
+
+		// The frame was added by the JIT unwinder, with its return address.
+		if !state.unwindingJit {
+			if len(state.frames) >= u.maxStackDepth {
+				return true, ErrStackTruncated
+			}
+			state.add(state.regs.IP)
+		}
+		state.unwindingJit = false
+
+		regs, err := u.step(row, state.regs, readMemory)
+		if err != nil {
+			return true, err
+		}
+		state.regs = regs
+	}
+	return false, nil
+}
+
+// findMapping returns the mapping of the process pc is in, if any.
+func (u *Unwinder) findMapping(pc uint64) *Mapping {
+	for i, mapping := range u.process.Mappings {
+		if i >= maxMappingsPerProcess {
+			break
+		}
+		if mapping.Begin <= pc && pc <= mapping.End {
+			return &u.process.Mappings[i]
+		}
+	}
+	return nil
+}
+
+// find returns the row of the unwind table of the mapping covering pc, if any.
+func (u *Unwinder) find(mapping *Mapping, pc uint64) (*CompactUnwindTableRow, error) {
+	adjustedPC := pc - mapping.LoadAddress
+
+	var chunk *UnwindTableChunk
+	chunks := u.tables.Chunks[mapping.ExecutableID]
+	for i := 0; i < len(chunks) && i < MaxUnwindTableChunks; i++ {
+		// A zero chunk marks the last one.
+		if chunks[i].LowPC == 0 {
+			break
+		}
+		if chunks[i].LowPC <= adjustedPC && adjustedPC <= chunks[i].HighPC {
+			chunk = &chunks[i]
+			break
+		}
+	}
+	if chunk == nil {
+		return nil, nil
+	}
+
+	shard, ok := u.tables.Shards[chunk.ShardIndex]
+	if !ok || chunk.HighIndex > uint64(len(shard)) || chunk.LowIndex > chunk.HighIndex {
+		return nil, fmt.Errorf("%w: %d", errShardNotFound, chunk.ShardIndex)
+	}
+	rows := shard[chunk.LowIndex:chunk.HighIndex]
+	i := sort.Search(len(rows), func(i int) bool { return rows[i].pc > adjustedPC })
+	if i == 0 {
+		return nil, fmt.Errorf("%w: pc %#x", errRowNotFound, pc)
+	}
+	return &rows[i-1], nil
+}
+
+// findJit returns the row of the unwind table of the JIT code covering pc, if any.
+func (u *Unwinder) findJit(mapping *Mapping, pc uint64) *CompactUnwindTableRow {
+	row, err := u.find(mapping, pc)
+	if err != nil || row == nil || row.IsEndOfFDEMarker() {
+		return nil
+	}
+	return row
+}
+
+// stepJit walks a frame of JIT code with frame pointers.
+func (u *Unwinder) stepJit(state *unwindState, readMemory func(addr uint64) (uint64, error)) error {
+	// The first frame is the one of the current program counter.
+	if len(state.frames) == 0 {
+		state.add(state.regs.IP)
+		return nil
+	}
+
+	fp, err := readMemory(state.regs.BP)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errFramePointerNotFound, err)
+	}
+	ra, err := readMemory(state.regs.BP + 8)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errReturnAddressNotFound, err)
+	}
+	if fp == 0 {
+		return errJitStackNotRecorded
+	}
+
+	// The return address is the instruction after the call, the one before it
+	// is in the caller.
+	state.regs = Registers{IP: ra - 1, SP: state.regs.BP + 16, BP: fp}
+	state.add(ra)
+	return nil
+}
+
+// step returns the registers of the caller of the frame the given row describes.
+func (u *Unwinder) step(row *CompactUnwindTableRow, regs Registers, readMemory func(addr uint64) (uint64, error)) (Registers, error) {
+	if row.cfaType == uint8(cfaTypeSignalFrame) {
+		// The registers of the interrupted code are restored from the signal frame.
+		var (
+			previous Registers
+			err      error
+		)
+		if previous.IP, err = readMemory(regs.SP + ucontextRIPOffset); err != nil {
+			return Registers{}, fmt.Errorf("%w: %w", errSignalFrameRegistersNotFound, err)
+		}
+		if previous.SP, err = readMemory(regs.SP + ucontextRSPOffset); err != nil {
+			return Registers{}, fmt.Errorf("%w: %w", errSignalFrameRegistersNotFound, err)
+		}
+		if previous.BP, err = readMemory(regs.SP + ucontextRBPOffset); err != nil {
+			return Registers{}, fmt.Errorf("%w: %w", errSignalFrameRegistersNotFound, err)
+		}
+		return previous, nil
+	}
+
+	rbpExpression := DwarfExpressionID(row.rbpOffset)
+	if row.rbpType == uint8(rbpRuleRegister) || (row.rbpType == uint8(rbpTypeExpression) && rbpExpression == ExpressionUnknown) {
+		return Registers{}, fmt.Errorf("%w: %d", errUnsupportedFramePointerAction, row.rbpType)
+	}
+
+	var cfa uint64
+	//nolint:exhaustive
+	switch BpfCfaType(row.cfaType) {
+	case cfaTypeRbp:
+		cfa = regs.BP + uint64(row.cfaOffset)
+	case cfaTypeRsp:
+		cfa = regs.SP + uint64(row.cfaOffset)
+	case cfaTypeExpression:
+		id := DwarfExpressionID(row.cfaOffset)
+		switch id {
+		case ExpressionUnknown:
+			return Registers{}, fmt.Errorf("%w: unknown expression", errUnsupportedCFA)
+		case ExpressionPlt1, ExpressionPlt2:
+			threshold := uint64(11)
+			if id == ExpressionPlt2 {
+				threshold = 10
+			}
+			cfa = regs.SP + 8
+			if regs.IP&15 >= threshold {
+				cfa += 8
+			}
+		default:
+			expression, err := u.expression(id)
+			if err != nil {
+				return Registers{}, err
+			}
+			cfa, err = expression.Evaluate(ExpressionRegisters(regs), readMemory)
+			if err != nil {
+				return Registers{}, fmt.Errorf("%w: %w", errUnsupportedCFA, err)
+			}
+		}
+	default:
+		return Registers{}, fmt.Errorf("%w: type %d", errUnsupportedCFA, row.cfaType)
+	}
+
+	if cfa == 0 {
+		return Registers{}, fmt.Errorf("%w: zero", errUnsupportedCFA)
+	}
+
+	// As in the BPF unwinder, the return address is assumed to be right below the CFA.
+	ra, err := readMemory(cfa - 8)
+	if err == nil && ra == 0 {
+		err = fmt.Errorf("zero at %#x", cfa-8)
+	}
+	if err != nil {
+		if u.process.IsJitCompiler {
+			return Registers{}, fmt.Errorf("%w: %w", errJitMappingNotAdded, err)
+		}
+		return Registers{}, fmt.Errorf("%w: %w", errReturnAddressNotFound, err)
+	}
+
+	bp := regs.BP
+	//nolint:exhaustive
+	switch bpfRbpType(row.rbpType) {
+	case rbpRuleOffset:
+		if bp, err = readMemory(cfa + uint64(row.rbpOffset)); err != nil {
+			return Registers{}, fmt.Errorf("%w: %w", errFramePointerNotFound, err)
+		}
+	case rbpTypeExpression:
+		expression, err := u.expression(rbpExpression)
+		if err != nil {
+			return Registers{}, err
+		}
+		addr, err := expression.EvaluateRegisterRule(ExpressionRegisters(regs), cfa, readMemory)
+		if err != nil {
+			return Registers{}, fmt.Errorf("%w: %w", errFramePointerNotFound, err)
+		}
+		if bp, err = readMemory(addr); err != nil {
+			return Registers{}, fmt.Errorf("%w: %w", errFramePointerNotFound, err)
+		}
+	}
+
+	return Registers{IP: ra, SP: cfa, BP: bp}, nil
+}
+
+// expression returns the compiled expression with the given identifier.
+func (u *Unwinder) expression(id DwarfExpressionID) (Expression, error) {
+	index := int(id - ExpressionCompiled)
+	if index < 0 || index >= len(u.tables.Expressions) {
+		return nil, fmt.Errorf("%w: expression %d not found", errUnsupportedExpression, id)
+	}
+	return u.tables.Expressions[index], nil
+}
@@ -0,0 +1,347 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
+)
+
+// ehFrame returns an .eh_frame section with a single CIE with the given
+// augmentation, absolute 4 byte pointers, followed by an FDE per function.
+func ehFrame(augmentation string, fdes ...ehFrameFDE) []byte {
+	entry := func(section, body []byte) []byte {
+		for (len(body)+4)%8 != 0 {
+			body = append(body, frame.DW_CFA_nop)
+		}
+		section = binary.LittleEndian.AppendUint32(section, uint32(len(body)))
+		return append(section, body...)
+	}
+
+	cie := binary.LittleEndian.AppendUint32(nil, 0) // CIE id.
+	cie = append(cie, 1)                            // Version.
+	cie = append(cie, augmentation...)
+	cie = append(cie, 0,
+		1,    // Code alignment factor.
+		0x78, // Data alignment factor, -8.
+		16,   // Return address register.
+		1,    // Augmentation data length.
+		0x03, // Pointer encoding, udata4.
+	)
+	section := entry(nil, cie)
+
+	for _, fde := range fdes {
+		body := binary.LittleEndian.AppendUint32(nil, uint32(len(section)+4)) // CIE pointer.
+		body = binary.LittleEndian.AppendUint32(body, uint32(fde.begin))
+		body = binary.LittleEndian.AppendUint32(body, uint32(fde.size))
+		body = append(body, 0) // Augmentation data length.
+		body = append(body, fde.instructions...)
+		section = entry(section, body)
+	}
+	return section
+}
+
+type ehFrameFDE struct {
+	begin, size  uint64
+	instructions []byte
+}
+
+// restoreRtInstructions are the unwind instructions of glibc's __restore_rt on x86_64.
+var restoreRtInstructions = []byte{
+	frame.DW_CFA_def_cfa_expression, 4, frame.DW_OP_breg7, 0xa0, 0x01, frame.DW_OP_deref, // CFA = *(rsp + 160).
+	frame.DW_CFA_expression, 6, 3, frame.DW_OP_breg7, 0xf8, 0x00, // rbp saved at rsp + 120.
+	frame.DW_CFA_expression, 16, 3, frame.DW_OP_breg7, 0xa8, 0x01, // rip saved at rsp + 168.
+}
+
+func TestUnwindSignalFrame(t *testing.T) {
+	const (
+		mainPC      = 0x1000
+		restoreRtPC = 0x2000
+		handlerPC   = 0x3000
+	)
+
+	functions := []ehFrameFDE{
+		{
+			begin: mainPC,
+			size:  0x100,
+			instructions: []byte{
+				frame.DW_CFA_def_cfa, 7, 8,
+				frame.DW_CFA_advance_loc | 1,
+				frame.DW_CFA_def_cfa_offset, 16,
+				frame.DW_CFA_offset | 6, 2, // rbp saved at CFA - 16.
+				frame.DW_CFA_advance_loc | 3,
+				frame.DW_CFA_def_cfa_register, 6,
+			},
+		},
+		{
+			begin:        handlerPC,
+			size:         0x100,
+			instructions: []byte{frame.DW_CFA_def_cfa, 7, 8},
+		},
+	}
+	fdes, err := frame.Parse(ehFrame("zR", functions...), binary.LittleEndian, 0, 8, 0x100)
+	require.NoError(t, err)
+	signalFDEs, err := frame.Parse(ehFrame("zRS", ehFrameFDE{begin: restoreRtPC, size: 0x10, instructions: restoreRtInstructions}), binary.LittleEndian, 0, 8, 0x100)
+	require.NoError(t, err)
+	require.True(t, signalFDEs[0].CIE.SignalFrame())
+	fdes = append(fdes, signalFDEs...)
+
+	expressions := NewExpressionTable(16)
+	table, err := BuildCompactUnwindTableWithExpressions(fdes, expressions)
+	require.NoError(t, err)
+	sort.Sort(table)
+
+	// A signal interrupted main, which runs with a frame pointer. The kernel
+	// pushed a signal frame below its stack and ran the handler, that returns
+	// to __restore_rt.
+	memory := map[uint64]uint64{
+		// Frame of main.
+		0x7f10: 0,     // Saved frame pointer of the deepest frame.
+		0x7f18: 0x500, // Return address into code without unwind information.
+		// Signal frame.
+		0x6ff8:                     restoreRtPC,
+		0x7000 + ucontextRBPOffset: 0x7f10,
+		0x7000 + ucontextRSPOffset: 0x7f00,
+		0x7000 + ucontextRIPOffset: mainPC + 0x50,
+	}
+	readMemory := func(addr uint64) (uint64, error) {
+		v, ok := memory[addr]
+		if !ok {
+			return 0, errors.New("unmapped")
+		}
+		return v, nil
+	}
+	regs := Registers{IP: handlerPC + 0x10, SP: 0x6ff8, BP: 0xdead}
+
+	frames, err := NewUnwinder(table, expressions.Expressions()).Unwind(regs, readMemory)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{handlerPC + 0x10, restoreRtPC, mainPC + 0x50}, frames)
+
+	// Without recognising the trampoline the return address would be assumed
+	// to be below the CFA rather than taken from the signal frame.
+	fdes, err = frame.Parse(ehFrame("zR", append(functions, ehFrameFDE{begin: restoreRtPC, size: 0x10, instructions: restoreRtInstructions})...), binary.LittleEndian, 0, 8, 0x100)
+	require.NoError(t, err)
+	expressions = NewExpressionTable(16)
+	table, err = BuildCompactUnwindTableWithExpressions(fdes, expressions)
+	require.NoError(t, err)
+	sort.Sort(table)
+
+	frames, err = NewUnwinder(table, expressions.Expressions()).Unwind(regs, readMemory)
+	require.ErrorIs(t, err, errReturnAddressNotFound)
+	require.Equal(t, []uint64{handlerPC + 0x10, restoreRtPC}, frames)
+}
+
+func TestUnwindTruncated(t *testing.T) {
+	// A function that calls itself forever.
+	table := CompactUnwindTable{
+		{pc: 0x1000, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x1100, cfaType: uint8(cfaTypeEndFdeMarker)},
+	}
+	readMemory := func(addr uint64) (uint64, error) {
+		return 0x1010, nil
+	}
+
+	frames, err := NewUnwinder(table, nil).Unwind(Registers{IP: 0x1010, SP: 0x8000}, readMemory)
+	require.ErrorIs(t, err, ErrStackTruncated)
+	require.Len(t, frames, DefaultMaxStackDepth)
+
+	// Deeper stacks are walked with bpf_loop.
+	unwinder := NewUnwinder(table, nil)
+	unwinder.SetStackDepth(maxStackDepth, true)
+	frames, err = unwinder.Unwind(Registers{IP: 0x1010, SP: 0x8000}, readMemory)
+	require.ErrorIs(t, err, ErrStackTruncated)
+	require.Len(t, frames, maxStackDepth)
+
+	// Tail calls can walk fewer frames.
+	unwinder.SetStackDepth(maxStackDepth, false)
+	frames, err = unwinder.Unwind(Registers{IP: 0x1010, SP: 0x8000}, readMemory)
+	require.ErrorIs(t, err, ErrStackTruncated)
+	require.Len(t, frames, (maxTailCalls+1)*maxStackDepthPerProgram)
+}
+
+func TestUnwindMaxStackDepth(t *testing.T) {
+	table := CompactUnwindTable{
+		{pc: 0x1000, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x1100, cfaType: uint8(cfaTypeEndFdeMarker)},
+	}
+	// A recursive function 200 frames deep, called from code without unwind
+	// information at the bottom of the stack.
+	const depth = 200
+	readMemory := func(addr uint64) (uint64, error) {
+		if addr >= 0x8000+(depth-1)*8 {
+			return 0x2000, nil
+		}
+		return 0x1010, nil
+	}
+
+	for _, bpfLoop := range []bool{true, false} {
+		unwinder := NewUnwinder(table, nil)
+		_, err := unwinder.Unwind(Registers{IP: 0x1010, SP: 0x8000}, readMemory)
+		require.ErrorIs(t, err, ErrStackTruncated)
+
+		unwinder.SetStackDepth(depth, bpfLoop)
+		frames, err := unwinder.Unwind(Registers{IP: 0x1010, SP: 0x8000}, readMemory)
+		require.NoError(t, err)
+		require.Len(t, frames, depth)
+	}
+}
+
+func TestUnwindPCNotCovered(t *testing.T) {
+	table := CompactUnwindTable{
+		{pc: 0x1000, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x1100, cfaType: uint8(cfaTypeEndFdeMarker)},
+	}
+	readMemory := func(addr uint64) (uint64, error) {
+		return 0x2000, nil
+	}
+
+	frames, err := NewUnwinder(table, nil).Unwind(Registers{IP: 0x1010, SP: 0x8000, BP: 0x9000}, readMemory)
+	require.ErrorIs(t, err, errPCNotCovered)
+	require.Equal(t, []uint64{0x1010}, frames)
+}
+
+// stackMemory returns a function reading memory from the given words.
+func stackMemory(memory map[uint64]uint64) func(addr uint64) (uint64, error) {
+	return func(addr uint64) (uint64, error) {
+		v, ok := memory[addr]
+		if !ok {
+			return 0, errors.New("unmapped")
+		}
+		return v, nil
+	}
+}
+
+func TestUnwindProcess(t *testing.T) {
+	const libLoadAddress = 0x7f0000000000
+
+	// The executable's table is split in two chunks, and the library's is
+	// stored after the rows of another executable.
+	shard := CompactUnwindTable{
+		{pc: 0x1000, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x1001, cfaType: uint8(cfaTypeRsp), cfaOffset: 16, rbpType: uint8(rbpRuleOffset), rbpOffset: -16},
+		{pc: 0x1004, cfaType: uint8(cfaTypeRbp), cfaOffset: 16, rbpType: uint8(rbpRuleOffset), rbpOffset: -16},
+		{pc: 0x1100, cfaType: uint8(cfaTypeEndFdeMarker)},
+		// Another executable.
+		{pc: 0x2000, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x2100, cfaType: uint8(cfaTypeEndFdeMarker)},
+		// The library.
+		{pc: 0x500, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x504, cfaType: uint8(cfaTypeRsp), cfaOffset: 32},
+		{pc: 0x600, cfaType: uint8(cfaTypeEndFdeMarker)},
+	}
+	tables := &UnwindTables{
+		Chunks: map[uint64][]UnwindTableChunk{
+			1: {
+				{LowPC: 0x1000, HighPC: 0x1100, ShardIndex: 0, LowIndex: 0, HighIndex: 4},
+				{LowPC: 0x1200, HighPC: 0x1300, ShardIndex: 1, LowIndex: 0, HighIndex: 2},
+			},
+			2: {{LowPC: 0x2000, HighPC: 0x2100, ShardIndex: 0, LowIndex: 4, HighIndex: 6}},
+			3: {{LowPC: 0x500, HighPC: 0x600, ShardIndex: 0, LowIndex: 6, HighIndex: 9}},
+		},
+		Shards: map[uint64]CompactUnwindTable{
+			0: shard,
+			1: {
+				{pc: 0x1200, cfaType: uint8(cfaTypeRsp), cfaOffset: 16},
+				{pc: 0x1300, cfaType: uint8(cfaTypeEndFdeMarker)},
+			},
+		},
+	}
+	process := ProcessInfo{Mappings: []Mapping{
+		{Begin: 0x1000, End: 0x2000, ExecutableID: 1},
+		{LoadAddress: libLoadAddress, Begin: libLoadAddress + 0x500, End: libLoadAddress + 0x1000, ExecutableID: 3},
+		{Begin: 0xffff0000, End: 0xffff1000, Type: MappingTypeSpecial},
+	}}
+
+	// The library was called from 0x1210, which was called from 0x1050,
+	// whose caller has no unwind information.
+	memory := map[uint64]uint64{
+		0x7fd8: 0x1210, // Return address of the library's frame.
+		0x7fe8: 0x1050, // Return address of the frame at 0x1210.
+		0x7ff0: 0,      // Saved frame pointer of the frame at 0x1050.
+		0x7ff8: 0x800,  // Return address of the frame at 0x1050.
+	}
+	regs := Registers{IP: libLoadAddress + 0x510, SP: 0x7fd8 - 24, BP: 0x7ff0}
+
+	frames, err := NewProcessUnwinder(process, tables, false).Unwind(regs, stackMemory(memory))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{libLoadAddress + 0x510, 0x1210, 0x1050}, frames)
+
+	// The BPF program stops in special mappings such as the vDSO.
+	_, err = NewProcessUnwinder(process, tables, false).Unwind(Registers{IP: 0xffff0010}, stackMemory(memory))
+	require.ErrorIs(t, err, errSpecialMapping)
+
+	// A chunk pointing to a shard that is not loaded.
+	delete(tables.Shards, 1)
+	frames, err = NewProcessUnwinder(process, tables, false).Unwind(regs, stackMemory(memory))
+	require.ErrorIs(t, err, errShardNotFound)
+	require.Equal(t, []uint64{libLoadAddress + 0x510}, frames)
+}
+
+func TestUnwindJit(t *testing.T) {
+	table := CompactUnwindTable{
+		{pc: 0x1000, cfaType: uint8(cfaTypeRsp), cfaOffset: 8},
+		{pc: 0x1001, cfaType: uint8(cfaTypeRsp), cfaOffset: 16, rbpType: uint8(rbpRuleOffset), rbpOffset: -16},
+		{pc: 0x1004, cfaType: uint8(cfaTypeRbp), cfaOffset: 16, rbpType: uint8(rbpRuleOffset), rbpOffset: -16},
+		{pc: 0x1100, cfaType: uint8(cfaTypeEndFdeMarker)},
+	}
+	tables := &UnwindTables{
+		Chunks: map[uint64][]UnwindTableChunk{1: {{LowPC: 0x1000, HighPC: 0x1100, HighIndex: uint64(len(table))}}},
+		Shards: map[uint64]CompactUnwindTable{0: table},
+	}
+	process := ProcessInfo{
+		IsJitCompiler: true,
+		Mappings: []Mapping{
+			{Begin: 0x1000, End: 0x2000, ExecutableID: 1},
+			{Begin: 0x9000, End: 0xa000, Type: MappingTypeJitted},
+		},
+	}
+
+	// JIT code at 0x9010 called more JIT code from 0x9110, which was called from
+	// native code at 0x1050, whose caller has no unwind information.
+	memory := map[uint64]uint64{
+		0x7f00: 0x7f80, // Saved frame pointer of the frame at 0x9010.
+		0x7f08: 0x9110,
+		0x7f80: 0x7ff0, // Saved frame pointer of the frame at 0x9110.
+		0x7f88: 0x1050,
+		0x7ff0: 0,
+		0x7ff8: 0x800,
+	}
+	regs := Registers{IP: 0x9010, SP: 0x7ef0, BP: 0x7f00}
+
+	_, err := NewProcessUnwinder(process, tables, false).Unwind(regs, stackMemory(memory))
+	require.ErrorIs(t, err, errJitMixedModeDisabled)
+
+	// The return addresses of JIT frames are recorded as they are.
+	frames, err := NewProcessUnwinder(process, tables, true).Unwind(regs, stackMemory(memory))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0x9010, 0x9110, 0x1050}, frames)
+
+	// Native code without unwind information is assumed to be JIT code whose
+	// mapping has not been added yet.
+	frames, err = NewProcessUnwinder(process, tables, true).Unwind(Registers{IP: 0x5000, BP: 0x7f00}, stackMemory(memory))
+	require.ErrorIs(t, err, errJitMappingNotAdded)
+	require.Empty(t, frames)
+
+	// The BPF program does not record stacks whose bottom is in JIT code.
+	memory[0x7f80] = 0
+	frames, err = NewProcessUnwinder(process, tables, true).Unwind(regs, stackMemory(memory))
+	require.ErrorIs(t, err, errJitStackNotRecorded)
+	require.Equal(t, []uint64{0x9010, 0x9110}, frames)
+}
@@ -0,0 +1,283 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
+)
+
+// MaxDwarfExpressions is the number of distinct DWARF expressions the
+// BPF unwinder supports.
+const MaxDwarfExpressions = 1024 // Always need to be in sync with MAX_DWARF_EXPRESSIONS.
+
+// minReportedGapBytes is the size of the gaps in the unwind information of a
+// section without functions that are reported, smaller ones are most likely
+// the padding that aligns functions.
+const minReportedGapBytes = 16
+
+var errNoTextSection = errors.New("no .text section found")
+
+// ValidationReport describes how well the unwind table of an executable covers its code.
+type ValidationReport struct {
+	// Addresses of the .text section.
+	TextStart, TextEnd uint64
+	// Bytes of the .text section covered by the unwind table.
+	CoveredBytes uint64
+	Rows         int
+	// Ranges of the .text section without unwind information.
+	Gaps []CoverageGap
+	// Rows of the DWARF unwind information the unwinder does not support.
+	Unsupported []UnsupportedRow
+}
+
+// Coverage returns the percentage of the .text section covered by the unwind table.
+func (r *ValidationReport) Coverage() float64 {
+	if r.TextEnd == r.TextStart {
+		return 100
+	}
+	return 100 * float64(r.CoveredBytes) / float64(r.TextEnd-r.TextStart)
+}
+
+// CoverageGap is a range of code without unwind information, [Start, End).
+type CoverageGap struct {
+	Start, End uint64
+	// Functions that start in the gap.
+	Functions []string
+}
+
+// UnsupportedRow is a row of the DWARF unwind information the unwinder does not support.
+type UnsupportedRow struct {
+	PC       uint64
+	Function string
+	Reason   string
+}
+
+// Validate checks the unwind information of the executable at path, along with the
+// one of its separate debug file at debugPath, if any. It reports the ranges of its
+// .text section the unwind table does not cover, as well as the rows the unwinder
+// does not support, such as the ones whose DWARF expressions cannot be compiled.
+func Validate(path, debugPath string) (*ValidationReport, error) {
+	obj, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open elf: %w", err)
+	}
+	defer obj.Close()
+
+	text := obj.Section(".text")
+	if text == nil {
+		return nil, errNoTextSection
+	}
+	symbols := newFunctionSymbols(obj)
+
+	table, err := GenerateCompactUnwindTable(path, debugPath, NewExpressionTable(MaxDwarfExpressions))
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ValidationReport{
+		TextStart: text.Addr,
+		TextEnd:   text.Addr + text.Size,
+		Rows:      len(table),
+	}
+
+	// Coverage of the .text section, the ranges of the functions of the table are sorted.
+	covered := report.TextStart
+	addGap := func(start, end uint64) {
+		gap := CoverageGap{Start: start, End: end, Functions: symbols.startingIn(start, end)}
+		if len(gap.Functions) > 0 || end-start >= minReportedGapBytes {
+			report.Gaps = append(report.Gaps, gap)
+		}
+	}
+	for _, f := range tableFunctions(table) {
+		start, end := f.start, f.end
+		if start < covered {
+			start = covered
+		}
+		if end > report.TextEnd {
+			end = report.TextEnd
+		}
+		if start >= end {
+			continue
+		}
+		if start > covered {
+			addGap(covered, start)
+		}
+		report.CoveredBytes += end - start
+		covered = end
+	}
+	if covered < report.TextEnd {
+		addGap(covered, report.TextEnd)
+	}
+
+	fdes, err := ReadFDEsWithDebugFile(path, debugPath)
+	if err != nil && !errors.Is(err, ErrFrameSectionNotFound) && !errors.Is(err, ErrNoFDEsFound) {
+		return nil, err
+	}
+	sort.Sort(fdes)
+	for _, fde := range fdes {
+		if fde.CIE != nil && fde.CIE.SignalFrame() {
+			continue
+		}
+		frameContext := frame.ExecuteDwarfProgram(fde, nil)
+		for insCtx := frameContext.Next(); frameContext.HasNext(); insCtx = frameContext.Next() {
+			row := unwindTableRow(insCtx)
+			if row == nil {
+				break
+			}
+			for _, reason := range unsupportedRules(row) {
+				report.Unsupported = append(report.Unsupported, UnsupportedRow{
+					PC:       row.Loc,
+					Function: symbols.containing(row.Loc),
+					Reason:   reason,
+				})
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// unsupportedRules returns why the unwinder does not support the rules of the row, if it does not.
+func unsupportedRules(row *UnwindTableRow) []string {
+	var reasons []string
+
+	//nolint:exhaustive
+	switch row.CFA.Rule {
+	case frame.RuleCFA:
+		if row.CFA.Reg != frame.X86_64StackPointer && row.CFA.Reg != frame.X86_64FramePointer {
+			reasons = append(reasons, fmt.Sprintf("CFA is relative to $%s", x64RegisterToString(row.CFA.Reg)))
+		}
+		if row.CFA.Offset < math.MinInt16 || row.CFA.Offset > math.MaxInt16 {
+			reasons = append(reasons, fmt.Sprintf("CFA offset %d out of range", row.CFA.Offset))
+		}
+	case frame.RuleExpression:
+		if ExpressionIdentifier(row.CFA.Expression) == ExpressionUnknown {
+			if _, err := CompileExpression(row.CFA.Expression); err != nil {
+				reasons = append(reasons, fmt.Sprintf("CFA expression: %v", err))
+			}
+		}
+	default:
+		reasons = append(reasons, fmt.Sprintf("CFA rule %d", row.CFA.Rule))
+	}
+
+	//nolint:exhaustive
+	switch row.RBP.Rule {
+	case frame.RuleOffset:
+		if row.RBP.Offset < math.MinInt16 || row.RBP.Offset > math.MaxInt16 {
+			reasons = append(reasons, fmt.Sprintf("frame pointer offset %d out of range", row.RBP.Offset))
+		}
+	case frame.RuleRegister:
+		reasons = append(reasons, fmt.Sprintf("frame pointer restored from $%s", x64RegisterToString(row.RBP.Reg)))
+	case frame.RuleExpression:
+		if _, err := CompileRegisterRuleExpression(row.RBP.Expression); err != nil {
+			reasons = append(reasons, fmt.Sprintf("frame pointer expression: %v", err))
+		}
+	case frame.RuleValOffset, frame.RuleValExpression:
+		reasons = append(reasons, fmt.Sprintf("frame pointer rule %d", row.RBP.Rule))
+	}
+
+	return reasons
+}
+
+// tableFunction is the range of a function in a compact unwind table, [start, end).
+type tableFunction struct {
+	start, end uint64
+	rows       CompactUnwindTable
+}
+
+// tableFunctions splits a sorted compact unwind table in its functions.
+func tableFunctions(table CompactUnwindTable) []tableFunction {
+	var functions []tableFunction
+	first := -1
+	for i, row := range table {
+		if !row.IsEndOfFDEMarker() {
+			if first < 0 {
+				first = i
+			}
+			continue
+		}
+		if first >= 0 {
+			functions = append(functions, tableFunction{start: table[first].pc, end: row.pc, rows: table[first:i]})
+		}
+		first = -1
+	}
+	return functions
+}
+
+type functionSymbol struct {
+	name        string
+	start, size uint64
+}
+
+// functionSymbols are the function symbols of an executable, sorted by address.
+type functionSymbols []functionSymbol
+
+func newFunctionSymbols(obj *elf.File) functionSymbols {
+	var symbols functionSymbols
+	seen := map[uint64]struct{}{}
+	for _, read := range []func() ([]elf.Symbol, error){obj.Symbols, obj.DynamicSymbols} {
+		elfSymbols, err := read()
+		if err != nil {
+			continue
+		}
+		for _, s := range elfSymbols {
+			if elf.ST_TYPE(s.Info) != elf.STT_FUNC || s.Value == 0 {
+				continue
+			}
+			if _, ok := seen[s.Value]; ok {
+				continue
+			}
+			seen[s.Value] = struct{}{}
+			symbols = append(symbols, functionSymbol{name: s.Name, start: s.Value, size: s.Size})
+		}
+	}
+	sort.Slice(symbols, func(i, j int) bool { return symbols[i].start < symbols[j].start })
+	return symbols
+}
+
+// startingIn returns the names of the functions that start in [start, end).
+func (s functionSymbols) startingIn(start, end uint64) []string {
+	var names []string
+	for i := sort.Search(len(s), func(i int) bool { return s[i].start >= start }); i < len(s) && s[i].start < end; i++ {
+		names = append(names, s[i].name)
+	}
+	return names
+}
+
+// at returns the name of the function that starts at pc, if any.
+func (s functionSymbols) at(pc uint64) (string, bool) {
+	i := sort.Search(len(s), func(i int) bool { return s[i].start >= pc })
+	if i < len(s) && s[i].start == pc {
+		return s[i].name, true
+	}
+	return "", false
+}
+
+// containing returns the name of the function pc is in, if any.
+func (s functionSymbols) containing(pc uint64) string {
+	i := sort.Search(len(s), func(i int) bool { return s[i].start > pc })
+	if i == 0 {
+		return ""
+	}
+	if f := s[i-1]; pc < f.start+f.size || f.size == 0 && pc == f.start {
+		return f.name
+	}
+	return ""
+}
@@ -0,0 +1,70 @@
+// Copyright 2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unwind
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/parca-dev/parca-agent/internal/dwarf/frame"
+)
+
+func TestValidate(t *testing.T) {
+	executable, err := os.Executable()
+	require.NoError(t, err)
+
+	report, err := Validate(executable, "")
+	require.NoError(t, err)
+	require.Greater(t, report.Rows, 0)
+	require.Greater(t, report.Coverage(), 50.0)
+	require.LessOrEqual(t, report.Coverage(), 100.0)
+	for _, gap := range report.Gaps {
+		require.Less(t, gap.Start, gap.End)
+		require.GreaterOrEqual(t, gap.Start, report.TextStart)
+		require.LessOrEqual(t, gap.End, report.TextEnd)
+	}
+
+	_, err = Validate("testdata/does-not-exist", "")
+	require.Error(t, err)
+}
+
+func TestUnsupportedRules(t *testing.T) {
+	require.Empty(t, unsupportedRules(&UnwindTableRow{
+		CFA: frame.DWRule{Rule: frame.RuleCFA, Reg: frame.X86_64StackPointer, Offset: 16},
+		RBP: frame.DWRule{Rule: frame.RuleOffset, Offset: -16},
+	}))
+	require.Len(t, unsupportedRules(&UnwindTableRow{
+		CFA: frame.DWRule{Rule: frame.RuleCFA, Reg: 3, Offset: 1 << 20},
+		RBP: frame.DWRule{Rule: frame.RuleRegister, Reg: 3},
+	}), 3)
+}
+
+func TestDiffCompactUnwindTables(t *testing.T) {
+	executable, err := os.Executable()
+	require.NoError(t, err)
+
+	diff, err := DiffCompactUnwindTables(executable, executable)
+	require.NoError(t, err)
+	require.True(t, diff.Empty())
+	require.Greater(t, diff.Unchanged, 0)
+}
+
+func TestCompactUnwindTableRowPutBinary(t *testing.T) {
+	row := CompactUnwindTableRow{pc: 0x1122334455667788, cfaType: uint8(cfaTypeRbp), rbpType: uint8(rbpRuleOffset), cfaOffset: 16, rbpOffset: -16}
+	buf := make([]byte, CompactUnwindRowSizeBytes)
+	row.PutBinary(buf)
+	require.Equal(t, []byte{0x88, 0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11, 1, 1, 16, 0, 0xf0, 0xff}, buf)
+}
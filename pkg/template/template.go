@@ -38,8 +38,10 @@ type Process struct {
 	Profiler        string
 	Labels          labels.Labels
 	ProfilingStatus string
-	Error           error
-	Link            string
+	// Settings are the effective profiling settings of the process, e.g. its sampling frequency.
+	Settings []string
+	Error    error
+	Link     string
 }
 
 type StatusPage struct {
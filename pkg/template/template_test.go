@@ -51,6 +51,7 @@ func TestStatusPageTemplate(t *testing.T) {
 				},
 			},
 			ProfilingStatus: "errors",
+			Settings:        []string{"sampling frequency: 9Hz", "debuginfo upload: disabled"},
 			Error:           errors.New("test"),
 			Link:            "/test123",
 		}},
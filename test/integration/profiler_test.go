@@ -245,6 +245,7 @@ func prepareProfiler(t *testing.T, profileStore profiler.ProfileStore, logger lo
 		logger,
 		trace.NewNoopTracerProvider().Tracer("test"),
 		reg,
+		pfs,
 		[]metadata.Provider{
 			metadata.Compiler(logger, reg, ofp),
 			metadata.Process(pfs),
@@ -267,6 +268,7 @@ func prepareProfiler(t *testing.T, profileStore profiler.ProfileStore, logger lo
 			ofp,
 			process.NewMapManager(reg, pfs, ofp, normalizeAddresses),
 			dbginfo,
+			nil,
 			labelsManager,
 			loopDuration,
 			loopDuration,
@@ -291,6 +293,12 @@ func prepareProfiler(t *testing.T, profileStore profiler.ProfileStore, logger lo
 		false,
 		false,
 		true,
+		cpu.MaxStackDepth,
+		nil,
+		nil,
+		ofp,
+		nil,
+		nil,
 		bpfProgramLoaded,
 	)
 